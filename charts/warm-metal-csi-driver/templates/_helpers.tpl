@@ -52,6 +52,11 @@ component: controllerplugin
 {{ include "warm-metal-csi-driver.labels" . }}
 {{- end }}
 
+{{- define "warm-metal-csi-driver.populator.labels" -}}
+component: populator
+{{ include "warm-metal-csi-driver.labels" . }}
+{{- end }}
+
 {{/*
 Selector labels
 */}}
@@ -68,4 +73,9 @@ component: nodeplugin
 {{- define "warm-metal-csi-driver.controllerplugin.selectorLabels" -}}
 component: controllerplugin
 {{ include "warm-metal-csi-driver.selectorLabels" . }}
+{{- end }}
+
+{{- define "warm-metal-csi-driver.populator.selectorLabels" -}}
+component: populator
+{{ include "warm-metal-csi-driver.selectorLabels" . }}
 {{- end }}
\ No newline at end of file
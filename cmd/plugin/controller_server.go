@@ -2,32 +2,59 @@ package main
 
 import (
 	"context"
+	"strconv"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/pkg/errors"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
 	csicommon "github.com/warm-metal/container-image-csi-driver/pkg/csi-common"
+	"github.com/warm-metal/container-image-csi-driver/pkg/registry"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
 	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
 )
 
-const (
-	// GiB = 1024 * 1024 * 1024
-	GiB = 1024 * 1024 * 1024
-	// Default volume size = 1GB
-	defaultVolumeSize = 1 * GiB
-)
+// ControllerServerOption configures optional features of the ControllerServer.
+type ControllerServerOption func(*ControllerServer)
 
-func NewControllerServer(driver *csicommon.CSIDriver, watcher *watcher.Watcher) *ControllerServer {
-	return &ControllerServer{
-		driver:  driver,
-		watcher: watcher,
+// WithoutImageValidation stops checking that images of volumes exist in registries, e.g. in air-gapped clusters or
+// if nodes mount images from local sources only.
+func WithoutImageValidation() ControllerServerOption {
+	return func(c *ControllerServer) {
+		c.skipValidation = true
 	}
 }
 
+func NewControllerServer(
+	driver *csicommon.CSIDriver, watcher *watcher.Watcher, secretStore secret.Store, opts ...ControllerServerOption,
+) *ControllerServer {
+	c := &ControllerServer{
+		driver:       driver,
+		watcher:      watcher,
+		secretStore:  secretStore,
+		imageChecker: newImageChecker(secretStore),
+		inspectImage: registry.Inspect,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
 type ControllerServer struct {
-	driver  *csicommon.CSIDriver
-	watcher *watcher.Watcher
+	driver       *csicommon.CSIDriver
+	watcher      *watcher.Watcher
+	secretStore  secret.Store
+	imageChecker *imageChecker
+	// skipValidation is true if images are never checked in registries.
+	skipValidation bool
+	inspectImage   func(ctx context.Context, image reference.Named, keyring secret.DockerKeyring,
+		platform platforms.MatchComparer) (*registry.ImageInfo, error)
 	csi.UnimplementedControllerServer
 }
 
@@ -35,60 +62,273 @@ func (c ControllerServer) ControllerExpandVolume(context.Context, *csi.Controlle
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (c ControllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume returns the volume of PVs with the volume handle, along with whether its image is still
+// available in the registry.
+func (c *ControllerServer) ControllerGetVolume(_ context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if len(req.VolumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+
+	pvs, err := c.watcher.GetVolumes(c.driver.GetName(), req.VolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to fetch PV of volume %q: %s", req.VolumeId, err)
+	}
+
+	if len(pvs) == 0 {
+		return nil, status.Errorf(codes.NotFound, "volume %q is not found", req.VolumeId)
+	}
+
+	volume, volumeStatus := c.volumeOf(pvs)
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: volumeStatus.VolumeCondition},
+	}, nil
 }
 
 func (c *ControllerServer) DeleteVolume(_ context.Context, _ *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (c ControllerServer) CreateVolume(_ context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	volumeSize := int64(defaultVolumeSize)
-	if req.GetCapacityRange() != nil {
-		volumeSize = req.GetCapacityRange().GetRequiredBytes()
+// CreateVolume returns a volume of the image given by the PVC annotation or StorageClass parameters.
+// The image must exist in the registry, and the capacity of the volume is the size of the image, unless validation
+// is skipped. The requested capacity is used then.
+func (c ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if len(req.Name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "name is missing")
+	}
+
+	params, err := parseVolumeParams(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var pvc *corev1.PersistentVolumeClaim
+	if len(params.pvcName) > 0 && len(params.pvcNamespace) > 0 {
+		if pvc, err = c.watcher.GetPVC(params.pvcNamespace, params.pvcName); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "unable to fetch PVC %s/%s: %s",
+				params.pvcNamespace, params.pvcName, err)
+		}
+	} else if pvc, err = c.watcher.GetPVCByVolumeName(req.Name); err != nil {
+		if params.empty() {
+			return nil, status.Errorf(codes.Unavailable, "failed to get volume handle: %s", err)
+		}
+
+		klog.Warningf("unable to fetch PVC of volume %q: %s. its annotations are ignored", req.Name, err)
+	}
+
+	annotations := &watcher.VolumeAnnotations{}
+	if pvc != nil {
+		if annotations, err = watcher.ParseAnnotations(pvc); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "PVC %s/%s: %s", pvc.Namespace, pvc.Name, err)
+		}
+	}
+
+	var image string
+	if params.empty() {
+		if len(annotations.Image) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"neither the annotation %s of the PVC nor StorageClass parameters provide the image",
+				watcher.ImageAnnotation)
+		}
+
+		image = annotations.Image
+	} else {
+		if len(annotations.Image) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"the annotation %s conflicts with the image given by the StorageClass", watcher.ImageAnnotation)
+		}
+
+		if image, err = params.resolveImage(pvc); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// The VolumeAttributesClass given at creation applies right away.
+	if len(req.MutableParameters) > 0 {
+		if image, err = modifyImage(image, req.MutableParameters); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
 
-	volumeID, err := c.watcher.GetImage(req.Name)
+	// Each volume has its own handle, so that it can be modified alone.
+	volumeID := req.Name
+
+	volumeContext := params.volumeContext(req.Name, image, annotations)
+	info, err := c.validateImage(ctx, image, volumeContext)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get volume handle")
+		return nil, err
+	}
+
+	// The accessible topology of volumes would become a required node affinity of their PVs, which can't express
+	// preferences. Volumes are always accessible from all nodes.
+	if params.preferCachedNodes {
+		klog.Warningf("parameter %q of volume %q is deprecated and ignored", paramPreferCachedNodes, req.Name)
 	}
 
+	// The capacity must satisfy the requested range even if the image is smaller.
+	var imageSize int64
+	if info != nil {
+		imageSize = info.Size
+	}
+
+	volumeSize := imageSize
+	if required := req.GetCapacityRange().GetRequiredBytes(); required > volumeSize {
+		volumeSize = required
+	}
+
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && volumeSize > limit {
+		return nil, status.Errorf(codes.OutOfRange, "image %q of %d bytes exceeds the capacity limit %d",
+			image, imageSize, limit)
+	}
+
+	klog.Infof("volume %q uses image %q of %d bytes", req.Name, image, imageSize)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
 			CapacityBytes: volumeSize,
+			VolumeContext: volumeContext,
 		},
 	}, nil
 }
 
-// ControllerModifyVolume implements the required interface
-func (cs *ControllerServer) ControllerModifyVolume(context.Context, *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// validateImage checks that the image exists in the registry using credentials of the volume,
+// and returns its digest and the size of the image of the volume platform.
+// Nil is returned without looking up the registry if validation is skipped for the volume.
+func (c *ControllerServer) validateImage(ctx context.Context, image string, volumeContext map[string]string) (
+	*registry.ImageInfo, error,
+) {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image %q: %s", image, err)
+	}
+
+	if c.skipValidation || volumeContext[ctxKeyValidateImage] == "false" {
+		return nil, nil
+	}
+
+	// Images in containerd namespaces other than the one of the CRI are loaded into nodes and never pulled from
+	// registries.
+	if len(volumeContext[ctxKeyContainerdNamespace]) > 0 {
+		klog.V(2).Infof("skip validating image %q in containerd namespace %q",
+			image, volumeContext[ctxKeyContainerdNamespace])
+		return nil, nil
+	}
+
+	platform := platforms.Default()
+	if p := volumeContext[ctxKeyPlatform]; len(p) > 0 {
+		spec, err := platforms.Parse(p)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid platform %q: %s", p, err)
+		}
+
+		platform = platforms.Only(spec)
+	}
+
+	keyring, err := volumeKeyring(ctx, c.secretStore, volumeContext[ctxKeyPullSecretNamespace],
+		volumeContext[ctxKeyPullSecret])
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to fetch credentials of image %q: %s", image, err)
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, defaultResolveTimeout)
+	defer cancel()
+	info, err := c.inspectImage(resolveCtx, named, keyring, platform)
+	if err != nil {
+		if registry.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "image %q is not found in the registry: %s", image, err)
+		}
+
+		return nil, status.Errorf(codes.Unavailable, "unable to resolve image %q: %s", image, err)
+	}
+
+	return info, nil
+}
+
+// ControllerModifyVolume changes the image of a volume via mutable parameters of a VolumeAttributesClass.
+// The new image is validated like images of new volumes, then recorded on the PV. Pods published afterwards get the new image, while mounted pods keep theirs
+// until they are republished.
+func (c *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if len(req.VolumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+
+	pvs, err := c.watcher.GetVolumes(c.driver.GetName(), req.VolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to fetch PV of volume %q: %s", req.VolumeId, err)
+	}
+
+	if len(pvs) == 0 {
+		return nil, status.Errorf(codes.NotFound, "volume %q is not found", req.VolumeId)
+	}
+
+	// Only provisioned PVs, whose volume handles are unique, can be modified. The image of static PVs sharing the
+	// handle would be changed otherwise.
+	if len(pvs) > 1 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume %q can't be modified since it is shared by %d PVs", req.VolumeId, len(pvs))
+	}
+
+	pv := pvs[0]
+	if len(pv.Spec.CSI.VolumeAttributes[ctxKeyPVName]) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume %q can't be modified since it is not provisioned by this version of the driver", req.VolumeId)
+	}
+
+	current := currentImage(pv)
+	image, err := modifyImage(current, req.MutableParameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if image == current {
+		return &csi.ControllerModifyVolumeResponse{}, nil
+	}
+
+	if _, err = c.validateImage(ctx, image, pv.Spec.CSI.VolumeAttributes); err != nil {
+		return nil, err
+	}
+
+	if err = c.watcher.SetVolumeImage(ctx, pv.Name, image); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to modify volume %q: %s", req.VolumeId, err)
+	}
+
+	klog.Infof("volume %q now uses image %q instead of %q", req.VolumeId, image, current)
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+// currentImage returns the image the volume of the PV currently maps to.
+func currentImage(pv *corev1.PersistentVolume) string {
+	if image := watcher.CurrentImage(pv); len(image) > 0 {
+		return image
+	}
+
+	return volumeImage(pv.Spec.CSI.VolumeHandle, pv.Spec.CSI.VolumeAttributes)
 }
 
 // ControllerGetCapabilities returns the capabilities of the controller service.
 func (c *ControllerServer) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
-			},
-		},
+		Capabilities: c.driver.GetControllerServiceCapabilities(),
 	}, nil
 }
 
-// ValidateVolumeCapabilities validates the volume capabilities.
-func (c *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+// ValidateVolumeCapabilities validates the volume capabilities, and that the image of the volume exists.
+func (c *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if len(req.VolumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+
+	if _, err := c.validateImage(ctx, volumeImage(req.VolumeId, req.VolumeContext), req.VolumeContext); err != nil {
+		return nil, err
+	}
+
+	readWrite := req.VolumeContext[ctxKeyReadWrite] == "true"
 	for _, cap := range req.VolumeCapabilities {
-		if cap.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY &&
-			cap.AccessMode.Mode != csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+		if !accessModeSupported(cap.AccessMode.Mode, readWrite) {
 			return &csi.ValidateVolumeCapabilitiesResponse{
-				Message: "Only ReadOnlyMany or ReadOnlyOnce access modes are supported",
+				Message: "Only ReadOnlyMany or ReadOnlyOnce access modes are supported, " +
+					"or ReadWriteOnce if the volume is read-write",
 			}, nil
 		}
 	}
@@ -102,9 +342,99 @@ func (c *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *cs
 	}, nil
 }
 
-// ListVolumes is not implemented.
-func (c *ControllerServer) ListVolumes(_ context.Context, _ *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// accessModeSupported returns true if volumes can be published in the access mode.
+// Writable volumes can only be published on a single node since changes are local to the node.
+func accessModeSupported(mode csi.VolumeCapability_AccessMode_Mode, readWrite bool) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return readWrite
+	default:
+		return false
+	}
+}
+
+// ListVolumes returns volumes of PVs provisioned by the driver, sorted by volume IDs. PVs sharing a volume handle are
+// the same volume. The starting token is the index of the first volume to return.
+func (c *ControllerServer) ListVolumes(_ context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max_entries must not be negative")
+	}
+
+	volumes := groupByHandle(c.watcher.ListVolumes(c.driver.GetName()))
+
+	start := 0
+	if len(req.StartingToken) > 0 {
+		var err error
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(volumes) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.StartingToken)
+		}
+	}
+
+	end := len(volumes)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, pvs := range volumes[start:end] {
+		volume, volumeStatus := c.volumeOf(pvs)
+		entries = append(entries, &csi.ListVolumesResponse_Entry{Volume: volume, Status: volumeStatus})
+	}
+
+	nextToken := ""
+	if end < len(volumes) {
+		nextToken = strconv.Itoa(end)
+	}
+
+	return &csi.ListVolumesResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// groupByHandle groups PVs sorted by volume handles into volumes.
+func groupByHandle(pvs []*corev1.PersistentVolume) [][]*corev1.PersistentVolume {
+	var volumes [][]*corev1.PersistentVolume
+	for i, pv := range pvs {
+		if i > 0 && pv.Spec.CSI.VolumeHandle == pvs[i-1].Spec.CSI.VolumeHandle {
+			volumes[len(volumes)-1] = append(volumes[len(volumes)-1], pv)
+			continue
+		}
+
+		volumes = append(volumes, []*corev1.PersistentVolume{pv})
+	}
+
+	return volumes
+}
+
+// volumeOf returns the volume shared by the given PVs, along with its condition. The volume is abnormal if the image
+// of any PV is not available.
+func (c *ControllerServer) volumeOf(pvs []*corev1.PersistentVolume) (*csi.Volume, *csi.ListVolumesResponse_VolumeStatus) {
+	volume := &csi.Volume{
+		VolumeId:      pvs[0].Spec.CSI.VolumeHandle,
+		VolumeContext: pvs[0].Spec.CSI.VolumeAttributes,
+	}
+
+	if capacity, found := pvs[0].Spec.Capacity[corev1.ResourceStorage]; found {
+		volume.CapacityBytes = capacity.Value()
+	}
+
+	volumeStatus := &csi.ListVolumesResponse_VolumeStatus{}
+	for _, pv := range pvs {
+		volumeContext := pv.Spec.CSI.VolumeAttributes
+		pullSecretNamespace := volumeContext[ctxKeyPullSecretNamespace]
+		if len(pullSecretNamespace) == 0 && pv.Spec.ClaimRef != nil {
+			pullSecretNamespace = pv.Spec.ClaimRef.Namespace
+		}
+
+		condition := c.imageChecker.condition(currentImage(pv), pullSecretNamespace, volumeContext[ctxKeyPullSecret])
+		if volumeStatus.VolumeCondition == nil || condition.Abnormal {
+			volumeStatus.VolumeCondition = condition
+		}
+	}
+
+	return volume, volumeStatus
 }
 
 // GetCapacity is not implemented.
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	csicommon "github.com/warm-metal/container-image-csi-driver/pkg/csi-common"
+	"github.com/warm-metal/container-image-csi-driver/pkg/registry"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeSecretStore struct {
+	guard            sync.Mutex
+	secretNamespaces []string
+}
+
+func (f *fakeSecretStore) GetDockerKeyring(context.Context, map[string]string) (secret.DockerKeyring, error) {
+	return secret.NewDockerKeyring(), nil
+}
+
+func (f *fakeSecretStore) GetDockerKeyringFromSecrets(_ context.Context, namespace string, _ []string) (secret.DockerKeyring, error) {
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	f.secretNamespaces = append(f.secretNamespaces, namespace)
+	return secret.NewDockerKeyring(), nil
+}
+
+func testPV(name, driver, handle string, attributes map[string]string, claim string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver:           driver,
+				VolumeHandle:     handle,
+				VolumeAttributes: attributes,
+			}},
+		},
+	}
+
+	if len(claim) > 0 {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "default", Name: claim}
+	}
+
+	return pv
+}
+
+func TestListVolumes(t *testing.T) {
+	objects := []runtime.Object{
+		testPV("pv-b", driverName, "pvc-b", map[string]string{
+			ctxKeyImage:      "docker.io/library/missing:latest",
+			ctxKeyPullSecret: "creds",
+		}, "claim-b"),
+		testPV("pv-a", driverName, "docker.io/library/alpine:3", nil, "claim-a"),
+		testPV("pv-a2", driverName, "docker.io/library/alpine:3", nil, "claim-a2"),
+		testPV("pv-other", "other.csi.k8s.io", "foo", nil, ""),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := watcher.NewWithClient(ctx, fake.NewSimpleClientset(objects...), 0)
+	defer w.Stop()
+	assert.True(t, w.WaitForCacheSync(ctx))
+
+	secretStore := &fakeSecretStore{}
+	c := NewControllerServer(csicommon.NewCSIDriver(driverName, driverVersion, ""), w, secretStore)
+	var guard sync.Mutex
+	var resolved []string
+	c.imageChecker.resolve = func(_ context.Context, image reference.Named, _ secret.DockerKeyring) error {
+		guard.Lock()
+		defer guard.Unlock()
+		resolved = append(resolved, image.String())
+		if image.Name() == "docker.io/library/missing" {
+			return errdefs.ErrNotFound
+		}
+
+		return nil
+	}
+
+	// Images are checked in the background. Conditions are pending until checked.
+	resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	for _, entry := range resp.Entries {
+		assert.Equal(t, &csi.VolumeCondition{Message: "pending"}, entry.Status.VolumeCondition)
+	}
+	c.imageChecker.checks.Wait()
+
+	resp, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Entries, 1) {
+		entry := resp.Entries[0]
+		assert.Equal(t, "docker.io/library/alpine:3", entry.Volume.VolumeId)
+		assert.Equal(t, int64(1<<30), entry.Volume.CapacityBytes)
+		assert.False(t, entry.Status.VolumeCondition.Abnormal)
+	}
+	assert.Equal(t, "1", resp.NextToken)
+
+	resp, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Entries, 1) {
+		entry := resp.Entries[0]
+		assert.Equal(t, "pvc-b", entry.Volume.VolumeId)
+		assert.True(t, entry.Status.VolumeCondition.Abnormal)
+	}
+	assert.Empty(t, resp.NextToken)
+	assert.Equal(t, []string{"default"}, secretStore.secretNamespaces,
+		"pull secrets should be fetched from the namespace of the PVC")
+
+	_, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "3"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	getResp, err := c.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "pvc-b"})
+	assert.NoError(t, err)
+	assert.True(t, getResp.Status.VolumeCondition.Abnormal)
+	c.imageChecker.checks.Wait()
+	assert.Len(t, resolved, 2, "conditions should be cached")
+
+	_, err = c.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "foo"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testPV("pvc-a", driverName, "pvc-a", map[string]string{
+			ctxKeyImage: "docker.io/library/alpine:3", ctxKeyPVName: "pvc-a",
+		}, "claim-a"),
+		testPV("static", driverName, "docker.io/library/alpine:3", nil, ""),
+		testPV("shared-a", driverName, "shared", map[string]string{
+			ctxKeyImage: "docker.io/library/alpine:3", ctxKeyPVName: "shared-a",
+		}, ""),
+		testPV("shared-b", driverName, "shared", map[string]string{
+			ctxKeyImage: "docker.io/library/alpine:3", ctxKeyPVName: "shared-b",
+		}, ""),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := watcher.NewWithClient(ctx, client, 0)
+	defer w.Stop()
+	assert.True(t, w.WaitForCacheSync(ctx))
+
+	c := NewControllerServer(csicommon.NewCSIDriver(driverName, driverVersion, ""), w, &fakeSecretStore{})
+	c.inspectImage = func(_ context.Context, image reference.Named, _ secret.DockerKeyring, _ platforms.MatchComparer) (
+		*registry.ImageInfo, error,
+	) {
+		if image.String() == "docker.io/library/alpine:missing" {
+			return nil, errdefs.ErrNotFound
+		}
+
+		return &registry.ImageInfo{Digest: alpineDigest, Size: 5 << 20}, nil
+	}
+
+	_, err := c.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "pvc-a",
+		MutableParameters: map[string]string{paramTag: "missing"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "new images should be validated")
+
+	_, err = c.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "pvc-a",
+		MutableParameters: map[string]string{paramTag: "3.20"},
+	})
+	assert.NoError(t, err)
+
+	image, err := watcher.NewVolumeImages(ctx, client, 0).Image(ctx, "pvc-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine:3.20", image)
+
+	_, err = c.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "pvc-a",
+		MutableParameters: map[string]string{"foo": "bar"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = c.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "docker.io/library/alpine:3",
+		MutableParameters: map[string]string{paramTag: "3.20"},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "volumes without PV names can't be modified")
+
+	_, err = c.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "shared",
+		MutableParameters: map[string]string{paramTag: "3.20"},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "volumes shared by PVs can't be modified")
+	for _, pvName := range []string{"shared-a", "shared-b"} {
+		image, err = watcher.NewVolumeImages(ctx, client, 0).Image(ctx, pvName)
+		assert.NoError(t, err)
+		assert.Empty(t, image, "PVs sharing the volume should not be modified")
+	}
+}
+
+const alpineDigest = digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+
+func TestCreateVolume(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-a", Annotations: map[string]string{
+			watcher.PullSecretAnnotation: "creds",
+		}},
+	}, &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-b", Annotations: map[string]string{
+			watcher.ImageAnnotation: "docker.io/library/alpine:3",
+		}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := watcher.NewWithClient(ctx, client, 0)
+	defer w.Stop()
+	assert.True(t, w.WaitForCacheSync(ctx))
+
+	secretStore := &fakeSecretStore{}
+	c := NewControllerServer(csicommon.NewCSIDriver(driverName, driverVersion, ""), w, secretStore)
+	c.inspectImage = func(_ context.Context, image reference.Named, _ secret.DockerKeyring, _ platforms.MatchComparer) (
+		*registry.ImageInfo, error,
+	) {
+		if image.Name() == "docker.io/library/missing" {
+			return nil, errdefs.ErrNotFound
+		}
+
+		return &registry.ImageInfo{Digest: alpineDigest, Size: 5 << 20}, nil
+	}
+
+	request := func(image string, required int64) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          "pvc-a",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: required},
+			Parameters: map[string]string{
+				paramImage:        image,
+				paramPVCName:      "claim-a",
+				paramPVCNamespace: "default",
+			},
+		}
+	}
+
+	resp, err := c.CreateVolume(ctx, request("docker.io/library/alpine:3", 1<<20))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5<<20), resp.Volume.CapacityBytes, "the capacity should be the image size")
+	assert.Equal(t, []string{"default"}, secretStore.secretNamespaces,
+		"pull secrets should be fetched from the namespace of the PVC")
+
+	resp, err = c.CreateVolume(ctx, request("docker.io/library/alpine:3", 1<<30))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<30), resp.Volume.CapacityBytes, "the capacity should satisfy the request")
+
+	modified := request("docker.io/library/alpine:3", 0)
+	modified.MutableParameters = map[string]string{paramTag: "3.20"}
+	resp, err = c.CreateVolume(ctx, modified)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine:3.20", resp.Volume.VolumeContext[ctxKeyImage],
+		"the VolumeAttributesClass should apply at creation")
+
+	// Volumes of the PVC annotation have their own handles too.
+	resp, err = c.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "pvc-b",
+		Parameters: map[string]string{paramPVCName: "claim-b", paramPVCNamespace: "default"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "pvc-b", resp.Volume.VolumeId)
+	assert.Equal(t, "docker.io/library/alpine:3", resp.Volume.VolumeContext[ctxKeyImage])
+	assert.Equal(t, "pvc-b", resp.Volume.VolumeContext[ctxKeyPVName])
+
+	_, err = c.CreateVolume(ctx, request("docker.io/library/missing:latest", 0))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = c.CreateVolume(ctx, request("docker.io/library/Alpine:3", 0))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "docker.io/library/missing:latest",
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	local := request("docker.io/library/missing:latest", 1<<20)
+	local.Parameters[paramValidateImage] = "false"
+	resp, err = c.CreateVolume(ctx, local)
+	assert.NoError(t, err, "images should not be validated if the StorageClass skips validation")
+	assert.Equal(t, int64(1<<20), resp.Volume.CapacityBytes, "the requested capacity should be used")
+	_, err = c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: resp.Volume.VolumeId, VolumeContext: resp.Volume.VolumeContext,
+	})
+	assert.NoError(t, err)
+
+	local = request("docker.io/library/missing:latest", 0)
+	local.Parameters[paramContainerdNamespace] = "moby"
+	_, err = c.CreateVolume(ctx, local)
+	assert.NoError(t, err, "images in containerd namespaces should not be validated")
+
+	c = NewControllerServer(csicommon.NewCSIDriver(driverName, driverVersion, ""), w, secretStore,
+		WithoutImageValidation())
+	_, err = c.CreateVolume(ctx, request("docker.io/library/missing:latest", 0))
+	assert.NoError(t, err, "images should not be validated if validation is disabled")
+}
+
+func TestCreateVolumeOnCachedNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := watcher.NewWithClient(ctx, fake.NewSimpleClientset(), 0)
+	defer w.Stop()
+	assert.True(t, w.WaitForCacheSync(ctx))
+
+	c := NewControllerServer(csicommon.NewCSIDriver(driverName, driverVersion, ""), w, &fakeSecretStore{})
+	c.inspectImage = func(context.Context, reference.Named, secret.DockerKeyring, platforms.MatchComparer) (
+		*registry.ImageInfo, error,
+	) {
+		return &registry.ImageInfo{Digest: alpineDigest, Size: 5 << 20}, nil
+	}
+
+	host := func(node string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"kubernetes.io/hostname": node}}
+	}
+
+	resp, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "pvc-a",
+		Parameters: map[string]string{paramImage: "docker.io/library/alpine:3", paramPreferCachedNodes: "true"},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{host("cold"), host("warm")},
+			Preferred: []*csi.Topology{host("warm"), host("cold")},
+		},
+	})
+	assert.NoError(t, err, "the deprecated parameter should still be accepted")
+	assert.Empty(t, resp.Volume.AccessibleTopology, "volumes should be accessible from all nodes")
+}
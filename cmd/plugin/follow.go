@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/warm-metal/container-image-csi-driver/pkg/pullcoord"
+	"github.com/warm-metal/container-image-csi-driver/pkg/registry"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// followSource resolves and pulls images of volumes following tags, with credentials of the node plugin and the
+// pull secrets of the volumes.
+type followSource struct {
+	imageSvc        cri.ImageServiceClient
+	secretStore     secret.Store
+	pullCoordinator *pullcoord.Coordinator
+	pullers         *pullers
+}
+
+func (s *followSource) keyring(ctx context.Context, volumeContext map[string]string) (secret.DockerKeyring, error) {
+	keyring, err := s.secretStore.GetDockerKeyring(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return withPullSecret(ctx, s.secretStore, volumeContext, keyring)
+}
+
+func (s *followSource) Resolve(
+	ctx context.Context, image reference.Named, volumeContext map[string]string,
+) (digest.Digest, error) {
+	keyring, err := s.keyring(ctx, volumeContext)
+	if err != nil {
+		return "", err
+	}
+
+	desc, err := registry.Resolve(ctx, image, keyring)
+	if err != nil {
+		return "", err
+	}
+
+	return desc.Digest, nil
+}
+
+func (s *followSource) MountContext(
+	ctx context.Context, volumeContext map[string]string,
+) (context.Context, error) {
+	return s.pullers.mountContext(ctx, volumeContext)
+}
+
+func (s *followSource) Pull(ctx context.Context, image reference.Named, volumeContext map[string]string) (string, error) {
+	keyring, err := s.keyring(ctx, volumeContext)
+	if err != nil {
+		return "", err
+	}
+
+	puller, err := s.pullers.newPuller(image, keyring, volumeContext)
+	if err != nil {
+		return "", err
+	}
+
+	if s.pullCoordinator != nil {
+		puller = s.pullCoordinator.Wrap(puller, image, keyring)
+	}
+
+	if err = puller.Pull(ctx); err != nil {
+		return "", err
+	}
+
+	// Images pulled via containerd may not be visible to the CRI yet, or at all.
+	if imageID := puller.ImageID(); len(imageID) > 0 {
+		return imageID, nil
+	}
+
+	return remoteimage.LocalImageID(ctx, s.imageSvc, image)
+}
@@ -5,18 +5,34 @@ import (
 	goflag "flag"
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/containerd/containerd/v2/client"
 	flag "github.com/spf13/pflag"
 	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
 	"github.com/warm-metal/container-image-csi-driver/pkg/backend/containerd"
 	"github.com/warm-metal/container-image-csi-driver/pkg/backend/crio"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend/oci"
 	"github.com/warm-metal/container-image-csi-driver/pkg/cri"
 	csicommon "github.com/warm-metal/container-image-csi-driver/pkg/csi-common"
+	"github.com/warm-metal/container-image-csi-driver/pkg/events"
+	"github.com/warm-metal/container-image-csi-driver/pkg/follow"
+	"github.com/warm-metal/container-image-csi-driver/pkg/imagecache"
+	"github.com/warm-metal/container-image-csi-driver/pkg/imagegc"
 	"github.com/warm-metal/container-image-csi-driver/pkg/metrics"
+	"github.com/warm-metal/container-image-csi-driver/pkg/prewarm"
+	"github.com/warm-metal/container-image-csi-driver/pkg/pullcoord"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/schedgate"
 	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
 	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 	"k8s.io/klog/v2"
 )
 
@@ -26,9 +42,17 @@ const (
 
 	containerdScheme = "containerd"
 	criOScheme       = "cri-o"
+	ociScheme        = "oci"
 
 	nodeMode       = "node"
 	controllerMode = "controller"
+
+	pullRecordsFile = "pull-records.json"
+	identityKeyFile = "identity.key"
+	imageUsageFile  = "image-usage.json"
+	followFile      = "follow-volumes.json"
+	mountStateFile  = "mounts.json"
+	ociStoreDir     = "oci-store"
 )
 
 var (
@@ -41,8 +65,9 @@ var (
 	runtimeAddr = flag.String(
 		"runtime-addr", "",
 		fmt.Sprintf("The unix socket of the container runtime. Currently both containerd and cri-o are supported."+
-			"Users need to replace the leading %q with %q or %q to indicate the working runtime.",
-			"unix", containerdScheme, criOScheme),
+			"Users need to replace the leading %q with %q or %q to indicate the working runtime. "+
+			"Without container runtimes, %q followed by a directory of OCI layouts and tarballs mounts images in it.",
+			"unix", containerdScheme, criOScheme, ociScheme+"://"),
 	)
 	icpConf = flag.String("image-credential-provider-config", "",
 		"The path to the credential provider plugin config file.")
@@ -57,9 +82,93 @@ var (
 	mode = flag.String("mode", nodeMode,
 		fmt.Sprintf("Mode determines the role this instance plays. One of %q or %q.", nodeMode, controllerMode))
 	watcherResyncPeriod = flag.Duration("watcher-resync-period", 10*time.Minute,
-		"Resync period for the PVC watcher. Only valid in controller mode.")
+		"Resync period for the PVC watcher, and the PV cache of nodes looking up images of modified volumes.")
 	metricsPort = flag.Int("metrics-port", 8080,
 		"Port for serving Prometheus metrics.")
+	stateDir = flag.String("state-dir", "/csi",
+		"The directory where the node plugin saves its states. It should be persistent across restarts.")
+	ensureImageCredentials = flag.Bool("ensure-image-credentials", false,
+		"Mount cached images only if credentials of the workload have pulled them, or are able to pull them. "+
+			"Only valid in node mode.")
+	enableImagePrewarm = flag.Bool("enable-image-prewarm", false,
+		"Pull images requested by ImagePrewarm objects on the current node. Only valid in node mode.")
+	prewarmResyncPeriod = flag.Duration("prewarm-resync-period", 10*time.Minute,
+		"Resync period of ImagePrewarm objects. Only valid if --enable-image-prewarm is set.")
+	prewarmWorkers = flag.Int("prewarm-workers", 4,
+		"Number of ImagePrewarm objects processed, and images pulled, at the same time. "+
+			"Only valid if --enable-image-prewarm is set.")
+	podEvents = flag.Bool("pod-events", false,
+		"Emit events of image pulls and mounts on pods consuming volumes. Only valid in node mode.")
+	imageGCInterval = flag.Duration("image-gc-interval", 0,
+		"Interval to remove unused images pulled by the driver. Image garbage collection is disabled if it is 0. "+
+			"Only valid in node mode.")
+	imageGCTTL = flag.Duration("image-gc-ttl", 0,
+		"Remove images pulled by the driver if they haven't been mounted for the duration.")
+	imageGCQuota = flag.String("image-gc-quota", "",
+		"Total size of images pulled by the driver, e.g. 20Gi. Least recently used images are removed if exceeded.")
+	imageGCMaxImages = flag.Int("image-gc-max-images", 0,
+		"Maximum number of images pulled by the driver. Least recently used images are removed if exceeded.")
+	cachedImagesReportInterval = flag.Duration("cached-images-report-interval", 0,
+		"Interval to report images cached on the current node via the NodeImageCache object of the node. "+
+			"Reporting is disabled if it is 0. Only valid in node mode.")
+	validateImages = flag.Bool("validate-images", true,
+		"Check that images of new or modified volumes exist in registries. "+
+			"Disable it if images are only available on nodes, e.g. in air-gapped clusters or with the oci backend. Only valid in controller mode.")
+	pullCoordinationSlots = flag.Int("pull-coordination-slots", 0,
+		"The number of nodes allowed to pull the same image at a time, coordinated via Leases. "+
+			"Coordination is disabled if it is 0. Only valid in node mode.")
+	pullCoordinationNamespace = flag.String("pull-coordination-namespace", "",
+		"The namespace of Leases to coordinate pulls. Only valid if --pull-coordination-slots is set.")
+	pullCoordinationMaxWait = flag.Duration("pull-coordination-max-wait", 5*time.Minute,
+		"Images are pulled without coordination if no slot is available in the duration.")
+	schedulingGateTimeout = flag.Duration("scheduling-gate-timeout", 0,
+		"Prewarm images of volumes of pods with the scheduling gate "+schedgate.GateName+", and remove the gate "+
+			"once images are warm, or after the timeout. Disabled if it is 0. Only valid in controller mode.")
+	schedulingGateMinNodes = flag.Int("scheduling-gate-min-nodes", 1,
+		"The number of nodes which should hold images before the scheduling gate is removed.")
+	p2pPort = flag.Int("p2p-port", 0,
+		"Serve blobs held by the container runtime to node plugins on other nodes on the port, and run a registry "+
+			"mirror fetching blobs from them at --p2p-mirror-addr. Disabled if it is 0. Only valid in node mode.")
+	p2pMirrorAddr = flag.String("p2p-mirror-addr", "127.0.0.1:5001",
+		"The address of the registry mirror, which should be configured as a mirror of the container runtime.")
+	p2pIP = flag.String("p2p-ip", "",
+		"The IP of the node plugin pod, which blobs are served on. Only valid if --p2p-port is set.")
+	p2pTLSCertFile = flag.String("p2p-tls-cert-file", "",
+		"The TLS certificate node plugins present to each other, which must be valid for --p2p-tls-server-name.")
+	p2pTLSKeyFile = flag.String("p2p-tls-key-file", "",
+		"The private key of --p2p-tls-cert-file.")
+	p2pTLSCAFile = flag.String("p2p-tls-ca-file", "",
+		"The CA signing certificates of all node plugins.")
+	p2pTLSServerName = flag.String("p2p-tls-server-name", "container-image-csi-driver-p2p",
+		"The name node plugins verify certificates of peers against, since peers are addressed by pod IPs.")
+	p2pNamespace = flag.String("p2p-namespace", "",
+		"The namespace of node plugins. Only valid if --p2p-port is set.")
+	p2pPeerSelector = flag.String("p2p-peer-selector", "",
+		"The label selector of pods of node plugins. Only valid if --p2p-port is set.")
+	followInterval = flag.Duration("follow-interval", 0,
+		"Interval to check tags of volumes with the attribute follow, and switch them to new images. "+
+			"Following tags is disabled if it is 0. Only valid in node mode.")
+	defaultPuller = flag.String("puller", pullerCRI,
+		fmt.Sprintf("The default puller of images, %q or %q. The %q puller pulls images via the CRI image service, "+
+			"while the %q puller pulls and unpacks images directly via containerd. Volumes can override it via the "+
+			"attribute %q. Only valid in node mode.", pullerCRI, pullerContainerd, pullerCRI, pullerContainerd,
+			ctxKeyPuller))
+	registryHostsDir = flag.String("registry-hosts-dir", "/etc/containerd/certs.d",
+		"The directory of hosts.toml of registries used by the containerd puller.")
+	snapshotter = flag.String("snapshotter", "",
+		fmt.Sprintf("The containerd snapshotter which images of volumes are unpacked to, e.g. stargz or nydus. "+
+			"Volumes can override it via the attribute %q. The default snapshotter of containerd is used if it is "+
+			"empty. Only valid on containerd.", ctxKeySnapshotter))
+	containerdNamespace = flag.String("containerd-namespace", criNamespace,
+		fmt.Sprintf("The containerd namespace of images. Volumes can override it via the attribute %q. Images in "+
+			"namespaces other than %q are pulled via containerd, and invisible to the CRI. Only valid on containerd.",
+			ctxKeyContainerdNamespace, criNamespace))
+	reconcileInterval = flag.Duration("reconcile-interval", 0,
+		"Interval to compare snapshots, mounts and reference counts of volumes, and fix drift between them, e.g. "+
+			"leaked snapshots and targets unmounted behind the driver. Reconciliation is disabled if it is 0. "+
+			"Only valid in node mode.")
+	reconcileDryRun = flag.Bool("reconcile-dry-run", false,
+		"Only report drift found by the reconciler via metrics, without fixing it.")
 )
 
 func main() {
@@ -89,6 +198,10 @@ func main() {
 	})
 	driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	})
 
 	if len(*mode) == 0 {
@@ -113,7 +226,15 @@ func main() {
 			*runtimeAddr = addr.String()
 		}
 
+		mounterOpts := []backend.MounterOption{backend.WithStateFile(filepath.Join(*stateDir, mountStateFile))}
+		if *reconcileInterval > 0 {
+			mounterOpts = append(mounterOpts, backend.WithReconciler(*reconcileInterval, *reconcileDryRun))
+		}
+
 		var mounter backend.Mounter
+		var blobStore backend.BlobStore
+		var criClient criapi.ImageServiceClient
+		var containerdClient *client.Client
 		if len(*runtimeAddr) > 0 {
 			addr, err := url.Parse(*runtimeAddr)
 			if err != nil {
@@ -123,9 +244,32 @@ func main() {
 			klog.Infof("runtime %s at %q", addr.Scheme, addr.Path)
 			switch addr.Scheme {
 			case containerdScheme:
-				mounter = containerd.NewMounter(addr.Path)
+				mounter = containerd.NewMounter(addr.Path, *containerdNamespace, mounterOpts...)
+				if *p2pPort > 0 {
+					blobStore = containerd.NewBlobStore(addr.Path, *containerdNamespace)
+				}
+
+				containerdClient, err = client.New(addr.Path, client.WithDefaultNamespace(*containerdNamespace))
+				if err != nil {
+					klog.Fatalf("unable to connect to containerd: %s", err)
+				}
 			case criOScheme:
-				mounter = crio.NewMounter(addr.Path)
+				mounter = crio.NewMounter(addr.Path, mounterOpts...)
+				if *p2pPort > 0 {
+					blobStore = crio.NewBlobStore(addr.Path)
+				}
+			case ociScheme:
+				if *p2pPort > 0 || *imageGCInterval > 0 {
+					klog.Fatalf("p2p distribution and image gc require a container runtime")
+				}
+
+				store, err := oci.NewStore(addr.Path, filepath.Join(*stateDir, ociStoreDir))
+				if err != nil {
+					klog.Fatalf("unable to create the image store: %s", err)
+				}
+
+				mounter = oci.NewMounter(store, mounterOpts...)
+				criClient = oci.NewImageService(store)
 			default:
 				klog.Fatalf("unknown container runtime %q", addr.Scheme)
 			}
@@ -134,17 +278,189 @@ func main() {
 			*runtimeAddr = addr.String()
 		}
 
-		criClient, err := cri.NewRemoteImageService(*runtimeAddr, time.Second)
-		if err != nil {
-			klog.Fatalf(`unable to connect to cri daemon "%s": %s`, *endpoint, err)
+		var err error
+		if criClient == nil {
+			if criClient, err = cri.NewRemoteImageService(*runtimeAddr, time.Second); err != nil {
+				klog.Fatalf(`unable to connect to cri daemon "%s": %s`, *endpoint, err)
+			}
+		}
+
+		if len(*snapshotter) > 0 && containerdClient == nil {
+			klog.Fatalf("--snapshotter requires the containerd runtime")
+		}
+
+		switch *defaultPuller {
+		case pullerCRI:
+		case pullerContainerd:
+			if containerdClient == nil {
+				klog.Fatalf("the %q puller requires the containerd runtime", pullerContainerd)
+			}
+		default:
+			klog.Fatalf("unknown puller %q", *defaultPuller)
+		}
+
+		imagePullers := &pullers{
+			imageSvc:      criClient,
+			containerd:    containerdClient,
+			hostsDir:      *registryHostsDir,
+			defaultPuller: *defaultPuller,
+			snapshotter:   *snapshotter,
+		}
+
+		if containerdClient != nil {
+			imagePullers.namespace = *containerdNamespace
 		}
 
 		secretStore := secret.CreateStoreOrDie(*icpConf, *icpBin, *nodePluginSA, *enableCache)
 
+		nodeOpts := []NodeServerOption{WithPullers(imagePullers)}
+		var pullRecords *remoteimage.PullRecords
+		if *ensureImageCredentials {
+			if err = secret.LoadIdentityKey(filepath.Join(*stateDir, identityKeyFile)); err != nil {
+				klog.Fatalf("unable to load the key of credential identities: %s", err)
+			}
+
+			pullRecords, err = remoteimage.LoadPullRecords(filepath.Join(*stateDir, pullRecordsFile))
+			if err != nil {
+				klog.Fatalf("unable to load pull records: %s", err)
+			}
+
+			nodeOpts = append(nodeOpts, WithPullRecords(pullRecords))
+		}
+
+		var gc *imagegc.Collector
+		var tracker *imagegc.Tracker
+		if *imageGCInterval > 0 {
+			policy := imagegc.Policy{TTL: *imageGCTTL, MaxImages: *imageGCMaxImages}
+			if len(*imageGCQuota) > 0 {
+				quota, err := resource.ParseQuantity(*imageGCQuota)
+				if err != nil {
+					klog.Fatalf("invalid image gc quota %q: %s", *imageGCQuota, err)
+				}
+
+				policy.Quota = quota.Value()
+			}
+
+			if !policy.Enabled() {
+				klog.Fatalf("--image-gc-ttl, --image-gc-quota or --image-gc-max-images is required by image gc")
+			}
+
+			tracker, err = imagegc.LoadTracker(filepath.Join(*stateDir, imageUsageFile), mounter)
+			if err != nil {
+				klog.Fatalf("unable to load image usages: %s", err)
+			}
+
+			runtimeClient, err := cri.NewRemoteRuntimeService(*runtimeAddr, time.Second)
+			if err != nil {
+				klog.Fatalf(`unable to connect to cri daemon "%s": %s`, *runtimeAddr, err)
+			}
+
+			var onRemoved func(string)
+			if pullRecords != nil {
+				onRemoved = func(imageID string) {
+					if err := pullRecords.Forget(imageID); err != nil {
+						klog.Errorf("unable to forget pull records of image %q: %s", imageID, err)
+					}
+				}
+			}
+
+			gc = imagegc.NewCollector(tracker, criClient, runtimeClient, policy, onRemoved)
+			nodeOpts = append(nodeOpts, WithImageTracker(tracker))
+		}
+
+		var recorder *events.Recorder
+		if *podEvents {
+			kubeConfig, err := rest.InClusterConfig()
+			if err != nil {
+				klog.Fatalf("unable to get cluster config: %s", err)
+			}
+
+			recorder = events.NewRecorder(kubernetes.NewForConfigOrDie(kubeConfig), *nodeID)
+			defer recorder.Shutdown()
+			nodeOpts = append(nodeOpts, WithEventRecorder(recorder))
+		}
+
+		if kubeConfig, err := rest.InClusterConfig(); err != nil {
+			klog.Warningf("unable to get cluster config, images of modified volumes are ignored: %s", err)
+		} else {
+			nodeOpts = append(nodeOpts,
+				WithVolumeImages(watcher.NewVolumeImages(context.Background(), kubernetes.NewForConfigOrDie(kubeConfig),
+					*watcherResyncPeriod)))
+		}
+
+		var coordinator *pullcoord.Coordinator
+		if *pullCoordinationSlots > 0 {
+			if len(*pullCoordinationNamespace) == 0 {
+				klog.Fatalf("--pull-coordination-namespace is required by pull coordination")
+			}
+
+			kubeConfig, err := rest.InClusterConfig()
+			if err != nil {
+				klog.Fatalf("unable to get cluster config: %s", err)
+			}
+
+			coordinator = pullcoord.NewCoordinator(kubernetes.NewForConfigOrDie(kubeConfig),
+				*pullCoordinationNamespace, *nodeID, *pullCoordinationSlots, *pullCoordinationMaxWait)
+			nodeOpts = append(nodeOpts, WithPullCoordinator(coordinator))
+		}
+
+		var follower *follow.Follower
+		if *followInterval > 0 {
+			source := &followSource{
+				imageSvc:        criClient,
+				secretStore:     secretStore,
+				pullCoordinator: coordinator,
+				pullers:         imagePullers,
+			}
+			follower, err = follow.Load(filepath.Join(*stateDir, followFile), mounter, source, recorder, tracker)
+			if err != nil {
+				klog.Fatalf("unable to load following volumes: %s", err)
+			}
+
+			nodeOpts = append(nodeOpts, WithFollower(follower))
+		}
+
+		nodeServer := NewNodeServer(driver, mounter, criClient, secretStore, *asyncImagePullTimeout, nodeOpts...)
+		if *enableImagePrewarm {
+			kubeConfig, err := rest.InClusterConfig()
+			if err != nil {
+				klog.Fatalf("unable to get cluster config: %s", err)
+			}
+
+			ctrl := prewarm.NewController(*nodeID, kubernetes.NewForConfigOrDie(kubeConfig),
+				dynamic.NewForConfigOrDie(kubeConfig), criClient, secretStore, nodeServer.asyncImagePuller,
+				nodeServer.asyncImagePullTimeout, pullRecords, coordinator, *prewarmResyncPeriod,
+				imagePullers.nodePuller(), *prewarmWorkers)
+			go ctrl.Run(context.Background())
+		}
+
+		if gc != nil {
+			go gc.Run(context.Background(), *imageGCInterval)
+		}
+
+		if *cachedImagesReportInterval > 0 {
+			kubeConfig, err := rest.InClusterConfig()
+			if err != nil {
+				klog.Fatalf("unable to get cluster config: %s", err)
+			}
+
+			reporter := imagecache.NewReporter(*nodeID, kubernetes.NewForConfigOrDie(kubeConfig),
+				dynamic.NewForConfigOrDie(kubeConfig), criClient)
+			go reporter.Run(context.Background(), *cachedImagesReportInterval)
+		}
+
+		if blobStore != nil {
+			startP2P(blobStore)
+		}
+
+		if follower != nil {
+			go follower.Run(context.Background(), *followInterval)
+		}
+
 		server.Start(*endpoint,
 			NewIdentityServer(driverVersion),
 			nil,
-			NewNodeServer(driver, mounter, criClient, secretStore, *asyncImagePullTimeout))
+			nodeServer)
 	case controllerMode:
 		watcher, err := watcher.New(context.Background(), *watcherResyncPeriod)
 		if err != nil {
@@ -153,9 +469,33 @@ func main() {
 
 		defer watcher.Stop()
 
+		// Credentials are only used to check whether images of volumes are available in registries.
+		secretStore := secret.CreateStoreOrDie(*icpConf, *icpBin, "", false)
+
+		var controllerOpts []ControllerServerOption
+		if !*validateImages {
+			controllerOpts = append(controllerOpts, WithoutImageValidation())
+		}
+
+		if *schedulingGateTimeout > 0 {
+			kubeConfig, err := rest.InClusterConfig()
+			if err != nil {
+				klog.Fatalf("unable to get cluster config: %s", err)
+			}
+
+			kubeClient := kubernetes.NewForConfigOrDie(kubeConfig)
+			ctrl, err := schedgate.NewController(kubeClient, dynamic.NewForConfigOrDie(kubeConfig), watcher,
+				podImages(kubeClient, watcher), *schedulingGateMinNodes, *schedulingGateTimeout)
+			if err != nil {
+				klog.Fatalf("unable to create scheduling gate controller: %s", err)
+			}
+
+			go ctrl.Run(context.Background())
+		}
+
 		server.Start(*endpoint,
 			NewIdentityServer(driverVersion),
-			NewControllerServer(driver, watcher),
+			NewControllerServer(driver, watcher, secretStore, controllerOpts...),
 			nil,
 		)
 	}
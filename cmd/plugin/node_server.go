@@ -2,22 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/containerd/platforms"
 	"github.com/distribution/reference"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
 	csicommon "github.com/warm-metal/container-image-csi-driver/pkg/csi-common"
+	"github.com/warm-metal/container-image-csi-driver/pkg/events"
+	"github.com/warm-metal/container-image-csi-driver/pkg/follow"
+	"github.com/warm-metal/container-image-csi-driver/pkg/imagegc"
 	"github.com/warm-metal/container-image-csi-driver/pkg/metrics"
+	"github.com/warm-metal/container-image-csi-driver/pkg/pullcoord"
 	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
 	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimageasync"
 	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
 	"k8s.io/klog/v2"
 	k8smount "k8s.io/mount-utils"
@@ -28,6 +37,33 @@ const (
 	ctxKeyImage           = "image"
 	ctxKeyPullAlways      = "pullAlways"
 	ctxKeyEphemeralVolume = "csi.storage.k8s.io/ephemeral"
+	// ctxKeyPullSecret is the name of the Secret to pull the image, in the namespace ctxKeyPullSecretNamespace,
+	// or the namespace of the pod if not set.
+	ctxKeyPullSecret          = "pullSecret"
+	ctxKeyPullSecretNamespace = "pullSecretNamespace"
+	// ctxKeyPlatform is the platform of the image. Volumes can only be published on nodes of the same platform.
+	ctxKeyPlatform = "platform"
+	// ctxKeyReadWrite allows PVs of the ReadWriteOnce access mode. Changes are discarded once unpublished.
+	ctxKeyReadWrite    = "readWrite"
+	ctxKeyPodNamespace = "csi.storage.k8s.io/pod.namespace"
+	// ctxKeyPVName is the name of the PV of dynamically provisioned volumes. Nodes look up the PV for the image
+	// the volume currently maps to since the volume context is immutable.
+	ctxKeyPVName = "pvName"
+	// ctxKeyFollow makes read-only volumes follow the tag of their images. Pods see new images without restarts.
+	ctxKeyFollow = "follow"
+	// ctxKeyPuller selects how the image is pulled, "cri" or "containerd". The default puller of the node is used if
+	// it is empty.
+	ctxKeyPuller = "puller"
+	// ctxKeyRegistryHosts is a subdirectory of the registry hosts directory of the node for the containerd puller.
+	ctxKeyRegistryHosts = "registryHosts"
+	// ctxKeySnapshotter is the containerd snapshotter which the image is unpacked to, e.g. stargz or nydus for lazy
+	// pulling. The default snapshotter of the node is used if it is empty.
+	ctxKeySnapshotter = "snapshotter"
+	// ctxKeyContainerdNamespace is the containerd namespace of the image, e.g. images loaded via "ctr -n moby".
+	// The default namespace of the node is used if it is empty.
+	ctxKeyContainerdNamespace = "containerdNamespace"
+	// ctxKeyValidateImage is "false" if the controller doesn't check the image in the registry. Nodes ignore it.
+	ctxKeyValidateImage = "validateImage"
 )
 
 type ImagePullStatus int
@@ -39,13 +75,73 @@ type NodeServer struct {
 	secretStore           secret.Store
 	asyncImagePullTimeout time.Duration
 	asyncImagePuller      remoteimageasync.AsyncPuller
+	pullRecords           *remoteimage.PullRecords
+	imageTracker          *imagegc.Tracker
+	recorder              *events.Recorder
+	volumeImages          *watcher.VolumeImages
+	pullCoordinator       *pullcoord.Coordinator
+	follower              *follow.Follower
+	pullers               *pullers
 	csi.UnimplementedNodeServer
 }
 
+// NodeServerOption configures optional features of the NodeServer.
+type NodeServerOption func(*NodeServer)
+
+// WithPullRecords enables the "ensure credentials" mode. Images already on the node are only mounted if
+// the credentials of the workload have pulled them before, or are able to pull them from the registry.
+func WithPullRecords(records *remoteimage.PullRecords) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.pullRecords = records
+	}
+}
+
+// WithImageTracker records images pulled and mounted by the driver for garbage collection.
+func WithImageTracker(tracker *imagegc.Tracker) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.imageTracker = tracker
+	}
+}
+
+// WithEventRecorder emits events of pulls and mounts on pods consuming volumes.
+func WithEventRecorder(recorder *events.Recorder) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.recorder = recorder
+	}
+}
+
+// WithVolumeImages publishes modified volumes with the images recorded on their PVs.
+func WithVolumeImages(volumeImages *watcher.VolumeImages) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.volumeImages = volumeImages
+	}
+}
+
+// WithPullCoordinator limits how many nodes pull the same image at a time.
+func WithPullCoordinator(coordinator *pullcoord.Coordinator) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.pullCoordinator = coordinator
+	}
+}
+
+// WithFollower lets volumes with the attribute follow switch to new images of their tags.
+func WithFollower(follower *follow.Follower) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.follower = follower
+	}
+}
+
+// WithPullers selects pullers of images other than the CRI puller.
+func WithPullers(p *pullers) NodeServerOption {
+	return func(ns *NodeServer) {
+		ns.pullers = p
+	}
+}
+
 // Remove exported method and keep only unexported one
 func (ns *NodeServer) mustEmbedUnimplementedNodeServer() {}
 
-func NewNodeServer(driver *csicommon.CSIDriver, mounter backend.Mounter, imageSvc cri.ImageServiceClient, secretStore secret.Store, asyncImagePullTimeout time.Duration) *NodeServer {
+func NewNodeServer(driver *csicommon.CSIDriver, mounter backend.Mounter, imageSvc cri.ImageServiceClient, secretStore secret.Store, asyncImagePullTimeout time.Duration, opts ...NodeServerOption) *NodeServer {
 	ns := &NodeServer{
 		driver:                driver,
 		mounter:               mounter,
@@ -53,6 +149,13 @@ func NewNodeServer(driver *csicommon.CSIDriver, mounter backend.Mounter, imageSv
 		secretStore:           secretStore,
 		asyncImagePullTimeout: asyncImagePullTimeout,
 		asyncImagePuller:      nil,
+		pullers:               &pullers{imageSvc: imageSvc, defaultPuller: pullerCRI},
+	}
+	for _, opt := range opts {
+		opt(ns)
+	}
+	if ns.pullRecords != nil {
+		klog.Info("Ensure credentials of workloads before mounting cached images")
 	}
 	if asyncImagePullTimeout >= time.Duration(30*time.Second) {
 		klog.Infof("Starting node server in Async mode with %v timeout", asyncImagePullTimeout)
@@ -93,12 +196,59 @@ func (n NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishV
 	}
 
 	if req.VolumeContext[ctxKeyEphemeralVolume] != "true" &&
-		req.VolumeCapability.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY &&
-		req.VolumeCapability.AccessMode.Mode != csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
-		err = status.Error(codes.InvalidArgument, "AccessMode of PV can be only ReadOnlyMany or ReadOnlyOnce")
+		!accessModeSupported(req.VolumeCapability.AccessMode.Mode, req.VolumeContext[ctxKeyReadWrite] == "true") {
+		err = status.Error(codes.InvalidArgument,
+			"AccessMode of PV can be only ReadOnlyMany or ReadOnlyOnce, or ReadWriteOnce if the PV is read-write")
+		return
+	}
+
+	if platform := req.VolumeContext[ctxKeyPlatform]; len(platform) > 0 {
+		var spec specs.Platform
+		if spec, err = platforms.Parse(platform); err != nil {
+			err = status.Errorf(codes.InvalidArgument, "invalid platform %q: %s", platform, err)
+			return
+		}
+
+		if !platforms.Default().Match(spec) {
+			err = status.Errorf(codes.FailedPrecondition, "image platform %q doesn't match the node platform %q",
+				platform, platforms.DefaultString())
+			return
+		}
+	}
+
+	// Images are unpacked and mounted via the snapshotter of the volume.
+	if ctx, err = n.pullers.mountContext(ctx, req.VolumeContext); err != nil {
+		return
+	}
+
+	ro := readOnly(req)
+	following := strings.ToLower(req.VolumeContext[ctxKeyFollow]) == "true"
+	if following {
+		if n.follower == nil {
+			err = status.Error(codes.FailedPrecondition, "following tags of images is not enabled on the node")
+			return
+		}
+
+		if !ro {
+			err = status.Error(codes.InvalidArgument, "only read-only volumes can follow tags of images")
+			return
+		}
+	}
+
+	// Images in other containerd namespaces are invisible to the CRI, so they are neither tracked for garbage
+	// collection nor recorded for credentials.
+	visibleToCRI := n.pullers.visibleToCRI(req.VolumeContext)
+	if following && !visibleToCRI {
+		err = status.Errorf(codes.InvalidArgument, "volumes in containerd namespaces other than %q can't follow "+
+			"tags of images", criNamespace)
 		return
 	}
 
+	imageTracker := n.imageTracker
+	if !visibleToCRI {
+		imageTracker = nil
+	}
+
 	notMnt, err := k8smount.New("").IsLikelyNotMountPoint(req.TargetPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -119,12 +269,18 @@ func (n NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishV
 	}
 
 	// For PVs, VolumeId is the image. For ephemeral volumes, it is a string.
-	image := req.VolumeId
+	image := volumeImage(req.VolumeId, req.VolumeContext)
+	if pvName := volumePVName(req.VolumeContext); n.volumeImages != nil && len(pvName) > 0 {
+		var modified string
+		if modified, err = n.volumeImages.Image(ctx, pvName); err != nil {
+			err = status.Errorf(codes.Unavailable, "unable to fetch the image of volume %q: %s", req.VolumeId, err)
+			return
+		}
 
-	if len(req.VolumeContext[ctxKeyVolumeHandle]) > 0 {
-		image = req.VolumeContext[ctxKeyVolumeHandle]
-	} else if len(req.VolumeContext[ctxKeyImage]) > 0 {
-		image = req.VolumeContext[ctxKeyImage]
+		if len(modified) > 0 {
+			klog.Infof("volume %q has been modified to use image %q", req.VolumeId, modified)
+			image = modified
+		}
 	}
 
 	pullAlways := strings.ToLower(req.VolumeContext[ctxKeyPullAlways]) == "true"
@@ -135,55 +291,260 @@ func (n NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishV
 		return
 	}
 
+	if keyring, err = withPullSecret(ctx, n.secretStore, req.VolumeContext, keyring); err != nil {
+		err = status.Error(codes.Aborted, err.Error())
+		return
+	}
+
 	namedRef, err := reference.ParseDockerRef(image)
 	if err != nil {
 		klog.Errorf("unable to normalize image %q: %s", image, err)
 		return
 	}
 
+	if _, digested := namedRef.(reference.Digested); following && digested {
+		err = status.Errorf(codes.InvalidArgument, "image %q is referred by digest and can't be followed", image)
+		return
+	}
+
+	// Credentials are identified to ensure that workloads only share pull sessions and cached images
+	// with workloads owning the same credentials.
+	identities := secret.KeyringIdentities(keyring, namedRef.Name())
+
+	// Images must not be collected after being checked and before being mounted, while pulls must not block the
+	// collector.
+	endUse := func() {}
+	defer func() { endUse() }()
+	if imageTracker != nil {
+		endUse = imageTracker.BeginUse()
+	}
+
 	// NOTE: we are relying on n.mounter.ImageExists() to return false when
 	//      a first-time pull is in progress, else this logic may not be
 	//      correct. should test this.
-	if pullAlways || !n.mounter.ImageExists(ctx, namedRef) {
+	needPull := pullAlways || !n.mounter.ImageExists(ctx, namedRef)
+	if !needPull && n.pullRecords != nil && (!visibleToCRI || !n.credentialsVerified(ctx, namedRef, identities)) {
+		valuesLogger.Info("Credentials of the workload have not pulled the cached image. Verify them against the registry",
+			"image", image)
+		needPull = true
+	}
+
+	// imageID is the ID of the image returned by the puller, if pulled.
+	imageID := ""
+	if needPull {
+		endUse()
+		endUse = func() {}
+
+		var puller remoteimage.Puller
+		if puller, err = n.pullers.newPuller(namedRef, keyring, req.VolumeContext); err != nil {
+			return
+		}
+
 		klog.Errorf("pull image %q", image)
-		puller := remoteimage.NewPuller(n.imageSvc, namedRef, keyring)
+		n.eventf(req.VolumeContext, corev1.EventTypeNormal, events.ReasonPulling, "Pulling image %q", image)
+
+		if n.pullCoordinator != nil {
+			puller = n.pullCoordinator.Wrap(puller, namedRef, keyring)
+		}
+
+		identity := ""
+		pullStart := time.Now()
 
 		if n.asyncImagePuller != nil {
 			var session *remoteimageasync.PullSession
-			session, err = n.asyncImagePuller.StartPull(image, puller, n.asyncImagePullTimeout)
+			session, err = n.asyncImagePuller.StartPull(remoteimageasync.SessionKey(namedRef, identities), puller, n.asyncImagePullTimeout)
 			if err != nil {
+				n.pullFailed(req.VolumeContext, image, err)
 				err = status.Errorf(codes.Aborted, "unable to pull image %q: %s", image, err)
 				metrics.OperationErrorsCount.WithLabelValues("pull-async-start").Inc()
 				return
 			}
 			if err = n.asyncImagePuller.WaitForPull(session, ctx); err != nil {
+				n.pullFailed(req.VolumeContext, image, err)
 				err = status.Errorf(codes.Aborted, "unable to pull image %q: %s", image, err)
 				metrics.OperationErrorsCount.WithLabelValues("pull-async-wait").Inc()
 				return
 			}
+			identity = session.CredentialIdentity()
+			imageID = session.ImageID()
 		} else {
 			if err = puller.Pull(ctx); err != nil {
+				n.pullFailed(req.VolumeContext, image, err)
 				err = status.Errorf(codes.Aborted, "unable to pull image %q: %s", image, err)
 				metrics.OperationErrorsCount.WithLabelValues("pull-sync-call").Inc()
 				return
 			}
+			identity = puller.CredentialIdentity()
+			imageID = puller.ImageID()
+		}
+
+		n.pulled(ctx, req.VolumeContext, puller, time.Since(pullStart))
+		if visibleToCRI {
+			n.recordPull(ctx, namedRef, identity)
+		}
+
+		// Images removed after being pulled fail to be mounted, then the volume is published again.
+		if imageTracker != nil {
+			endUse = imageTracker.BeginUse()
 		}
 	}
 
-	ro := req.Readonly ||
-		req.VolumeCapability.AccessMode.Mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
-		req.VolumeCapability.AccessMode.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
-	if err = n.mounter.Mount(ctx, req.VolumeId, backend.MountTarget(req.TargetPath), namedRef, ro); err != nil {
-		err = status.Error(codes.Internal, err.Error())
+	if imageTracker != nil || following {
+		// Images pulled via containerd may not be visible to the CRI yet.
+		if len(imageID) == 0 {
+			if imageID, err = remoteimage.LocalImageID(ctx, n.imageSvc, namedRef); err != nil {
+				err = status.Errorf(codes.Internal, "unable to fetch ID of image %q: %s", image, err)
+				return
+			}
+		}
+
+		if imageTracker != nil {
+			if needPull {
+				if err = imageTracker.Pulled(imageID, namedRef.String()); err != nil {
+					klog.Errorf("unable to track the pull of image %q: %s", image, err)
+				}
+			}
+
+			// Mounts of the image are counted by the mounter.
+			ctx = backend.WithCRIImageID(ctx, imageID)
+		}
+	}
+
+	if following {
+		err = n.follower.Publish(ctx, req.VolumeId, req.TargetPath, namedRef, imageID, req.VolumeContext)
+	} else {
+		err = n.mounter.Mount(ctx, req.VolumeId, backend.MountTarget(req.TargetPath), namedRef, ro)
+	}
+
+	if err != nil {
+		n.eventf(req.VolumeContext, corev1.EventTypeWarning, events.ReasonMountFailed,
+			"Failed to mount image %q: %s", image, err)
+		err = mountError(err)
 		metrics.OperationErrorsCount.WithLabelValues("mount").Inc()
 		return
 	}
 
+	// The follower tracks images of following volumes by itself.
+	if imageTracker != nil && !following {
+		if err := imageTracker.Mounted(imageID, namedRef.String()); err != nil {
+			klog.Errorf("unable to track the mount of image %q: %s", image, err)
+		}
+	}
+
+	n.eventf(req.VolumeContext, corev1.EventTypeNormal, events.ReasonMounted, "Successfully mounted image %q", image)
 	valuesLogger.Info("Successfully completed NodePublishVolume request", "request string", protosanitizer.StripSecrets(req))
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// volumePVName returns the PV of the volume, whose image may have been modified. Ephemeral volumes are defined by
+// pods, so they never refer to PVs, which would expose images and pull secrets of other volumes.
+func volumePVName(volumeContext map[string]string) string {
+	if volumeContext[ctxKeyEphemeralVolume] == "true" {
+		return ""
+	}
+
+	return volumeContext[ctxKeyPVName]
+}
+
+// readOnly returns true if the volume is published read-only.
+func readOnly(req *csi.NodePublishVolumeRequest) bool {
+	return req.Readonly ||
+		req.VolumeCapability.AccessMode.Mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		req.VolumeCapability.AccessMode.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// withPullSecret adds credentials of the pull secret of the volume, if any, to the keyring. The pull secret is in
+// the namespace ctxKeyPullSecretNamespace, or the namespace of the pod.
+// Ephemeral volumes are defined by pods, so their pull secrets are always in the namespace of the pod. Secrets of
+// other namespaces can only be given by StorageClasses or PVs.
+func withPullSecret(
+	ctx context.Context, secretStore secret.Store, volumeContext map[string]string, keyring secret.DockerKeyring,
+) (secret.DockerKeyring, error) {
+	pullSecret := volumeContext[ctxKeyPullSecret]
+	if len(pullSecret) == 0 {
+		return keyring, nil
+	}
+
+	podNamespace := volumeContext[ctxKeyPodNamespace]
+	namespace := volumeContext[ctxKeyPullSecretNamespace]
+	if volumeContext[ctxKeyEphemeralVolume] == "true" {
+		if len(podNamespace) == 0 {
+			return nil, fmt.Errorf("namespace of the pod is required by the pull secret %q of ephemeral volumes",
+				pullSecret)
+		}
+
+		if len(namespace) > 0 && namespace != podNamespace {
+			klog.Warningf("ephemeral volumes can't use secrets in other namespaces. use secret %q in namespace %q "+
+				"instead of %q", pullSecret, podNamespace, namespace)
+		}
+
+		namespace = podNamespace
+	} else if len(namespace) == 0 {
+		namespace = podNamespace
+	}
+
+	secretKeyring, err := secretStore.GetDockerKeyringFromSecrets(ctx, namespace, []string{pullSecret})
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch keyring from secret %s/%s: %s", namespace, pullSecret, err)
+	}
+
+	return secret.UnionDockerKeyring{secretKeyring, keyring}, nil
+}
+
+// eventf emits an event on the pod consuming the volume if events are enabled.
+func (n NodeServer) eventf(volumeContext map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	if n.recorder == nil {
+		return
+	}
+
+	n.recorder.Eventf(volumeContext, eventType, reason, messageFmt, args...)
+}
+
+func (n NodeServer) pulled(ctx context.Context, volumeContext map[string]string, puller remoteimage.Puller, elapsed time.Duration) {
+	if n.recorder == nil {
+		return
+	}
+
+	size, err := puller.ImageSize(ctx)
+	if err != nil {
+		n.eventf(volumeContext, corev1.EventTypeNormal, events.ReasonPulled,
+			"Successfully pulled image %q in %s", puller.ImageWithTag(), elapsed.Round(time.Millisecond))
+		return
+	}
+
+	n.eventf(volumeContext, corev1.EventTypeNormal, events.ReasonPulled,
+		"Successfully pulled image %q in %s. Image size: %d bytes", puller.ImageWithTag(),
+		elapsed.Round(time.Millisecond), size)
+}
+
+func (n NodeServer) pullFailed(volumeContext map[string]string, image string, err error) {
+	n.eventf(volumeContext, corev1.EventTypeWarning, events.ReasonPullFailed, "Failed to pull image %q (%s): %s",
+		image, remoteimage.ClassifyPullError(err), err)
+}
+
+// credentialsVerified checks whether any of the given credentials, or no credentials, pulled the local image before.
+func (n NodeServer) credentialsVerified(ctx context.Context, image reference.Named, identities []string) bool {
+	imageID, err := remoteimage.LocalImageID(ctx, n.imageSvc, image)
+	if err != nil {
+		klog.Errorf("unable to fetch ID of image %q: %s", image, err)
+		return false
+	}
+
+	return n.pullRecords.Verify(imageID, identities)
+}
+
+// recordPull saves the credential identity used to pull the image if ensuring credentials is enabled.
+func (n NodeServer) recordPull(ctx context.Context, image reference.Named, identity string) {
+	if n.pullRecords == nil {
+		return
+	}
+
+	if err := n.pullRecords.RecordPull(ctx, n.imageSvc, image, identity); err != nil {
+		klog.Errorf("unable to record the pull of image %q: %s", image, err)
+	}
+}
+
 func (n NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (resp *csi.NodeUnpublishVolumeResponse, err error) {
 	klog.V(4).Infof("NodeUnpublishVolume: unmount request: %s", protosanitizer.StripSecrets(req))
 
@@ -215,7 +576,13 @@ func (n NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpubl
 	}
 
 	// Attempt to unmount
-	if err = n.mounter.Unmount(ctx, req.VolumeId, backend.MountTarget(req.TargetPath)); err != nil {
+	if n.follower != nil && n.follower.Follows(req.TargetPath) {
+		err = n.follower.Unpublish(ctx, req.TargetPath)
+	} else {
+		err = n.mounter.Unmount(ctx, req.VolumeId, backend.MountTarget(req.TargetPath))
+	}
+
+	if err != nil {
 		metrics.OperationErrorsCount.WithLabelValues("unmount").Inc()
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to unmount volume at %s: %v", req.TargetPath, err))
 	}
@@ -261,3 +628,17 @@ func (n NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCap
 		},
 	}, nil
 }
+
+// mountError converts errors of mounts to gRPC errors. Images removed from the runtime after pulls are reported as
+// unavailable since the kubelet retries the mount, which pulls them again.
+func mountError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	if errors.Is(err, backend.ErrImageNotFound) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
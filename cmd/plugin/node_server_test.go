@@ -294,7 +294,7 @@ func TestMetrics(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, criClient)
 
-	mounter := containerd.NewMounter(addr.Path)
+	mounter := containerd.NewMounter(addr.Path, criNamespace)
 	assert.NotNil(t, mounter)
 
 	driver := csicommon.NewCSIDriver(driverName, driverVersion, "fake-node")
@@ -456,3 +456,44 @@ type testSecretStore struct{}
 func (t *testSecretStore) GetDockerKeyring(ctx context.Context, secrets map[string]string) (secret.DockerKeyring, error) {
 	return secret.NewDockerKeyring(), nil
 }
+
+func (t *testSecretStore) GetDockerKeyringFromSecrets(ctx context.Context, namespace string, names []string) (secret.DockerKeyring, error) {
+	return secret.NewDockerKeyring(), nil
+}
+
+func TestVolumePVName(t *testing.T) {
+	assert.Equal(t, "pv-a", volumePVName(map[string]string{ctxKeyPVName: "pv-a"}))
+	assert.Empty(t, volumePVName(map[string]string{ctxKeyPVName: "pv-a", ctxKeyEphemeralVolume: "true"}),
+		"ephemeral volumes should not refer to PVs")
+}
+
+func TestWithPullSecret(t *testing.T) {
+	ctx := context.Background()
+	secretStore := &fakeSecretStore{}
+	ephemeral := map[string]string{
+		ctxKeyEphemeralVolume:     "true",
+		ctxKeyPodNamespace:        "default",
+		ctxKeyPullSecret:          "foo",
+		ctxKeyPullSecretNamespace: "kube-system",
+	}
+
+	_, err := withPullSecret(ctx, secretStore, ephemeral, secret.NewDockerKeyring())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default"}, secretStore.secretNamespaces,
+		"ephemeral volumes should not use secrets of other namespaces")
+
+	delete(ephemeral, ctxKeyPodNamespace)
+	_, err = withPullSecret(ctx, secretStore, ephemeral, secret.NewDockerKeyring())
+	assert.Error(t, err)
+
+	// PVs are created by admins or the driver.
+	secretStore.secretNamespaces = nil
+	pv := map[string]string{
+		ctxKeyPodNamespace:        "default",
+		ctxKeyPullSecret:          "foo",
+		ctxKeyPullSecretNamespace: "kube-system",
+	}
+	_, err = withPullSecret(ctx, secretStore, pv, secret.NewDockerKeyring())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kube-system"}, secretStore.secretNamespaces)
+}
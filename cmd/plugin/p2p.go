@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"github.com/warm-metal/container-image-csi-driver/pkg/p2p"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// originTimeout is the timeout of requests to origin registries checking whether content can be served.
+const originTimeout = 10 * time.Second
+
+// startP2P serves blobs of the given store to peers, and runs the registry mirror fetching blobs from peers.
+func startP2P(store backend.BlobStore) {
+	if len(*p2pIP) == 0 || len(*p2pNamespace) == 0 || len(*p2pPeerSelector) == 0 {
+		klog.Fatalf("--p2p-ip, --p2p-namespace and --p2p-peer-selector are required by p2p distribution")
+	}
+
+	if len(*p2pTLSCertFile) == 0 || len(*p2pTLSKeyFile) == 0 || len(*p2pTLSCAFile) == 0 {
+		klog.Fatalf("--p2p-tls-cert-file, --p2p-tls-key-file and --p2p-tls-ca-file are required by p2p distribution")
+	}
+
+	serverTLS, clientTLS, err := p2p.NewTLSConfigs(*p2pTLSCertFile, *p2pTLSKeyFile, *p2pTLSCAFile,
+		*p2pTLSServerName)
+	if err != nil {
+		klog.Fatalf("unable to load TLS configs of p2p: %s", err)
+	}
+
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		klog.Fatalf("unable to get cluster config: %s", err)
+	}
+
+	peers, err := p2p.NewPeers(kubernetes.NewForConfigOrDie(kubeConfig), *p2pNamespace, *p2pPeerSelector, *nodeID,
+		*p2pPort, 0)
+	if err != nil {
+		klog.Fatalf("invalid peer selector %q: %s", *p2pPeerSelector, err)
+	}
+
+	go peers.Run(context.Background())
+
+	origin := p2p.NewOrigin(&http.Client{Timeout: originTimeout})
+	server := &http.Server{
+		Addr:      net.JoinHostPort(*p2pIP, strconv.Itoa(*p2pPort)),
+		Handler:   p2p.NewServer(store, origin),
+		TLSConfig: serverTLS,
+	}
+
+	go func() {
+		klog.Infof("serving blobs to peers at %s", server.Addr)
+		klog.Fatal(server.ListenAndServeTLS("", ""))
+	}()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientTLS
+	mirror := p2p.NewMirror(peers.Addresses, &http.Client{Transport: transport}, origin)
+	go func() {
+		klog.Infof("serving the registry mirror at %s", *p2pMirrorAddr)
+		klog.Fatal(http.ListenAndServe(*p2pMirrorAddr, mirror))
+	}()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	pullerCRI        = "cri"
+	pullerContainerd = "containerd"
+
+	// criNamespace is the containerd namespace of images of the CRI.
+	criNamespace = "k8s.io"
+)
+
+// pullers creates pullers of images via the CRI image service, or directly via containerd if a client is given.
+// On containerd, it also selects namespaces and snapshotters of images of volumes.
+type pullers struct {
+	imageSvc cri.ImageServiceClient
+	// containerd is nil if the runtime is not containerd.
+	containerd *client.Client
+	// hostsDir is the directory of hosts.toml of registries used by the containerd puller.
+	hostsDir string
+	// defaultPuller is the puller of volumes without the attribute puller, and pulls not bound to volumes.
+	defaultPuller string
+	// snapshotter is the snapshotter of volumes without the attribute snapshotter. The default snapshotter of
+	// containerd is used if it is empty.
+	snapshotter string
+	// namespace is the default containerd namespace of images, which is empty if the runtime is not containerd.
+	namespace string
+}
+
+// newPuller creates a puller of the image for the volume. volumeContext can be nil for pulls not bound to volumes.
+func (p *pullers) newPuller(
+	image reference.Named, keyring secret.DockerKeyring, volumeContext map[string]string,
+) (remoteimage.Puller, error) {
+	puller := p.defaultPuller
+	if v := volumeContext[ctxKeyPuller]; len(v) > 0 {
+		puller = v
+	}
+
+	namespace, err := p.namespaceOf(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.visibleToCRI(volumeContext) {
+		// The CRI only pulls images to its own namespace.
+		if volumeContext[ctxKeyPuller] == pullerCRI {
+			return nil, status.Errorf(codes.InvalidArgument, "images in containerd namespace %q can't be pulled "+
+				"via the CRI", namespace)
+		}
+
+		puller = pullerContainerd
+	}
+
+	switch puller {
+	case "", pullerCRI:
+		return remoteimage.NewPuller(p.imageSvc, image, keyring), nil
+	case pullerContainerd:
+		if p.containerd == nil {
+			return nil, status.Error(codes.FailedPrecondition, "the containerd puller requires the containerd runtime")
+		}
+
+		snapshotter, err := p.snapshotterOf(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := remoteimage.ContainerdPullOptions{
+			HostsDir:    p.hostsDir,
+			Platform:    volumeContext[ctxKeyPlatform],
+			Snapshotter: snapshotter,
+			Namespace:   namespace,
+		}
+
+		if hosts := volumeContext[ctxKeyRegistryHosts]; len(hosts) > 0 {
+			if !filepath.IsLocal(hosts) {
+				return nil, status.Errorf(codes.InvalidArgument, "%s %q must be a relative path without \"..\"",
+					ctxKeyRegistryHosts, hosts)
+			}
+
+			opts.HostsDir = filepath.Join(p.hostsDir, hosts)
+		}
+
+		return remoteimage.NewContainerdPuller(p.containerd, image, keyring, opts), nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown puller %q", puller)
+	}
+}
+
+// snapshotterOf returns the snapshotter which the image of the volume is unpacked to.
+func (p *pullers) snapshotterOf(volumeContext map[string]string) (string, error) {
+	snapshotter := volumeContext[ctxKeySnapshotter]
+	if len(snapshotter) == 0 {
+		return p.snapshotter, nil
+	}
+
+	if p.containerd == nil {
+		return "", status.Error(codes.FailedPrecondition, "snapshotters can only be selected on containerd")
+	}
+
+	return snapshotter, nil
+}
+
+// namespaceOf returns the containerd namespace of the image of the volume.
+func (p *pullers) namespaceOf(volumeContext map[string]string) (string, error) {
+	namespace := volumeContext[ctxKeyContainerdNamespace]
+	if len(namespace) == 0 {
+		return p.namespace, nil
+	}
+
+	if p.containerd == nil {
+		return "", status.Error(codes.FailedPrecondition, "namespaces can only be selected on containerd")
+	}
+
+	return namespace, nil
+}
+
+// visibleToCRI returns true if the image of the volume is visible to the CRI image service.
+func (p *pullers) visibleToCRI(volumeContext map[string]string) bool {
+	namespace := volumeContext[ctxKeyContainerdNamespace]
+	if len(namespace) == 0 {
+		namespace = p.namespace
+	}
+
+	return len(namespace) == 0 || namespace == criNamespace
+}
+
+// mountContext returns the context to mount the image of the volume in its namespace via its snapshotter.
+func (p *pullers) mountContext(ctx context.Context, volumeContext map[string]string) (context.Context, error) {
+	snapshotter, err := p.snapshotterOf(volumeContext)
+	if err != nil {
+		return ctx, err
+	}
+
+	namespace, err := p.namespaceOf(volumeContext)
+	if err != nil {
+		return ctx, err
+	}
+
+	if len(snapshotter) > 0 {
+		ctx = backend.WithSnapshotter(ctx, snapshotter)
+	}
+
+	// Images of the default namespace keep their snapshots shared with volumes without the attribute.
+	if namespace != p.namespace {
+		ctx = backend.WithNamespace(ctx, namespace)
+	}
+
+	return ctx, nil
+}
+
+// nodePuller returns the default puller of the node for pulls not bound to volumes, e.g. prewarms.
+func (p *pullers) nodePuller() remoteimage.NewPullerFunc {
+	return func(image reference.Named, keyring secret.DockerKeyring) (remoteimage.Puller, error) {
+		return p.newPuller(image, keyring, nil)
+	}
+}
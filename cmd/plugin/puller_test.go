@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewPuller(t *testing.T) {
+	image, err := reference.ParseDockerRef("docker.io/library/alpine:3")
+	require.NoError(t, err)
+
+	p := &pullers{defaultPuller: pullerCRI, hostsDir: "/etc/containerd/certs.d"}
+	puller, err := p.newPuller(image, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine:3", puller.ImageWithTag())
+
+	_, err = p.newPuller(image, nil, map[string]string{ctxKeyPuller: pullerContainerd})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "containerd is required")
+
+	_, err = p.newPuller(image, nil, map[string]string{ctxKeyPuller: "docker"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMountContext(t *testing.T) {
+	p := &pullers{defaultPuller: pullerCRI}
+	ctx, err := p.mountContext(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, backend.SnapshotterFrom(ctx))
+
+	_, err = p.mountContext(context.Background(), map[string]string{ctxKeySnapshotter: "stargz"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "snapshotters require containerd")
+
+	p.snapshotter = "nydus"
+	ctx, err = p.mountContext(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "nydus", backend.SnapshotterFrom(ctx))
+
+	_, err = p.mountContext(context.Background(), map[string]string{ctxKeyContainerdNamespace: "moby"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "namespaces require containerd")
+}
+
+func TestVisibleToCRI(t *testing.T) {
+	p := &pullers{}
+	assert.True(t, p.visibleToCRI(nil), "runtimes other than containerd")
+
+	p.namespace = criNamespace
+	assert.True(t, p.visibleToCRI(nil))
+	assert.False(t, p.visibleToCRI(map[string]string{ctxKeyContainerdNamespace: "moby"}))
+
+	p.namespace = "moby"
+	assert.False(t, p.visibleToCRI(nil))
+	assert.True(t, p.visibleToCRI(map[string]string{ctxKeyContainerdNamespace: criNamespace}))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/schedgate"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podImages returns images of volumes of the driver used by pods. Images of unbound PVCs are determined the same
+// way they are provisioned, so that pods using PVCs of the WaitForFirstConsumer binding mode can be gated too.
+func podImages(client kubernetes.Interface, w *watcher.Watcher) schedgate.ImagesFunc {
+	return func(pod *corev1.Pod) (*schedgate.PodImages, error) {
+		images := &schedgate.PodImages{}
+		add := func(image, pullSecret string) {
+			images.Images = appendUnique(images.Images, image)
+			if len(pullSecret) > 0 {
+				images.PullSecrets = appendUnique(images.PullSecrets, pullSecret)
+			}
+		}
+
+		for _, v := range pod.Spec.Volumes {
+			switch {
+			case v.CSI != nil && v.CSI.Driver == driverName:
+				image := v.CSI.VolumeAttributes[ctxKeyImage]
+				if len(image) == 0 {
+					return nil, fmt.Errorf("volume %q doesn't specify the image", v.Name)
+				}
+
+				add(image, v.CSI.VolumeAttributes[ctxKeyPullSecret])
+			case v.PersistentVolumeClaim != nil:
+				image, pullSecret, err := claimImage(client, w, pod.Namespace, v.PersistentVolumeClaim.ClaimName)
+				if err != nil {
+					return nil, err
+				}
+
+				if len(image) > 0 {
+					add(image, pullSecret)
+				}
+			}
+		}
+
+		return images, nil
+	}
+}
+
+// claimImage returns the image of the PVC and its pull secret, or an empty image if the PVC is not of the driver.
+func claimImage(client kubernetes.Interface, w *watcher.Watcher, namespace, name string) (string, string, error) {
+	pvc, err := w.GetPVC(namespace, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(pvc.Spec.VolumeName) > 0 {
+		pv, err := w.GetPV(pvc.Spec.VolumeName)
+		if err != nil {
+			return "", "", err
+		}
+
+		if pv == nil {
+			return "", "", fmt.Errorf("PV %q of PVC %s/%s is not found", pvc.Spec.VolumeName, namespace, name)
+		}
+
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			return "", "", nil
+		}
+
+		return currentImage(pv), pv.Spec.CSI.VolumeAttributes[ctxKeyPullSecret], nil
+	}
+
+	if pvc.Spec.StorageClassName == nil || len(*pvc.Spec.StorageClassName) == 0 {
+		return "", "", fmt.Errorf("PVC %s/%s is not bound", namespace, name)
+	}
+
+	sc, err := client.StorageV1().StorageClasses().Get(context.TODO(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+
+	if sc.Provisioner != driverName {
+		return "", "", nil
+	}
+
+	annotations, err := watcher.ParseAnnotations(pvc)
+	if err != nil {
+		return "", "", fmt.Errorf("PVC %s/%s: %w", namespace, name, err)
+	}
+
+	parameters := map[string]string{paramPVCName: name, paramPVCNamespace: namespace}
+	for k, v := range sc.Parameters {
+		parameters[k] = v
+	}
+
+	params, err := parseVolumeParams(parameters)
+	if err != nil {
+		return "", "", fmt.Errorf("StorageClass %s: %w", sc.Name, err)
+	}
+
+	if params.empty() {
+		return annotations.Image, annotations.PullSecret, nil
+	}
+
+	image, err := params.resolveImage(pvc)
+	return image, annotations.PullSecret, err
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, e := range s {
+		if e == v {
+			return s
+		}
+	}
+
+	return append(s, v)
+}
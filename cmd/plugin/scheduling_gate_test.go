@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPodImages(t *testing.T) {
+	sc := "container-image"
+	objects := []runtime.Object{
+		&storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: sc},
+			Provisioner: driverName,
+			Parameters:  map[string]string{paramImageTemplate: "docker.io/library/${pvc.name}:latest"},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unbound", Annotations: map[string]string{
+				watcher.PullSecretAnnotation: "creds",
+			}},
+			Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &sc},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "bound"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-bound"},
+		},
+		testPV("pv-bound", driverName, "docker.io/library/alpine:3", nil, "bound"),
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-other"},
+		},
+		testPV("pv-other", "other.csi.k8s.io", "foo", nil, "other"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset(objects...)
+	w := watcher.NewWithClient(ctx, client, 0)
+	defer w.Stop()
+	assert.True(t, w.WaitForCacheSync(ctx))
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}}
+	for _, claim := range []string{"unbound", "bound", "other"} {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: claim,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			},
+		})
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "inline",
+		VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+			Driver:           driverName,
+			VolumeAttributes: map[string]string{ctxKeyImage: "docker.io/library/alpine:3"},
+		}},
+	})
+
+	images, err := podImages(client, w)(pod)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/library/unbound:latest", "docker.io/library/alpine:3"}, images.Images)
+	assert.Equal(t, []string{"creds"}, images.PullSecrets)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/registry"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultConditionTTL   = 10 * time.Minute
+	defaultResolveTimeout = 10 * time.Second
+)
+
+// volumeImage returns the image of a volume. For static PVs, and PVs created via the PVC annotation by older
+// versions, the volume ID is the image.
+func volumeImage(volumeID string, volumeContext map[string]string) string {
+	if len(volumeContext[ctxKeyVolumeHandle]) > 0 {
+		return volumeContext[ctxKeyVolumeHandle]
+	}
+
+	if len(volumeContext[ctxKeyImage]) > 0 {
+		return volumeContext[ctxKeyImage]
+	}
+
+	return volumeID
+}
+
+// volumeKeyring returns credentials of a volume, which are the pull secret of the volume if set,
+// along with credentials of the driver.
+func volumeKeyring(ctx context.Context, secretStore secret.Store, pullSecretNamespace, pullSecret string) (
+	secret.DockerKeyring, error,
+) {
+	if len(pullSecret) > 0 {
+		return secretStore.GetDockerKeyringFromSecrets(ctx, pullSecretNamespace, []string{pullSecret})
+	}
+
+	return secretStore.GetDockerKeyring(ctx, nil)
+}
+
+type cachedCondition struct {
+	condition *csi.VolumeCondition
+	expiresAt time.Time
+}
+
+// imageChecker reports whether images of volumes are still available in registries.
+// Registries are never hit by ListVolumes or ControllerGetVolume calls. Conditions are refreshed in the background
+// once expired, while the last known conditions are returned meanwhile.
+type imageChecker struct {
+	secretStore secret.Store
+	ttl         time.Duration
+	timeout     time.Duration
+	resolve     func(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) error
+
+	guard      sync.Mutex
+	conditions map[string]cachedCondition
+	// conditions being refreshed
+	refreshing map[string]struct{}
+	// checks waits for running refreshes
+	checks sync.WaitGroup
+}
+
+func newImageChecker(secretStore secret.Store) *imageChecker {
+	return &imageChecker{
+		secretStore: secretStore,
+		ttl:         defaultConditionTTL,
+		timeout:     defaultResolveTimeout,
+		resolve: func(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) error {
+			_, err := registry.Resolve(ctx, image, keyring)
+			return err
+		},
+		conditions: make(map[string]cachedCondition),
+		refreshing: make(map[string]struct{}),
+	}
+}
+
+// condition returns the last known condition of a volume, or a normal condition pending the first check. The volume
+// is abnormal if its image can't be resolved using credentials of the volume. Expired conditions are refreshed in the
+// background.
+func (c *imageChecker) condition(image, pullSecretNamespace, pullSecret string) *csi.VolumeCondition {
+	key := fmt.Sprintf("%s|%s/%s", image, pullSecretNamespace, pullSecret)
+
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	cached, found := c.conditions[key]
+	if found && time.Now().Before(cached.expiresAt) {
+		return cached.condition
+	}
+
+	if _, running := c.refreshing[key]; !running {
+		c.refreshing[key] = struct{}{}
+		c.checks.Add(1)
+		go c.refresh(key, image, pullSecretNamespace, pullSecret)
+	}
+
+	if !found {
+		return &csi.VolumeCondition{Message: "pending"}
+	}
+
+	return cached.condition
+}
+
+// refresh checks the image and caches its condition. Conditions not refreshed for long are dropped, which are of
+// volumes deleted or modified.
+func (c *imageChecker) refresh(key, image, pullSecretNamespace, pullSecret string) {
+	defer c.checks.Done()
+	condition := c.check(context.Background(), image, pullSecretNamespace, pullSecret)
+
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	now := time.Now()
+	for k, v := range c.conditions {
+		if now.After(v.expiresAt.Add(c.ttl)) {
+			delete(c.conditions, k)
+		}
+	}
+
+	c.conditions[key] = cachedCondition{condition: condition, expiresAt: now.Add(c.ttl)}
+	delete(c.refreshing, key)
+}
+
+func (c *imageChecker) check(ctx context.Context, image, pullSecretNamespace, pullSecret string) *csi.VolumeCondition {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return abnormal("invalid image %q: %s", image, err)
+	}
+
+	keyring, err := volumeKeyring(ctx, c.secretStore, pullSecretNamespace, pullSecret)
+	if err != nil {
+		return abnormal("unable to fetch credentials of image %q: %s", image, err)
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	if err = c.resolve(resolveCtx, named, keyring); err != nil {
+		klog.Warningf("image %q is not available: %s", image, err)
+		if registry.IsNotFound(err) {
+			return abnormal("image %q is not found in the registry", image)
+		}
+
+		return abnormal("unable to resolve image %q: %s", image, err)
+	}
+
+	return &csi.VolumeCondition{Message: fmt.Sprintf("image %q is available", image)}
+}
+
+func abnormal(format string, args ...interface{}) *csi.VolumeCondition {
+	return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// paramImage is the StorageClass parameter of the image of volumes.
+	paramImage = "image"
+	// paramImageTemplate is the StorageClass parameter of a template to build images from PVC metadata,
+	// e.g. "docker.io/foo/${pvc.annotations['app']}:${pvc.labels['version']}".
+	// Supported variables are ${pvc.name}, ${pvc.namespace}, ${pvc.annotations['key']} and ${pvc.labels['key']}.
+	paramImageTemplate = "imageTemplate"
+	// paramPullAlways is the StorageClass parameter to pull images every time volumes are mounted.
+	paramPullAlways = "pullAlways"
+	// paramPreferCachedNodes is the deprecated StorageClass parameter to make volumes accessible only from nodes
+	// which already hold their images. It is ignored since required node affinities of PVs can't express preferences.
+	paramPreferCachedNodes = "preferCachedNodes"
+	// paramFollow is the StorageClass parameter to make read-only volumes follow the tag of their images.
+	paramFollow = "follow"
+	// paramPuller is the StorageClass parameter to select the puller of images, "cri" or "containerd".
+	paramPuller = "puller"
+	// paramRegistryHosts is the StorageClass parameter of the subdirectory of registry hosts used by the containerd
+	// puller.
+	paramRegistryHosts = "registryHosts"
+	// paramSnapshotter is the StorageClass parameter of the containerd snapshotter which images are unpacked to.
+	paramSnapshotter = "snapshotter"
+	// paramContainerdNamespace is the StorageClass parameter of the containerd namespace of images.
+	paramContainerdNamespace = "containerdNamespace"
+	// paramValidateImage is the StorageClass parameter to skip checking images in registries if it is "false",
+	// e.g. for images only available on nodes.
+	paramValidateImage = "validateImage"
+	// paramTag is the VolumeAttributesClass parameter to change the tag of the image of volumes.
+	// The VolumeAttributesClass parameter paramImage replaces the whole image.
+	paramTag = "tag"
+
+	// Parameters added by the external-provisioner if --extra-create-metadata is set.
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	paramPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+var (
+	templateVarPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+	templateMapPattern = regexp.MustCompile(`^pvc\.(annotations|labels)\['([^']+)'\]$`)
+)
+
+// volumeParams are StorageClass parameters of dynamically provisioned volumes.
+type volumeParams struct {
+	image             string
+	imageTemplate     string
+	pullAlways        bool
+	preferCachedNodes bool
+	follow            bool
+	puller            string
+	registryHosts     string
+	snapshotter       string
+	namespace         string
+	skipValidation    bool
+	pvcName           string
+	pvcNamespace      string
+}
+
+// parseVolumeParams validates StorageClass parameters.
+func parseVolumeParams(params map[string]string) (*volumeParams, error) {
+	p := &volumeParams{}
+	for k, v := range params {
+		switch k {
+		case paramImage:
+			p.image = v
+		case paramImageTemplate:
+			p.imageTemplate = v
+		case paramPullAlways:
+			pullAlways, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter %q: %s", k, err)
+			}
+			p.pullAlways = pullAlways
+		case paramPreferCachedNodes:
+			preferCachedNodes, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter %q: %s", k, err)
+			}
+			p.preferCachedNodes = preferCachedNodes
+		case paramFollow:
+			follow, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter %q: %s", k, err)
+			}
+			p.follow = follow
+		case paramPuller:
+			switch v {
+			case pullerCRI, pullerContainerd:
+			default:
+				return nil, fmt.Errorf("invalid parameter %q: unknown puller %q", k, v)
+			}
+			p.puller = v
+		case paramRegistryHosts:
+			if !filepath.IsLocal(v) {
+				return nil, fmt.Errorf("invalid parameter %q: %q must be a relative path without \"..\"", k, v)
+			}
+			p.registryHosts = v
+		case paramSnapshotter:
+			p.snapshotter = v
+		case paramContainerdNamespace:
+			p.namespace = v
+		case paramValidateImage:
+			validate, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter %q: %s", k, err)
+			}
+			p.skipValidation = !validate
+		case paramPVCName:
+			p.pvcName = v
+		case paramPVCNamespace:
+			p.pvcNamespace = v
+		case paramPVName:
+		default:
+			return nil, fmt.Errorf("unknown parameter %q", k)
+		}
+	}
+
+	if p.image != "" && p.imageTemplate != "" {
+		return nil, fmt.Errorf("parameters %q and %q are mutually exclusive", paramImage, paramImageTemplate)
+	}
+
+	if p.imageTemplate != "" {
+		for _, match := range templateVarPattern.FindAllStringSubmatch(p.imageTemplate, -1) {
+			switch v := match[1]; v {
+			case "pvc.name", "pvc.namespace":
+			default:
+				if !templateMapPattern.MatchString(v) {
+					return nil, fmt.Errorf("unknown variable %q in parameter %q", match[0], paramImageTemplate)
+				}
+			}
+		}
+
+		if p.pvcName == "" || p.pvcNamespace == "" {
+			return nil, fmt.Errorf("PVC metadata is required by parameter %q. "+
+				"Please enable --extra-create-metadata of the external-provisioner", paramImageTemplate)
+		}
+	}
+
+	return p, nil
+}
+
+// empty returns true if no image is given via parameters.
+func (p *volumeParams) empty() bool {
+	return p.image == "" && p.imageTemplate == ""
+}
+
+// needPVC returns true if the image template refers to annotations or labels of the PVC.
+func (p *volumeParams) needPVC() bool {
+	return strings.Contains(p.imageTemplate, "pvc.annotations[") || strings.Contains(p.imageTemplate, "pvc.labels[")
+}
+
+// resolveImage returns the image of the volume. pvc is only required if needPVC returns true.
+func (p *volumeParams) resolveImage(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	image := p.image
+	if p.imageTemplate != "" {
+		var err error
+		image = templateVarPattern.ReplaceAllStringFunc(p.imageTemplate, func(variable string) string {
+			if err != nil {
+				return ""
+			}
+
+			name := templateVarPattern.FindStringSubmatch(variable)[1]
+			switch name {
+			case "pvc.name":
+				return p.pvcName
+			case "pvc.namespace":
+				return p.pvcNamespace
+			}
+
+			match := templateMapPattern.FindStringSubmatch(name)
+			values := pvc.Annotations
+			if match[1] == "labels" {
+				values = pvc.Labels
+			}
+
+			value, found := values[match[2]]
+			if !found || value == "" {
+				err = fmt.Errorf("PVC %s/%s doesn't have %s %q required by the image template",
+					p.pvcNamespace, p.pvcName, strings.TrimSuffix(match[1], "s"), match[2])
+			}
+			return value
+		})
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := reference.ParseDockerRef(image); err != nil {
+		return "", fmt.Errorf("invalid image %q: %s", image, err)
+	}
+
+	return image, nil
+}
+
+// modifyImage returns the image of a volume after applying the mutable parameters of a VolumeAttributesClass.
+// If both parameters are given, the tag replaces the tag of the given image.
+func modifyImage(current string, params map[string]string) (string, error) {
+	image := current
+	tag := ""
+	for k, v := range params {
+		switch k {
+		case paramImage:
+			image = v
+		case paramTag:
+			tag = v
+		default:
+			return "", fmt.Errorf("unknown mutable parameter %q", k)
+		}
+	}
+
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %q: %s", image, err)
+	}
+
+	if tag == "" {
+		return image, nil
+	}
+
+	tagged, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return "", fmt.Errorf("invalid tag %q: %s", tag, err)
+	}
+
+	return tagged.String(), nil
+}
+
+// volumeContext returns the VolumeContext of the volume using the given image.
+// Settings given by PVC annotations take precedence over StorageClass parameters.
+func (p *volumeParams) volumeContext(
+	pvName, image string, annotations *watcher.VolumeAnnotations,
+) map[string]string {
+	pullAlways := p.pullAlways
+	if annotations.PullAlways != nil {
+		pullAlways = *annotations.PullAlways
+	}
+
+	volumeContext := map[string]string{
+		ctxKeyImage:      image,
+		ctxKeyPullAlways: strconv.FormatBool(pullAlways),
+		ctxKeyPVName:     pvName,
+	}
+
+	if len(annotations.PullSecret) > 0 {
+		volumeContext[ctxKeyPullSecret] = annotations.PullSecret
+		volumeContext[ctxKeyPullSecretNamespace] = annotations.PullSecretNamespace
+	}
+
+	if len(annotations.Platform) > 0 {
+		volumeContext[ctxKeyPlatform] = annotations.Platform
+	}
+
+	if annotations.ReadWrite {
+		volumeContext[ctxKeyReadWrite] = "true"
+	}
+
+	if p.follow {
+		volumeContext[ctxKeyFollow] = "true"
+	}
+
+	if len(p.puller) > 0 {
+		volumeContext[ctxKeyPuller] = p.puller
+	}
+
+	if len(p.registryHosts) > 0 {
+		volumeContext[ctxKeyRegistryHosts] = p.registryHosts
+	}
+
+	if len(p.snapshotter) > 0 {
+		volumeContext[ctxKeySnapshotter] = p.snapshotter
+	}
+
+	if len(p.namespace) > 0 {
+		volumeContext[ctxKeyContainerdNamespace] = p.namespace
+	}
+
+	if p.skipValidation {
+		volumeContext[ctxKeyValidateImage] = "false"
+	}
+
+	return volumeContext
+}
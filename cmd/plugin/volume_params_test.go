@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeParams(t *testing.T) {
+	params, err := parseVolumeParams(map[string]string{paramImage: "docker.io/library/alpine:3", paramPullAlways: "true"})
+	assert.NoError(t, err)
+	assert.False(t, params.needPVC())
+	image, err := params.resolveImage(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		ctxKeyImage: "docker.io/library/alpine:3", ctxKeyPullAlways: "true", ctxKeyPVName: "pvc-uid",
+	}, params.volumeContext("pvc-uid", image, &watcher.VolumeAnnotations{}))
+
+	params, err = parseVolumeParams(map[string]string{paramImage: "docker.io/library/alpine:3", paramFollow: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", params.volumeContext("pvc-uid", image, &watcher.VolumeAnnotations{})[ctxKeyFollow])
+
+	params, err = parseVolumeParams(map[string]string{
+		paramImage: "docker.io/library/alpine:3", paramPuller: pullerContainerd, paramRegistryHosts: "mirrors",
+		paramSnapshotter: "stargz", paramContainerdNamespace: "moby",
+	})
+	assert.NoError(t, err)
+	volumeContext := params.volumeContext("pvc-uid", image, &watcher.VolumeAnnotations{})
+	assert.Equal(t, pullerContainerd, volumeContext[ctxKeyPuller])
+	assert.Equal(t, "mirrors", volumeContext[ctxKeyRegistryHosts])
+	assert.Equal(t, "stargz", volumeContext[ctxKeySnapshotter])
+	assert.Equal(t, "moby", volumeContext[ctxKeyContainerdNamespace])
+
+	params, err = parseVolumeParams(map[string]string{
+		paramImageTemplate: "docker.io/${pvc.namespace}/${pvc.annotations['app']}:${pvc.labels['version']}",
+		paramPVCName:       "foo",
+		paramPVCNamespace:  "bar",
+		paramPVName:        "pvc-uid",
+	})
+	assert.NoError(t, err)
+	assert.True(t, params.needPVC())
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{"app": "web"},
+		Labels:      map[string]string{"version": "v1"},
+	}}
+	image, err = params.resolveImage(pvc)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/bar/web:v1", image)
+
+	delete(pvc.Labels, "version")
+	_, err = params.resolveImage(pvc)
+	assert.Error(t, err, "missing labels should be reported")
+
+	invalid := []map[string]string{
+		{"foo": "bar"},
+		{paramPullAlways: "sometimes"},
+		{paramFollow: "sometimes"},
+		{paramValidateImage: "sometimes"},
+		{paramPuller: "docker"},
+		{paramRegistryHosts: "../etc"},
+		{paramImage: "a", paramImageTemplate: "b"},
+		{paramImageTemplate: "docker.io/${pvc.uid}", paramPVCName: "foo", paramPVCNamespace: "bar"},
+		{paramImageTemplate: "docker.io/${pvc.name}"},
+	}
+	for _, p := range invalid {
+		_, err = parseVolumeParams(p)
+		assert.Error(t, err, "%v", p)
+	}
+
+	params, err = parseVolumeParams(map[string]string{paramImage: "Invalid Image"})
+	assert.NoError(t, err)
+	_, err = params.resolveImage(nil)
+	assert.Error(t, err)
+}
+
+func TestModifyImage(t *testing.T) {
+	image, err := modifyImage("docker.io/library/alpine:3", map[string]string{paramTag: "3.20"})
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine:3.20", image)
+
+	image, err = modifyImage("docker.io/library/alpine:3", map[string]string{paramImage: "docker.io/library/busybox"})
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/busybox", image)
+
+	image, err = modifyImage("alpine@sha256:"+strings.Repeat("a", 64),
+		map[string]string{paramImage: "busybox:1", paramTag: "latest"})
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/busybox:latest", image)
+
+	_, err = modifyImage("docker.io/library/alpine:3", map[string]string{paramTag: "in valid"})
+	assert.Error(t, err)
+
+	_, err = modifyImage("docker.io/library/alpine:3", map[string]string{paramPullAlways: "true"})
+	assert.Error(t, err, "unknown parameters should be rejected")
+}
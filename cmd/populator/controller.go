@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// populateFinalizer protects PVCs being populated, so that their prime PVCs and populate pods are removed
+	// along with them.
+	populateFinalizer = v1alpha1.GroupName + "/populate-target-protection"
+	// annTarget is the annotation of prime PVCs and populate pods with the key of the PVC being populated.
+	annTarget = v1alpha1.GroupName + "/populate-target"
+	// annPopulatedFrom is the annotation of populated PVs with the ContainerImageSource they are populated from.
+	annPopulatedFrom = v1alpha1.GroupName + "/populated-from"
+	// annSelectedNode is the annotation of the node selected by the scheduler for PVCs of the WaitForFirstConsumer
+	// binding mode.
+	annSelectedNode = "volume.kubernetes.io/selected-node"
+
+	primePrefix = "prime-"
+	podPrefix   = "populate-"
+
+	imageMountPath  = "/image"
+	targetMountPath = "/target"
+
+	reasonPopulating     = "Populating"
+	reasonPopulated      = "Populated"
+	reasonPopulateFailed = "PopulateFailed"
+)
+
+// Controller populates PVCs referring to ContainerImageSource objects via dataSourceRef.
+//
+// For each PVC, a prime PVC of the same spec is created in the namespace of the populator, along with a pod copying
+// contents of the image into it. The image is mounted via an ephemeral volume of the driver, so that it is pulled the
+// same way as other volumes. Once the copy finishes, the PV of the prime PVC is rebound to the original PVC.
+type Controller struct {
+	kubeClient kubernetes.Interface
+	client     dynamic.Interface
+	namespace  string
+	image      string
+	recorder   record.EventRecorder
+
+	pvcLister listersv1.PersistentVolumeClaimLister
+	synced    []cache.InformerSynced
+	start     func(stopCh <-chan struct{})
+
+	queue workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewController creates a volume populator. Prime PVCs and populate pods are created in the given namespace,
+// and pods run the given image of the populator.
+func NewController(
+	kubeClient kubernetes.Interface, client dynamic.Interface, recorder record.EventRecorder, namespace, image string,
+	resyncPeriod time.Duration,
+) (*Controller, error) {
+	factory := informers.NewSharedInformerFactory(kubeClient, resyncPeriod)
+	podFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, resyncPeriod,
+		informers.WithNamespace(namespace))
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	podInformer := podFactory.Core().V1().Pods()
+
+	c := &Controller{
+		kubeClient: kubeClient,
+		client:     client,
+		namespace:  namespace,
+		image:      image,
+		recorder:   recorder,
+		pvcLister:  pvcInformer.Lister(),
+		synced:     []cache.InformerSynced{pvcInformer.Informer().HasSynced, podInformer.Informer().HasSynced},
+		start: func(stopCh <-chan struct{}) {
+			factory.Start(stopCh)
+			podFactory.Start(stopCh)
+		},
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "populator"},
+		),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, newObj interface{}) { c.enqueue(newObj) },
+		DeleteFunc: c.enqueue,
+	}
+
+	if _, err := pvcInformer.Informer().AddEventHandler(handler); err != nil {
+		return nil, err
+	}
+
+	if _, err := podInformer.Informer().AddEventHandler(handler); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Run populates PVCs until the context is cancelled.
+func (c *Controller) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	klog.Infof("starting volume populator of %s in namespace %q", v1alpha1.ContainerImageSourceKind, c.namespace)
+	c.start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		klog.Errorf("unable to sync PVCs and pods")
+		return
+	}
+
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	<-ctx.Done()
+	klog.Infof("volume populator stopped")
+}
+
+// enqueue adds the PVC being populated. Prime PVCs and populate pods enqueue the PVCs they populate.
+func (c *Controller) enqueue(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+
+	if target, found := object.GetAnnotations()[annTarget]; found {
+		c.queue.Add(target)
+		return
+	}
+
+	if pvc, ok := obj.(*corev1.PersistentVolumeClaim); ok && populatedByImage(pvc) {
+		key, err := cache.MetaNamespaceKeyFunc(pvc)
+		if err != nil {
+			klog.Errorf("unable to get key of PVC %#v: %s", pvc, err)
+			return
+		}
+
+		c.queue.Add(key)
+	}
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key); err != nil {
+		klog.Errorf("unable to populate PVC %q: %s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// sync moves the given PVC one step forward. Each step is triggered by changes of the PVC, its prime PVC or
+// its populate pod.
+func (c *Controller) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	pvc, err := c.pvcLister.PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if !populatedByImage(pvc) {
+		return nil
+	}
+
+	if len(pvc.Spec.VolumeName) > 0 || pvc.DeletionTimestamp != nil {
+		return c.cleanup(ctx, pvc)
+	}
+
+	if pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == corev1.PersistentVolumeBlock {
+		c.recorder.Event(pvc, corev1.EventTypeWarning, reasonPopulateFailed,
+			"block volumes can't be populated from images")
+		return nil
+	}
+
+	if pvc.Spec.StorageClassName == nil || len(*pvc.Spec.StorageClassName) == 0 {
+		c.recorder.Event(pvc, corev1.EventTypeWarning, reasonPopulateFailed, "the StorageClass is required")
+		return nil
+	}
+
+	sc, err := c.kubeClient.StorageV1().StorageClasses().Get(ctx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	selectedNode := ""
+	if sc.VolumeBindingMode != nil && *sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer {
+		selectedNode = pvc.Annotations[annSelectedNode]
+		if len(selectedNode) == 0 {
+			klog.V(4).Infof("PVC %q waits for its first consumer", key)
+			return nil
+		}
+	}
+
+	source, err := c.source(ctx, pvc)
+	if err != nil {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPopulateFailed, "%s", err)
+		return err
+	}
+
+	if err = c.addFinalizer(ctx, pvc); err != nil {
+		return err
+	}
+
+	prime, err := c.ensurePrime(ctx, pvc, selectedNode)
+	if err != nil {
+		return err
+	}
+
+	pod, err := c.ensurePod(ctx, pvc, source, selectedNode)
+	if err != nil {
+		return err
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+	case corev1.PodFailed:
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, reasonPopulateFailed,
+			"unable to copy image %q: %s. retry", source.Spec.Image, podMessage(pod))
+		err = c.kubeClient.CoreV1().Pods(c.namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		return fmt.Errorf("populate pod %s/%s failed", c.namespace, pod.Name)
+	default:
+		return nil
+	}
+
+	if len(prime.Spec.VolumeName) == 0 {
+		return nil
+	}
+
+	return c.rebind(ctx, pvc, prime, source)
+}
+
+// source returns the ContainerImageSource the PVC refers to.
+func (c *Controller) source(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (
+	*v1alpha1.ContainerImageSource, error,
+) {
+	namespace := pvc.Namespace
+	if ns := pvc.Spec.DataSourceRef.Namespace; ns != nil && len(*ns) > 0 && *ns != pvc.Namespace {
+		return nil, fmt.Errorf("%s in other namespaces is not supported", v1alpha1.ContainerImageSourceKind)
+	}
+
+	obj, err := c.client.Resource(v1alpha1.ContainerImageSourceResource).Namespace(namespace).
+		Get(ctx, pvc.Spec.DataSourceRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s %s/%s: %w", v1alpha1.ContainerImageSourceKind, namespace,
+			pvc.Spec.DataSourceRef.Name, err)
+	}
+
+	source := &v1alpha1.ContainerImageSource{}
+	if err = v1alpha1.FromUnstructured(obj, source); err != nil {
+		return nil, err
+	}
+
+	if len(source.Spec.Image) == 0 {
+		return nil, fmt.Errorf("%s %s/%s doesn't specify the image", v1alpha1.ContainerImageSourceKind,
+			source.Namespace, source.Name)
+	}
+
+	return source, nil
+}
+
+// ensurePrime creates the prime PVC of the given PVC if it doesn't exist.
+func (c *Controller) ensurePrime(ctx context.Context, pvc *corev1.PersistentVolumeClaim, selectedNode string) (
+	*corev1.PersistentVolumeClaim, error,
+) {
+	pvcs := c.kubeClient.CoreV1().PersistentVolumeClaims(c.namespace)
+	prime, err := pvcs.Get(ctx, primePrefix+string(pvc.UID), metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		return prime, err
+	}
+
+	annotations := map[string]string{annTarget: pvc.Namespace + "/" + pvc.Name}
+	if len(selectedNode) > 0 {
+		annotations[annSelectedNode] = selectedNode
+	}
+
+	return pvcs.Create(ctx, &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        primePrefix + string(pvc.UID),
+			Namespace:   c.namespace,
+			Annotations: annotations,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      pvc.Spec.AccessModes,
+			Resources:        pvc.Spec.Resources,
+			StorageClassName: pvc.Spec.StorageClassName,
+			VolumeMode:       pvc.Spec.VolumeMode,
+		},
+	}, metav1.CreateOptions{})
+}
+
+// ensurePod creates the pod copying the image into the prime PVC if it doesn't exist. The pod runs on the selected
+// node if any, where the prime PVC is provisioned.
+func (c *Controller) ensurePod(
+	ctx context.Context, pvc *corev1.PersistentVolumeClaim, source *v1alpha1.ContainerImageSource, selectedNode string,
+) (*corev1.Pod, error) {
+	pods := c.kubeClient.CoreV1().Pods(c.namespace)
+	pod, err := pods.Get(ctx, podPrefix+string(pvc.UID), metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		return pod, err
+	}
+
+	attributes := map[string]string{"image": source.Spec.Image}
+	if len(source.Spec.PullSecret) > 0 {
+		attributes["pullSecret"] = source.Spec.PullSecret
+		attributes["pullSecretNamespace"] = source.Namespace
+	}
+
+	c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPopulating, "copying image %q", source.Spec.Image)
+	return pods.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        podPrefix + string(pvc.UID),
+			Namespace:   c.namespace,
+			Annotations: map[string]string{annTarget: pvc.Namespace + "/" + pvc.Name},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			NodeName:      selectedNode,
+			Containers: []corev1.Container{{
+				Name:    "populate",
+				Image:   c.image,
+				Command: []string{populatorBinary},
+				Args: []string{
+					"--mode=" + populateMode,
+					"--source=" + path.Join(imageMountPath, path.Clean("/"+source.Spec.SubPath)),
+					"--target=" + targetMountPath,
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "image", MountPath: imageMountPath, ReadOnly: true},
+					{Name: "target", MountPath: targetMountPath},
+				},
+			}},
+			Volumes: []corev1.Volume{
+				{
+					Name: "image",
+					VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+						Driver:           driverName,
+						ReadOnly:         &[]bool{true}[0],
+						VolumeAttributes: attributes,
+					}},
+				},
+				{
+					Name: "target",
+					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: primePrefix + string(pvc.UID),
+					}},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+}
+
+// rebind binds the PV of the prime PVC to the given PVC. The prime PVC is left lost and removed by cleanup.
+func (c *Controller) rebind(
+	ctx context.Context, pvc, prime *corev1.PersistentVolumeClaim, source *v1alpha1.ContainerImageSource,
+) error {
+	pv, err := c.kubeClient.CoreV1().PersistentVolumes().Get(ctx, prime.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.UID == pvc.UID {
+		return nil
+	}
+
+	pv.Spec.ClaimRef = &corev1.ObjectReference{
+		Kind:            "PersistentVolumeClaim",
+		APIVersion:      "v1",
+		Namespace:       pvc.Namespace,
+		Name:            pvc.Name,
+		UID:             pvc.UID,
+		ResourceVersion: pvc.ResourceVersion,
+	}
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+
+	pv.Annotations[annPopulatedFrom] = source.Namespace + "/" + source.Name
+	if _, err = c.kubeClient.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(pvc, corev1.EventTypeNormal, reasonPopulated, "populated from image %q", source.Spec.Image)
+	return nil
+}
+
+// cleanup removes the prime PVC and the populate pod of the given PVC, then its finalizer.
+func (c *Controller) cleanup(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	if !hasFinalizer(pvc) {
+		return nil
+	}
+
+	err := c.kubeClient.CoreV1().Pods(c.namespace).Delete(ctx, podPrefix+string(pvc.UID), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	err = c.kubeClient.CoreV1().PersistentVolumeClaims(c.namespace).Delete(ctx, primePrefix+string(pvc.UID),
+		metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	latest := pvc.DeepCopy()
+	latest.Finalizers = latest.Finalizers[:0]
+	for _, f := range pvc.Finalizers {
+		if f != populateFinalizer {
+			latest.Finalizers = append(latest.Finalizers, f)
+		}
+	}
+
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(ctx, latest, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (c *Controller) addFinalizer(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	if hasFinalizer(pvc) {
+		return nil
+	}
+
+	latest := pvc.DeepCopy()
+	latest.Finalizers = append(latest.Finalizers, populateFinalizer)
+	_, err := c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(ctx, latest, metav1.UpdateOptions{})
+	return err
+}
+
+// populatedByImage returns true if the PVC refers to a ContainerImageSource via dataSourceRef.
+func populatedByImage(pvc *corev1.PersistentVolumeClaim) bool {
+	ref := pvc.Spec.DataSourceRef
+	return ref != nil && ref.APIGroup != nil && *ref.APIGroup == v1alpha1.GroupName &&
+		ref.Kind == v1alpha1.ContainerImageSourceKind
+}
+
+func hasFinalizer(pvc *corev1.PersistentVolumeClaim) bool {
+	for _, f := range pvc.Finalizers {
+		if f == populateFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podMessage returns the termination message of the pod, or its status message.
+func podMessage(pod *corev1.Pod) string {
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.State.Terminated != nil && len(s.State.Terminated.Message) > 0 {
+			return s.State.Terminated.Message
+		}
+	}
+
+	return pod.Status.Message
+}
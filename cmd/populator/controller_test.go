@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const populatorNamespace = "populator"
+
+func newTestController(t *testing.T, bindingMode storagev1.VolumeBindingMode) (*Controller, cache.Indexer) {
+	source, err := v1alpha1.ToUnstructured(&v1alpha1.ContainerImageSource{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupName + "/" + v1alpha1.Version, Kind: "ContainerImageSource"},
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+		Spec:       v1alpha1.ContainerImageSourceSpec{Image: "docker.io/foo/data:v1", PullSecret: "foo", SubPath: "../data"},
+	})
+	assert.NoError(t, err)
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.ContainerImageSourceResource: "ContainerImageSourceList"},
+		source)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c := &Controller{
+		kubeClient: fake.NewSimpleClientset(&storagev1.StorageClass{
+			ObjectMeta:        metav1.ObjectMeta{Name: "standard"},
+			VolumeBindingMode: &bindingMode,
+		}),
+		client:    client,
+		namespace: populatorNamespace,
+		image:     "populator:latest",
+		recorder:  record.NewFakeRecorder(10),
+		pvcLister: listersv1.NewPersistentVolumeClaimLister(indexer),
+	}
+
+	return c, indexer
+}
+
+func newTargetPVC() *corev1.PersistentVolumeClaim {
+	apiGroup := v1alpha1.GroupName
+	storageClass := "standard"
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", UID: "uid-db"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &storageClass,
+			DataSourceRef: &corev1.TypedObjectReference{
+				APIGroup: &apiGroup, Kind: v1alpha1.ContainerImageSourceKind, Name: "data",
+			},
+		},
+	}
+}
+
+// update saves the PVC to both the client and the lister.
+func update(t *testing.T, c *Controller, indexer cache.Indexer, pvc *corev1.PersistentVolumeClaim) {
+	pvcs := c.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace)
+	_, err := pvcs.Update(context.TODO(), pvc, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = pvcs.Create(context.TODO(), pvc, metav1.CreateOptions{})
+	}
+
+	assert.NoError(t, err)
+	assert.NoError(t, indexer.Update(pvc))
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.TODO()
+	c, indexer := newTestController(t, storagev1.VolumeBindingImmediate)
+	pvc := newTargetPVC()
+	update(t, c, indexer, pvc)
+
+	assert.NoError(t, c.sync(ctx, "default/db"))
+	latest, err := c.kubeClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{populateFinalizer}, latest.Finalizers)
+
+	prime, err := c.kubeClient.CoreV1().PersistentVolumeClaims(populatorNamespace).Get(ctx, "prime-uid-db",
+		metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "default/db", prime.Annotations[annTarget])
+	assert.Equal(t, pvc.Spec.StorageClassName, prime.Spec.StorageClassName)
+
+	pod, err := c.kubeClient.CoreV1().Pods(populatorNamespace).Get(ctx, "populate-uid-db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, pod.Spec.NodeName)
+	assert.Contains(t, pod.Spec.Containers[0].Args, "--source=/image/data", "sub-paths should not escape the image")
+	assert.Equal(t, map[string]string{
+		"image": "docker.io/foo/data:v1", "pullSecret": "foo", "pullSecretNamespace": "default",
+	}, pod.Spec.Volumes[0].CSI.VolumeAttributes)
+
+	// The PV is not rebound until the copy succeeds.
+	pod.Status.Phase = corev1.PodSucceeded
+	_, err = c.kubeClient.CoreV1().Pods(populatorNamespace).UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	prime.Spec.VolumeName = "pv-1"
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(populatorNamespace).Update(ctx, prime, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, err = c.kubeClient.CoreV1().PersistentVolumes().Create(ctx, &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{ClaimRef: &corev1.ObjectReference{
+			Namespace: populatorNamespace, Name: prime.Name, UID: "uid-prime",
+		}},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, indexer.Update(latest))
+	assert.NoError(t, c.sync(ctx, "default/db"))
+	pv, err := c.kubeClient.CoreV1().PersistentVolumes().Get(ctx, "pv-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", pv.Spec.ClaimRef.Namespace)
+	assert.Equal(t, "db", pv.Spec.ClaimRef.Name)
+	assert.Equal(t, pvc.UID, pv.Spec.ClaimRef.UID)
+	assert.Equal(t, "default/data", pv.Annotations[annPopulatedFrom])
+
+	// Prime PVCs and pods are removed once the PVC is bound.
+	latest.Spec.VolumeName = "pv-1"
+	update(t, c, indexer, latest)
+	assert.NoError(t, c.sync(ctx, "default/db"))
+	_, err = c.kubeClient.CoreV1().Pods(populatorNamespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(populatorNamespace).Get(ctx, prime.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	latest, err = c.kubeClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, latest.Finalizers)
+}
+
+func TestSyncWaitForFirstConsumer(t *testing.T) {
+	ctx := context.TODO()
+	c, indexer := newTestController(t, storagev1.VolumeBindingWaitForFirstConsumer)
+	pvc := newTargetPVC()
+	update(t, c, indexer, pvc)
+
+	assert.NoError(t, c.sync(ctx, "default/db"))
+	_, err := c.kubeClient.CoreV1().Pods(populatorNamespace).Get(ctx, "populate-uid-db", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "PVCs should wait for their first consumers")
+
+	pvc.Annotations = map[string]string{annSelectedNode: "node-a"}
+	update(t, c, indexer, pvc)
+	assert.NoError(t, c.sync(ctx, "default/db"))
+	pod, err := c.kubeClient.CoreV1().Pods(populatorNamespace).Get(ctx, "populate-uid-db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", pod.Spec.NodeName)
+	prime, err := c.kubeClient.CoreV1().PersistentVolumeClaims(populatorNamespace).Get(ctx, "prime-uid-db",
+		metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", prime.Annotations[annSelectedNode])
+}
+
+func TestSyncIgnoresOtherPVCs(t *testing.T) {
+	ctx := context.TODO()
+	c, indexer := newTestController(t, storagev1.VolumeBindingImmediate)
+	pvc := newTargetPVC()
+	pvc.Spec.DataSourceRef = &corev1.TypedObjectReference{Kind: "PersistentVolumeClaim", Name: "other"}
+	update(t, c, indexer, pvc)
+
+	assert.NoError(t, c.sync(ctx, "default/db"))
+	pods, err := c.kubeClient.CoreV1().Pods(populatorNamespace).List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, pods.Items)
+}
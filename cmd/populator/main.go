@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	goflag "flag"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	driverName = "container-image.csi.k8s.io"
+
+	// populatorBinary is the path of the populator in the image of the driver.
+	populatorBinary = "/usr/bin/container-image-csi-populator"
+
+	controllerMode = "controller"
+	populateMode   = "populate"
+)
+
+var (
+	mode = flag.String("mode", controllerMode,
+		"The mode of the populator. Valid values are \""+controllerMode+"\" and \""+populateMode+"\".")
+	namespace = flag.String("namespace", "",
+		"The namespace of prime PVCs and populate pods. Only valid in controller mode.")
+	image = flag.String("image", "",
+		"The image of the populator run by populate pods. Only valid in controller mode.")
+	resyncPeriod = flag.Duration("resync-period", 10*time.Minute,
+		"Resync period of PVCs and pods. Only valid in controller mode.")
+	source = flag.String("source", "", "The directory to copy. Only valid in populate mode.")
+	target = flag.String("target", "", "The directory to copy to. Only valid in populate mode.")
+)
+
+func main() {
+	klog.InitFlags(nil)
+	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
+	flag.Parse()
+	defer klog.Flush()
+
+	switch *mode {
+	case populateMode:
+		if len(*source) == 0 || len(*target) == 0 {
+			klog.Fatalf("--source and --target are required")
+		}
+
+		klog.Infof("copying %q to %q", *source, *target)
+		if err := populate(*source, *target); err != nil {
+			klog.Fatalf("unable to copy %q to %q: %s", *source, *target, err)
+		}
+
+		klog.Infof("copied %q to %q", *source, *target)
+	case controllerMode:
+		if len(*namespace) == 0 || len(*image) == 0 {
+			klog.Fatalf("--namespace and --image are required")
+		}
+
+		kubeConfig, err := rest.InClusterConfig()
+		if err != nil {
+			klog.Fatalf("unable to get cluster config: %s", err)
+		}
+
+		kubeClient := kubernetes.NewForConfigOrDie(kubeConfig)
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartStructuredLogging(4)
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+		defer broadcaster.Shutdown()
+		recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "container-image-csi-populator"})
+
+		ctrl, err := NewController(kubeClient, dynamic.NewForConfigOrDie(kubeConfig), recorder, *namespace, *image,
+			*resyncPeriod)
+		if err != nil {
+			klog.Fatalf("unable to create the populator: %s", err)
+		}
+
+		ctrl.Run(context.Background())
+	default:
+		klog.Fatalf("unknown mode %q", *mode)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// populate copies the directory tree at source into target, keeping modes, ownership and modification times.
+// Existing files in target are overwritten. Special files, e.g. devices and sockets, are skipped.
+func populate(source, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", source)
+	}
+
+	return filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(target, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err = os.MkdirAll(dst, mode.Perm()); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err = copyFile(path, dst, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			if err = os.Remove(dst); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			if err = os.Symlink(link, dst); err != nil {
+				return err
+			}
+		default:
+			klog.Warningf("skip special file %q", rel)
+			return nil
+		}
+
+		return copyMetadata(dst, info)
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// copyMetadata applies ownership, the mode and the modification time of the source to dst.
+func copyMetadata(dst string, info fs.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	// Modes are masked by umask on creation.
+	if err := os.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
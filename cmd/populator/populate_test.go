@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopulate(t *testing.T) {
+	source := t.TempDir()
+	target := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "data", "sub"), 0o750))
+	assert.NoError(t, os.WriteFile(filepath.Join(source, "data", "sub", "file"), []byte("content"), 0o640))
+	assert.NoError(t, os.Symlink("sub/file", filepath.Join(source, "data", "link")))
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(filepath.Join(source, "data", "sub", "file"), mtime, mtime))
+
+	// Existing files are overwritten.
+	assert.NoError(t, os.WriteFile(filepath.Join(target, "link"), []byte("stale"), 0o644))
+
+	assert.NoError(t, populate(filepath.Join(source, "data"), target))
+
+	data, err := os.ReadFile(filepath.Join(target, "sub", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	info, err := os.Stat(filepath.Join(target, "sub", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	assert.True(t, mtime.Equal(info.ModTime()))
+
+	info, err = os.Stat(filepath.Join(target, "sub"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), info.Mode().Perm())
+
+	link, err := os.Readlink(filepath.Join(target, "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sub/file", link)
+
+	assert.Error(t, populate(filepath.Join(source, "absent"), target))
+}
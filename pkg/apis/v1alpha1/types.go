@@ -0,0 +1,174 @@
+// Package v1alpha1 contains custom resources of the driver.
+// Resources are accessed through the dynamic client and converted from unstructured objects,
+// so no generated clientsets are needed.
+package v1alpha1
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// GroupName is the API group of all custom resources of the driver.
+	GroupName = "csi.warm-metal.tech"
+	// Version is the API version of resources in this package.
+	Version = "v1alpha1"
+)
+
+// ImagePrewarmResource is the resource of ImagePrewarm objects.
+var ImagePrewarmResource = schema.GroupVersionResource{Group: GroupName, Version: Version, Resource: "imageprewarms"}
+
+// ImagePrewarm asks node plugins to pull images before workloads land on nodes.
+type ImagePrewarm struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImagePrewarmSpec   `json:"spec"`
+	Status ImagePrewarmStatus `json:"status,omitempty"`
+}
+
+// ImagePrewarmSpec describes which images to pull on which nodes.
+type ImagePrewarmSpec struct {
+	// Images to be pulled.
+	Images []string `json:"images"`
+	// NodeSelector selects nodes by labels. Images are pulled on all nodes if it is empty.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// ImagePullSecrets are names of Secrets in the same namespace used to pull images.
+	ImagePullSecrets []string `json:"imagePullSecrets,omitempty"`
+	// Schedule is the interval to pull images again, e.g. "1h", to catch up with moving tags.
+	// Images are pulled only once if it is not set.
+	Schedule *metav1.Duration `json:"schedule,omitempty"`
+}
+
+// PrewarmPhase is the pull state of an image on a node.
+type PrewarmPhase string
+
+const (
+	PrewarmPending PrewarmPhase = "Pending"
+	PrewarmPulling PrewarmPhase = "Pulling"
+	PrewarmReady   PrewarmPhase = "Ready"
+	PrewarmFailed  PrewarmPhase = "Failed"
+)
+
+// ImagePrewarmStatus is the progress reported by node plugins.
+type ImagePrewarmStatus struct {
+	Nodes []NodePrewarmStatus `json:"nodes,omitempty"`
+}
+
+// NodePrewarmStatus is the progress on a single node.
+type NodePrewarmStatus struct {
+	NodeName string              `json:"nodeName"`
+	Images   []ImagePrewarmState `json:"images,omitempty"`
+}
+
+// ImagePrewarmState is the pull state of an image on a node.
+type ImagePrewarmState struct {
+	Image   string       `json:"image"`
+	Phase   PrewarmPhase `json:"phase"`
+	Message string       `json:"message,omitempty"`
+	// LastPullTime is the time when the image was pulled successfully.
+	LastPullTime *metav1.Time `json:"lastPullTime,omitempty"`
+}
+
+// NodeStatus returns the status of the given node, or nil if the node hasn't reported.
+func (s *ImagePrewarmStatus) NodeStatus(node string) *NodePrewarmStatus {
+	for i := range s.Nodes {
+		if s.Nodes[i].NodeName == node {
+			return &s.Nodes[i]
+		}
+	}
+
+	return nil
+}
+
+// ImageState returns the state of the given image, or nil if the image hasn't been reported.
+func (s *NodePrewarmStatus) ImageState(image string) *ImagePrewarmState {
+	for i := range s.Images {
+		if s.Images[i].Image == image {
+			return &s.Images[i]
+		}
+	}
+
+	return nil
+}
+
+// NodeImageCacheResource is the resource of NodeImageCache objects.
+var NodeImageCacheResource = schema.GroupVersionResource{Group: GroupName, Version: Version, Resource: "nodeimagecaches"}
+
+// NodeImageCache lists images cached on a node. It is cluster-scoped, named after the node,
+// and reported by the node plugin running on it.
+type NodeImageCache struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status NodeImageCacheStatus `json:"status,omitempty"`
+}
+
+// NodeImageCacheStatus is the image list reported by the node plugin.
+type NodeImageCacheStatus struct {
+	// Images cached on the node.
+	Images []CachedImage `json:"images,omitempty"`
+	// LastUpdateTime is the time when the list was reported.
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// CachedImage is an image cached on a node.
+type CachedImage struct {
+	// RepoDigests are references of the image by digest, e.g. "docker.io/library/alpine@sha256:...".
+	RepoDigests []string `json:"repoDigests,omitempty"`
+	// RepoTags are references of the image by tag.
+	RepoTags []string `json:"repoTags,omitempty"`
+	// Size is the size of the image on the node in bytes.
+	Size int64 `json:"size,omitempty"`
+}
+
+// ContainerImageSourceKind is the kind of ContainerImageSource objects, used in dataSourceRef of PVCs.
+const ContainerImageSourceKind = "ContainerImageSource"
+
+// ContainerImageSourceResource is the resource of ContainerImageSource objects.
+var ContainerImageSourceResource = schema.GroupVersionResource{
+	Group: GroupName, Version: Version, Resource: "containerimagesources",
+}
+
+// ContainerImageSource is a data source of PVCs. The volume populator copies contents of the image into PVCs
+// referring to it via dataSourceRef.
+type ContainerImageSource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ContainerImageSourceSpec `json:"spec"`
+}
+
+// ContainerImageSourceSpec describes the image to copy.
+type ContainerImageSourceSpec struct {
+	// Image to be copied.
+	Image string `json:"image"`
+	// PullSecret is the name of a Secret in the same namespace used to pull the image.
+	PullSecret string `json:"pullSecret,omitempty"`
+	// SubPath is the directory in the image to copy. The whole rootfs is copied if it is empty.
+	SubPath string `json:"subPath,omitempty"`
+}
+
+// FromUnstructured converts an unstructured object to the given typed object.
+func FromUnstructured(obj interface{}, typed interface{}) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("expect an unstructured object but got %T", obj)
+	}
+
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), typed)
+}
+
+// ToUnstructured converts a typed object to an unstructured object.
+func ToUnstructured(typed interface{}) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(typed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unstructured.Unstructured{Object: content}, nil
+}
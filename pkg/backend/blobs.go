@@ -0,0 +1,19 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrBlobNotFound is returned by BlobStore if the runtime doesn't hold the blob.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore reads blobs of images held by the container runtime, e.g. manifests, configs and layers.
+type BlobStore interface {
+	// Open returns a reader of the blob with the given digest and its size.
+	// It returns an error wrapping ErrBlobNotFound if the runtime doesn't hold the blob.
+	Open(ctx context.Context, dgst digest.Digest) (io.ReadCloser, int64, error)
+}
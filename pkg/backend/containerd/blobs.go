@@ -0,0 +1,57 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+type blobStore struct {
+	content content.Store
+}
+
+// NewBlobStore returns blobs of the containerd content store, which holds manifests, configs and compressed layers
+// of images exactly as they were pulled. Blobs are served from the given namespace.
+func NewBlobStore(socketPath, namespace string) backend.BlobStore {
+	c, err := client.New(socketPath, client.WithDefaultNamespace(namespace))
+	if err != nil {
+		klog.Fatalf("unable to connect to containerd: %s", err)
+	}
+
+	return &blobStore{content: c.ContentStore()}
+}
+
+func (s *blobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	info, err := s.content.Info(ctx, dgst)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, 0, fmt.Errorf("%w: %s", backend.ErrBlobNotFound, dgst)
+		}
+
+		return nil, 0, err
+	}
+
+	ra, err := s.content.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst, Size: info.Size})
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, 0, fmt.Errorf("%w: %s", backend.ErrBlobNotFound, dgst)
+		}
+
+		return nil, 0, err
+	}
+
+	return &blobReader{Reader: io.NewSectionReader(ra, 0, info.Size), Closer: ra}, info.Size, nil
+}
+
+type blobReader struct {
+	io.Reader
+	io.Closer
+}
@@ -5,56 +5,146 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/defaults"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/plugins"
+	"github.com/containerd/errdefs"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/image-spec/identity"
 	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend/hostmount"
 	"k8s.io/klog/v2"
+	k8smount "k8s.io/utils/mount"
 )
 
 type snapshotMounter struct {
-	snapshotter snapshots.Snapshotter
-	cli         *client.Client
+	cli *client.Client
+	// snapshots maps keys of snapshots to their namespaces and snapshotters, which are different from the defaults.
+	snapshots *snapshotIndex
+	// pins records images pinned by targets and serializes updates of their labels.
+	pins *pinIndex
 }
 
-func NewMounter(socketPath string) backend.Mounter {
-	c, err := client.New(socketPath, client.WithDefaultNamespace("k8s.io"))
-	if err != nil {
-		klog.Fatalf("containerd connection is broken because the mounted unix socket somehow dose not work,"+
-			"recreate the container may fix: %s", err)
+// snapshotRef is where a snapshot lives. Empty fields are the default namespace and the default snapshotter.
+type snapshotRef struct {
+	namespace   string
+	snapshotter string
+}
+
+// snapshotIndex records namespaces and snapshotters of snapshots, since keys of read-write snapshots don't carry
+// them.
+type snapshotIndex struct {
+	sync.Mutex
+	keys map[backend.SnapshotKey]snapshotRef
+}
+
+func (i *snapshotIndex) get(key backend.SnapshotKey) snapshotRef {
+	i.Lock()
+	defer i.Unlock()
+	return i.keys[key]
+}
+
+func (i *snapshotIndex) set(key backend.SnapshotKey, ref snapshotRef) {
+	i.Lock()
+	defer i.Unlock()
+	if ref == (snapshotRef{}) {
+		delete(i.keys, key)
+		return
 	}
 
-	return backend.NewMounter(&snapshotMounter{
-		snapshotter: c.SnapshotService(""),
-		cli:         c,
-	})
+	i.keys[key] = ref
+}
+
+// pinnedImage is an image in a namespace of containerd.
+type pinnedImage struct {
+	namespace string
+	name      string
 }
 
-// selinuxContext returns the configured SELinux mount context or a safe default.
-// Default: system_u:object_r:container_file_t:s0
-func selinuxContext() string {
-	if v := os.Getenv("CSI_SELINUX_CONTEXT"); v != "" {
-		return v
+// pinLock serializes updates of labels of an image. It is removed once no one waits for it.
+type pinLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// pinIndex records images pinned by targets, so that they are unpinned without listing images, and serializes
+// read-modify-writes of labels of each image, so that concurrent updates don't drop labels of each other.
+type pinIndex struct {
+	sync.Mutex
+	locks   map[pinnedImage]*pinLock
+	targets map[backend.MountTarget]pinnedImage
+}
+
+// lock locks labels of the image until the returned function is called.
+func (i *pinIndex) lock(img pinnedImage) (unlock func()) {
+	i.Lock()
+	l := i.locks[img]
+	if l == nil {
+		l = &pinLock{}
+		i.locks[img] = l
+	}
+
+	l.waiters++
+	i.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		i.Lock()
+		defer i.Unlock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(i.locks, img)
+		}
 	}
-	return "system_u:object_r:container_file_t:s0"
 }
 
-// isSELinuxEnforcing checks host kernel SELinux enforcing state via /sys/fs/selinux/enforce.
-// Returns true only when the file exists and contains "1".
-func isSELinuxEnforcing() bool {
-	b, err := os.ReadFile("/sys/fs/selinux/enforce")
+func (i *pinIndex) get(target backend.MountTarget) (pinnedImage, bool) {
+	i.Lock()
+	defer i.Unlock()
+	img, found := i.targets[target]
+	return img, found
+}
+
+func (i *pinIndex) set(target backend.MountTarget, img pinnedImage) {
+	i.Lock()
+	defer i.Unlock()
+	i.targets[target] = img
+}
+
+func (i *pinIndex) remove(target backend.MountTarget) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.targets, target)
+}
+
+// NewMounter returns a mounter of images in the given namespace of containerd by default. Volumes can select other
+// namespaces via backend.WithNamespace.
+func NewMounter(socketPath, namespace string, opts ...backend.MounterOption) backend.Mounter {
+	c, err := client.New(socketPath, client.WithDefaultNamespace(namespace))
 	if err != nil {
-		return false
+		klog.Fatalf("containerd connection is broken because the mounted unix socket somehow dose not work,"+
+			"recreate the container may fix: %s", err)
 	}
 
-	s := strings.TrimSpace(string(b))
-	return s == "1"
+	m := &snapshotMounter{
+		cli:       c,
+		snapshots: &snapshotIndex{keys: make(map[backend.SnapshotKey]snapshotRef)},
+		pins: &pinIndex{
+			locks:   make(map[pinnedImage]*pinLock),
+			targets: make(map[backend.MountTarget]pinnedImage),
+		},
+	}
+
+	m.releaseStalePins(context.TODO())
+	return backend.NewMounter(m, opts...)
 }
 
 // mountInHostNamespace mounts in the host mount namespace using a re-exec of the
@@ -66,29 +156,11 @@ func isSELinuxEnforcing() bool {
 // mount(2) syscall is not affected. See docs/design/bottlerocket-1.59-overlay-regression.md.
 func mountInHostNamespace(ctx context.Context, mounts []mount.Mount, target string) error {
 	// Compute SELinux enforcement once per mount operation.
-	enforcing := isSELinuxEnforcing()
-	var contextOpt string
-	if enforcing {
-		contextOpt = fmt.Sprintf("context=\"%s\"", selinuxContext())
-	}
-
+	label := hostmount.MountLabel()
 	for i, m := range mounts {
 		// When SELinux is enforcing on the host, inject context=... into the options.
-		mountOptions := m.Options
-		if enforcing {
-			alreadySet := false
-			for _, opt := range mountOptions {
-				if strings.HasPrefix(opt, "context=") {
-					alreadySet = true
-					break
-				}
-			}
-			if !alreadySet {
-				mountOptions = append(mountOptions, contextOpt)
-			}
-		}
-
-		if err := syscallMountInHostNamespace(m.Source, target, m.Type, mountOptions); err != nil {
+		mountOptions := hostmount.WithMountLabel(m.Options, label)
+		if err := hostmount.Mount(m.Source, target, m.Type, mountOptions); err != nil {
 			klog.Errorf("mount failed (attempt %d/%d): source=%s target=%s type=%s opts=%v err=%s",
 				i+1, len(mounts), m.Source, target, m.Type, mountOptions, err)
 			return err
@@ -100,23 +172,35 @@ func mountInHostNamespace(ctx context.Context, mounts []mount.Mount, target stri
 	return nil
 }
 
-// unmountInHostNamespace unmounts directly in the host mount namespace using nsenter
-func unmountInHostNamespace(ctx context.Context, target string) error {
-	cmd := exec.CommandContext(ctx,
-		"nsenter", "--mount=/host/proc/1/ns/mnt", "--",
-		"umount", target)
+// withNamespace returns the context of the containerd namespace selected via backend.WithNamespace.
+func withNamespace(ctx context.Context) context.Context {
+	if namespace := backend.NamespaceFrom(ctx); len(namespace) > 0 {
+		return namespaces.WithNamespace(ctx, namespace)
+	}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		klog.Errorf("nsenter unmount failed: %s, output: %s", err, string(output))
-		return fmt.Errorf("unmount failed: %w, output: %s", err, string(output))
+	return ctx
+}
+
+// refOf returns where snapshots are created with the context.
+func refOf(ctx context.Context) snapshotRef {
+	return snapshotRef{namespace: backend.NamespaceFrom(ctx), snapshotter: backend.SnapshotterFrom(ctx)}
+}
+
+// snapshotter returns the snapshotter holding the snapshot, along with the context of its namespace.
+func (s snapshotMounter) snapshotter(ctx context.Context, key backend.SnapshotKey) (
+	context.Context, snapshots.Snapshotter,
+) {
+	ref := s.snapshots.get(key)
+	if len(ref.namespace) > 0 {
+		ctx = namespaces.WithNamespace(ctx, ref.namespace)
 	}
-	klog.V(4).Infof("unmounted %s using nsenter", target)
-	return nil
+
+	return ctx, s.cli.SnapshotService(ref.snapshotter)
 }
 
 func (s snapshotMounter) Mount(ctx context.Context, key backend.SnapshotKey, target backend.MountTarget, ro bool) error {
-	mounts, err := s.snapshotter.Mounts(ctx, string(key))
+	ctx, snapshotter := s.snapshotter(ctx, key)
+	mounts, err := snapshotter.Mounts(ctx, string(key))
 	if err != nil {
 		klog.Errorf("unable to retrieve mounts of snapshot %q: %s", key, err)
 		return err
@@ -137,7 +221,7 @@ func (s snapshotMounter) Mount(ctx context.Context, key backend.SnapshotKey, tar
 }
 
 func (s snapshotMounter) Unmount(ctx context.Context, target backend.MountTarget) error {
-	if err := unmountInHostNamespace(ctx, string(target)); err != nil {
+	if err := hostmount.Unmount(ctx, string(target)); err != nil {
 		klog.Errorf("fail to unmount %s: %s", target, err)
 		return err
 	}
@@ -146,44 +230,69 @@ func (s snapshotMounter) Unmount(ctx context.Context, target backend.MountTarget
 }
 
 func (s snapshotMounter) ImageExists(ctx context.Context, image reference.Named) bool {
-	_, err := s.cli.GetImage(ctx, image.String())
-	return err == nil
+	ctx = withNamespace(ctx)
+	img, err := s.cli.GetImage(ctx, image.String())
+	if err != nil {
+		return false
+	}
+
+	// Images pulled lazily via another snapshotter may lack layers to unpack.
+	if snapshotter := backend.SnapshotterFrom(ctx); len(snapshotter) > 0 {
+		unpacked, err := img.IsUnpacked(ctx, snapshotter)
+		return err == nil && unpacked
+	}
+
+	return true
 }
 
-func (s snapshotMounter) GetImageIDOrDie(ctx context.Context, image reference.Named) string {
+func (s snapshotMounter) GetImageID(ctx context.Context, image reference.Named) (string, error) {
+	ctx = withNamespace(ctx)
 	localImage, err := s.cli.GetImage(ctx, image.String())
 	if err != nil {
-		klog.Fatalf("unable to retrieve local image %q: %s", image, err)
+		if errdefs.IsNotFound(err) {
+			return "", fmt.Errorf("%w: %s", backend.ErrImageNotFound, image)
+		}
+
+		return "", fmt.Errorf("unable to retrieve local image %q: %w", image, err)
 	}
 
-	if err = localImage.Unpack(ctx, ""); err != nil {
-		klog.Fatalf("unable to unpack image %q: %s", image, err)
+	snapshotter := backend.SnapshotterFrom(ctx)
+	if err = localImage.Unpack(ctx, snapshotter); err != nil {
+		// Layers may be removed by the garbage collection of containerd along with the image.
+		if errdefs.IsNotFound(err) {
+			return "", fmt.Errorf("%w: layers of %s: %s", backend.ErrImageNotFound, image, err)
+		}
+
+		return "", fmt.Errorf("unable to unpack image %q via snapshotter %q: %w", image, snapshotter, err)
 	}
 
-	klog.Infof("image %q unpacked", image)
+	klog.Infof("image %q unpacked via snapshotter %q", image, snapshotter)
 	diffIDs, err := localImage.RootFS(ctx)
 	if err != nil {
-		klog.Fatalf("unable to fetch rootfs of image %q: %s", image, err)
+		return "", fmt.Errorf("unable to fetch rootfs of image %q: %w", image, err)
 	}
 
-	return identity.ChainID(diffIDs).String()
+	return identity.ChainID(diffIDs).String(), nil
 }
 
 func (s snapshotMounter) PrepareReadOnlySnapshot(
 	ctx context.Context, imageID string, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
 ) error {
-	labels := defaultSnapshotLabels()
-	if metadata != nil {
-		labels = withTargets(defaultSnapshotLabels(), metadata.GetTargets())
+	labels, err := snapshotLabels(metadata)
+	if err != nil {
+		return err
 	}
 
-	klog.Infof("create ro snapshot %q for image %q with metadata %#v", key, imageID, labels)
+	ref := refOf(ctx)
+	klog.Infof("create ro snapshot %q for image %q in %#v with metadata %#v", key, imageID, ref, labels)
+	s.snapshots.set(key, ref)
 	info, err := s.FindSnapshot(ctx, string(key), imageID, snapshots.KindView, labels)
 	if info != nil {
 		return err
 	}
 
-	if _, err = s.snapshotter.View(ctx, string(key), imageID, snapshots.WithLabels(labels)); err != nil {
+	ctx, snapshotter := s.snapshotter(ctx, key)
+	if _, err = snapshotter.View(ctx, string(key), imageID, snapshots.WithLabels(labels)); err != nil {
 		klog.Errorf("unable to create read-only snapshot %q of image %q: %s", key, imageID, err)
 	}
 
@@ -193,18 +302,21 @@ func (s snapshotMounter) PrepareReadOnlySnapshot(
 func (s snapshotMounter) PrepareRWSnapshot(
 	ctx context.Context, imageID string, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
 ) error {
-	labels := defaultSnapshotLabels()
-	if metadata != nil {
-		labels = withTargets(defaultSnapshotLabels(), metadata.GetTargets())
+	labels, err := snapshotLabels(metadata)
+	if err != nil {
+		return err
 	}
 
-	klog.Infof("create rw snapshot %q for image %q with metadata %#v", key, imageID, labels)
+	ref := refOf(ctx)
+	klog.Infof("create rw snapshot %q for image %q in %#v with metadata %#v", key, imageID, ref, labels)
+	s.snapshots.set(key, ref)
 	info, err := s.FindSnapshot(ctx, string(key), imageID, snapshots.KindActive, labels)
 	if info != nil {
 		return err
 	}
 
-	if _, err = s.snapshotter.Prepare(ctx, string(key), imageID, snapshots.WithLabels(labels)); err != nil {
+	ctx, snapshotter := s.snapshotter(ctx, key)
+	if _, err = snapshotter.Prepare(ctx, string(key), imageID, snapshots.WithLabels(labels)); err != nil {
 		klog.Errorf("unable to create snapshot %q of image %q: %s", key, imageID, err)
 	}
 
@@ -214,7 +326,8 @@ func (s snapshotMounter) PrepareRWSnapshot(
 func (s snapshotMounter) FindSnapshot(
 	ctx context.Context, key, parent string, kind snapshots.Kind, labels map[string]string,
 ) (info *snapshots.Info, err error) {
-	stat, err := s.snapshotter.Stat(ctx, key)
+	ctx, snapshotter := s.snapshotter(ctx, backend.SnapshotKey(key))
+	stat, err := snapshotter.Stat(ctx, key)
 	if err != nil {
 		return
 	}
@@ -245,7 +358,8 @@ func (s snapshotMounter) UpdateSnapshotMetadata(
 	ctx context.Context, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
 ) error {
 	klog.Infof("update metadata of snapshot %q to %#v", key, metadata)
-	info, err := s.snapshotter.Stat(ctx, string(key))
+	ctx, snapshotter := s.snapshotter(ctx, key)
+	info, err := snapshotter.Stat(ctx, string(key))
 	if err != nil {
 		klog.Errorf("unable to fetch stat of snapshot %q: %s", key, err)
 		return err
@@ -257,9 +371,14 @@ func (s snapshotMounter) UpdateSnapshotMetadata(
 		}
 	}
 
-	info.Labels = withTargets(info.Labels, metadata.GetTargets())
+	targets, err := metadata.GetTargets()
+	if err != nil {
+		return err
+	}
+
+	info.Labels = withTargets(info.Labels, targets)
 	klog.Infof("labels of snapshot %q are %#v", key, info.Labels)
-	_, err = s.snapshotter.Update(ctx, info)
+	_, err = snapshotter.Update(ctx, info)
 	if err != nil {
 		klog.Errorf("unable to update metadata of snapshot %q: %s", key, err)
 	}
@@ -268,21 +387,261 @@ func (s snapshotMounter) UpdateSnapshotMetadata(
 
 func (s snapshotMounter) DestroySnapshot(ctx context.Context, key backend.SnapshotKey) error {
 	klog.Infof("remove snapshot %q", key)
-	err := s.snapshotter.Remove(ctx, string(key))
-	if err != nil {
+	snapshotCtx, snapshotter := s.snapshotter(ctx, key)
+	err := snapshotter.Remove(snapshotCtx, string(key))
+	if err != nil && !errdefs.IsNotFound(err) {
 		klog.Errorf("unable to remove the snapshot %q: %s", key, err)
+		return err
 	}
 
-	return err
+	if err != nil {
+		klog.Infof("snapshot %q doesn't exist. it may have not been created", key)
+	}
+
+	s.snapshots.set(key, snapshotRef{})
+	return nil
+}
+
+func (s snapshotMounter) LocateSnapshot(ctx context.Context, key backend.SnapshotKey) {
+	s.snapshots.set(key, refOf(ctx))
+}
+
+func (s snapshotMounter) PinImage(ctx context.Context, image reference.Named, target backend.MountTarget) error {
+	ref := pinnedImage{namespace: backend.NamespaceFrom(ctx), name: image.String()}
+	if len(ref.namespace) == 0 {
+		ref.namespace = s.cli.DefaultNamespace()
+	}
+
+	ctx = namespaces.WithNamespace(ctx, ref.namespace)
+	unlock := s.pins.lock(ref)
+	defer unlock()
+
+	img, err := s.cli.ImageService().Get(ctx, ref.name)
+	if err != nil {
+		klog.Errorf("unable to retrieve local image %q: %s", image, err)
+		return err
+	}
+
+	if img.Labels == nil {
+		img.Labels = make(map[string]string)
+	}
+
+	targetLabel := genTargetLabel(string(target))
+	img.Labels[targetLabel] = "√"
+	fields := []string{"labels." + targetLabel}
+
+	// Images pinned by others, e.g. the sandbox image, are left untouched.
+	if _, pinned := img.Labels[criPinnedLabel]; !pinned {
+		img.Labels[criPinnedLabel] = criPinnedValue
+		img.Labels[pinnedLabel] = "√"
+		fields = append(fields, "labels."+criPinnedLabel, "labels."+pinnedLabel)
+	}
+
+	klog.Infof("pin image %q for target %q", image, target)
+	if _, err = s.cli.ImageService().Update(ctx, img, fields...); err != nil {
+		klog.Errorf("unable to pin image %q: %s", image, err)
+		return err
+	}
+
+	s.pins.set(target, ref)
+	return nil
+}
+
+// listNamespaces returns all namespaces of containerd, or only the default namespace if they are unavailable.
+func (s snapshotMounter) listNamespaces(ctx context.Context) []string {
+	names, err := s.cli.NamespaceService().List(ctx)
+	if err != nil {
+		klog.Warningf("unable to list namespaces, only the default namespace %q is used: %s",
+			s.cli.DefaultNamespace(), err)
+		return []string{s.cli.DefaultNamespace()}
+	}
+
+	return names
+}
+
+// UnpinImage drops the reference of the target to the image it pinned. Pins of mounted targets are recorded on
+// startup, so targets not recorded didn't pin any images.
+func (s snapshotMounter) UnpinImage(ctx context.Context, target backend.MountTarget) error {
+	pinned, found := s.pins.get(target)
+	if !found {
+		klog.Infof("target %q didn't pin any images", target)
+		return nil
+	}
+
+	if err := s.unpinImage(ctx, pinned, genTargetLabel(string(target))); err != nil {
+		return err
+	}
+
+	s.pins.remove(target)
+	return nil
+}
+
+// unpinImage drops the target label from the image, and unpins the image if no other targets refer to it. Labels are
+// re-read under the lock of the image, so that concurrent pins are kept.
+func (s snapshotMounter) unpinImage(ctx context.Context, pinned pinnedImage, targetLabel string) error {
+	ctx = namespaces.WithNamespace(ctx, pinned.namespace)
+	unlock := s.pins.lock(pinned)
+	defer unlock()
+
+	img, err := s.cli.ImageService().Get(ctx, pinned.name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			klog.Infof("image %q has been removed. no need to unpin it", pinned.name)
+			return nil
+		}
+
+		klog.Errorf("unable to retrieve local image %q: %s", pinned.name, err)
+		return err
+	}
+
+	if _, found := img.Labels[targetLabel]; !found {
+		return nil
+	}
+
+	delete(img.Labels, targetLabel)
+	fields := []string{"labels." + targetLabel}
+
+	referred := false
+	for k := range img.Labels {
+		if strings.HasPrefix(k, targetLabelPrefix) {
+			referred = true
+			break
+		}
+	}
+
+	if !referred {
+		klog.Infof("image %q isn't mounted any more. unpin it", img.Name)
+		if _, pinnedByUs := img.Labels[pinnedLabel]; pinnedByUs {
+			delete(img.Labels, criPinnedLabel)
+			delete(img.Labels, pinnedLabel)
+			fields = append(fields, "labels."+criPinnedLabel, "labels."+pinnedLabel)
+		}
+	}
+
+	if _, err = s.cli.ImageService().Update(ctx, img, fields...); err != nil {
+		klog.Errorf("unable to unpin image %q: %s", img.Name, err)
+		return err
+	}
+
+	return nil
+}
+
+// releaseStalePins drops references of targets which were unmounted while the driver was down, and records pins of
+// targets still mounted.
+func (s snapshotMounter) releaseStalePins(ctx context.Context) {
+	for _, namespace := range s.listNamespaces(ctx) {
+		s.releaseStalePinsIn(ctx, namespace)
+	}
+}
+
+func (s snapshotMounter) releaseStalePinsIn(ctx context.Context, namespace string) {
+	imgs, err := s.cli.ImageService().List(namespaces.WithNamespace(ctx, namespace))
+	if err != nil {
+		klog.Errorf("unable to list images. stale pins are released on the next start: %s", err)
+		return
+	}
+
+	mounter := k8smount.New("")
+	for _, img := range imgs {
+		pinned := pinnedImage{namespace: namespace, name: img.Name}
+		for k := range img.Labels {
+			if !strings.HasPrefix(k, targetLabelPrefix) {
+				continue
+			}
+
+			target := k[len(targetLabelPrefix)+1:]
+			if notMount, err := mounter.IsLikelyNotMountPoint(target); err == nil && !notMount {
+				s.pins.set(backend.MountTarget(target), pinned)
+				continue
+			}
+
+			klog.Infof("target %q of image %q is not a mountpoint any more. release it", target, img.Name)
+			if err = s.unpinImage(ctx, pinned, k); err != nil {
+				klog.Errorf("unable to unpin image %q. it is released on the next start: %s", img.Name, err)
+			}
+		}
+	}
+}
+
+// listSnapshotters returns names of snapshotters loaded by containerd, or nil if they are unavailable.
+func (s snapshotMounter) listSnapshotters(ctx context.Context) []string {
+	resp, err := s.cli.IntrospectionService().Plugins(ctx, "type=="+string(plugins.SnapshotPlugin))
+	if err != nil {
+		klog.Warningf("unable to list snapshotters, only snapshots of the default snapshotter are loaded: %s", err)
+		return nil
+	}
+
+	var names []string
+	for _, p := range resp.Plugins {
+		if p.InitErr == nil {
+			names = append(names, p.ID)
+		}
+	}
+
+	return names
 }
 
 func (s snapshotMounter) ListSnapshots(ctx context.Context) (ss []backend.SnapshotMetadata, err error) {
-	err = s.snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
-		if len(info.Labels) == 0 {
+	snapshotters := s.listSnapshotters(ctx)
+	for _, namespace := range s.listNamespaces(ctx) {
+		nsCtx := namespaces.WithNamespace(ctx, namespace)
+		// The default snapshotter of the namespace is recorded as "", as well as the default namespace, so that
+		// snapshots of defaults are absent from the index.
+		defaultSnapshotter, err := s.cli.GetLabel(nsCtx, defaults.DefaultSnapshotterNSLabel)
+		if err != nil {
+			klog.Errorf("unable to get the default snapshotter of namespace %q: %s", namespace, err)
+			return nil, err
+		}
+
+		if len(defaultSnapshotter) == 0 {
+			defaultSnapshotter = defaults.DefaultSnapshotter
+		}
+
+		names := snapshotters
+		if len(names) == 0 {
+			names = []string{defaultSnapshotter}
+		}
+
+		ref := snapshotRef{}
+		if namespace != s.cli.DefaultNamespace() {
+			ref.namespace = namespace
+		}
+
+		for _, snapshotter := range names {
+			ref.snapshotter = snapshotter
+			if snapshotter == defaultSnapshotter {
+				ref.snapshotter = ""
+			}
+
+			if err := s.listSnapshots(nsCtx, ref, &ss); err != nil {
+				if len(ref.snapshotter) > 0 {
+					// Proxy snapshotters may be unavailable. Their snapshots are left until the next restart.
+					klog.Warningf("unable to list snapshots of snapshotter %q in namespace %q: %s", snapshotter,
+						namespace, err)
+					continue
+				}
+
+				klog.Errorf("unable to list snapshots in namespace %q: %s", namespace, err)
+				return nil, err
+			}
+		}
+	}
+
+	return
+}
+
+// listSnapshots appends snapshots of the namespace and snapshotter created by the driver to ss, and records where
+// they are.
+func (s snapshotMounter) listSnapshots(ctx context.Context, ref snapshotRef, ss *[]backend.SnapshotMetadata) error {
+	return s.cli.SnapshotService(ref.snapshotter).Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if !strings.HasPrefix(info.Name, labelPrefix+"-") {
 			return nil
 		}
 
+		s.snapshots.set(backend.SnapshotKey(info.Name), ref)
+		// Snapshots referred in the state file don't have targets, but are listed as well.
 		targets := make(map[backend.MountTarget]struct{}, len(info.Labels))
+		legacy := false
 		for k := range info.Labels {
 			// To be compatible with old snapshots(prior to v0.4.2), we must filter read-write snapshots out.
 			// The read-write snapshot always has a key of leading with "csi-", while the key of a read-only snapshot
@@ -291,7 +650,7 @@ func (s snapshotMounter) ListSnapshots(ctx context.Context) (ss []backend.Snapsh
 				if strings.HasPrefix(info.Name[len(labelPrefix)+1:], "csi-") {
 					klog.Infof("rw snapshot %q with labels %#v is created by an old versioned driver, skip it",
 						info.Name, info.Labels)
-					targets = nil
+					legacy = true
 					break
 				}
 
@@ -299,7 +658,7 @@ func (s snapshotMounter) ListSnapshots(ctx context.Context) (ss []backend.Snapsh
 					klog.Warningf("snapshot %q with labels %#v is an old versioned snapshot used by a PV. "+
 						"It will be excluded from the ro snapshot cache, but it still can be unmounted normally.",
 						info.Name, info.Labels)
-					targets = nil
+					legacy = true
 					break
 				}
 			}
@@ -309,23 +668,25 @@ func (s snapshotMounter) ListSnapshots(ctx context.Context) (ss []backend.Snapsh
 			}
 		}
 
-		if len(targets) > 0 {
-			metadata := make(backend.SnapshotMetadata)
-			metadata.SetSnapshotKey(info.Name)
-			metadata.SetTargets(targets)
-			ss = append(ss, metadata)
-			klog.Infof("got ro snapshot %q with targets %#v", info.Name, targets)
+		if legacy {
+			return nil
 		}
 
-		return nil
-	})
+		metadata := make(backend.SnapshotMetadata)
+		metadata.SetSnapshotKey(info.Name)
+		metadata.SetTargets(targets)
+		metadata.SetNamespace(ref.namespace)
+		metadata.SetSnapshotter(ref.snapshotter)
+		if info.Kind == snapshots.KindActive {
+			metadata.SetReadWrite()
+		}
 
-	if err != nil {
-		klog.Errorf("unable to list snapshots: %s", err)
-		return nil, err
-	}
+		*ss = append(*ss, metadata)
+		klog.Infof("got snapshot %q in %#v, read-write %t, with targets %#v", info.Name, ref,
+			metadata.IsReadWrite(), targets)
 
-	return
+		return nil
+	})
 }
 
 const (
@@ -333,6 +694,11 @@ const (
 	targetLabelPrefix   = labelPrefix + "/target"
 	volumeIdLabelPrefix = labelPrefix + "/id"
 	gcLabel             = "containerd.io/gc.root"
+	// pinnedLabel indicates that the image is pinned by the driver.
+	pinnedLabel = labelPrefix + "/pinned"
+	// Pinned images are excluded from the image garbage collection of the kubelet.
+	criPinnedLabel = "io.cri-containerd.pinned"
+	criPinnedValue = "pinned"
 )
 
 func defaultSnapshotLabels() map[string]string {
@@ -350,6 +716,21 @@ func withTarget(labels map[string]string, target string) map[string]string {
 	return labels
 }
 
+// snapshotLabels returns labels of new snapshots, including targets in metadata if not nil.
+func snapshotLabels(metadata backend.SnapshotMetadata) (map[string]string, error) {
+	labels := defaultSnapshotLabels()
+	if metadata == nil {
+		return labels, nil
+	}
+
+	targets, err := metadata.GetTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	return withTargets(labels, targets), nil
+}
+
 func withTargets(labels map[string]string, targets map[backend.MountTarget]struct{}) map[string]string {
 	for target := range targets {
 		withTarget(labels, string(target))
@@ -0,0 +1,119 @@
+package crio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"go.podman.io/storage"
+	"go.podman.io/storage/pkg/archive"
+	"k8s.io/klog/v2"
+)
+
+type blobStore struct {
+	imageStore storage.Store
+}
+
+// NewBlobStore returns blobs of containers/storage used by CRI-O.
+//
+// Layers are stored unpacked, and compressed layers can't be reproduced byte by byte. So only manifests, configs and
+// uncompressed layers are available. Layers are generated from the storage, which is slower than reading files.
+func NewBlobStore(socketPath string) backend.BlobStore {
+	store, err := storage.GetStore(fetchCriOConfigOrDie(socketPath))
+	if err != nil {
+		klog.Fatalf("unable to create image store: %s", err)
+	}
+
+	return &blobStore{imageStore: store}
+}
+
+func (s *blobStore) Open(_ context.Context, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	if data, err := s.manifest(dgst); err != nil || data != nil {
+		return bytesBlob(data, err)
+	}
+
+	if data, err := s.config(dgst); err != nil || data != nil {
+		return bytesBlob(data, err)
+	}
+
+	layers, err := s.imageStore.LayersByUncompressedDigest(dgst)
+	if err != nil && !errors.Is(err, storage.ErrLayerUnknown) {
+		return nil, 0, err
+	}
+
+	for _, layer := range layers {
+		if layer.UncompressedSize <= 0 {
+			continue
+		}
+
+		uncompressed := archive.Uncompressed
+		rc, err := s.imageStore.Diff("", layer.ID, &storage.DiffOptions{Compression: &uncompressed})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return rc, layer.UncompressedSize, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: %s", backend.ErrBlobNotFound, dgst)
+}
+
+// manifest returns the manifest with the given digest, or nil if no image refers to it.
+func (s *blobStore) manifest(dgst digest.Digest) ([]byte, error) {
+	images, err := s.imageStore.ImagesByDigest(dgst)
+	if err != nil && !errors.Is(err, storage.ErrImageUnknown) {
+		return nil, err
+	}
+
+	for _, image := range images {
+		keys := []string{storage.ImageDigestManifestBigDataNamePrefix + "-" + dgst.String()}
+		if image.Digest == dgst {
+			keys = append(keys, storage.ImageDigestBigDataKey)
+		}
+
+		for _, key := range keys {
+			data, err := s.imageStore.ImageBigData(image.ID, key)
+			if err == nil && digest.FromBytes(data) == dgst {
+				return data, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// config returns the image config with the given digest, or nil if no image has it. IDs of images are digests of
+// their configs.
+func (s *blobStore) config(dgst digest.Digest) ([]byte, error) {
+	if dgst.Validate() != nil {
+		return nil, nil
+	}
+
+	image, err := s.imageStore.Image(dgst.Encoded())
+	if err != nil {
+		if errors.Is(err, storage.ErrImageUnknown) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	data, err := s.imageStore.ImageBigData(image.ID, dgst.String())
+	if err != nil || digest.FromBytes(data) != dgst {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+func bytesBlob(data []byte, err error) (io.ReadCloser, int64, error) {
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
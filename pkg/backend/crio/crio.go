@@ -2,6 +2,7 @@ package crio
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,17 +13,17 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/distribution/reference"
 	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend/hostmount"
 	"go.podman.io/storage"
 	"go.podman.io/storage/types"
 	"k8s.io/klog/v2"
-	k8smount "k8s.io/utils/mount"
 )
 
 type snapshotMounter struct {
 	imageStore storage.Store
 }
 
-func NewMounter(socketPath string) *backend.SnapshotMounter {
+func NewMounter(socketPath string, opts ...backend.MounterOption) *backend.SnapshotMounter {
 	store, err := storage.GetStore(fetchCriOConfigOrDie(socketPath))
 	if err != nil {
 		klog.Fatalf("unable to create image store: %s", err)
@@ -30,11 +31,14 @@ func NewMounter(socketPath string) *backend.SnapshotMounter {
 
 	return backend.NewMounter(&snapshotMounter{
 		imageStore: store,
-	})
+	}, opts...)
 }
 
+// Mount binds the snapshot, mounted by the image store in the snapshot root shared with the host, to the target in the
+// host mount namespace. On SELinux-enforcing hosts, the snapshot is labeled when it is mounted, since bind mounts
+// inherit the label of their source.
 func (s snapshotMounter) Mount(_ context.Context, key backend.SnapshotKey, target backend.MountTarget, ro bool) error {
-	src, err := s.imageStore.Mount(string(key), "")
+	src, err := s.imageStore.Mount(string(key), hostmount.MountLabel())
 	if err != nil {
 		klog.Errorf("unable to mount snapshot %q: %s", key, err)
 		return err
@@ -45,7 +49,7 @@ func (s snapshotMounter) Mount(_ context.Context, key backend.SnapshotKey, targe
 		mountOpts = append(mountOpts, "ro")
 	}
 
-	if err = k8smount.New("").Mount(src, string(target), "", mountOpts); err != nil {
+	if err = hostmount.Mount(src, string(target), "", mountOpts); err != nil {
 		klog.Errorf("unable to bind %q to %q: %s", src, target, err)
 		return err
 	}
@@ -53,8 +57,8 @@ func (s snapshotMounter) Mount(_ context.Context, key backend.SnapshotKey, targe
 	return nil
 }
 
-func (s snapshotMounter) Unmount(_ context.Context, target backend.MountTarget) error {
-	if err := k8smount.New("").Unmount(string(target)); err != nil {
+func (s snapshotMounter) Unmount(ctx context.Context, target backend.MountTarget) error {
+	if err := hostmount.Unmount(ctx, string(target)); err != nil {
 		klog.Errorf("unable to unmount %q: %s", target, err)
 		return err
 	}
@@ -71,13 +75,17 @@ func (s snapshotMounter) ImageExists(ctx context.Context, image reference.Named)
 	return true
 }
 
-func (s snapshotMounter) GetImageIDOrDie(ctx context.Context, image reference.Named) string {
+func (s snapshotMounter) GetImageID(ctx context.Context, image reference.Named) (string, error) {
 	img, err := s.imageStore.Image(image.String())
 	if err != nil {
-		klog.Fatalf("unable to retrieve local image %q: %s", image, err)
+		if errors.Is(err, storage.ErrImageUnknown) {
+			return "", fmt.Errorf("%w: %s", backend.ErrImageNotFound, image)
+		}
+
+		return "", fmt.Errorf("unable to retrieve local image %q: %w", image, err)
 	}
 
-	return img.ID
+	return img.ID, nil
 }
 
 func (s snapshotMounter) PrepareReadOnlySnapshot(
@@ -97,7 +105,10 @@ func (s snapshotMounter) prepareSnapshot(
 ) error {
 	var metaString string
 	if metadata != nil {
-		metaString = metadata.Encode()
+		var err error
+		if metaString, err = metadata.Encode(); err != nil {
+			return err
+		}
 	}
 
 	if opts != nil {
@@ -114,7 +125,8 @@ func (s snapshotMounter) prepareSnapshot(
 			return fmt.Errorf("found existed snapshot %q with different image %#v", key, c.ImageID)
 		}
 
-		if metadata == nil {
+		// Read-write snapshots are only left by crashed publishes of the same volume.
+		if metadata == nil || metadata.IsReadWrite() {
 			klog.Infof("found existed snapshot %q, use it", key)
 			return nil
 		}
@@ -150,10 +162,13 @@ func (s snapshotMounter) prepareSnapshot(
 func (s snapshotMounter) UpdateSnapshotMetadata(
 	_ context.Context, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
 ) error {
-	metaString := metadata.Encode()
-	klog.Infof("update metadata of snapshot %q to %#v(compressed length %d)", key, metadata, len(metaString))
-	err := s.imageStore.SetMetadata(string(key), metaString)
+	metaString, err := metadata.Encode()
 	if err != nil {
+		return err
+	}
+
+	klog.Infof("update metadata of snapshot %q to %#v(compressed length %d)", key, metadata, len(metaString))
+	if err = s.imageStore.SetMetadata(string(key), metaString); err != nil {
 		klog.Errorf("unable to update metadata of snapshot %q: %s", key, err)
 		return err
 	}
@@ -162,9 +177,21 @@ func (s snapshotMounter) UpdateSnapshotMetadata(
 }
 
 func (s snapshotMounter) DestroySnapshot(_ context.Context, key backend.SnapshotKey) error {
+	if _, err := s.imageStore.Container(string(key)); errors.Is(err, storage.ErrContainerUnknown) {
+		klog.Infof("container %q doesn't exist. it may have not been created", key)
+		return nil
+	}
+
 	klog.Infof("unmount container %q", key)
-	if stillMounted, err := s.imageStore.Unmount(string(key), true); err != nil || stillMounted {
-		klog.Errorf("unable to unmount %q: %t %s", key, stillMounted, err)
+	stillMounted, err := s.imageStore.Unmount(string(key), true)
+	if err != nil {
+		klog.Errorf("unable to unmount container %q: %s", key, err)
+		return fmt.Errorf("unable to unmount snapshot %q: %w", key, err)
+	}
+
+	if stillMounted {
+		klog.Errorf("container %q is still mounted", key)
+		return fmt.Errorf("snapshot %q is still mounted", key)
 	}
 
 	klog.Infof("remove container %q", key)
@@ -176,6 +203,20 @@ func (s snapshotMounter) DestroySnapshot(_ context.Context, key backend.Snapshot
 	return nil
 }
 
+// LocateSnapshot does nothing since snapshots are all containers of the image store.
+func (s snapshotMounter) LocateSnapshot(context.Context, backend.SnapshotKey) {}
+
+// PinImage does nothing since the snapshot, a container in the image store, already refers to the image.
+// Images used by containers can't be removed from the store.
+func (s snapshotMounter) PinImage(context.Context, reference.Named, backend.MountTarget) error {
+	return nil
+}
+
+// UnpinImage does nothing since the reference is dropped along with the snapshot.
+func (s snapshotMounter) UnpinImage(context.Context, backend.MountTarget) error {
+	return nil
+}
+
 func (s snapshotMounter) ListSnapshots(context.Context) (ss []backend.SnapshotMetadata, err error) {
 	containers, err := s.imageStore.Containers()
 	if err != nil {
@@ -188,14 +229,21 @@ func (s snapshotMounter) ListSnapshots(context.Context) (ss []backend.SnapshotMe
 	for _, c := range containers {
 		if c.Metadata != "" {
 			metadata := make(backend.SnapshotMetadata)
-			if err := metadata.Decode(c.Metadata); err == nil {
-				metadata.SetSnapshotKey(c.ID)
-				ss = append(ss, metadata)
-				klog.Infof("got ro snapshot %q with targets %#v", c.ID, metadata.GetTargets())
-			} else {
+			if err := metadata.Decode(c.Metadata); err != nil {
 				klog.Warningf("unable to decode the metadata of snapshot %q: %s. it may be not a snapshot",
 					c.ID, err)
+				continue
 			}
+
+			targets, err := metadata.GetTargets()
+			if err != nil {
+				klog.Warningf("snapshot %q has malformed metadata %s. skip it: %s", c.ID, c.Metadata, err)
+				continue
+			}
+
+			metadata.SetSnapshotKey(c.ID)
+			ss = append(ss, metadata)
+			klog.Infof("got snapshot %q, read-write %t, with targets %#v", c.ID, metadata.IsReadWrite(), targets)
 		}
 	}
 
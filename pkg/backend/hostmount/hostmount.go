@@ -0,0 +1,79 @@
+// Package hostmount mounts and unmounts volumes in the host mount namespace, so that kubelet sees them without
+// relying on mount propagation, and labels them for SELinux-enforcing hosts. It is shared by backends of all
+// container runtimes.
+package hostmount
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// hostMountNS is the bind-mounted host mount namespace inside the driver container.
+const hostMountNS = "/host/proc/1/ns/mnt"
+
+// SELinuxContext returns the configured SELinux mount context or a safe default.
+// Default: system_u:object_r:container_file_t:s0
+func SELinuxContext() string {
+	if v := os.Getenv("CSI_SELINUX_CONTEXT"); v != "" {
+		return v
+	}
+	return "system_u:object_r:container_file_t:s0"
+}
+
+// SELinuxEnforcing checks host kernel SELinux enforcing state via /sys/fs/selinux/enforce.
+// Returns true only when the file exists and contains "1".
+func SELinuxEnforcing() bool {
+	b, err := os.ReadFile("/sys/fs/selinux/enforce")
+	if err != nil {
+		return false
+	}
+
+	s := strings.TrimSpace(string(b))
+	return s == "1"
+}
+
+// MountLabel returns the SELinux context which mounts are labeled with, or an empty string if SELinux is not
+// enforcing on the host.
+func MountLabel() string {
+	if !SELinuxEnforcing() {
+		return ""
+	}
+
+	return SELinuxContext()
+}
+
+// WithMountLabel injects context=... of the label into the options, unless the label is empty or a context is already
+// set.
+func WithMountLabel(options []string, label string) []string {
+	if label == "" {
+		return options
+	}
+
+	for _, opt := range options {
+		if strings.HasPrefix(opt, "context=") {
+			return options
+		}
+	}
+
+	return append(options[:len(options):len(options)], fmt.Sprintf("context=\"%s\"", label))
+}
+
+// Unmount unmounts directly in the host mount namespace using nsenter.
+func Unmount(ctx context.Context, target string) error {
+	cmd := exec.CommandContext(ctx,
+		"nsenter", "--mount="+hostMountNS, "--",
+		"umount", target)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		klog.Errorf("nsenter unmount failed: %s, output: %s", err, string(output))
+		return fmt.Errorf("unmount failed: %w, output: %s", err, string(output))
+	}
+	klog.V(4).Infof("unmounted %s using nsenter", target)
+	return nil
+}
@@ -0,0 +1,18 @@
+package hostmount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMountLabel(t *testing.T) {
+	options := []string{"ro", "lowerdir=/a:/b"}
+	assert.Equal(t, options, WithMountLabel(options, ""))
+	assert.Equal(t, []string{"ro", "lowerdir=/a:/b", `context="system_u:object_r:container_file_t:s0"`},
+		WithMountLabel(options, "system_u:object_r:container_file_t:s0"))
+	assert.Equal(t, []string{"ro", "lowerdir=/a:/b"}, options, "options are not modified")
+
+	labeled := []string{"ro", `context="foo"`}
+	assert.Equal(t, labeled, WithMountLabel(labeled, "bar"))
+}
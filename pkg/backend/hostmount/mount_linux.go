@@ -1,6 +1,6 @@
 //go:build linux
 
-package containerd
+package hostmount
 
 // Re-exec-based syscall.Mount for host mount namespace.
 //
@@ -34,8 +34,6 @@ import (
 const (
 	// envNsenterMount is the sentinel env var that triggers the re-exec child path.
 	envNsenterMount = "_CSI_NSENTER_MOUNT"
-	// hostMountNS is the bind-mounted host mount namespace inside the driver container.
-	hostMountNS = "/host/proc/1/ns/mnt"
 	// mountHelperName is the name of the helper binary on the hostPath volume.
 	mountHelperName = "mount-helper"
 )
@@ -68,16 +66,66 @@ func runNsenterMountChild() error {
 		return fmt.Errorf("decode mount request: %w", err)
 	}
 
-	data := strings.Join(req.Options, ",")
-
-	if err := unix.Mount(req.Source, req.Target, req.FSType, 0, data); err != nil {
+	flags, data := parseMountOptions(req.Options)
+	if err := unix.Mount(req.Source, req.Target, req.FSType, flags, data); err != nil {
 		return fmt.Errorf("mount(%q → %q, type=%q, data=%q): %w",
 			req.Source, req.Target, req.FSType, data, err)
 	}
 
+	// Bind mounts ignore MS_RDONLY until they are remounted.
+	if flags&unix.MS_BIND != 0 && flags&unix.MS_RDONLY != 0 {
+		if err := unix.Mount("", req.Target, "", flags|unix.MS_REMOUNT, ""); err != nil {
+			_ = unix.Unmount(req.Target, 0)
+			return fmt.Errorf("remount %q read-only: %w", req.Target, err)
+		}
+	}
+
 	return nil
 }
 
+// mountFlags are options of mount(8) which are flags of mount(2) rather than data of the filesystem.
+var mountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"bind":       {false, unix.MS_BIND},
+	"rbind":      {false, unix.MS_BIND | unix.MS_REC},
+	"ro":         {false, unix.MS_RDONLY},
+	"rw":         {true, unix.MS_RDONLY},
+	"nosuid":     {false, unix.MS_NOSUID},
+	"suid":       {true, unix.MS_NOSUID},
+	"nodev":      {false, unix.MS_NODEV},
+	"dev":        {true, unix.MS_NODEV},
+	"noexec":     {false, unix.MS_NOEXEC},
+	"exec":       {true, unix.MS_NOEXEC},
+	"noatime":    {false, unix.MS_NOATIME},
+	"atime":      {true, unix.MS_NOATIME},
+	"nodiratime": {false, unix.MS_NODIRATIME},
+	"diratime":   {true, unix.MS_NODIRATIME},
+	"relatime":   {false, unix.MS_RELATIME},
+	"norelatime": {true, unix.MS_RELATIME},
+}
+
+// parseMountOptions splits options into flags of mount(2) and the comma-joined data of the filesystem.
+func parseMountOptions(options []string) (flags uintptr, data string) {
+	var fsOptions []string
+	for _, o := range options {
+		f, found := mountFlags[o]
+		if !found {
+			fsOptions = append(fsOptions, o)
+			continue
+		}
+
+		if f.clear {
+			flags &^= f.flag
+		} else {
+			flags |= f.flag
+		}
+	}
+
+	return flags, strings.Join(fsOptions, ",")
+}
+
 // csiSocketDir returns the host-side path of the CSI socket directory.
 // This directory is a hostPath volume visible from both the container and host namespaces.
 // The initContainer copies the driver binary here as "mount-helper" before the main
@@ -90,10 +138,11 @@ func csiSocketDir() string {
 	return "/var/lib/kubelet/plugins/container-image.csi.k8s.io"
 }
 
-// syscallMountInHostNamespace uses nsenter to enter the host mount namespace and then
-// execs the mount-helper binary (placed on the socket-dir hostPath by the initContainer)
-// to call unix.Mount (legacy mount(2)) directly.
-func syscallMountInHostNamespace(source, target, fstype string, options []string) error {
+// Mount uses nsenter to enter the host mount namespace and then execs the mount-helper
+// binary (placed on the socket-dir hostPath by the initContainer) to call unix.Mount
+// (legacy mount(2)) directly. Options like rbind and ro are translated to flags of mount(2),
+// while the others are passed to the filesystem.
+func Mount(source, target, fstype string, options []string) error {
 	hostHelper := filepath.Join(csiSocketDir(), mountHelperName)
 
 	req := nsenterMountRequest{
@@ -0,0 +1,20 @@
+//go:build linux
+
+package hostmount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	flags, data := parseMountOptions([]string{"rbind", "ro"})
+	assert.Equal(t, uintptr(unix.MS_BIND|unix.MS_REC|unix.MS_RDONLY), flags)
+	assert.Empty(t, data)
+
+	flags, data = parseMountOptions([]string{"ro", "index=off", "lowerdir=/a:/b", "rw", `context="foo"`})
+	assert.Zero(t, flags)
+	assert.Equal(t, `index=off,lowerdir=/a:/b,context="foo"`, data)
+}
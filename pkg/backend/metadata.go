@@ -2,6 +2,7 @@ package backend
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"k8s.io/klog/v2"
 )
@@ -9,19 +10,25 @@ import (
 const (
 	FakeMetaDataSnapshotKey = iota
 	MetaDataKeyTargets
+	// MetaDataKeyReadWrite is set on read-write snapshots, whose only target is the volume mounting it.
+	MetaDataKeyReadWrite
+	// MetaDataKeyNamespace and MetaDataKeySnapshotter are set on snapshots out of the defaults of the runtime.
+	MetaDataKeyNamespace
+	MetaDataKeySnapshotter
 )
 
 type SnapshotMetadataKey int
 type SnapshotMetadata map[SnapshotMetadataKey]interface{}
 
-func (m SnapshotMetadata) GetSnapshotKey() SnapshotKey {
+// GetSnapshotKey returns the key of the snapshot, or an error if the metadata is malformed.
+func (m SnapshotMetadata) GetSnapshotKey() (SnapshotKey, error) {
 	switch v := m[FakeMetaDataSnapshotKey].(type) {
 	case SnapshotKey:
-		return v
+		return v, nil
 	case string:
-		return SnapshotKey(v)
+		return SnapshotKey(v), nil
 	default:
-		panic(m[FakeMetaDataSnapshotKey])
+		return "", fmt.Errorf("malformed snapshot key %#v", v)
 	}
 }
 
@@ -29,19 +36,20 @@ func (m SnapshotMetadata) SetSnapshotKey(key string) {
 	m[FakeMetaDataSnapshotKey] = SnapshotKey(key)
 }
 
-func (m SnapshotMetadata) GetTargets() map[MountTarget]struct{} {
+// GetTargets returns targets of the snapshot, or an error if the metadata is malformed.
+func (m SnapshotMetadata) GetTargets() (map[MountTarget]struct{}, error) {
 	switch v := m[MetaDataKeyTargets].(type) {
 	case map[MountTarget]struct{}:
-		return v
+		return v, nil
 	case map[string]interface{}:
 		r := make(map[MountTarget]struct{}, len(v))
 		for k := range v {
 			r[MountTarget(k)] = struct{}{}
 		}
 
-		return r
+		return r, nil
 	default:
-		panic(m[MetaDataKeyTargets])
+		return nil, fmt.Errorf("malformed snapshot targets %#v", v)
 	}
 }
 
@@ -49,20 +57,57 @@ func (m SnapshotMetadata) SetTargets(targets map[MountTarget]struct{}) {
 	m[MetaDataKeyTargets] = targets
 }
 
-func (m SnapshotMetadata) CopyTargets(targets map[MountTarget]struct{}) {
-	metaTargets := m[MetaDataKeyTargets].(map[MountTarget]struct{})
+func (m SnapshotMetadata) CopyTargets(targets map[MountTarget]struct{}) error {
+	metaTargets, err := m.GetTargets()
+	if err != nil {
+		return err
+	}
+
 	for target := range targets {
 		metaTargets[target] = struct{}{}
 	}
+
+	m.SetTargets(metaTargets)
+	return nil
+}
+
+// IsReadWrite returns true if the snapshot is a read-write snapshot.
+func (m SnapshotMetadata) IsReadWrite() bool {
+	rw, _ := m[MetaDataKeyReadWrite].(bool)
+	return rw
+}
+
+func (m SnapshotMetadata) SetReadWrite() {
+	m[MetaDataKeyReadWrite] = true
+}
+
+// GetNamespace returns the namespace of the snapshot, or "" for the default.
+func (m SnapshotMetadata) GetNamespace() string {
+	namespace, _ := m[MetaDataKeyNamespace].(string)
+	return namespace
 }
 
-func (m SnapshotMetadata) Encode() string {
+func (m SnapshotMetadata) SetNamespace(namespace string) {
+	m[MetaDataKeyNamespace] = namespace
+}
+
+// GetSnapshotter returns the snapshotter of the snapshot, or "" for the default.
+func (m SnapshotMetadata) GetSnapshotter() string {
+	snapshotter, _ := m[MetaDataKeySnapshotter].(string)
+	return snapshotter
+}
+
+func (m SnapshotMetadata) SetSnapshotter(snapshotter string) {
+	m[MetaDataKeySnapshotter] = snapshotter
+}
+
+func (m SnapshotMetadata) Encode() (string, error) {
 	bytes, err := json.Marshal(m)
 	if err != nil {
-		klog.Fatalf("unable to encode snapshot metadata: %s", err)
+		return "", fmt.Errorf("unable to encode snapshot metadata: %w", err)
 	}
 
-	return string(bytes)
+	return string(bytes), nil
 }
 
 func (m SnapshotMetadata) Decode(encoded string) error {
@@ -79,6 +124,23 @@ func createSnapshotMetaData(target MountTarget) SnapshotMetadata {
 	}
 }
 
+func createRWSnapshotMetaData(target MountTarget) SnapshotMetadata {
+	metadata := createSnapshotMetaData(target)
+	metadata.SetReadWrite()
+	return metadata
+}
+
+// createSnapshotMetaDataWithoutTargets returns metadata of snapshots whose references are saved in the state file.
+// They are still listed by runtimes, so that the reconciler finds snapshots leaked out of the state file.
+func createSnapshotMetaDataWithoutTargets(readWrite bool) SnapshotMetadata {
+	metadata := buildSnapshotMetaData(map[MountTarget]struct{}{})
+	if readWrite {
+		metadata.SetReadWrite()
+	}
+
+	return metadata
+}
+
 func buildSnapshotMetaData(targets map[MountTarget]struct{}) SnapshotMetadata {
 	return SnapshotMetadata{
 		MetaDataKeyTargets: targets,
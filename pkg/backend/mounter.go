@@ -8,30 +8,117 @@ import (
 
 	"github.com/distribution/reference"
 	"k8s.io/klog/v2"
-	k8smount "k8s.io/utils/mount"
 )
 
+// repairInterval is the interval to retry updating snapshots whose metadata are out of sync with the cache.
+const repairInterval = time.Minute
+
 type SnapshotMounter struct {
 	runtime ContainerRuntimeMounter
 
+	// saving serializes writes of the state file. savedVersion is the version of the cache last saved, and is
+	// protected by saving.
+	saving       sync.Mutex
+	savedVersion uint64
+
+	// guard protects maps below. It is never held across calls to the runtime, except on startup.
 	guard sync.Mutex
+	// locks of snapshots serializing references to each snapshot
+	snapshotLocks map[SnapshotKey]*snapshotLock
+	// targets being published or unpublished, or fixed by the reconciler
+	busyTargets map[MountTarget]struct{}
 	// mapping from targets to key of read-only snapshots
 	targetRoSnapshotMap map[MountTarget]SnapshotKey
 	// reference counter of read-only snapshots
 	roSnapshotTargetsMap map[SnapshotKey]map[MountTarget]struct{}
+	// mapping from targets to key of read-write snapshots
+	targetRwSnapshotMap map[MountTarget]SnapshotKey
+	// mapping from targets to IDs of volumes mounted to them
+	targetVolumeMap map[MountTarget]string
+	// mapping from targets to CRI IDs of images mounted to them
+	targetImageMap map[MountTarget]string
+	// namespaces and snapshotters of snapshots saved in the state file, since the runtime can't tell them from keys
+	snapshotPlaces map[SnapshotKey]snapshotPlace
+	// read-only snapshots whose metadata in the runtime failed to be updated. They are synced with the cache, or
+	// destroyed if no targets refer to them, later.
+	repairs map[SnapshotKey]struct{}
+	// version of the cache, which increases on every save, so that concurrent saves are coalesced
+	version uint64
+
+	reconcileInterval time.Duration
+	dryRun            bool
+	// mountedTargets returns mount points of the host.
+	mountedTargets func() (map[MountTarget]struct{}, error)
+	// state keeps references of snapshots instead of metadata of snapshots in the runtime if it is not nil.
+	state *stateFile
+}
+
+// MounterOption configures optional features of the SnapshotMounter.
+type MounterOption func(*SnapshotMounter)
+
+// WithReconciler compares the cache with snapshots of the runtime and mounts of the host at the interval, and fixes
+// drift between them. Drift is only reported via metrics if dryRun is set.
+func WithReconciler(interval time.Duration, dryRun bool) MounterOption {
+	return func(s *SnapshotMounter) {
+		s.reconcileInterval = interval
+		s.dryRun = dryRun
+	}
 }
 
-func NewMounter(runtime ContainerRuntimeMounter) *SnapshotMounter {
+// WithStateFile keeps references of snapshots in the given file instead of metadata of snapshots in the runtime, so
+// that volumes are published without updating snapshots. References in metadata are migrated to the file if it
+// doesn't exist, and removed from the runtime then.
+func WithStateFile(path string) MounterOption {
+	return func(s *SnapshotMounter) {
+		s.state = &stateFile{path: path}
+	}
+}
+
+func NewMounter(runtime ContainerRuntimeMounter, opts ...MounterOption) *SnapshotMounter {
 	mounter := &SnapshotMounter{
 		runtime:              runtime,
 		targetRoSnapshotMap:  make(map[MountTarget]SnapshotKey),
 		roSnapshotTargetsMap: make(map[SnapshotKey]map[MountTarget]struct{}),
+		targetRwSnapshotMap:  make(map[MountTarget]SnapshotKey),
+		targetVolumeMap:      make(map[MountTarget]string),
+		targetImageMap:       make(map[MountTarget]string),
+		snapshotPlaces:       make(map[SnapshotKey]snapshotPlace),
+		repairs:              make(map[SnapshotKey]struct{}),
+		snapshotLocks:        make(map[SnapshotKey]*snapshotLock),
+		busyTargets:          make(map[MountTarget]struct{}),
+		mountedTargets:       listMountedTargets,
+	}
+
+	for _, opt := range opts {
+		opt(mounter)
+	}
+
+	if mounter.state != nil {
+		mounter.loadStateOrDie()
+	} else {
+		mounter.buildSnapshotCacheOrDie()
+	}
+
+	// The cache has just been built. Both loops start after the first interval.
+	go every(repairInterval, mounter.repair)
+	if mounter.reconcileInterval > 0 {
+		go every(mounter.reconcileInterval, mounter.reconcile)
 	}
 
-	mounter.buildSnapshotCacheOrDie()
 	return mounter
 }
 
+// every calls f at the interval forever.
+func every(interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f()
+	}
+}
+
+// buildSnapshotCacheOrDie loads read-only snapshots from the runtime. It only crashes if snapshots can't be listed,
+// since the cache can't be built at all. Snapshots failed to be updated are repaired later.
 func (s *SnapshotMounter) buildSnapshotCacheOrDie() {
 	// FIXME the timeout can be a flag.
 	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
@@ -44,139 +131,534 @@ func (s *SnapshotMounter) buildSnapshotCacheOrDie() {
 
 	klog.Infof("load %d snapshots from runtime", len(snapshots))
 
-	mounter := k8smount.New("")
+	mounted, err := s.mountedTargets()
+	if err != nil {
+		klog.Fatalf("unable to list mounts: %s", err)
+	}
 
 	s.guard.Lock()
 	defer s.guard.Unlock()
 	for _, metadata := range snapshots {
-		key := metadata.GetSnapshotKey()
+		key, err := metadata.GetSnapshotKey()
+		if err != nil {
+			klog.Errorf("found a snapshot with malformed metadata %#v. skip it: %s", metadata, err)
+			continue
+		}
+
 		if key == "" {
-			klog.Fatalf("found a snapshot with a empty key")
+			klog.Errorf("found a snapshot with a empty key. skip it")
+			continue
+		}
+
+		s.placeSnapshotLocked(key, snapshotPlace{metadata.GetNamespace(), metadata.GetSnapshotter()})
+
+		// Snapshots with malformed targets may still be mounted, so they are left alone.
+		targets, err := metadata.GetTargets()
+		if err != nil {
+			klog.Errorf("snapshot %q has malformed metadata. skip it: %s", key, err)
+			continue
+		}
+
+		if metadata.IsReadWrite() {
+			s.loadRWSnapshot(ctx, key, targets, mounted)
+			continue
 		}
 
 		if len(s.roSnapshotTargetsMap[key]) > 0 {
-			klog.Fatalf("another snapshot with key %q has already been loaded", key)
+			klog.Errorf("another snapshot with key %q has already been loaded. skip it", key)
+			continue
 		}
 
-		targets := metadata.GetTargets()
 		if len(targets) == 0 {
-			klog.Fatalf("snapshot %q doesn't have a targets", key)
+			klog.Errorf("snapshot %q doesn't have a targets. skip it", key)
+			continue
 		}
 
 		numTargetsLoaded := len(targets)
 		for target := range targets {
 			// FIXME Considering using checksum of target instead to shorten metadata.
 			// But the mountpoint checking become unavailable any more.
-			if notMount, err := mounter.IsLikelyNotMountPoint(string(target)); err != nil || notMount {
+			if _, found := mounted[target]; !found {
 				klog.Errorf("target %q is not a mountpoint yet. trying to release the ref of snapshot %q",
 					target, key)
 				delete(targets, target)
 				continue
 			}
 
+			if loaded := s.targetRoSnapshotMap[target]; loaded != "" && loaded != key {
+				klog.Errorf("target %q is referred by both snapshot %q and %q. keep the former", target, loaded, key)
+				delete(targets, target)
+				continue
+			}
+
 			s.targetRoSnapshotMap[target] = key
 			klog.Infof("snapshot %q mounted to %s", key, target)
 		}
 
-		if len(targets) > 0 {
-			if len(targets) != numTargetsLoaded {
-				klog.Infof("some targets of snapshot %q changed, update metadata", key)
-				if err := s.runtime.UpdateSnapshotMetadata(ctx, key, buildSnapshotMetaData(targets)); err != nil {
-					klog.Fatalf("unable to update metadata of snapshot %q: %s", key, err)
-				}
-			}
-
-			s.roSnapshotTargetsMap[key] = targets
-		} else {
+		if len(targets) == 0 {
 			klog.Infof("snapshot %q doesn't have any mounts. delete!", key)
 			if err := s.runtime.DestroySnapshot(ctx, key); err != nil {
-				klog.Fatalf("unable to destroy snapshot %q: %s", key, err)
+				klog.Errorf("unable to destroy snapshot %q. retry later: %s", key, err)
+				s.repairs[key] = struct{}{}
 			}
+
+			continue
+		}
+
+		s.roSnapshotTargetsMap[key] = targets
+		if len(targets) != numTargetsLoaded {
+			klog.Infof("some targets of snapshot %q changed, update metadata", key)
+			if err := s.runtime.UpdateSnapshotMetadata(ctx, key, buildSnapshotMetaData(targets)); err != nil {
+				klog.Errorf("unable to update metadata of snapshot %q. retry later: %s", key, err)
+				s.repairs[key] = struct{}{}
+			}
+		}
+	}
+}
+
+// loadRWSnapshot loads the read-write snapshot if its target is mounted, or destroys it since the publish creating it
+// didn't complete.
+func (s *SnapshotMounter) loadRWSnapshot(
+	ctx context.Context, key SnapshotKey, targets map[MountTarget]struct{}, mounted map[MountTarget]struct{},
+) {
+	for target := range targets {
+		if _, found := mounted[target]; found {
+			s.targetRwSnapshotMap[target] = key
+			klog.Infof("rw snapshot %q mounted to %s", key, target)
+			return
+		}
+	}
+
+	klog.Infof("rw snapshot %q isn't mounted. delete!", key)
+	if err := s.runtime.DestroySnapshot(ctx, key); err != nil {
+		klog.Errorf("unable to destroy rw snapshot %q: %s", key, err)
+	}
+}
+
+// repair syncs metadata of snapshots failed to be updated with the cache, or destroys them if they are not
+// referred any more. Each snapshot is repaired under its lock, so that volumes are published meanwhile.
+func (s *SnapshotMounter) repair() {
+	s.guard.Lock()
+	repairs := make([]SnapshotKey, 0, len(s.repairs))
+	for key := range s.repairs {
+		repairs = append(repairs, key)
+	}
+	s.guard.Unlock()
+	if len(repairs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), repairInterval)
+	defer cancel()
+
+	for _, key := range repairs {
+		s.repairSnapshot(ctx, key)
+	}
+
+	if err := s.saveState(); err != nil {
+		klog.Errorf("unable to save repaired snapshots: %s", err)
+	}
+}
+
+func (s *SnapshotMounter) repairSnapshot(ctx context.Context, key SnapshotKey) {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	_, pending := s.repairs[key]
+	targets := copyTargets(s.roSnapshotTargetsMap[key])
+	s.guard.Unlock()
+	if !pending {
+		// Synced by a publish meanwhile.
+		return
+	}
+
+	var err error
+	if len(targets) > 0 {
+		if s.state != nil {
+			// Targets in metadata are not used any more.
+			s.repaired(key)
+			return
+		}
+
+		klog.Infof("repair metadata of snapshot %q", key)
+		err = s.runtime.UpdateSnapshotMetadata(ctx, key, buildSnapshotMetaData(targets))
+	} else {
+		klog.Infof("destroy snapshot %q which isn't referred any more", key)
+		err = s.runtime.DestroySnapshot(ctx, key)
+	}
+
+	if err != nil {
+		klog.Errorf("unable to repair snapshot %q. retry later: %s", key, err)
+		return
+	}
+
+	s.repaired(key)
+}
+
+// repairLater queues the snapshot for repair.
+func (s *SnapshotMounter) repairLater(key SnapshotKey) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	s.repairs[key] = struct{}{}
+}
+
+// repaired removes the snapshot from the repair queue.
+func (s *SnapshotMounter) repaired(key SnapshotKey) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	delete(s.repairs, key)
+}
+
+// snapshotLock serializes references to a snapshot. It is removed once no one waits for it.
+type snapshotLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lockSnapshot locks the snapshot until the returned function is called, so that references to different snapshots
+// are updated in parallel.
+func (s *SnapshotMounter) lockSnapshot(key SnapshotKey) (unlock func()) {
+	s.guard.Lock()
+	l := s.snapshotLocks[key]
+	if l == nil {
+		l = &snapshotLock{}
+		s.snapshotLocks[key] = l
+	}
+
+	l.waiters++
+	s.guard.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.guard.Lock()
+		defer s.guard.Unlock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(s.snapshotLocks, key)
 		}
 	}
 }
 
 func (s *SnapshotMounter) refROSnapshot(
-	ctx context.Context, target MountTarget, imageID string, key SnapshotKey, metadata SnapshotMetadata,
+	ctx context.Context, volumeId string, target MountTarget, imageID string, key SnapshotKey,
+	metadata SnapshotMetadata,
 ) (err error) {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
 	s.guard.Lock()
-	defer s.guard.Unlock()
+	if mounted := s.targetRoSnapshotMap[target]; mounted != "" {
+		s.guard.Unlock()
+		return fmt.Errorf("target %q has already been mounted to snapshot %q", target, mounted)
+	}
 
-	if s.targetRoSnapshotMap[target] != "" {
-		klog.Fatalf("target %q has already been mounted to snapshot %q", target, s.targetRoSnapshotMap[target])
+	existing := copyTargets(s.roSnapshotTargetsMap[key])
+	if s.state != nil {
+		// References are saved before the snapshot is created, so that it is destroyed if the driver crashes.
+		s.addROTarget(volumeId, target, key, CRIImageIDFrom(ctx))
+		s.placeSnapshotLocked(key, placeOf(ctx))
 	}
+	s.guard.Unlock()
+
+	if s.state != nil {
+		if err = s.saveState(); err == nil && len(existing) == 0 {
+			klog.Infof("create snapshot %q of image %q and refer it", key, imageID)
+			err = s.runtime.PrepareReadOnlySnapshot(ctx, imageID, key, createSnapshotMetaDataWithoutTargets(false))
+		}
+
+		if err != nil {
+			s.guard.Lock()
+			s.removeROTarget(target)
+			s.guard.Unlock()
+			if saveErr := s.saveState(); saveErr != nil {
+				klog.Errorf("unable to save references of snapshot %q: %s", key, saveErr)
+			}
 
-	if len(s.roSnapshotTargetsMap[key]) > 0 {
-		klog.Infof("snapshot %q has already been used by other volumes. update its metadata to refer", key)
-		metadata.CopyTargets(s.roSnapshotTargetsMap[key])
-		if err := s.runtime.UpdateSnapshotMetadata(ctx, key, metadata); err != nil {
 			return err
 		}
 	} else {
-		klog.Infof("create snapshot %q of image %q and refer it", key, imageID)
-		if err := s.runtime.PrepareReadOnlySnapshot(ctx, imageID, key, metadata); err != nil {
+		if len(existing) > 0 {
+			klog.Infof("snapshot %q has already been used by other volumes. update its metadata to refer", key)
+			if err = metadata.CopyTargets(existing); err == nil {
+				err = s.runtime.UpdateSnapshotMetadata(ctx, key, metadata)
+			}
+		} else {
+			klog.Infof("create snapshot %q of image %q and refer it", key, imageID)
+			err = s.runtime.PrepareReadOnlySnapshot(ctx, imageID, key, metadata)
+		}
+
+		if err != nil {
 			return err
 		}
-		s.roSnapshotTargetsMap[key] = map[MountTarget]struct{}{}
+
+		s.guard.Lock()
+		s.addROTarget(volumeId, target, key, CRIImageIDFrom(ctx))
+		s.guard.Unlock()
+	}
+
+	// The snapshot is in sync with the cache now.
+	s.repaired(key)
+	klog.Infof("snapshot %q is shared by %d volumes", key, len(existing)+1)
+	return nil
+}
+
+// addROTarget adds the target to the cache of read-only snapshots. criImageID is empty if mounts of the image are not
+// counted.
+func (s *SnapshotMounter) addROTarget(volumeId string, target MountTarget, key SnapshotKey, criImageID string) {
+	if s.roSnapshotTargetsMap[key] == nil {
+		s.roSnapshotTargetsMap[key] = make(map[MountTarget]struct{})
 	}
 
 	s.roSnapshotTargetsMap[key][target] = struct{}{}
 	s.targetRoSnapshotMap[target] = key
-	klog.Infof("snapshot %q is shared by %d volumes", key, len(s.roSnapshotTargetsMap[key]))
-	return nil
+	s.targetVolumeMap[target] = volumeId
+	s.trackImageLocked(target, criImageID)
+}
+
+// snapshotPlace is the namespace and the snapshotter of a snapshot. Empty fields are the defaults of the runtime.
+type snapshotPlace struct {
+	namespace   string
+	snapshotter string
+}
+
+// placeOf returns the namespace and the snapshotter in the context.
+func placeOf(ctx context.Context) snapshotPlace {
+	return snapshotPlace{namespace: NamespaceFrom(ctx), snapshotter: SnapshotterFrom(ctx)}
+}
+
+// withPlace adds the namespace and the snapshotter to the context.
+func withPlace(ctx context.Context, place snapshotPlace) context.Context {
+	if place.namespace != "" {
+		ctx = WithNamespace(ctx, place.namespace)
+	}
+
+	if place.snapshotter != "" {
+		ctx = WithSnapshotter(ctx, place.snapshotter)
+	}
+
+	return ctx
+}
+
+// placeSnapshotLocked records the namespace and the snapshotter of the snapshot to be saved in the state file.
+func (s *SnapshotMounter) placeSnapshotLocked(key SnapshotKey, place snapshotPlace) {
+	if s.state == nil || place == (snapshotPlace{}) {
+		return
+	}
+
+	s.snapshotPlaces[key] = place
 }
 
+// trackImageLocked records the CRI ID of the image mounted to the target.
+func (s *SnapshotMounter) trackImageLocked(target MountTarget, criImageID string) {
+	if criImageID == "" {
+		delete(s.targetImageMap, target)
+		return
+	}
+
+	s.targetImageMap[target] = criImageID
+}
+
+// removeROTarget removes the target from the cache of read-only snapshots, and returns targets still referring to
+// the snapshot.
+func (s *SnapshotMounter) removeROTarget(target MountTarget) map[MountTarget]struct{} {
+	key := s.targetRoSnapshotMap[target]
+	delete(s.targetRoSnapshotMap, target)
+	delete(s.targetVolumeMap, target)
+	delete(s.targetImageMap, target)
+	targets := s.roSnapshotTargetsMap[key]
+	delete(targets, target)
+	if len(targets) == 0 {
+		delete(s.roSnapshotTargetsMap, key)
+	}
+
+	return targets
+}
+
+// unrefROSnapshot drops the reference of the target to its read-only snapshot, and destroys the snapshot if no other
+// targets refer to it. The cache is always updated, while snapshots failed to be updated are repaired later.
 func (s *SnapshotMounter) unrefROSnapshot(ctx context.Context, target MountTarget) (found bool) {
 	s.guard.Lock()
-	defer s.guard.Unlock()
-
 	key := s.targetRoSnapshotMap[target]
+	s.guard.Unlock()
 	if key == "" {
 		klog.Infof("target %q is not read-only", target)
 		return false
 	}
 
-	targets := s.roSnapshotTargetsMap[key]
-	if len(targets) > 1 {
-		delete(targets, target)
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	if s.targetRoSnapshotMap[target] != key {
+		// Unreferenced meanwhile.
+		s.guard.Unlock()
+		return true
+	}
+
+	targets := copyTargets(s.removeROTarget(target))
+	s.guard.Unlock()
+
+	defer func() {
+		if err := s.saveState(); err != nil {
+			klog.Errorf("unable to save references of snapshot %q: %s", key, err)
+		}
+	}()
+
+	if len(targets) > 0 {
+		if s.state != nil {
+			return true
+		}
+
 		klog.Infof("snapshot %q is also used by other volumes. update its metadata", key)
 		if err := s.runtime.UpdateSnapshotMetadata(ctx, key, buildSnapshotMetaData(targets)); err != nil {
-			klog.Fatalf("unable to update snapshot %q to unref it: %s. We will crash. The snapshot will be "+
-				"updated when restarting", key, err)
+			klog.Errorf("unable to update snapshot %q to unref it. retry later: %s", key, err)
+			s.repairLater(key)
 		}
-		delete(s.targetRoSnapshotMap, target)
-		return true
-	}
 
-	if len(targets) == 0 {
-		klog.Fatalf("refcount of snapshot %q is 0", key)
+		return true
 	}
 
 	klog.Infof("snapshot %q isn't used by other volumes. delete it", key)
 	if err := s.runtime.DestroySnapshot(ctx, key); err != nil {
-		klog.Fatalf("unable to destroy snapshot %q: %s. We will crash. Dangling snapshots will be destroyed "+
-			"when restarting", key, err)
+		klog.Errorf("unable to destroy snapshot %q. retry later: %s", key, err)
+		s.repairLater(key)
 	}
 
-	delete(s.roSnapshotTargetsMap, key)
-	delete(s.targetRoSnapshotMap, target)
 	return true
 }
 
+// trackRWSnapshot records the read-write snapshot of the volume mounted to the target.
+func (s *SnapshotMounter) trackRWSnapshot(
+	ctx context.Context, volumeId string, target MountTarget, key SnapshotKey,
+) error {
+	s.guard.Lock()
+	s.targetRwSnapshotMap[target] = key
+	s.targetVolumeMap[target] = volumeId
+	s.trackImageLocked(target, CRIImageIDFrom(ctx))
+	s.placeSnapshotLocked(key, placeOf(ctx))
+	s.guard.Unlock()
+
+	if err := s.saveState(); err != nil {
+		s.untrackRWSnapshot(target)
+		return err
+	}
+
+	return nil
+}
+
+// prepareRWSnapshot records the read-write snapshot of the volume, then creates it. The snapshot is locked
+// meanwhile, so that the reconciler doesn't take it as leaked.
+func (s *SnapshotMounter) prepareRWSnapshot(
+	ctx context.Context, volumeId string, target MountTarget, imageID string, key SnapshotKey,
+) error {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	if err := s.trackRWSnapshot(ctx, volumeId, target, key); err != nil {
+		return err
+	}
+
+	metadata := createSnapshotMetaDataWithoutTargets(true)
+	if s.state == nil {
+		metadata = createRWSnapshotMetaData(target)
+	}
+
+	if err := s.runtime.PrepareRWSnapshot(ctx, imageID, key, metadata); err != nil {
+		s.untrackRWSnapshot(target)
+		return err
+	}
+
+	return nil
+}
+
+// untrackRWSnapshot drops the record of the read-write snapshot mounted to the target.
+func (s *SnapshotMounter) untrackRWSnapshot(target MountTarget) {
+	s.guard.Lock()
+	delete(s.targetRwSnapshotMap, target)
+	delete(s.targetVolumeMap, target)
+	delete(s.targetImageMap, target)
+	s.guard.Unlock()
+
+	if err := s.saveState(); err != nil {
+		klog.Errorf("unable to save references of snapshots: %s", err)
+	}
+}
+
+// destroyRWSnapshot drops the record of the read-write snapshot mounted to the target, and destroys the snapshot.
+// Snapshots failed to be destroyed are repaired later.
+func (s *SnapshotMounter) destroyRWSnapshot(ctx context.Context, target MountTarget, key SnapshotKey) error {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	delete(s.targetRwSnapshotMap, target)
+	delete(s.targetVolumeMap, target)
+	delete(s.targetImageMap, target)
+	s.guard.Unlock()
+
+	err := s.runtime.DestroySnapshot(ctx, key)
+	if err != nil {
+		klog.Errorf("unable to destroy rw snapshot %q. retry later: %s", key, err)
+		s.repairLater(key)
+	}
+
+	if saveErr := s.saveState(); saveErr != nil {
+		klog.Errorf("unable to save references of snapshot %q: %s", key, saveErr)
+	}
+
+	return err
+}
+
+// claimTarget marks the target busy until the returned function is called, so that the reconciler doesn't fix
+// targets being published or unpublished, and the other way around. It returns nil if the target is already busy.
+func (s *SnapshotMounter) claimTarget(target MountTarget) (release func()) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if _, busy := s.busyTargets[target]; busy {
+		return nil
+	}
+
+	s.busyTargets[target] = struct{}{}
+	return func() {
+		s.guard.Lock()
+		defer s.guard.Unlock()
+		delete(s.busyTargets, target)
+	}
+}
+
+// errTargetBusy is returned if the target is being fixed by the reconciler. The kubelet retries later.
+func errTargetBusy(target MountTarget) error {
+	return fmt.Errorf("target %q is busy. retry later", target)
+}
+
 func (s *SnapshotMounter) Mount(
 	ctx context.Context, volumeId string, target MountTarget, image reference.Named, ro bool,
 ) (err error) {
 	var key SnapshotKey
-	imageID := s.runtime.GetImageIDOrDie(ctx, image)
+	imageID, err := s.runtime.GetImageID(ctx, image)
+	if err != nil {
+		return err
+	}
+
+	// Images may be unpacked above, which takes long. Only operations on snapshots block the reconciler.
+	release := s.claimTarget(target)
+	if release == nil {
+		return errTargetBusy(target)
+	}
+
+	defer release()
+
 	if ro {
 		// Use the image ID as the key of the read-only snapshot
 		if imageID == "" {
-			klog.Fatalf("invalid image id of image %q", image)
+			return fmt.Errorf("invalid image id of image %q", image)
 		}
 
-		key = GenSnapshotKey(imageID)
+		key = genROSnapshotKey(NamespaceFrom(ctx), SnapshotterFrom(ctx), imageID)
 		klog.Infof("refer read-only snapshot of image %q with key %q", image, key)
-		if err := s.refROSnapshot(ctx, target, imageID, key, createSnapshotMetaData(target)); err != nil {
+		if err := s.refROSnapshot(ctx, volumeId, target, imageID, key, createSnapshotMetaData(target)); err != nil {
 			return err
 		}
 
@@ -184,7 +666,7 @@ func (s *SnapshotMounter) Mount(
 			if err != nil {
 				klog.Infof("unref read-only snapshot because of error %s", err)
 				if !s.unrefROSnapshot(ctx, target) {
-					klog.Fatalf("target %q not found in the snapshot cache", target)
+					klog.Errorf("target %q not found in the snapshot cache", target)
 				}
 			}
 		}()
@@ -192,28 +674,48 @@ func (s *SnapshotMounter) Mount(
 		// For read-write volumes, they must be ephemeral volumes, that which volumeIDs are unique strings.
 		key = GenSnapshotKey(volumeId)
 		klog.Infof("create read-write snapshot of image %q with key %q", image, key)
-		if err := s.runtime.PrepareRWSnapshot(ctx, imageID, key, nil); err != nil {
+		if err := s.prepareRWSnapshot(ctx, volumeId, target, imageID, key); err != nil {
 			return err
 		}
 
 		defer func() {
 			if err != nil {
 				klog.Infof("unref read-write snapshot because of error %s", err)
-				s.runtime.DestroySnapshot(ctx, key)
+				s.destroyRWSnapshot(ctx, target, key)
 			}
 		}()
 	}
 
-	err = s.runtime.Mount(ctx, key, target, ro)
+	if err = s.runtime.Mount(ctx, key, target, ro); err != nil {
+		return err
+	}
+
+	if err = s.runtime.PinImage(ctx, image, target); err != nil {
+		klog.Errorf("unable to pin image %q: %s", image, err)
+		if unmountErr := s.runtime.Unmount(ctx, target); unmountErr != nil {
+			klog.Errorf("unable to unmount %q: %s", target, unmountErr)
+		}
+	}
+
 	return err
 }
 
 func (s *SnapshotMounter) Unmount(ctx context.Context, volumeId string, target MountTarget) error {
 	klog.Infof("unmount volume %q at %q", volumeId, target)
+	release := s.claimTarget(target)
+	if release == nil {
+		return errTargetBusy(target)
+	}
+
+	defer release()
 	if err := s.runtime.Unmount(ctx, target); err != nil {
 		return err
 	}
 
+	if err := s.runtime.UnpinImage(ctx, target); err != nil {
+		klog.Errorf("unable to unpin the image mounted to %q: %s", target, err)
+	}
+
 	klog.Infof("try to unref read-only snapshot")
 	// Try to unref a read-only snapshot.
 	if s.unrefROSnapshot(ctx, target) {
@@ -221,14 +723,54 @@ func (s *SnapshotMounter) Unmount(ctx context.Context, volumeId string, target M
 	}
 
 	klog.Infof("delete the read-write snapshot")
-	// Must be a read-write snapshot
-	return s.runtime.DestroySnapshot(ctx, GenSnapshotKey(volumeId))
+	// Must be a read-write snapshot. Snapshots failed to be destroyed are repaired later.
+	s.destroyRWSnapshot(ctx, target, GenSnapshotKey(volumeId))
+	return nil
+}
+
+// copyTargets returns a copy of targets, so that they can be used without the guard.
+func copyTargets(targets map[MountTarget]struct{}) map[MountTarget]struct{} {
+	copied := make(map[MountTarget]struct{}, len(targets))
+	for target := range targets {
+		copied[target] = struct{}{}
+	}
+
+	return copied
 }
 
 func (s *SnapshotMounter) ImageExists(ctx context.Context, image reference.Named) bool {
 	return s.runtime.ImageExists(ctx, image)
 }
 
+// MountedImages returns the number of targets each image is mounted to, keyed by IDs set via WithCRIImageID.
+// Images mounted without IDs are not counted.
+func (s *SnapshotMounter) MountedImages() map[string]int {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	images := make(map[string]int, len(s.targetImageMap))
+	for _, imageID := range s.targetImageMap {
+		images[imageID]++
+	}
+
+	return images
+}
+
 func GenSnapshotKey(parent string) SnapshotKey {
 	return SnapshotKey(fmt.Sprintf("container-image.csi.k8s.io-%s", parent))
 }
+
+// genROSnapshotKey returns the key of the read-only snapshot of the image in the namespace via the snapshotter.
+// Images of different namespaces or snapshotters never share snapshots. Keys of defaults are kept as is.
+func genROSnapshotKey(namespace, snapshotter, imageID string) SnapshotKey {
+	parent := imageID
+	if len(snapshotter) > 0 {
+		parent = snapshotter + "-" + parent
+	}
+
+	if len(namespace) > 0 {
+		parent = namespace + "/" + parent
+	}
+
+	return GenSnapshotKey(parent)
+}
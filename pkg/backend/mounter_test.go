@@ -0,0 +1,285 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errRuntime = errors.New("runtime error")
+
+// fakeRuntime keeps snapshots in memory. Updates and removals of snapshots fail if broken is set.
+type fakeRuntime struct {
+	mu sync.Mutex
+	// latency is the time each call to snapshots or mounts takes.
+	latency time.Duration
+
+	images    map[string]string
+	snapshots map[SnapshotKey]map[MountTarget]struct{}
+	rw        map[SnapshotKey]bool
+	// malformed snapshots are listed with targets of an unknown type, until their metadata are updated.
+	malformed map[SnapshotKey]bool
+	broken    bool
+	// updates is the number of metadata updates.
+	updates int
+	// located are where snapshots are known to be, like the index of containerd, and destroyed are where snapshots
+	// were destroyed.
+	located   map[SnapshotKey]snapshotPlace
+	destroyed map[SnapshotKey]snapshotPlace
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{
+		images:    map[string]string{"docker.io/library/foo:v1": "sha256:foo"},
+		snapshots: make(map[SnapshotKey]map[MountTarget]struct{}),
+		rw:        make(map[SnapshotKey]bool),
+		malformed: make(map[SnapshotKey]bool),
+		located:   make(map[SnapshotKey]snapshotPlace),
+		destroyed: make(map[SnapshotKey]snapshotPlace),
+	}
+}
+
+// call simulates the latency of a call to the runtime, then locks it.
+func (r *fakeRuntime) call() (unlock func()) {
+	time.Sleep(r.latency)
+	r.mu.Lock()
+	return r.mu.Unlock
+}
+
+func (r *fakeRuntime) Mount(context.Context, SnapshotKey, MountTarget, bool) error {
+	defer r.call()()
+	return nil
+}
+
+func (r *fakeRuntime) Unmount(context.Context, MountTarget) error {
+	defer r.call()()
+	return nil
+}
+
+func (r *fakeRuntime) ImageExists(_ context.Context, image reference.Named) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, found := r.images[image.String()]
+	return found
+}
+
+func (r *fakeRuntime) GetImageID(_ context.Context, image reference.Named) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, found := r.images[image.String()]
+	if !found {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, image)
+	}
+
+	return id, nil
+}
+
+func (r *fakeRuntime) PrepareReadOnlySnapshot(
+	ctx context.Context, _ string, key SnapshotKey, metadata SnapshotMetadata,
+) error {
+	defer r.call()()
+	targets, err := targetsOf(metadata)
+	if err != nil {
+		return err
+	}
+
+	r.snapshots[key] = targets
+	r.located[key] = placeOf(ctx)
+	return nil
+}
+
+func (r *fakeRuntime) PrepareRWSnapshot(ctx context.Context, _ string, key SnapshotKey, metadata SnapshotMetadata) error {
+	defer r.call()()
+	targets, err := targetsOf(metadata)
+	if err != nil {
+		return err
+	}
+
+	r.snapshots[key] = targets
+	r.located[key] = placeOf(ctx)
+	r.rw[key] = metadata.IsReadWrite()
+	return nil
+}
+
+func (r *fakeRuntime) UpdateSnapshotMetadata(_ context.Context, key SnapshotKey, metadata SnapshotMetadata) error {
+	defer r.call()()
+	if r.broken {
+		return errRuntime
+	}
+
+	targets, err := targetsOf(metadata)
+	if err != nil {
+		return err
+	}
+
+	r.updates++
+	r.snapshots[key] = targets
+	r.rw[key] = metadata.IsReadWrite()
+	delete(r.malformed, key)
+	return nil
+}
+
+// targetsOf returns a copy of targets in metadata, which can be nil.
+func targetsOf(metadata SnapshotMetadata) (map[MountTarget]struct{}, error) {
+	targets := make(map[MountTarget]struct{})
+	if metadata == nil {
+		return targets, nil
+	}
+
+	metaTargets, err := metadata.GetTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	for target := range metaTargets {
+		targets[target] = struct{}{}
+	}
+
+	return targets, nil
+}
+
+func (r *fakeRuntime) DestroySnapshot(_ context.Context, key SnapshotKey) error {
+	defer r.call()()
+	if r.broken {
+		return errRuntime
+	}
+
+	delete(r.snapshots, key)
+	delete(r.rw, key)
+	r.destroyed[key] = r.located[key]
+	delete(r.located, key)
+	return nil
+}
+
+func (r *fakeRuntime) LocateSnapshot(ctx context.Context, key SnapshotKey) {
+	defer r.call()()
+	r.located[key] = placeOf(ctx)
+}
+
+func (r *fakeRuntime) PinImage(context.Context, reference.Named, MountTarget) error { return nil }
+func (r *fakeRuntime) UnpinImage(context.Context, MountTarget) error                { return nil }
+
+func (r *fakeRuntime) ListSnapshots(context.Context) (ss []SnapshotMetadata, err error) {
+	defer r.call()()
+	for key, targets := range r.snapshots {
+		metadata := buildSnapshotMetaData(targets)
+		metadata.SetSnapshotKey(string(key))
+		if r.rw[key] {
+			metadata.SetReadWrite()
+		}
+
+		if r.malformed[key] {
+			metadata[MetaDataKeyTargets] = "malformed"
+		}
+
+		ss = append(ss, metadata)
+	}
+
+	return
+}
+
+func TestRepairSnapshots(t *testing.T) {
+	ctx := context.Background()
+	runtime := newFakeRuntime()
+	m := NewMounter(runtime)
+
+	image, err := reference.ParseDockerRef("foo:v1")
+	require.NoError(t, err)
+	require.NoError(t, m.Mount(ctx, "a", "/a", image, true))
+	require.NoError(t, m.Mount(ctx, "b", "/b", image, true))
+	key := GenSnapshotKey("sha256:foo")
+	assert.Len(t, runtime.snapshots[key], 2)
+
+	runtime.broken = true
+	require.NoError(t, m.Unmount(ctx, "a", "/a"), "failed updates are repaired later")
+	assert.Len(t, runtime.snapshots[key], 2)
+	assert.Contains(t, m.repairs, key)
+
+	m.repair()
+	assert.Contains(t, m.repairs, key, "the runtime is still broken")
+
+	runtime.broken = false
+	m.repair()
+	assert.Empty(t, m.repairs)
+	assert.Equal(t, map[MountTarget]struct{}{"/b": {}}, runtime.snapshots[key])
+
+	runtime.broken = true
+	require.NoError(t, m.Unmount(ctx, "b", "/b"))
+	assert.Empty(t, m.targetRoSnapshotMap)
+	assert.Empty(t, m.roSnapshotTargetsMap)
+	assert.Contains(t, runtime.snapshots, key)
+
+	runtime.broken = false
+	m.repair()
+	assert.Empty(t, m.repairs)
+	assert.NotContains(t, runtime.snapshots, key, "snapshots not referred any more are destroyed")
+
+	missing, err := reference.ParseDockerRef("bar:v1")
+	require.NoError(t, err)
+	assert.ErrorIs(t, m.Mount(ctx, "c", "/c", missing, true), ErrImageNotFound)
+	assert.Empty(t, m.targetRoSnapshotMap)
+}
+
+// BenchmarkMount publishes and unpublishes read-only volumes concurrently, with each call to the runtime taking a
+// millisecond. Volumes of different images are published in parallel, while those of the same image wait for each
+// other. With the state file, each publish and unpublish also saves references to disk.
+func BenchmarkMount(b *testing.B) {
+	for _, numImages := range []int{1, 64} {
+		for _, stateFile := range []bool{false, true} {
+			b.Run(fmt.Sprintf("images=%d/stateFile=%t", numImages, stateFile), func(b *testing.B) {
+				benchmarkMount(b, numImages, stateFile)
+			})
+		}
+	}
+}
+
+func benchmarkMount(b *testing.B, numImages int, stateFile bool) {
+	ctx := context.Background()
+	runtime := newFakeRuntime()
+	runtime.latency = time.Millisecond
+	images := make([]reference.Named, numImages)
+	for i := range images {
+		image, err := reference.ParseDockerRef(fmt.Sprintf("foo-%d:v1", i))
+		require.NoError(b, err)
+		runtime.images[image.String()] = fmt.Sprintf("sha256:foo-%d", i)
+		images[i] = image
+	}
+
+	var opts []MounterOption
+	if stateFile {
+		opts = append(opts, WithStateFile(filepath.Join(b.TempDir(), "mounts.json")))
+	}
+
+	m := NewMounter(runtime, opts...)
+	var n atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := n.Add(1)
+			volumeId := strconv.FormatInt(i, 10)
+			target := MountTarget("/" + volumeId)
+			if err := m.Mount(ctx, volumeId, target, images[i%int64(numImages)], true); err != nil {
+				b.Error(err)
+				return
+			}
+
+			if err := m.Unmount(ctx, volumeId, target); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "publishes/s")
+}
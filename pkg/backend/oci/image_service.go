@@ -0,0 +1,115 @@
+package oci
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// imageService serves images of the store via the CRI image service API, in place of a container runtime.
+// Images are placed on nodes by other means, so they are neither pulled nor removed. Pulls succeed if images exist.
+type imageService struct {
+	store *Store
+}
+
+// NewImageService returns an image service of images in the store.
+func NewImageService(store *Store) cri.ImageServiceClient {
+	return &imageService{store: store}
+}
+
+func toCRIImage(img *image) *cri.Image {
+	criImage := &cri.Image{Id: img.id}
+	for _, name := range img.names {
+		if strings.Contains(name, "@") {
+			criImage.RepoDigests = append(criImage.RepoDigests, name)
+		} else {
+			criImage.RepoTags = append(criImage.RepoTags, name)
+		}
+	}
+
+	for _, l := range img.layers {
+		criImage.Size += uint64(l.size)
+	}
+
+	return criImage
+}
+
+func (s *imageService) ListImages(
+	_ context.Context, req *cri.ListImagesRequest, _ ...grpc.CallOption,
+) (*cri.ListImagesResponse, error) {
+	if filter := req.GetFilter().GetImage().GetImage(); len(filter) > 0 {
+		resp := &cri.ListImagesResponse{}
+		if img := s.store.image(filter); img != nil {
+			resp.Images = append(resp.Images, toCRIImage(img))
+		}
+
+		return resp, nil
+	}
+
+	if err := s.store.scan(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// The same image may be found in several sources under different names.
+	resp := &cri.ListImagesResponse{}
+	byID := make(map[string]*cri.Image)
+	for _, img := range s.store.list() {
+		criImage := toCRIImage(img)
+		if found := byID[img.id]; found != nil {
+			found.RepoTags = append(found.RepoTags, criImage.RepoTags...)
+			found.RepoDigests = append(found.RepoDigests, criImage.RepoDigests...)
+			continue
+		}
+
+		byID[img.id] = criImage
+		resp.Images = append(resp.Images, criImage)
+	}
+
+	return resp, nil
+}
+
+func (s *imageService) StreamImages(
+	context.Context, *cri.StreamImagesRequest, ...grpc.CallOption,
+) (grpc.ServerStreamingClient[cri.StreamImagesResponse], error) {
+	return nil, status.Error(codes.Unimplemented, "images can't be streamed")
+}
+
+func (s *imageService) ImageStatus(
+	_ context.Context, req *cri.ImageStatusRequest, _ ...grpc.CallOption,
+) (*cri.ImageStatusResponse, error) {
+	img := s.store.image(req.GetImage().GetImage())
+	if img == nil {
+		return &cri.ImageStatusResponse{}, nil
+	}
+
+	return &cri.ImageStatusResponse{Image: toCRIImage(img)}, nil
+}
+
+func (s *imageService) PullImage(
+	_ context.Context, req *cri.PullImageRequest, _ ...grpc.CallOption,
+) (*cri.PullImageResponse, error) {
+	image := req.GetImage().GetImage()
+	img := s.store.image(image)
+	if img == nil {
+		return nil, status.Errorf(codes.NotFound, "image %q not found in %q. Images can't be pulled without "+
+			"container runtimes", image, s.store.imageDir)
+	}
+
+	return &cri.PullImageResponse{ImageRef: img.id}, nil
+}
+
+func (s *imageService) RemoveImage(
+	context.Context, *cri.RemoveImageRequest, ...grpc.CallOption,
+) (*cri.RemoveImageResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "images can only be removed from the image directory")
+}
+
+func (s *imageService) ImageFsInfo(
+	context.Context, *cri.ImageFsInfoRequest, ...grpc.CallOption,
+) (*cri.ImageFsInfoResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "image filesystem info is not available")
+}
@@ -0,0 +1,169 @@
+// Package oci mounts images in OCI layout directories and tarballs created by "docker save" without any container
+// runtime. Layers are unpacked to the driver's own store, and assembled via overlayfs.
+package oci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+type snapshotMounter struct {
+	store *Store
+}
+
+func NewMounter(store *Store, opts ...backend.MounterOption) *backend.SnapshotMounter {
+	return backend.NewMounter(&snapshotMounter{store: store}, opts...)
+}
+
+func (s snapshotMounter) Mount(_ context.Context, key backend.SnapshotKey, target backend.MountTarget, ro bool) error {
+	mounts, err := s.store.mounts(string(key), ro)
+	if err != nil {
+		klog.Errorf("unable to retrieve mounts of snapshot %q: %s", key, err)
+		return err
+	}
+
+	if err = mount.All(mounts, string(target)); err != nil {
+		klog.Errorf("unable to mount snapshot %q to %q: %s", key, target, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s snapshotMounter) Unmount(_ context.Context, target backend.MountTarget) error {
+	if err := mount.Unmount(string(target), 0); err != nil {
+		klog.Errorf("unable to unmount %q: %s", target, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s snapshotMounter) ImageExists(_ context.Context, image reference.Named) bool {
+	if s.store.image(image.String()) == nil {
+		klog.Errorf("image %q not found in %q", image, s.store.imageDir)
+		return false
+	}
+
+	return true
+}
+
+func (s snapshotMounter) GetImageID(_ context.Context, image reference.Named) (string, error) {
+	img := s.store.image(image.String())
+	if img == nil {
+		return "", fmt.Errorf("%w: %s in %q", backend.ErrImageNotFound, image, s.store.imageDir)
+	}
+
+	return img.id, nil
+}
+
+func (s snapshotMounter) PrepareReadOnlySnapshot(
+	ctx context.Context, imageID string, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
+) error {
+	return s.prepareSnapshot(ctx, imageID, key, true, metadata)
+}
+
+func (s snapshotMounter) PrepareRWSnapshot(
+	ctx context.Context, imageID string, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
+) error {
+	return s.prepareSnapshot(ctx, imageID, key, false, metadata)
+}
+
+func (s snapshotMounter) prepareSnapshot(
+	ctx context.Context, imageID string, key backend.SnapshotKey, ro bool, metadata backend.SnapshotMetadata,
+) error {
+	var metaString string
+	if metadata != nil {
+		var err error
+		if metaString, err = metadata.Encode(); err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("create snapshot %q for image %q, read-only %t, with metadata %#v", key, imageID, ro, metadata)
+	if err := s.store.prepare(ctx, imageID, string(key), ro, metaString); err != nil {
+		klog.Errorf("unable to create snapshot %q for image %q: %s", key, imageID, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s snapshotMounter) UpdateSnapshotMetadata(
+	_ context.Context, key backend.SnapshotKey, metadata backend.SnapshotMetadata,
+) error {
+	klog.Infof("update metadata of snapshot %q to %#v", key, metadata)
+	metaString, err := metadata.Encode()
+	if err != nil {
+		return err
+	}
+
+	if err = s.store.updateMetadata(string(key), metaString); err != nil {
+		klog.Errorf("unable to update metadata of snapshot %q: %s", key, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s snapshotMounter) DestroySnapshot(_ context.Context, key backend.SnapshotKey) error {
+	klog.Infof("remove snapshot %q", key)
+	if err := s.store.remove(string(key)); err != nil {
+		klog.Errorf("unable to remove snapshot %q: %s", key, err)
+		return err
+	}
+
+	return nil
+}
+
+// LocateSnapshot does nothing since snapshots are all in the store.
+func (s snapshotMounter) LocateSnapshot(context.Context, backend.SnapshotKey) {}
+
+// PinImage does nothing since images on disk are never removed by the driver, and layers are kept as long as
+// snapshots use them.
+func (s snapshotMounter) PinImage(context.Context, reference.Named, backend.MountTarget) error {
+	return nil
+}
+
+// UnpinImage does nothing since images are never pinned.
+func (s snapshotMounter) UnpinImage(context.Context, backend.MountTarget) error {
+	return nil
+}
+
+func (s snapshotMounter) ListSnapshots(context.Context) (ss []backend.SnapshotMetadata, err error) {
+	snapshots, err := s.store.snapshots()
+	if err != nil {
+		klog.Errorf("unable to list snapshots: %s", err)
+		return nil, err
+	}
+
+	klog.Infof("found %d snapshots", len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot.Metadata == "" {
+			continue
+		}
+
+		metadata := make(backend.SnapshotMetadata)
+		if err := metadata.Decode(snapshot.Metadata); err != nil {
+			klog.Warningf("unable to decode the metadata of snapshot %q: %s", snapshot.Key, err)
+			continue
+		}
+
+		targets, err := metadata.GetTargets()
+		if err != nil {
+			klog.Warningf("snapshot %q has malformed metadata %s. skip it: %s", snapshot.Key, snapshot.Metadata, err)
+			continue
+		}
+
+		metadata.SetSnapshotKey(snapshot.Key)
+		ss = append(ss, metadata)
+		klog.Infof("got snapshot %q, read-write %t, with targets %#v", snapshot.Key, metadata.IsReadWrite(), targets)
+	}
+
+	return
+}
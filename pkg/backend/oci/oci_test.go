@@ -0,0 +1,383 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// newLayer returns a tar of the given files. Names ending with "/" are directories.
+func newLayer(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+
+	// Entries are sorted for reproducible digests, and parent directories go first.
+	sort.Strings(names)
+	for _, name := range names {
+		content := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(content))}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+
+		require.NoError(t, w.WriteHeader(hdr))
+		_, err := w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func writeBlob(t *testing.T, layout string, data []byte) digest.Digest {
+	dgst := digest.FromBytes(data)
+	dir := filepath.Join(layout, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dgst.Encoded()), data, 0o644))
+	return dgst
+}
+
+func writeJSONBlob(t *testing.T, layout string, v interface{}) (digest.Digest, int64) {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return writeBlob(t, layout, data), int64(len(data))
+}
+
+var (
+	baseLayer = map[string]string{"a/": "", "a/f": "foo", "a/g": "bar", "b/": "", "b/h": "baz", "c": "qux"}
+	// topLayer removes a/f and everything in b.
+	topLayer = map[string]string{"a/.wh.f": "", "b/.wh..wh..opq": "", "b/i": "new", "c": "quux"}
+)
+
+// newLayout creates an OCI layout of an image with baseLayer and topLayer, tagged tag, and returns the image ID.
+func newLayout(t *testing.T, layout, tag string) string {
+	base := newLayer(t, baseLayer)
+	top := newLayer(t, topLayer)
+	config := specs.Image{RootFS: specs.RootFS{
+		Type:    "layers",
+		DiffIDs: []digest.Digest{digest.FromBytes(base), digest.FromBytes(top)},
+	}}
+
+	configDigest, configSize := writeJSONBlob(t, layout, config)
+	baseBlob := gzipped(t, base)
+	manifest := specs.Manifest{
+		MediaType: specs.MediaTypeImageManifest,
+		Config:    specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Digest: configDigest, Size: configSize},
+		Layers: []specs.Descriptor{
+			{MediaType: specs.MediaTypeImageLayerGzip, Digest: writeBlob(t, layout, baseBlob)},
+			{MediaType: specs.MediaTypeImageLayer, Digest: writeBlob(t, layout, top)},
+		},
+	}
+
+	manifestDigest, manifestSize := writeJSONBlob(t, layout, manifest)
+	platform := platforms.DefaultSpec()
+	index := specs.Index{Manifests: []specs.Descriptor{{
+		MediaType: specs.MediaTypeImageIndex,
+		Digest: writeBlob(t, layout, must(json.Marshal(specs.Index{Manifests: []specs.Descriptor{{
+			MediaType: specs.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize, Platform: &platform,
+		}}}))),
+		Annotations: map[string]string{specs.AnnotationRefName: tag},
+	}}}
+
+	data, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(layout, specs.ImageIndexFile), data, 0o644))
+	return configDigest.String()
+}
+
+func must(data []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+// newDockerArchive creates a tarball like "docker save" of an image with baseLayer, and returns the image ID.
+func newDockerArchive(t *testing.T, path, tag string) string {
+	base := newLayer(t, baseLayer)
+	config := must(json.Marshal(specs.Image{RootFS: specs.RootFS{
+		Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(base)},
+	}}))
+
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	manifest := must(json.Marshal([]dockerManifest{{
+		Config: configName, RepoTags: []string{tag}, Layers: []string{"layer0/layer.tar"},
+	}}))
+
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"layer0/layer.tar", base}, {configName, config}, {"manifest.json", manifest}} {
+		require.NoError(t, w.WriteHeader(&tar.Header{
+			Name: f.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(f.data)),
+		}))
+		_, err := w.Write(f.data)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	return digest.FromBytes(config).String()
+}
+
+func TestImages(t *testing.T) {
+	imageDir := t.TempDir()
+	layout := filepath.Join(imageDir, "test")
+	require.NoError(t, os.Mkdir(layout, 0o755))
+	layoutID := newLayout(t, layout, "v1")
+	archiveID := newDockerArchive(t, filepath.Join(imageDir, "saved.tar"), "foo/bar:v2")
+	require.NoError(t, os.WriteFile(filepath.Join(imageDir, "README"), []byte("not an image"), 0o644))
+
+	store, err := NewStore(imageDir, t.TempDir())
+	require.NoError(t, err)
+
+	// Images in OCI layouts are also named by digests of their manifests.
+	digested := store.image("test:v1").names[0]
+	assert.True(t, strings.HasPrefix(digested, "docker.io/library/test@sha256:"))
+
+	for name, id := range map[string]string{
+		"test:v1":                   layoutID,
+		"docker.io/library/test:v1": layoutID,
+		layoutID:                    layoutID,
+		digested:                    layoutID,
+		"foo/bar:v2":                archiveID,
+		"docker.io/foo/bar:v2":      archiveID,
+	} {
+		img := store.image(name)
+		if assert.NotNil(t, img, name) {
+			assert.Equal(t, id, img.id, name)
+		}
+	}
+
+	assert.Nil(t, store.image("test:v2"))
+	assert.Len(t, store.image(archiveID).layers, 1)
+
+	// Images added later are found on demand.
+	newDockerArchive(t, filepath.Join(imageDir, "later.tar"), "later:v1")
+	if img := store.image("later:v1"); assert.NotNil(t, img) {
+		assert.Equal(t, archiveID, img.id, "the image is the same as the one saved before")
+	}
+
+	svc := NewImageService(store)
+	resp, err := svc.ImageStatus(context.Background(), &cri.ImageStatusRequest{
+		Image: &cri.ImageSpec{Image: "docker.io/foo/bar:v2"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, archiveID, resp.Image.Id)
+	assert.Equal(t, []string{"docker.io/foo/bar:v2"}, resp.Image.RepoTags)
+
+	resp, err = svc.ImageStatus(context.Background(), &cri.ImageStatusRequest{
+		Image: &cri.ImageSpec{Image: "docker.io/foo/bar:v3"},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, resp.Image)
+
+	list, err := svc.ListImages(context.Background(), &cri.ListImagesRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Images, 2)
+	for _, img := range list.Images {
+		if img.Id == archiveID {
+			assert.ElementsMatch(t, []string{"docker.io/foo/bar:v2", "docker.io/library/later:v1"}, img.RepoTags)
+		}
+	}
+
+	pulled, err := svc.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: "test:v1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, layoutID, pulled.ImageRef)
+
+	_, err = svc.PullImage(context.Background(), &cri.PullImageRequest{Image: &cri.ImageSpec{Image: "test:v2"}})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestSnapshots(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("converting whiteouts for overlayfs requires root")
+	}
+
+	ctx := context.Background()
+	imageDir := t.TempDir()
+	layout := filepath.Join(imageDir, "test")
+	require.NoError(t, os.Mkdir(layout, 0o755))
+	imageID := newLayout(t, layout, "v1")
+	archiveID := newDockerArchive(t, filepath.Join(imageDir, "saved.tar"), "foo/bar:v2")
+
+	store, err := NewStore(imageDir, t.TempDir())
+	require.NoError(t, err)
+	m := &snapshotMounter{store: store}
+
+	named, err := reference.ParseDockerRef("test:v1")
+	require.NoError(t, err)
+	assert.True(t, m.ImageExists(ctx, named))
+	id, err := m.GetImageID(ctx, named)
+	require.NoError(t, err)
+	assert.Equal(t, imageID, id)
+
+	missing, err := reference.ParseDockerRef("test:missing")
+	require.NoError(t, err)
+	_, err = m.GetImageID(ctx, missing)
+	assert.ErrorIs(t, err, backend.ErrImageNotFound)
+
+	roKey := backend.GenSnapshotKey(imageID)
+	metadata := backend.SnapshotMetadata{
+		backend.MetaDataKeyTargets: map[backend.MountTarget]struct{}{"/target": {}},
+	}
+	require.NoError(t, m.PrepareReadOnlySnapshot(ctx, imageID, roKey, metadata))
+	assert.Error(t, m.PrepareRWSnapshot(ctx, imageID, roKey, nil), "the key is used by a read-only snapshot")
+
+	ss, err := store.readSnapshot(string(roKey))
+	require.NoError(t, err)
+	require.Len(t, ss.Layers, 2)
+	base, top := store.layerDir(ss.Layers[0]), store.layerDir(ss.Layers[1])
+
+	data, err := os.ReadFile(filepath.Join(base, "a", "f"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(data))
+	data, err = os.ReadFile(filepath.Join(top, "c"))
+	require.NoError(t, err)
+	assert.Equal(t, "quux", string(data))
+
+	// Whiteouts are converted for overlayfs.
+	info, err := os.Lstat(filepath.Join(top, "a", "f"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type())
+	_, err = os.Lstat(filepath.Join(top, "a", ".wh.f"))
+	assert.True(t, os.IsNotExist(err))
+	opaque := make([]byte, 1)
+	_, err = unix.Getxattr(filepath.Join(top, "b"), "trusted.overlay.opaque", opaque)
+	require.NoError(t, err)
+	assert.Equal(t, "y", string(opaque))
+
+	mounts, err := store.mounts(string(roKey), true)
+	require.NoError(t, err)
+	assert.Equal(t, "overlay", mounts[0].Type)
+	assert.Equal(t, []string{"lowerdir=" + top + ":" + base, "ro"}, mounts[0].Options)
+
+	rwKey := backend.GenSnapshotKey("volume")
+	require.NoError(t, m.PrepareRWSnapshot(ctx, imageID, rwKey, nil))
+	mounts, err = store.mounts(string(rwKey), false)
+	require.NoError(t, err)
+	rwDir := store.snapshotDir(string(rwKey))
+	assert.Equal(t, []string{
+		"lowerdir=" + top + ":" + base,
+		"upperdir=" + filepath.Join(rwDir, "upper"),
+		"workdir=" + filepath.Join(rwDir, "work"),
+	}, mounts[0].Options)
+
+	// Read-only snapshots of single layers are bind mounted.
+	archiveKey := backend.GenSnapshotKey(archiveID)
+	require.NoError(t, m.PrepareReadOnlySnapshot(ctx, archiveID, archiveKey, metadata))
+	mounts, err = store.mounts(string(archiveKey), true)
+	require.NoError(t, err)
+	assert.Equal(t, "bind", mounts[0].Type)
+	assert.Equal(t, base, mounts[0].Source, "layers are shared")
+
+	// Only read-only snapshots with metadata are listed for recovery.
+	metadata[backend.MetaDataKeyTargets] = map[backend.MountTarget]struct{}{"/target": {}, "/other": {}}
+	require.NoError(t, m.UpdateSnapshotMetadata(ctx, roKey, metadata))
+	listed, err := m.ListSnapshots(ctx)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	for _, l := range listed {
+		key, err := l.GetSnapshotKey()
+		require.NoError(t, err)
+		if key == roKey {
+			targets, err := l.GetTargets()
+			require.NoError(t, err)
+			assert.Len(t, targets, 2)
+		} else {
+			assert.Equal(t, archiveKey, key)
+		}
+	}
+
+	// Snapshots with malformed metadata are skipped.
+	require.NoError(t, store.updateMetadata(string(archiveKey), fmt.Sprintf(`{"%d":"/target"}`,
+		backend.MetaDataKeyTargets)))
+	listed, err = m.ListSnapshots(ctx)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+
+	// Layers of images on disk are kept.
+	require.NoError(t, m.DestroySnapshot(ctx, rwKey))
+	require.NoError(t, m.DestroySnapshot(ctx, roKey))
+	assert.NoError(t, m.DestroySnapshot(ctx, roKey), "destroying missing snapshots should succeed")
+	assert.DirExists(t, top)
+
+	// Layers are removed once neither snapshots nor images use them.
+	require.NoError(t, os.RemoveAll(layout))
+	require.NoError(t, store.scan())
+	require.NoError(t, m.DestroySnapshot(ctx, archiveKey))
+	assert.NoDirExists(t, top)
+	assert.DirExists(t, base, "the base layer is used by the image in the tarball")
+}
+
+func TestCrashBeforeSnapshotCreated(t *testing.T) {
+	store, err := NewStore(t.TempDir(), t.TempDir())
+	require.NoError(t, err)
+
+	// The driver crashed after saving the reference of the snapshot and before creating it.
+	path := filepath.Join(t.TempDir(), "mounts.json")
+	key := backend.GenSnapshotKey("sha256:foo")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(
+		`{"snapshots":[{"key":%q,"mounts":[{"volumeID":"a","target":"/not/mounted"}]}]}`, key)), 0o600))
+
+	backend.NewMounter(&snapshotMounter{store: store}, backend.WithStateFile(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"snapshots":[]}`, string(data), "the missing snapshot should not be kept for repair")
+}
+
+func TestUnpackDigestMismatch(t *testing.T) {
+	imageDir := t.TempDir()
+	layout := filepath.Join(imageDir, "test")
+	require.NoError(t, os.Mkdir(layout, 0o755))
+	imageID := newLayout(t, layout, "v1")
+
+	store, err := NewStore(imageDir, t.TempDir())
+	require.NoError(t, err)
+
+	img := store.image(imageID)
+	img.diffIDs[0] = digest.FromString("corrupted")
+	assert.Error(t, store.prepare(context.Background(), imageID, "key", true, ""))
+
+	entries, err := os.ReadDir(filepath.Join(store.root, layersDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "layers are only kept if they are unpacked successfully")
+}
@@ -0,0 +1,335 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotationImageName is the annotation of full image names set by containerd and nerdctl.
+	annotationImageName = "io.containerd.image.name"
+
+	tarballSuffix = ".tar"
+)
+
+// image is an image found in an OCI layout directory or a tarball.
+type image struct {
+	// id is the digest of the image config, the same as image IDs of container runtimes.
+	id string
+	// names are normalized references of the image, tagged or digested.
+	names   []string
+	diffIDs []digest.Digest
+	layers  []blob
+}
+
+// blob is a file in an OCI layout directory or a tarball.
+type blob struct {
+	open func() (io.ReadCloser, error)
+	size int64
+}
+
+// fileOpener opens files of an image source by their paths relative to the root of the source.
+type fileOpener func(name string) (blob, error)
+
+// loadSource loads images in the OCI layout directory or the tarball at the given path. Images in OCI layouts
+// tagged without repositories are named after the directory or the tarball.
+func loadSource(path string, info os.FileInfo) ([]*image, error) {
+	if info.IsDir() {
+		repo := info.Name()
+		return loadLayout(dirOpener(path), repo)
+	}
+
+	if !strings.HasSuffix(info.Name(), tarballSuffix) {
+		return nil, nil
+	}
+
+	open, err := tarballOpener(path)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := strings.TrimSuffix(info.Name(), tarballSuffix)
+	if _, err = open("manifest.json"); err == nil {
+		return loadDockerArchive(open)
+	}
+
+	return loadLayout(open, repo)
+}
+
+func dirOpener(dir string) fileOpener {
+	return func(name string) (blob, error) {
+		p := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+		info, err := os.Stat(p)
+		if err != nil {
+			return blob{}, err
+		}
+
+		return blob{
+			open: func() (io.ReadCloser, error) { return os.Open(p) },
+			size: info.Size(),
+		}, nil
+	}
+}
+
+// tarballOpener indexes regular files in the tarball, which are then read in place without extraction.
+func tarballOpener(tarball string) (fileOpener, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	type entry struct {
+		offset int64
+		size   int64
+	}
+
+	entries := make(map[string]entry)
+	r := tar.NewReader(f)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tarball %q: %s", tarball, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// The tar reader doesn't buffer, so the file is positioned at the beginning of the entry.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[path.Clean("/"+hdr.Name)] = entry{offset: offset, size: hdr.Size}
+	}
+
+	return func(name string) (blob, error) {
+		e, found := entries[path.Clean("/"+name)]
+		if !found {
+			return blob{}, fmt.Errorf("%q not found in tarball %q: %w", name, tarball, os.ErrNotExist)
+		}
+
+		return blob{
+			open: func() (io.ReadCloser, error) {
+				f, err := os.Open(tarball)
+				if err != nil {
+					return nil, err
+				}
+
+				return struct {
+					io.Reader
+					io.Closer
+				}{io.NewSectionReader(f, e.offset, e.size), f}, nil
+			},
+			size: e.size,
+		}, nil
+	}, nil
+}
+
+func readJSON(open fileOpener, name string, v interface{}) ([]byte, error) {
+	b, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("unable to decode %q: %s", name, err)
+	}
+
+	return data, nil
+}
+
+func blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+func readBlob(open fileOpener, dgst digest.Digest, v interface{}) error {
+	p, err := blobPath(dgst)
+	if err != nil {
+		return err
+	}
+
+	_, err = readJSON(open, p, v)
+	return err
+}
+
+// loadLayout loads images of the OCI image layout. Images are named by the annotation io.containerd.image.name,
+// or org.opencontainers.image.ref.name. References in the latter which are only tags are prefixed by repo.
+// Images are also named by repo and digests of their manifests.
+func loadLayout(open fileOpener, repo string) ([]*image, error) {
+	index := specs.Index{}
+	if _, err := readJSON(open, specs.ImageIndexFile, &index); err != nil {
+		return nil, err
+	}
+
+	var imgs []*image
+	for _, desc := range index.Manifests {
+		img, err := loadManifest(open, desc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load manifest %s: %s", desc.Digest, err)
+		}
+
+		if img == nil {
+			continue
+		}
+
+		names := []string{repo + "@" + desc.Digest.String()}
+		if name := desc.Annotations[annotationImageName]; len(name) > 0 {
+			names = append(names, name)
+		} else if name = desc.Annotations[specs.AnnotationRefName]; len(name) > 0 {
+			if !strings.ContainsAny(name, "/:@") {
+				name = repo + ":" + name
+			}
+			names = append(names, name)
+		}
+
+		for _, name := range names {
+			img.names = appendName(img.names, name)
+		}
+
+		imgs = append(imgs, img)
+	}
+
+	return imgs, nil
+}
+
+// loadManifest loads the image of the manifest, or the manifest of the default platform if it is an index.
+// nil is returned if no manifest matches the default platform.
+func loadManifest(open fileOpener, desc specs.Descriptor) (*image, error) {
+	switch desc.MediaType {
+	case specs.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		index := specs.Index{}
+		if err := readBlob(open, desc.Digest, &index); err != nil {
+			return nil, err
+		}
+
+		matcher := platforms.Default()
+		for _, m := range index.Manifests {
+			if m.Platform != nil && !matcher.Match(*m.Platform) {
+				continue
+			}
+
+			return loadManifest(open, m)
+		}
+
+		return nil, nil
+	case specs.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+	default:
+		return nil, fmt.Errorf("unsupported media type %q", desc.MediaType)
+	}
+
+	manifest := specs.Manifest{}
+	if err := readBlob(open, desc.Digest, &manifest); err != nil {
+		return nil, err
+	}
+
+	config := specs.Image{}
+	if err := readBlob(open, manifest.Config.Digest, &config); err != nil {
+		return nil, err
+	}
+
+	img := &image{id: manifest.Config.Digest.String(), diffIDs: config.RootFS.DiffIDs}
+	for _, l := range manifest.Layers {
+		p, err := blobPath(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := open(p)
+		if err != nil {
+			return nil, err
+		}
+
+		img.layers = append(img.layers, b)
+	}
+
+	return img, nil
+}
+
+// dockerManifest is an entry of manifest.json in tarballs created by "docker save".
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// loadDockerArchive loads images of the tarball created by "docker save". Images are named by their RepoTags.
+func loadDockerArchive(open fileOpener) ([]*image, error) {
+	var manifests []dockerManifest
+	if _, err := readJSON(open, "manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+
+	var imgs []*image
+	for _, m := range manifests {
+		config := specs.Image{}
+		data, err := readJSON(open, m.Config, &config)
+		if err != nil {
+			return nil, err
+		}
+
+		img := &image{id: digest.FromBytes(data).String(), diffIDs: config.RootFS.DiffIDs}
+		for _, name := range m.RepoTags {
+			img.names = appendName(img.names, name)
+		}
+
+		for _, l := range m.Layers {
+			b, err := open(l)
+			if err != nil {
+				return nil, err
+			}
+
+			img.layers = append(img.layers, b)
+		}
+
+		imgs = append(imgs, img)
+	}
+
+	return imgs, nil
+}
+
+// appendName appends the normalized name. Invalid names are ignored.
+func appendName(names []string, name string) []string {
+	named, err := reference.ParseDockerRef(name)
+	if err != nil {
+		klog.Warningf("ignore invalid image name %q: %s", name, err)
+		return names
+	}
+
+	return append(names, named.String())
+}
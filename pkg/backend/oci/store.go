@@ -0,0 +1,481 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	layersDir    = "layers"
+	snapshotsDir = "snapshots"
+	snapshotFile = "snapshot.json"
+	tmpPrefix    = ".tmp-"
+)
+
+// Store finds images in OCI layout directories and tarballs in the image directory, and keeps snapshots of them in
+// its root directory:
+//
+//	layers/<chain ID>/            the unpacked layer, whiteouts converted for overlayfs
+//	snapshots/<hash of key>/      the snapshot.json, along with upper and work directories of read-write snapshots
+//
+// Layers are shared by snapshots, and removed once neither snapshots nor images in the image directory use them.
+type Store struct {
+	imageDir string
+	root     string
+
+	guard   sync.Mutex
+	sources map[string]*source
+	images  map[string]*image
+
+	// layerGuard serializes unpacking and pruning of layers.
+	layerGuard sync.Mutex
+}
+
+// source is an OCI layout directory or a tarball loaded.
+type source struct {
+	modTime time.Time
+	size    int64
+	images  []*image
+}
+
+// snapshot is the record of a snapshot.
+type snapshot struct {
+	Key      string `json:"key"`
+	ImageID  string `json:"imageID"`
+	ReadOnly bool   `json:"readOnly"`
+	// Layers are chain IDs of layers of the image, from the bottom to the top.
+	Layers   []digest.Digest `json:"layers,omitempty"`
+	Metadata string          `json:"metadata,omitempty"`
+}
+
+// NewStore creates a store of images in imageDir, which keeps snapshots in root.
+func NewStore(imageDir, root string) (*Store, error) {
+	for _, dir := range []string{layersDir, snapshotsDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Store{
+		imageDir: imageDir,
+		root:     root,
+		sources:  make(map[string]*source),
+	}
+
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// scan loads images in the image directory. Sources which haven't changed since the last scan aren't loaded again.
+func (s *Store) scan() error {
+	entries, err := os.ReadDir(s.imageDir)
+	if err != nil {
+		return fmt.Errorf("unable to read the image directory %q: %s", s.imageDir, err)
+	}
+
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	sources := make(map[string]*source, len(entries))
+	images := make(map[string]*image)
+	for _, entry := range entries {
+		p := filepath.Join(s.imageDir, entry.Name())
+		info, err := os.Stat(p)
+		if err != nil {
+			klog.Warningf("unable to stat %q: %s", p, err)
+			continue
+		}
+
+		// Changes of OCI layouts always come with updates of their indexes.
+		stamp := info
+		if info.IsDir() {
+			if stamp, err = os.Stat(filepath.Join(p, specs.ImageIndexFile)); err != nil {
+				continue
+			}
+		}
+
+		src := s.sources[p]
+		if src == nil || !src.modTime.Equal(stamp.ModTime()) || src.size != stamp.Size() {
+			imgs, err := loadSource(p, info)
+			if err != nil {
+				klog.Errorf("unable to load images in %q: %s", p, err)
+				continue
+			}
+
+			src = &source{modTime: stamp.ModTime(), size: stamp.Size(), images: imgs}
+			klog.Infof("found %d images in %q", len(imgs), p)
+		}
+
+		sources[p] = src
+		for _, img := range src.images {
+			images[img.id] = img
+			for _, name := range img.names {
+				if prev := images[name]; prev != nil && prev.id != img.id {
+					klog.Warningf("image %q in %q replaces image %q", name, p, prev.id)
+				}
+
+				images[name] = img
+			}
+		}
+	}
+
+	s.sources = sources
+	s.images = images
+	return nil
+}
+
+// image returns the image of the given name or ID. The image directory is scanned again if it is not found.
+func (s *Store) image(nameOrID string) *image {
+	key := nameOrID
+	if _, err := digest.Parse(nameOrID); err != nil {
+		named, err := reference.ParseDockerRef(nameOrID)
+		if err != nil {
+			return nil
+		}
+
+		key = named.String()
+	}
+
+	s.guard.Lock()
+	img := s.images[key]
+	s.guard.Unlock()
+	if img != nil {
+		return img
+	}
+
+	if err := s.scan(); err != nil {
+		klog.Errorf("unable to scan images: %s", err)
+		return nil
+	}
+
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.images[key]
+}
+
+// list returns all images found in the last scan.
+func (s *Store) list() []*image {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	var imgs []*image
+	for _, src := range s.sources {
+		imgs = append(imgs, src.images...)
+	}
+
+	return imgs
+}
+
+func chainIDs(img *image) []digest.Digest {
+	return identity.ChainIDs(append([]digest.Digest(nil), img.diffIDs...))
+}
+
+func (s *Store) layerDir(chainID digest.Digest) string {
+	return filepath.Join(s.root, layersDir, chainID.Encoded())
+}
+
+func (s *Store) snapshotDir(key string) string {
+	return filepath.Join(s.root, snapshotsDir, digest.FromString(key).Encoded())
+}
+
+// unpack unpacks layers of the image which are not unpacked yet, and returns their chain IDs.
+// The caller must hold layerGuard.
+func (s *Store) unpack(ctx context.Context, img *image) ([]digest.Digest, error) {
+	if len(img.layers) != len(img.diffIDs) {
+		return nil, fmt.Errorf("image %q has %d layers but %d diff IDs", img.id, len(img.layers), len(img.diffIDs))
+	}
+
+	ids := chainIDs(img)
+	for i, chainID := range ids {
+		dir := s.layerDir(chainID)
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		klog.Infof("unpack layer %s of image %q", img.diffIDs[i], img.id)
+		if err := s.unpackLayer(ctx, img.layers[i], img.diffIDs[i], dir); err != nil {
+			return nil, fmt.Errorf("unable to unpack layer %s of image %q: %s", img.diffIDs[i], img.id, err)
+		}
+	}
+
+	return ids, nil
+}
+
+// unpackLayer applies the layer to an empty directory, then renames the directory to dir if the digest of the
+// uncompressed layer matches diffID.
+func (s *Store) unpackLayer(ctx context.Context, layer blob, diffID digest.Digest, dir string) error {
+	tmp, err := os.MkdirTemp(filepath.Join(s.root, layersDir), tmpPrefix)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	r, err := layer.open()
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	dr, err := compression.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+
+	defer dr.Close()
+
+	digester := diffID.Algorithm().Digester()
+	tr := io.TeeReader(dr, digester.Hash())
+	if _, err = archive.Apply(ctx, tmp, tr, archive.WithConvertWhiteout(archive.OverlayConvertWhiteout)); err != nil {
+		return err
+	}
+
+	// Read the padding of the tar stream for the digest.
+	if _, err = io.Copy(io.Discard, tr); err != nil {
+		return err
+	}
+
+	if digester.Digest() != diffID {
+		return fmt.Errorf("digest of the uncompressed layer is %s", digester.Digest())
+	}
+
+	if err = os.Chmod(tmp, 0o755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+func (s *Store) readSnapshot(key string) (*snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(s.snapshotDir(key), snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &snapshot{}
+	if err = json.Unmarshal(data, ss); err != nil {
+		return nil, fmt.Errorf("unable to decode snapshot %q: %s", key, err)
+	}
+
+	return ss, nil
+}
+
+func (s *Store) writeSnapshot(ss *snapshot) error {
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(s.snapshotDir(ss.Key), snapshotFile)
+	if err = os.WriteFile(p+".tmp", data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// prepare creates a snapshot of the image. An existing snapshot of the same image and mode is reused, and its
+// metadata is replaced if metadata is not empty.
+func (s *Store) prepare(ctx context.Context, imageID, key string, ro bool, metadata string) error {
+	if existing, err := s.readSnapshot(key); err == nil {
+		if existing.ImageID != imageID || existing.ReadOnly != ro {
+			return fmt.Errorf("found existed snapshot %q of image %q, read-only %t", key, existing.ImageID,
+				existing.ReadOnly)
+		}
+
+		klog.Infof("found existed snapshot %q, use it", key)
+		if len(metadata) == 0 {
+			return nil
+		}
+
+		existing.Metadata = metadata
+		return s.writeSnapshot(existing)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	img := s.image(imageID)
+	if img == nil {
+		return fmt.Errorf("image %q not found", imageID)
+	}
+
+	s.layerGuard.Lock()
+	defer s.layerGuard.Unlock()
+
+	layers, err := s.unpack(ctx, img)
+	if err != nil {
+		return err
+	}
+
+	dir := s.snapshotDir(key)
+	subdirs := []string{dir}
+	if !ro {
+		subdirs = append(subdirs, filepath.Join(dir, "upper"), filepath.Join(dir, "work"))
+	}
+
+	if len(layers) == 0 {
+		subdirs = append(subdirs, filepath.Join(dir, "empty"))
+	}
+
+	for _, d := range subdirs {
+		if err = os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+	}
+
+	return s.writeSnapshot(&snapshot{Key: key, ImageID: imageID, ReadOnly: ro, Layers: layers, Metadata: metadata})
+}
+
+// mounts returns mounts of the snapshot. Read-only snapshots of a single layer are bind mounted.
+func (s *Store) mounts(key string, ro bool) ([]mount.Mount, error) {
+	ss, err := s.readSnapshot(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := s.snapshotDir(key)
+	lowers := make([]string, 0, len(ss.Layers))
+	for i := len(ss.Layers) - 1; i >= 0; i-- {
+		lowers = append(lowers, s.layerDir(ss.Layers[i]))
+	}
+
+	if len(lowers) == 0 {
+		lowers = append(lowers, filepath.Join(dir, "empty"))
+	}
+
+	if ss.ReadOnly && len(lowers) == 1 {
+		return []mount.Mount{{Type: "bind", Source: lowers[0], Options: []string{"rbind", "ro"}}}, nil
+	}
+
+	options := []string{"lowerdir=" + strings.Join(lowers, ":")}
+	if !ss.ReadOnly {
+		options = append(options, "upperdir="+filepath.Join(dir, "upper"), "workdir="+filepath.Join(dir, "work"))
+	}
+
+	if ro || ss.ReadOnly {
+		options = append(options, "ro")
+	}
+
+	return []mount.Mount{{Type: "overlay", Source: "overlay", Options: options}}, nil
+}
+
+func (s *Store) updateMetadata(key, metadata string) error {
+	ss, err := s.readSnapshot(key)
+	if err != nil {
+		return err
+	}
+
+	ss.Metadata = metadata
+	return s.writeSnapshot(ss)
+}
+
+// remove removes the snapshot, then layers no longer used.
+func (s *Store) remove(key string) error {
+	dir := s.snapshotDir(key)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			klog.Infof("snapshot %q doesn't exist. it may have not been created", key)
+			return nil
+		}
+
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	s.prune()
+	return nil
+}
+
+// prune removes layers used by neither snapshots nor images in the image directory.
+func (s *Store) prune() {
+	s.layerGuard.Lock()
+	defer s.layerGuard.Unlock()
+
+	used := make(map[string]bool)
+	for _, img := range s.list() {
+		for _, id := range chainIDs(img) {
+			used[id.Encoded()] = true
+		}
+	}
+
+	snapshots, err := s.snapshots()
+	if err != nil {
+		klog.Errorf("unable to list snapshots to prune layers: %s", err)
+		return
+	}
+
+	for _, ss := range snapshots {
+		for _, id := range ss.Layers {
+			used[id.Encoded()] = true
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.root, layersDir))
+	if err != nil {
+		klog.Errorf("unable to list layers: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if used[entry.Name()] {
+			continue
+		}
+
+		klog.Infof("remove unused layer %s", entry.Name())
+		if err = os.RemoveAll(filepath.Join(s.root, layersDir, entry.Name())); err != nil {
+			klog.Errorf("unable to remove layer %s: %s", entry.Name(), err)
+		}
+	}
+}
+
+// snapshots returns records of all snapshots.
+func (s *Store) snapshots() ([]*snapshot, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, snapshotsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*snapshot
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(s.root, snapshotsDir, entry.Name(), snapshotFile))
+		if err != nil {
+			klog.Warningf("unable to read snapshot %q: %s", entry.Name(), err)
+			continue
+		}
+
+		ss := &snapshot{}
+		if err = json.Unmarshal(data, ss); err != nil {
+			klog.Warningf("unable to decode snapshot %q: %s", entry.Name(), err)
+			continue
+		}
+
+		snapshots = append(snapshots, ss)
+	}
+
+	return snapshots, nil
+}
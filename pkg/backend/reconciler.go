@@ -0,0 +1,425 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/metrics"
+	"k8s.io/klog/v2"
+	k8smount "k8s.io/utils/mount"
+)
+
+// reconcileTimeout is the timeout of a round of reconciliation.
+const reconcileTimeout = time.Minute
+
+// Drift between the cache, snapshots of the runtime and mounts of the host.
+const (
+	// driftUnmountedTarget is a target in the cache which is not mounted any more.
+	driftUnmountedTarget = "unmounted_target"
+	// driftUntrackedTarget is a mounted target recorded in a snapshot, but not in the cache.
+	driftUntrackedTarget = "untracked_target"
+	// driftLeakedSnapshot is a snapshot created by the driver which no mounted targets refer to.
+	driftLeakedSnapshot = "leaked_snapshot"
+	// driftStaleMetadata is a read-only snapshot whose targets in the runtime differ from the cache.
+	driftStaleMetadata = "stale_metadata"
+)
+
+// listMountedTargets returns mount points in /proc/self/mountinfo.
+func listMountedTargets() (map[MountTarget]struct{}, error) {
+	mounts, err := k8smount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[MountTarget]struct{}, len(mounts))
+	for _, m := range mounts {
+		targets[MountTarget(m.MountPoint)] = struct{}{}
+	}
+
+	return targets, nil
+}
+
+// reconcile compares the cache with snapshots of the runtime and mounts of the host, and fixes drift between them.
+// Volumes are published meanwhile. The cache is copied under the guard and the runtime is called without locks, then
+// each fix is applied under the lock of its snapshot or target once the drift is confirmed. Busy targets and
+// snapshots waiting for repair are skipped.
+func (s *SnapshotMounter) reconcile() {
+	ctx, cancel := context.WithTimeout(context.TODO(), reconcileTimeout)
+	defer cancel()
+
+	mounted, err := s.mountedTargets()
+	if err != nil {
+		klog.Errorf("unable to list mounts to reconcile snapshots: %s", err)
+		return
+	}
+
+	s.guard.Lock()
+	roTargets := unmountedTargets(s.targetRoSnapshotMap, mounted)
+	rwTargets := unmountedTargets(s.targetRwSnapshotMap, mounted)
+	s.guard.Unlock()
+
+	s.releaseUnmountedTargets(ctx, roTargets, rwTargets)
+
+	// Snapshots are listed after fixing the cache, so that they reflect the fixes.
+	snapshots, err := s.runtime.ListSnapshots(ctx)
+	if err != nil {
+		klog.Errorf("unable to list snapshots to reconcile: %s", err)
+		return
+	}
+
+	listed := make(map[SnapshotKey]struct{}, len(snapshots))
+	for _, metadata := range snapshots {
+		key, err := metadata.GetSnapshotKey()
+		if err != nil {
+			klog.Errorf("found a snapshot with malformed metadata %#v. skip it: %s", metadata, err)
+			continue
+		}
+
+		listed[key] = struct{}{}
+		if s.state != nil {
+			// Targets in metadata are not used. Snapshots are compared with the state file instead.
+			s.reconcileStatefulSnapshot(ctx, key)
+			continue
+		}
+
+		targets, err := metadata.GetTargets()
+		if err != nil {
+			s.reconcileMalformedSnapshot(key, metadata.IsReadWrite(), err)
+			continue
+		}
+
+		if metadata.IsReadWrite() {
+			s.reconcileRWSnapshot(ctx, key, targets, mounted)
+		} else {
+			s.reconcileROSnapshot(ctx, key, targets, mounted)
+		}
+	}
+
+	// Snapshots in use but not listed have lost their targets in the runtime. Snapshots in the state file are
+	// created after being saved, so they may be being created if not listed.
+	if s.state != nil {
+		return
+	}
+
+	s.guard.Lock()
+	var unlisted []SnapshotKey
+	for key := range s.roSnapshotTargetsMap {
+		if _, found := listed[key]; !found {
+			unlisted = append(unlisted, key)
+		}
+	}
+	s.guard.Unlock()
+
+	for _, key := range unlisted {
+		s.reconcileUnlistedSnapshot(ctx, key)
+	}
+}
+
+// releaseUnmountedTargets releases targets in the cache which are not mounted. Targets are claimed, so that they are
+// not published meanwhile, then released if they are still unmounted.
+func (s *SnapshotMounter) releaseUnmountedTargets(
+	ctx context.Context, roTargets, rwTargets map[MountTarget]SnapshotKey,
+) {
+	if len(roTargets) == 0 && len(rwTargets) == 0 {
+		return
+	}
+
+	claimed := make(map[MountTarget]struct{}, len(roTargets)+len(rwTargets))
+	for _, targets := range []map[MountTarget]SnapshotKey{roTargets, rwTargets} {
+		for target := range targets {
+			if release := s.claimTarget(target); release != nil {
+				defer release()
+				claimed[target] = struct{}{}
+			}
+		}
+	}
+
+	// Targets may have been mounted before being claimed.
+	mounted, err := s.mountedTargets()
+	if err != nil {
+		klog.Errorf("unable to list mounts to release targets: %s", err)
+		return
+	}
+
+	unmounted := func(target MountTarget, key SnapshotKey, cache map[MountTarget]SnapshotKey) bool {
+		if _, found := claimed[target]; !found {
+			return false
+		}
+
+		if _, found := mounted[target]; found {
+			return false
+		}
+
+		s.guard.Lock()
+		defer s.guard.Unlock()
+		return cache[target] == key
+	}
+
+	for target, key := range roTargets {
+		if !unmounted(target, key, s.targetRoSnapshotMap) {
+			continue
+		}
+
+		s.fix(driftUnmountedTarget, key, target, func() error {
+			s.unrefROSnapshot(ctx, target)
+			return s.runtime.UnpinImage(ctx, target)
+		})
+	}
+
+	for target, key := range rwTargets {
+		if !unmounted(target, key, s.targetRwSnapshotMap) {
+			continue
+		}
+
+		s.fix(driftUnmountedTarget, key, target, func() error {
+			if err := s.runtime.UnpinImage(ctx, target); err != nil {
+				klog.Errorf("unable to unpin the image mounted to %q: %s", target, err)
+			}
+
+			return s.destroyRWSnapshot(ctx, target, key)
+		})
+	}
+}
+
+// reconcileRWSnapshot adopts the read-write snapshot if its target is mounted, or destroys it.
+func (s *SnapshotMounter) reconcileRWSnapshot(
+	ctx context.Context, key SnapshotKey, targets map[MountTarget]struct{}, mounted map[MountTarget]struct{},
+) {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	if _, found := s.repairs[key]; found {
+		s.guard.Unlock()
+		return
+	}
+
+	var adopted MountTarget
+	for target := range targets {
+		if s.targetRwSnapshotMap[target] == key {
+			s.guard.Unlock()
+			return
+		}
+
+		if _, found := mounted[target]; found && !s.tracked(target) {
+			adopted = target
+			break
+		}
+	}
+	s.guard.Unlock()
+
+	if adopted != "" {
+		s.fix(driftUntrackedTarget, key, adopted, func() error {
+			s.guard.Lock()
+			defer s.guard.Unlock()
+			if s.tracked(adopted) || s.busy(adopted) {
+				return fmt.Errorf("target %q is being published", adopted)
+			}
+
+			s.targetRwSnapshotMap[adopted] = key
+			return nil
+		})
+
+		return
+	}
+
+	s.fix(driftLeakedSnapshot, key, "", func() error {
+		return s.runtime.DestroySnapshot(ctx, key)
+	})
+}
+
+// reconcileROSnapshot adopts mounted targets of the read-only snapshot which are not in the cache, then destroys the
+// snapshot if no targets refer to it, or syncs its metadata with the cache.
+func (s *SnapshotMounter) reconcileROSnapshot(
+	ctx context.Context, key SnapshotKey, targets map[MountTarget]struct{}, mounted map[MountTarget]struct{},
+) {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	if _, found := s.repairs[key]; found {
+		s.guard.Unlock()
+		return
+	}
+
+	expected := copyTargets(s.roSnapshotTargetsMap[key])
+	var adopted []MountTarget
+	for target := range targets {
+		if _, found := expected[target]; found {
+			continue
+		}
+
+		if _, found := mounted[target]; !found || s.tracked(target) || s.busy(target) {
+			continue
+		}
+
+		expected[target] = struct{}{}
+		adopted = append(adopted, target)
+	}
+	s.guard.Unlock()
+
+	for _, target := range adopted {
+		s.fix(driftUntrackedTarget, key, target, func() error {
+			s.guard.Lock()
+			defer s.guard.Unlock()
+			if s.tracked(target) || s.busy(target) {
+				return fmt.Errorf("target %q is being published", target)
+			}
+
+			s.addROTarget("", target, key, "")
+			return nil
+		})
+	}
+
+	if len(expected) == 0 {
+		s.fix(driftLeakedSnapshot, key, "", func() error {
+			if err := s.runtime.DestroySnapshot(ctx, key); err != nil {
+				s.repairLater(key)
+				return err
+			}
+
+			return nil
+		})
+
+		return
+	}
+
+	if sameTargets(targets, expected) {
+		return
+	}
+
+	s.fix(driftStaleMetadata, key, "", func() error {
+		if err := s.runtime.UpdateSnapshotMetadata(ctx, key, buildSnapshotMetaData(expected)); err != nil {
+			s.repairLater(key)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// reconcileStatefulSnapshot destroys the snapshot if it is not in the state file, which is the case if the driver
+// crashed while destroying it, or the state file was lost.
+func (s *SnapshotMounter) reconcileStatefulSnapshot(ctx context.Context, key SnapshotKey) {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	_, repairing := s.repairs[key]
+	inUse := len(s.roSnapshotTargetsMap[key]) > 0
+	for _, rwKey := range s.targetRwSnapshotMap {
+		inUse = inUse || rwKey == key
+	}
+	s.guard.Unlock()
+	if repairing || inUse {
+		return
+	}
+
+	s.fix(driftLeakedSnapshot, key, "", func() error {
+		if err := s.runtime.DestroySnapshot(ctx, key); err != nil {
+			s.repairLater(key)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// reconcileMalformedSnapshot queues the read-only snapshot for repair if the cache knows its targets, so that its
+// metadata is rewritten. Other snapshots with malformed metadata may still be mounted, so they are left alone.
+func (s *SnapshotMounter) reconcileMalformedSnapshot(key SnapshotKey, readWrite bool, err error) {
+	s.guard.Lock()
+	known := len(s.roSnapshotTargetsMap[key]) > 0
+	s.guard.Unlock()
+	if readWrite || !known {
+		klog.Errorf("snapshot %q has malformed metadata. skip it: %s", key, err)
+		return
+	}
+
+	s.fix(driftStaleMetadata, key, "", func() error {
+		s.repairLater(key)
+		return nil
+	})
+}
+
+// reconcileUnlistedSnapshot restores targets of the read-only snapshot in the runtime if it is still in use.
+func (s *SnapshotMounter) reconcileUnlistedSnapshot(ctx context.Context, key SnapshotKey) {
+	unlock := s.lockSnapshot(key)
+	defer unlock()
+
+	s.guard.Lock()
+	_, repairing := s.repairs[key]
+	targets := copyTargets(s.roSnapshotTargetsMap[key])
+	s.guard.Unlock()
+	if repairing || len(targets) == 0 {
+		return
+	}
+
+	s.fix(driftStaleMetadata, key, "", func() error {
+		if err := s.runtime.UpdateSnapshotMetadata(ctx, key, buildSnapshotMetaData(targets)); err != nil {
+			s.repairLater(key)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// fix fixes the drift of the snapshot, or the target if not empty, and reports it via metrics. Drift is only
+// reported in dry-run mode.
+func (s *SnapshotMounter) fix(drift string, key SnapshotKey, target MountTarget, fix func() error) {
+	if s.dryRun {
+		klog.Warningf("dry-run: found %s of snapshot %q, target %q", drift, key, target)
+		metrics.SnapshotDriftCount.WithLabelValues(drift, metrics.BoolToString(false)).Inc()
+		return
+	}
+
+	klog.Warningf("found %s of snapshot %q, target %q. fix it", drift, key, target)
+	if err := fix(); err != nil {
+		klog.Errorf("unable to fix %s of snapshot %q, target %q: %s", drift, key, target, err)
+		metrics.SnapshotDriftCount.WithLabelValues(drift, metrics.BoolToString(false)).Inc()
+		return
+	}
+
+	metrics.SnapshotDriftCount.WithLabelValues(drift, metrics.BoolToString(true)).Inc()
+}
+
+// unmountedTargets returns targets in the cache which are not mounted.
+func unmountedTargets(
+	targets map[MountTarget]SnapshotKey, mounted map[MountTarget]struct{},
+) map[MountTarget]SnapshotKey {
+	unmounted := make(map[MountTarget]SnapshotKey)
+	for target, key := range targets {
+		if _, found := mounted[target]; !found {
+			unmounted[target] = key
+		}
+	}
+
+	return unmounted
+}
+
+// busy returns true if the target is being published or unpublished. The guard must be held.
+func (s *SnapshotMounter) busy(target MountTarget) bool {
+	_, found := s.busyTargets[target]
+	return found
+}
+
+// tracked returns true if the target refers to any snapshot in the cache. The guard must be held.
+func (s *SnapshotMounter) tracked(target MountTarget) bool {
+	return s.targetRoSnapshotMap[target] != "" || s.targetRwSnapshotMap[target] != ""
+}
+
+func sameTargets(a, b map[MountTarget]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for target := range a {
+		if _, found := b[target]; !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/warm-metal/container-image-csi-driver/pkg/metrics"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	runtime := newFakeRuntime()
+	m := NewMounter(runtime)
+	mounted := map[MountTarget]struct{}{"/a": {}, "/b": {}, "/c": {}}
+	m.mountedTargets = func() (map[MountTarget]struct{}, error) {
+		return mounted, nil
+	}
+
+	image, err := reference.ParseDockerRef("foo:v1")
+	require.NoError(t, err)
+	imageCtx := WithCRIImageID(ctx, "sha256:foo")
+	require.NoError(t, m.Mount(imageCtx, "a", "/a", image, true))
+	require.NoError(t, m.Mount(imageCtx, "b", "/b", image, true))
+	require.NoError(t, m.Mount(imageCtx, "c", "/c", image, false))
+	roKey := GenSnapshotKey("sha256:foo")
+	rwKey := GenSnapshotKey("c")
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/c": rwKey}, m.targetRwSnapshotMap)
+	assert.True(t, runtime.rw[rwKey])
+
+	m.reconcile()
+	assert.Len(t, m.targetRoSnapshotMap, 2)
+	assert.Len(t, runtime.snapshots, 2, "nothing drifts")
+
+	// /a is unmounted behind the driver, and a read-write snapshot is leaked by a crashed publish.
+	delete(mounted, "/a")
+	leakedKey := GenSnapshotKey("d")
+	runtime.snapshots[leakedKey] = map[MountTarget]struct{}{"/d": {}}
+	runtime.rw[leakedKey] = true
+	leaked := testutil.ToFloat64(metrics.SnapshotDriftCount.WithLabelValues(driftLeakedSnapshot, "true"))
+
+	m.dryRun = true
+	m.reconcile()
+	assert.Contains(t, m.targetRoSnapshotMap, MountTarget("/a"), "dry-run only reports drift")
+	assert.Contains(t, runtime.snapshots, leakedKey)
+
+	m.dryRun = false
+	m.reconcile()
+	assert.NotContains(t, m.targetRoSnapshotMap, MountTarget("/a"))
+	assert.Equal(t, map[string]int{"sha256:foo": 2}, m.MountedImages(),
+		"images of released targets should not be protected from the image collector")
+	assert.Equal(t, map[MountTarget]struct{}{"/b": {}}, runtime.snapshots[roKey])
+	assert.NotContains(t, runtime.snapshots, leakedKey)
+	assert.Equal(t, leaked+1,
+		testutil.ToFloat64(metrics.SnapshotDriftCount.WithLabelValues(driftLeakedSnapshot, "true")))
+
+	// Stale targets in the runtime are dropped, while mounted targets missing in the cache are adopted.
+	runtime.snapshots[roKey]["/x"] = struct{}{}
+	delete(m.targetRwSnapshotMap, "/c")
+	m.reconcile()
+	assert.Equal(t, map[MountTarget]struct{}{"/b": {}}, runtime.snapshots[roKey])
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/c": rwKey}, m.targetRwSnapshotMap)
+
+	// Targets being published or unpublished are skipped, while others are fixed meanwhile.
+	delete(mounted, "/b")
+	delete(mounted, "/c")
+	release := m.claimTarget("/b")
+	require.NotNil(t, release)
+	assert.Nil(t, m.claimTarget("/b"))
+	m.reconcile()
+	assert.Contains(t, m.targetRoSnapshotMap, MountTarget("/b"), "busy targets should not be released")
+	assert.Empty(t, m.targetRwSnapshotMap)
+
+	release()
+	m.reconcile()
+	assert.Empty(t, m.targetRoSnapshotMap)
+	assert.Empty(t, m.roSnapshotTargetsMap)
+	assert.Empty(t, m.targetRwSnapshotMap)
+	assert.Empty(t, runtime.snapshots)
+	assert.Empty(t, m.MountedImages())
+}
+
+func TestMalformedMetadata(t *testing.T) {
+	ctx := context.Background()
+	runtime := newFakeRuntime()
+	unknownKey := GenSnapshotKey("sha256:unknown")
+	runtime.snapshots[unknownKey] = map[MountTarget]struct{}{"/unknown": {}}
+	runtime.malformed[unknownKey] = true
+
+	m := NewMounter(runtime, withMounts(map[MountTarget]struct{}{"/a": {}}))
+	assert.Empty(t, m.roSnapshotTargetsMap)
+	assert.Contains(t, runtime.snapshots, unknownKey, "snapshots with malformed metadata should not be destroyed")
+
+	image, err := reference.ParseDockerRef("foo:v1")
+	require.NoError(t, err)
+	require.NoError(t, m.Mount(WithCRIImageID(ctx, "sha256:foo"), "a", "/a", image, true))
+	roKey := GenSnapshotKey("sha256:foo")
+	runtime.malformed[roKey] = true
+
+	m.reconcile()
+	assert.Contains(t, m.repairs, roKey, "metadata of known snapshots should be repaired")
+	m.repair()
+	assert.Empty(t, m.repairs)
+	assert.NotContains(t, runtime.malformed, roKey)
+	assert.Equal(t, map[MountTarget]struct{}{"/a": {}}, runtime.snapshots[roKey])
+	assert.Contains(t, runtime.snapshots, unknownKey)
+}
+
+func TestReconcileWithStateFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "mounts.json")
+	runtime := newFakeRuntime()
+	mounted := map[MountTarget]struct{}{"/a": {}, "/b": {}, "/c": {}}
+	m := NewMounter(runtime, WithStateFile(path), withMounts(mounted))
+
+	image, err := reference.ParseDockerRef("foo:v1")
+	require.NoError(t, err)
+	imageCtx := WithCRIImageID(ctx, "sha256:foo")
+	require.NoError(t, m.Mount(imageCtx, "a", "/a", image, true))
+	require.NoError(t, m.Mount(imageCtx, "b", "/b", image, true))
+	require.NoError(t, m.Mount(imageCtx, "c", "/c", image, false))
+	roKey := GenSnapshotKey("sha256:foo")
+	rwKey := GenSnapshotKey("c")
+
+	m.reconcile()
+	assert.Len(t, runtime.snapshots, 2, "snapshots in the state file are kept")
+	assert.Zero(t, runtime.updates)
+
+	// Snapshots out of the state file are leaked, whatever their metadata refer to.
+	leakedRO := GenSnapshotKey("sha256:bar")
+	leakedRW := GenSnapshotKey("d")
+	runtime.snapshots[leakedRO] = map[MountTarget]struct{}{"/a": {}}
+	runtime.snapshots[leakedRW] = map[MountTarget]struct{}{}
+	runtime.rw[leakedRW] = true
+	delete(mounted, "/a")
+
+	m.dryRun = true
+	m.reconcile()
+	assert.Len(t, runtime.snapshots, 4, "dry-run only reports drift")
+
+	m.dryRun = false
+	m.reconcile()
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/b": roKey}, m.targetRoSnapshotMap)
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/c": rwKey}, m.targetRwSnapshotMap)
+	assert.Contains(t, runtime.snapshots, roKey)
+	assert.Contains(t, runtime.snapshots, rwKey)
+	assert.NotContains(t, runtime.snapshots, leakedRO)
+	assert.NotContains(t, runtime.snapshots, leakedRW)
+	assert.Zero(t, runtime.updates, "metadata of snapshots are not updated")
+
+	// Snapshots failed to be destroyed are repaired later.
+	runtime.snapshots[leakedRO] = map[MountTarget]struct{}{}
+	runtime.broken = true
+	m.reconcile()
+	assert.Contains(t, m.repairs, leakedRO)
+
+	runtime.broken = false
+	m.repair()
+	assert.NotContains(t, runtime.snapshots, leakedRO)
+	assert.Empty(t, m.repairs)
+}
@@ -2,10 +2,14 @@ package backend
 
 import (
 	"context"
+	"errors"
 
 	"github.com/distribution/reference"
 )
 
+// ErrImageNotFound is returned by ContainerRuntimeMounter if the image is not found, e.g. removed after being pulled.
+var ErrImageNotFound = errors.New("image not found")
+
 type MountOptions struct {
 	ReadOnly bool
 }
@@ -13,23 +17,65 @@ type MountOptions struct {
 type SnapshotKey string
 type MountTarget string
 
+type snapshotterKey struct{}
+type namespaceKey struct{}
+type criImageIDKey struct{}
+
+// WithSnapshotter returns a context making mounters unpack images and create snapshots via the given snapshotter of
+// the runtime. Runtimes without multiple snapshotters ignore it.
+func WithSnapshotter(ctx context.Context, snapshotter string) context.Context {
+	return context.WithValue(ctx, snapshotterKey{}, snapshotter)
+}
+
+// SnapshotterFrom returns the snapshotter set via WithSnapshotter. It is empty for the default snapshotter.
+func SnapshotterFrom(ctx context.Context) string {
+	snapshotter, _ := ctx.Value(snapshotterKey{}).(string)
+	return snapshotter
+}
+
+// WithNamespace returns a context making mounters look up images and create snapshots in the given namespace of the
+// runtime. Runtimes without namespaces ignore it.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// NamespaceFrom returns the namespace set via WithNamespace. It is empty for the default namespace.
+func NamespaceFrom(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceKey{}).(string)
+	return namespace
+}
+
+// WithCRIImageID returns a context making mounters count mounts of the image with the given ID reported by the CRI
+// image service, so that the image collector doesn't remove mounted images.
+func WithCRIImageID(ctx context.Context, imageID string) context.Context {
+	return context.WithValue(ctx, criImageIDKey{}, imageID)
+}
+
+// CRIImageIDFrom returns the image ID set via WithCRIImageID. It is empty if mounts of the image are not counted.
+func CRIImageIDFrom(ctx context.Context) string {
+	imageID, _ := ctx.Value(criImageIDKey{}).(string)
+	return imageID
+}
+
 // ContainerRuntimeMounter is a container runtime specific interface
 type ContainerRuntimeMounter interface {
 	Mount(ctx context.Context, key SnapshotKey, target MountTarget, ro bool) error
 	Unmount(ctx context.Context, target MountTarget) error
 
-	// Determines if a local image exists. A false should return if errors arise.
+	// Determines if a local image exists, and is ready to be unpacked via the snapshotter of the context.
+	// A false should return if errors arise.
 	ImageExists(ctx context.Context, image reference.Named) bool
 
-	// Retrieves the image ID of a local image.
-	// It should crash on any failures including not local image found.
-	GetImageIDOrDie(ctx context.Context, image reference.Named) string
+	// Retrieves the image ID of a local image, after unpacking it if necessary.
+	// It should return an error wrapping ErrImageNotFound if the image is not found.
+	GetImageID(ctx context.Context, image reference.Named) (string, error)
 
 	// Create a snapshot of the image using the given key and metadata.
 	// It should throw errors if any snapshot exists with the same key.
 	PrepareReadOnlySnapshot(ctx context.Context, imageID string, key SnapshotKey, metadata SnapshotMetadata) error
 
-	// Create a read-write snapshot of the image using the given key and metadata.
+	// Create a read-write snapshot of the image using the given key and metadata, which records the target and
+	// marks the snapshot read-write.
 	// It should throw errors if any snapshot exists with the same key.
 	PrepareRWSnapshot(ctx context.Context, imageID string, key SnapshotKey, metadata SnapshotMetadata) error
 
@@ -37,11 +83,24 @@ type ContainerRuntimeMounter interface {
 	UpdateSnapshotMetadata(ctx context.Context, key SnapshotKey, metadata SnapshotMetadata) error
 
 	// Destroy the snapshot with the given key.
-	// It should throw errors if the snapshot doesn't exist.
+	// It should succeed if the snapshot doesn't exist, e.g. if the driver crashed after saving its reference and
+	// before creating it.
 	DestroySnapshot(ctx context.Context, key SnapshotKey) error
 
-	// List metadata of all snapshots created by the driver.
+	// Record the namespace and snapshotter of the context as where the snapshot with the given key is, for snapshots
+	// loaded from the state file rather than listed from the runtime. Runtimes without them can ignore it.
+	LocateSnapshot(ctx context.Context, key SnapshotKey)
+
+	// Refer the image by the target to protect the image from garbage collection of the runtime and the kubelet
+	// while it is mounted.
+	PinImage(ctx context.Context, image reference.Named, target MountTarget) error
+
+	// Drop the reference of the target. The image is no longer protected if no targets refer to it.
+	UnpinImage(ctx context.Context, target MountTarget) error
+
+	// List metadata of all snapshots created by the driver, including those without targets.
 	// The snapshot key must also be saved in the returned map with the key "FakeMetaDataSnapshotKey".
+	// Read-write snapshots must be marked via SnapshotMetadata.SetReadWrite.
 	ListSnapshots(ctx context.Context) ([]SnapshotMetadata, error)
 }
 
@@ -56,4 +115,7 @@ type Mounter interface {
 
 	// ImageExists checks if the image already exists on the local machine
 	ImageExists(ctx context.Context, image reference.Named) bool
+
+	// MountedImages returns the number of targets each image is mounted to, keyed by IDs set via WithCRIImageID.
+	MountedImages() map[string]int
 }
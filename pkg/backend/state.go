@@ -0,0 +1,309 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// mountState is the state of snapshots saved in the state file.
+type mountState struct {
+	Snapshots []snapshotState `json:"snapshots"`
+}
+
+type snapshotState struct {
+	Key       SnapshotKey `json:"key"`
+	ReadWrite bool        `json:"readWrite,omitempty"`
+	// Namespace and Snapshotter are where the snapshot is in the runtime. They are empty for the defaults.
+	Namespace   string `json:"namespace,omitempty"`
+	Snapshotter string `json:"snapshotter,omitempty"`
+	// Mounts are volumes referring to the snapshot. Snapshots without mounts are to be destroyed.
+	Mounts []volumeMount `json:"mounts,omitempty"`
+}
+
+type volumeMount struct {
+	// VolumeID is empty if the mount is migrated from metadata of the snapshot.
+	VolumeID string      `json:"volumeID,omitempty"`
+	Target   MountTarget `json:"target"`
+	// CRIImageID is the ID of the mounted image if its mounts are counted.
+	CRIImageID string `json:"criImageID,omitempty"`
+}
+
+// stateFile saves references of snapshots. The file is replaced as a whole on changes, so that it is never partially
+// written. Concurrent changes are saved together.
+type stateFile struct {
+	path string
+}
+
+func (f *stateFile) load() (*mountState, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &mountState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to decode references of snapshots %q: %w", f.path, err)
+	}
+
+	return state, nil
+}
+
+func (f *stateFile) save(state *mountState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+
+	// The file is synced before the rename, and the directory after it, so that a crash leaves either the old or the
+	// new file on disk.
+	tmp := f.path + ".tmp"
+	if err = writeAndSync(tmp, data); err != nil {
+		return fmt.Errorf("unable to write references of snapshots: %w", err)
+	}
+
+	if err = os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("unable to save references of snapshots: %w", err)
+	}
+
+	if err = syncDir(filepath.Dir(f.path)); err != nil {
+		return fmt.Errorf("unable to save references of snapshots: %w", err)
+	}
+
+	return nil
+}
+
+func writeAndSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// saveState saves the cache to the state file if any. Saves are serialized, and each of them saves the latest cache,
+// so that the file never goes back to an older state. Saves waiting for another are coalesced, since the cache saved
+// by it already includes their changes.
+func (s *SnapshotMounter) saveState() error {
+	if s.state == nil {
+		return nil
+	}
+
+	s.guard.Lock()
+	s.version++
+	version := s.version
+	s.guard.Unlock()
+
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	if s.savedVersion >= version {
+		return nil
+	}
+
+	s.guard.Lock()
+	state := s.buildStateLocked()
+	version = s.version
+	s.guard.Unlock()
+	if err := s.state.save(state); err != nil {
+		return err
+	}
+
+	s.savedVersion = version
+	return nil
+}
+
+// saveStateLocked saves the cache to the state file with the guard held. It is only used on startup.
+func (s *SnapshotMounter) saveStateLocked() error {
+	if s.state == nil {
+		return nil
+	}
+
+	return s.state.save(s.buildStateLocked())
+}
+
+func (s *SnapshotMounter) buildStateLocked() *mountState {
+	snapshots := make(map[SnapshotKey]*snapshotState)
+	snapshotOf := func(key SnapshotKey) *snapshotState {
+		if snapshots[key] == nil {
+			snapshots[key] = &snapshotState{Key: key}
+		}
+
+		return snapshots[key]
+	}
+
+	for target, key := range s.targetRoSnapshotMap {
+		snapshot := snapshotOf(key)
+		snapshot.Mounts = append(snapshot.Mounts, s.volumeMountLocked(target))
+	}
+
+	for target, key := range s.targetRwSnapshotMap {
+		snapshot := snapshotOf(key)
+		snapshot.ReadWrite = true
+		snapshot.Mounts = append(snapshot.Mounts, s.volumeMountLocked(target))
+	}
+
+	for key := range s.repairs {
+		snapshotOf(key)
+	}
+
+	for key := range s.snapshotPlaces {
+		if snapshots[key] == nil {
+			delete(s.snapshotPlaces, key)
+		}
+	}
+
+	state := &mountState{Snapshots: make([]snapshotState, 0, len(snapshots))}
+	for _, snapshot := range snapshots {
+		place := s.snapshotPlaces[snapshot.Key]
+		snapshot.Namespace, snapshot.Snapshotter = place.namespace, place.snapshotter
+		sort.Slice(snapshot.Mounts, func(i, j int) bool {
+			return snapshot.Mounts[i].Target < snapshot.Mounts[j].Target
+		})
+
+		state.Snapshots = append(state.Snapshots, *snapshot)
+	}
+
+	sort.Slice(state.Snapshots, func(i, j int) bool {
+		return state.Snapshots[i].Key < state.Snapshots[j].Key
+	})
+
+	return state
+}
+
+// volumeMountLocked returns the record of the volume mounted to the target.
+func (s *SnapshotMounter) volumeMountLocked(target MountTarget) volumeMount {
+	return volumeMount{VolumeID: s.targetVolumeMap[target], Target: target, CRIImageID: s.targetImageMap[target]}
+}
+
+// loadStateOrDie loads references of snapshots from the state file, or migrates them from metadata of snapshots if
+// the file doesn't exist. Targets not mounted any more are released, and snapshots without targets are destroyed.
+func (s *SnapshotMounter) loadStateOrDie() {
+	state, err := s.state.load()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Fatalf("unable to load references of snapshots: %s", err)
+		}
+
+		s.migrateOrDie()
+		return
+	}
+
+	mounted, err := s.mountedTargets()
+	if err != nil {
+		klog.Fatalf("unable to list mounts: %s", err)
+	}
+
+	// FIXME the timeout can be a flag.
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	for _, snapshot := range state.Snapshots {
+		// The runtime may not find snapshots out of the defaults by keys.
+		place := snapshotPlace{namespace: snapshot.Namespace, snapshotter: snapshot.Snapshotter}
+		s.runtime.LocateSnapshot(withPlace(ctx, place), snapshot.Key)
+		s.placeSnapshotLocked(snapshot.Key, place)
+
+		loaded := 0
+		for _, m := range snapshot.Mounts {
+			if _, found := mounted[m.Target]; !found {
+				klog.Infof("target %q of snapshot %q is not a mountpoint any more. release it", m.Target,
+					snapshot.Key)
+				continue
+			}
+
+			if s.tracked(m.Target) {
+				klog.Errorf("target %q of snapshot %q has already been loaded. skip it", m.Target, snapshot.Key)
+				continue
+			}
+
+			if snapshot.ReadWrite {
+				s.targetRwSnapshotMap[m.Target] = snapshot.Key
+				s.targetVolumeMap[m.Target] = m.VolumeID
+				s.trackImageLocked(m.Target, m.CRIImageID)
+			} else {
+				s.addROTarget(m.VolumeID, m.Target, snapshot.Key, m.CRIImageID)
+			}
+
+			loaded++
+			klog.Infof("snapshot %q mounted to %s", snapshot.Key, m.Target)
+		}
+
+		if loaded == 0 {
+			klog.Infof("snapshot %q doesn't have any mounts. delete!", snapshot.Key)
+			if err := s.runtime.DestroySnapshot(withPlace(ctx, place), snapshot.Key); err != nil {
+				klog.Errorf("unable to destroy snapshot %q. retry later: %s", snapshot.Key, err)
+				s.repairs[snapshot.Key] = struct{}{}
+			}
+		}
+	}
+
+	klog.Infof("loaded %d snapshots from %q", len(state.Snapshots), s.state.path)
+	if err = s.saveStateLocked(); err != nil {
+		klog.Fatalf("unable to save references of snapshots: %s", err)
+	}
+}
+
+// migrateOrDie loads references of snapshots from their metadata, saves them to the state file, then removes targets
+// from metadata. Snapshots still hold labels of the runtime protecting them from garbage collection.
+func (s *SnapshotMounter) migrateOrDie() {
+	klog.Infof("migrate references of snapshots from their metadata to %q", s.state.path)
+	s.buildSnapshotCacheOrDie()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if err := s.saveStateLocked(); err != nil {
+		klog.Fatalf("unable to save references of snapshots: %s", err)
+	}
+
+	// Keys are mapped to whether snapshots are read-write, which is kept in their metadata.
+	keys := make(map[SnapshotKey]bool, len(s.roSnapshotTargetsMap)+len(s.targetRwSnapshotMap))
+	for key := range s.roSnapshotTargetsMap {
+		keys[key] = false
+	}
+
+	for _, key := range s.targetRwSnapshotMap {
+		keys[key] = true
+	}
+
+	for key, readWrite := range keys {
+		metadata := createSnapshotMetaDataWithoutTargets(readWrite)
+		if err := s.runtime.UpdateSnapshotMetadata(ctx, key, metadata); err != nil {
+			// The state file is used from now on. Targets left in metadata are ignored.
+			klog.Warningf("unable to remove targets from metadata of snapshot %q: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withMounts(mounted map[MountTarget]struct{}) MounterOption {
+	return func(s *SnapshotMounter) {
+		s.mountedTargets = func() (map[MountTarget]struct{}, error) {
+			return mounted, nil
+		}
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "mounts.json")
+	runtime := newFakeRuntime()
+	mounted := map[MountTarget]struct{}{"/a": {}, "/b": {}, "/c": {}}
+	m := NewMounter(runtime, WithStateFile(path), withMounts(mounted))
+	assert.FileExists(t, path)
+
+	image, err := reference.ParseDockerRef("foo:v1")
+	require.NoError(t, err)
+	imageCtx := WithCRIImageID(ctx, "sha256:foo")
+	require.NoError(t, m.Mount(imageCtx, "a", "/a", image, true))
+	require.NoError(t, m.Mount(imageCtx, "b", "/b", image, true))
+	require.NoError(t, m.Mount(imageCtx, "c", "/c", image, false))
+	assert.Equal(t, map[string]int{"sha256:foo": 3}, m.MountedImages())
+	roKey := GenSnapshotKey("sha256:foo")
+	rwKey := GenSnapshotKey("c")
+	assert.Empty(t, runtime.snapshots[roKey], "targets are not saved in the runtime")
+	assert.Empty(t, runtime.snapshots[rwKey])
+	assert.Zero(t, runtime.updates)
+
+	state, err := (&stateFile{path: path}).load()
+	require.NoError(t, err)
+	assert.Equal(t, []snapshotState{
+		{Key: rwKey, ReadWrite: true, Mounts: []volumeMount{{VolumeID: "c", Target: "/c", CRIImageID: "sha256:foo"}}},
+		{Key: roKey, Mounts: []volumeMount{
+			{VolumeID: "a", Target: "/a", CRIImageID: "sha256:foo"},
+			{VolumeID: "b", Target: "/b", CRIImageID: "sha256:foo"},
+		}},
+	}, state.Snapshots)
+
+	// References are loaded from the state file on restart. Targets not mounted any more are released.
+	delete(mounted, "/b")
+	m = NewMounter(runtime, WithStateFile(path), withMounts(mounted))
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/a": roKey}, m.targetRoSnapshotMap)
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/c": rwKey}, m.targetRwSnapshotMap)
+	assert.Equal(t, map[MountTarget]string{"/a": "a", "/c": "c"}, m.targetVolumeMap)
+	assert.Equal(t, map[string]int{"sha256:foo": 2}, m.MountedImages(), "mounts of images are counted after restart")
+
+	// Snapshots failed to be destroyed are kept in the state file, and destroyed on restart.
+	runtime.broken = true
+	require.NoError(t, m.Unmount(ctx, "a", "/a"))
+	require.NoError(t, m.Unmount(ctx, "c", "/c"))
+	assert.Len(t, runtime.snapshots, 2)
+	assert.Empty(t, m.MountedImages())
+
+	runtime.broken = false
+	m = NewMounter(runtime, WithStateFile(path), withMounts(mounted))
+	assert.Empty(t, runtime.snapshots)
+	assert.Empty(t, m.repairs)
+	state, err = (&stateFile{path: path}).load()
+	require.NoError(t, err)
+	assert.Empty(t, state.Snapshots)
+	assert.Zero(t, runtime.updates)
+}
+
+func TestStateFileKeepsPlacesOfSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mounts.json")
+	runtime := newFakeRuntime()
+	mounted := map[MountTarget]struct{}{"/a": {}, "/c": {}}
+	m := NewMounter(runtime, WithStateFile(path), withMounts(mounted))
+
+	image, err := reference.ParseDockerRef("foo:v1")
+	require.NoError(t, err)
+	ctx := WithSnapshotter(WithNamespace(context.Background(), "csi"), "stargz")
+	require.NoError(t, m.Mount(ctx, "a", "/a", image, true))
+	require.NoError(t, m.Mount(ctx, "c", "/c", image, false))
+	roKey := genROSnapshotKey("csi", "stargz", "sha256:foo")
+	rwKey := GenSnapshotKey("c")
+	place := snapshotPlace{namespace: "csi", snapshotter: "stargz"}
+
+	state, err := (&stateFile{path: path}).load()
+	require.NoError(t, err)
+	assert.Equal(t, []snapshotState{
+		{Key: rwKey, ReadWrite: true, Namespace: "csi", Snapshotter: "stargz",
+			Mounts: []volumeMount{{VolumeID: "c", Target: "/c"}}},
+		{Key: roKey, Namespace: "csi", Snapshotter: "stargz", Mounts: []volumeMount{{VolumeID: "a", Target: "/a"}}},
+	}, state.Snapshots)
+
+	// The runtime forgets where snapshots are on restart, and learns it from the state file.
+	runtime.located = make(map[SnapshotKey]snapshotPlace)
+	delete(mounted, "/c")
+	m = NewMounter(runtime, WithStateFile(path), withMounts(mounted))
+	assert.Equal(t, map[SnapshotKey]snapshotPlace{roKey: place}, runtime.located)
+	assert.Equal(t, place, runtime.destroyed[rwKey], "snapshots are destroyed where they are")
+
+	state, err = (&stateFile{path: path}).load()
+	require.NoError(t, err)
+	assert.Equal(t, []snapshotState{
+		{Key: roKey, Namespace: "csi", Snapshotter: "stargz", Mounts: []volumeMount{{VolumeID: "a", Target: "/a"}}},
+	}, state.Snapshots)
+
+	require.NoError(t, m.Unmount(context.Background(), "a", "/a"))
+	assert.Equal(t, place, runtime.destroyed[roKey])
+	assert.Empty(t, m.snapshotPlaces)
+}
+
+func TestMigrateToStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mounts.json")
+	runtime := newFakeRuntime()
+	roKey := GenSnapshotKey("sha256:foo")
+	rwKey := GenSnapshotKey("c")
+	runtime.snapshots[roKey] = map[MountTarget]struct{}{"/a": {}, "/b": {}}
+	runtime.snapshots[rwKey] = map[MountTarget]struct{}{"/c": {}}
+	runtime.rw[rwKey] = true
+
+	m := NewMounter(runtime, WithStateFile(path), withMounts(map[MountTarget]struct{}{"/a": {}, "/c": {}}))
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/a": roKey}, m.targetRoSnapshotMap)
+	assert.Equal(t, map[MountTarget]SnapshotKey{"/c": rwKey}, m.targetRwSnapshotMap)
+	assert.Empty(t, runtime.snapshots[roKey], "targets are removed from the runtime")
+	assert.Empty(t, runtime.snapshots[rwKey])
+	assert.True(t, runtime.rw[rwKey], "read-write snapshots should still be marked")
+	assert.False(t, runtime.rw[roKey])
+
+	state, err := (&stateFile{path: path}).load()
+	require.NoError(t, err)
+	assert.Equal(t, []snapshotState{
+		{Key: rwKey, ReadWrite: true, Mounts: []volumeMount{{Target: "/c"}}},
+		{Key: roKey, Mounts: []volumeMount{{Target: "/a"}}},
+	}, state.Snapshots)
+}
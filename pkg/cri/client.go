@@ -14,6 +14,26 @@ import (
 const maxMsgSize = 1024 * 1024 * 16
 
 func NewRemoteImageService(endpoint string, connectionTimeout time.Duration) (cri.ImageServiceClient, error) {
+	conn, err := dial(endpoint, connectionTimeout)
+	if err != nil {
+		klog.Errorf("Connect remote image service %s failed: %v", endpoint, err)
+		return nil, err
+	}
+
+	return cri.NewImageServiceClient(conn), nil
+}
+
+func NewRemoteRuntimeService(endpoint string, connectionTimeout time.Duration) (cri.RuntimeServiceClient, error) {
+	conn, err := dial(endpoint, connectionTimeout)
+	if err != nil {
+		klog.Errorf("Connect remote runtime service %s failed: %v", endpoint, err)
+		return nil, err
+	}
+
+	return cri.NewRuntimeServiceClient(conn), nil
+}
+
+func dial(endpoint string, connectionTimeout time.Duration) (*grpc.ClientConn, error) {
 	addr, dialer, err := util.GetAddressAndDialer(endpoint)
 	if err != nil {
 		return nil, err
@@ -22,17 +42,10 @@ func NewRemoteImageService(endpoint string, connectionTimeout time.Duration) (cr
 	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
 	defer cancel()
 
-	conn, err := grpc.DialContext(ctx, addr,
+	return grpc.DialContext(ctx, addr,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithContextDialer(dialer),
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize)),
 		grpc.WithBlock(),
 	)
-
-	if err != nil {
-		klog.Errorf("Connect remote image service %s failed: %v", addr, err)
-		return nil, err
-	}
-
-	return cri.NewImageServiceClient(conn), nil
 }
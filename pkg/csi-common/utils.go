@@ -132,6 +132,10 @@ func (d *CSIDriver) GetNodeID() string {
 	return d.nodeID
 }
 
+func (d *CSIDriver) GetName() string {
+	return d.name
+}
+
 func (d *CSIDriver) AddControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) {
 	var csc []*csi.ControllerServiceCapability
 
@@ -142,6 +146,10 @@ func (d *CSIDriver) AddControllerServiceCapabilities(cl []csi.ControllerServiceC
 	d.controllerCapabilities = csc
 }
 
+func (d *CSIDriver) GetControllerServiceCapabilities() []*csi.ControllerServiceCapability {
+	return d.controllerCapabilities
+}
+
 func (d *CSIDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_AccessMode_Mode) {
 	var vca []*csi.VolumeCapability_AccessMode
 	for _, c := range vc {
@@ -0,0 +1,105 @@
+// Package events emits Kubernetes Events on pods consuming image volumes.
+package events
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// Reasons of events emitted by the node plugin.
+const (
+	ReasonPulling     = "Pulling"
+	ReasonPulled      = "Pulled"
+	ReasonPullFailed  = "PullFailed"
+	ReasonMounted     = "Mounted"
+	ReasonMountFailed = "MountFailed"
+	// ReasonUpdated is emitted when a volume following a tag switches to the new image.
+	ReasonUpdated = "Updated"
+)
+
+const (
+	component = "container-image-csi-driver"
+
+	// Keys of pod info in the VolumeContext. They are populated by the kubelet if podInfoOnMount is enabled.
+	podNameKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey = "csi.storage.k8s.io/pod.namespace"
+	podUIDKey       = "csi.storage.k8s.io/pod.uid"
+
+	// Events of the same pod are limited to a burst of 25 and then 1 every 10 seconds.
+	eventBurst = 25
+	eventQPS   = 0.1
+)
+
+// Recorder emits events on pods.
+type Recorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+}
+
+// NewRecorder creates an event recorder which sends rate-limited events via the given client.
+func NewRecorder(client kubernetes.Interface, nodeName string) *Recorder {
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: eventBurst,
+		QPS:       eventQPS,
+	}))
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &Recorder{
+		broadcaster: broadcaster,
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+			Component: component,
+			Host:      nodeName,
+		}),
+	}
+}
+
+// Shutdown stops sending events.
+func (r *Recorder) Shutdown() {
+	r.broadcaster.Shutdown()
+}
+
+// Eventf emits an event on the pod identified in the VolumeContext.
+// Nothing is emitted if the pod can't be identified.
+func (r *Recorder) Eventf(volumeContext map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	pod := podFromVolumeContext(volumeContext)
+	if pod == nil {
+		klog.V(4).Infof("no pod found in the volume context. skip event %q", reason)
+		return
+	}
+
+	r.recorder.Eventf(pod, eventType, reason, messageFmt, args...)
+}
+
+func podFromVolumeContext(volumeContext map[string]string) *corev1.ObjectReference {
+	name := volumeContext[podNameKey]
+	if name == "" {
+		name = volumeContext["pod-name"]
+	}
+
+	namespace := volumeContext[podNamespaceKey]
+	if namespace == "" {
+		namespace = volumeContext["namespace"]
+	}
+
+	uid := volumeContext[podUIDKey]
+	if uid == "" {
+		uid = volumeContext["uid"]
+	}
+
+	if name == "" || namespace == "" {
+		return nil
+	}
+
+	return &corev1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Name:       name,
+		Namespace:  namespace,
+		UID:        types.UID(uid),
+	}
+}
@@ -0,0 +1,46 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRecorder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder := NewRecorder(client, "node")
+	defer recorder.Shutdown()
+
+	recorder.Eventf(map[string]string{
+		podNameKey:      "foo",
+		podNamespaceKey: "default",
+		podUIDKey:       "uid",
+	}, corev1.EventTypeNormal, ReasonPulled, "Successfully pulled image %q", "docker.io/library/alpine:3")
+	recorder.Eventf(map[string]string{}, corev1.EventTypeWarning, ReasonMountFailed, "no pod")
+
+	var events []corev1.Event
+	err := wait.PollUntilContextTimeout(context.Background(), 100*time.Millisecond, 10*time.Second, true,
+		func(ctx context.Context) (bool, error) {
+			list, err := client.CoreV1().Events("default").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return false, err
+			}
+
+			events = list.Items
+			return len(events) > 0, nil
+		})
+	assert.NoError(t, err)
+
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, ReasonPulled, events[0].Reason)
+		assert.Equal(t, "foo", events[0].InvolvedObject.Name)
+		assert.Equal(t, "Pod", events[0].InvolvedObject.Kind)
+		assert.Equal(t, "node", events[0].Source.Host)
+	}
+}
@@ -0,0 +1,483 @@
+// Package follow keeps read-only volumes up to date with the tags of their images.
+//
+// The target of a following volume is a small tmpfs, laid out like ConfigMap volumes:
+//
+//	target/..<image-id>/   the read-only snapshot of the current image
+//	target/..data          symlink to the directory of the current image
+//	target/<entry>         symlinks to ..data/<entry> for each top-level entry of the image
+//
+// When the tag moves, the new image is mounted beside the current one, ..data is flipped atomically via rename, and
+// the old snapshot is released. Pods must mount these volumes with mountPropagation HostToContainer to see snapshots
+// mounted after they start.
+package follow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"github.com/warm-metal/container-image-csi-driver/pkg/events"
+	"github.com/warm-metal/container-image-csi-driver/pkg/imagegc"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	k8smount "k8s.io/mount-utils"
+)
+
+const (
+	dataLink = "..data"
+	// tmpfsSize is the size of the tmpfs holding symlinks and mountpoints of snapshots.
+	tmpfsSize = "1m"
+)
+
+// Source resolves and pulls images of following volumes with credentials of the volumes.
+type Source interface {
+	// Resolve returns the digest which the tag of the image currently points to in the registry.
+	Resolve(ctx context.Context, image reference.Named, volumeContext map[string]string) (digest.Digest, error)
+	// Pull pulls the image and returns its local image ID.
+	Pull(ctx context.Context, image reference.Named, volumeContext map[string]string) (string, error)
+	// MountContext returns the context to mount images of the volume, e.g. with the snapshotter of the volume.
+	MountContext(ctx context.Context, volumeContext map[string]string) (context.Context, error)
+}
+
+// Volume is a volume following the tag of its image.
+type Volume struct {
+	VolumeID string `json:"volumeID"`
+	Target   string `json:"target"`
+	// Image is the reference by tag being followed.
+	Image string `json:"image"`
+	// ImageID is the ID of the local image currently exposed.
+	ImageID string `json:"imageID"`
+	// Digest is the digest of the tag when it was resolved last.
+	Digest        digest.Digest     `json:"digest,omitempty"`
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	// Retired are directories of previous images which couldn't be released yet, e.g. files are still open.
+	Retired []string `json:"retired,omitempty"`
+}
+
+// volume is a published volume. Its lock serializes updates and unpublishing.
+type volume struct {
+	sync.Mutex
+	Volume
+	unpublished bool
+}
+
+// Follower publishes volumes following tags and switches them to new images.
+type Follower struct {
+	path     string
+	mounter  backend.Mounter
+	source   Source
+	recorder *events.Recorder
+	tracker  *imagegc.Tracker
+
+	mountTmpfs func(target string) error
+	unmount    func(target string) error
+
+	guard   sync.Mutex
+	volumes map[string]*volume
+	// records are persisted copies of volumes
+	records map[string]Volume
+}
+
+// Load loads following volumes from the given file. Volumes whose targets are no longer mountpoints are dropped.
+// recorder and tracker are optional.
+func Load(
+	path string, mounter backend.Mounter, source Source, recorder *events.Recorder, tracker *imagegc.Tracker,
+) (*Follower, error) {
+	f := &Follower{
+		path:     path,
+		mounter:  mounter,
+		source:   source,
+		recorder: recorder,
+		tracker:  tracker,
+		mountTmpfs: func(target string) error {
+			return k8smount.New("").Mount("tmpfs", target, "tmpfs", []string{"size=" + tmpfsSize, "mode=0755"})
+		},
+		unmount: func(target string) error {
+			return k8smount.New("").Unmount(target)
+		},
+		volumes: make(map[string]*volume),
+		records: make(map[string]Volume),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+
+		return nil, fmt.Errorf("unable to read following volumes %q: %w", path, err)
+	}
+
+	var persisted []*Volume
+	if err = json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("unable to decode following volumes %q: %w", path, err)
+	}
+
+	mountChecker := k8smount.New("")
+	for _, v := range persisted {
+		if notMount, err := mountChecker.IsLikelyNotMountPoint(v.Target); err != nil || notMount {
+			klog.Infof("following volume %q at %q is not mounted any more. forget it", v.VolumeID, v.Target)
+			continue
+		}
+
+		f.volumes[v.Target] = &volume{Volume: *v}
+		f.records[v.Target] = *v
+	}
+
+	klog.Infof("loaded %d following volumes from %q", len(f.volumes), path)
+	return f, nil
+}
+
+// Follows returns true if the target is published by the follower.
+func (f *Follower) Follows(target string) bool {
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	_, found := f.volumes[target]
+	return found
+}
+
+// Publish mounts the local image of the given ID, which has been pulled via the tag image, to the target and starts
+// following the tag.
+func (f *Follower) Publish(
+	ctx context.Context, volumeID, target string, image reference.Named, imageID string,
+	volumeContext map[string]string,
+) (err error) {
+	if err = f.mountTmpfs(target); err != nil {
+		return fmt.Errorf("unable to mount tmpfs to %q: %w", target, err)
+	}
+
+	defer func() {
+		if err != nil {
+			if unmountErr := f.unmount(target); unmountErr != nil {
+				klog.Errorf("unable to unmount %q: %s", target, unmountErr)
+			}
+		}
+	}()
+
+	v := &volume{Volume: Volume{VolumeID: volumeID, Target: target, Image: image.String(), ImageID: imageID,
+		VolumeContext: volumeContext}}
+	v.Lock()
+	defer v.Unlock()
+	if v.Digest, err = f.source.Resolve(ctx, image, volumeContext); err != nil {
+		klog.Warningf("unable to resolve image %q. it will be resolved later: %s", image, err)
+		err = nil
+	}
+
+	if err = f.expose(ctx, &v.Volume, image, imageID); err != nil {
+		return err
+	}
+
+	f.guard.Lock()
+	f.volumes[target] = v
+	f.guard.Unlock()
+	return f.commit(v)
+}
+
+// Unpublish releases all images mounted to the target and unmounts it.
+func (f *Follower) Unpublish(ctx context.Context, target string) error {
+	f.guard.Lock()
+	v := f.volumes[target]
+	f.guard.Unlock()
+	if v == nil {
+		return fmt.Errorf("target %q is not following any image", target)
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	dirs := append([]string{versionDir(v.ImageID)}, v.Retired...)
+	for _, dir := range dirs {
+		if err := f.release(ctx, &v.Volume, dir); err != nil {
+			return err
+		}
+	}
+
+	if err := f.unmount(target); err != nil {
+		return err
+	}
+
+	v.unpublished = true
+	f.guard.Lock()
+	delete(f.volumes, target)
+	f.guard.Unlock()
+	return f.commit(v)
+}
+
+// Run checks tags of following volumes every interval until the context is cancelled.
+func (f *Follower) Run(ctx context.Context, interval time.Duration) {
+	klog.Infof("check tags of following volumes every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.Refresh(ctx)
+		}
+	}
+}
+
+// Refresh switches following volumes whose tags moved to the new images, and retries releasing previous images.
+func (f *Follower) Refresh(ctx context.Context) {
+	f.guard.Lock()
+	volumes := make([]*volume, 0, len(f.volumes))
+	for _, v := range f.volumes {
+		volumes = append(volumes, v)
+	}
+	f.guard.Unlock()
+
+	for _, v := range volumes {
+		v.Lock()
+		if !v.unpublished {
+			if err := f.refresh(ctx, &v.Volume); err != nil {
+				klog.Errorf("unable to update volume %q to the latest image %q: %s", v.VolumeID, v.Image, err)
+			}
+
+			if err := f.commit(v); err != nil {
+				klog.Errorf("unable to save following volumes: %s", err)
+			}
+		}
+		v.Unlock()
+	}
+}
+
+func (f *Follower) refresh(ctx context.Context, v *Volume) error {
+	retired := v.Retired[:0]
+	for _, dir := range v.Retired {
+		if err := f.release(ctx, v, dir); err != nil {
+			klog.Warningf("unable to release %q of volume %q. retry later: %s", dir, v.VolumeID, err)
+			retired = append(retired, dir)
+		}
+	}
+	v.Retired = retired
+
+	image, err := reference.ParseDockerRef(v.Image)
+	if err != nil {
+		return err
+	}
+
+	dgst, err := f.source.Resolve(ctx, image, v.VolumeContext)
+	if err != nil {
+		return err
+	}
+
+	if dgst == v.Digest {
+		return nil
+	}
+
+	klog.Infof("tag of image %q moved to %s. pull it", image, dgst)
+	imageID, err := f.source.Pull(ctx, image, v.VolumeContext)
+	if err != nil {
+		return err
+	}
+
+	if f.tracker != nil {
+		// Images must not be collected after being pulled and before being mounted. Pulls are not blocked by the
+		// collector and don't block it either.
+		done := f.tracker.BeginUse()
+		defer done()
+	}
+
+	if imageID == v.ImageID {
+		v.Digest = dgst
+		return nil
+	}
+
+	previous := versionDir(v.ImageID)
+	if err = f.expose(ctx, v, image, imageID); err != nil {
+		return err
+	}
+
+	v.Digest = dgst
+	if f.recorder != nil {
+		f.recorder.Eventf(v.VolumeContext, corev1.EventTypeNormal, events.ReasonUpdated, "Switched to image %q (%s)", image, dgst)
+	}
+
+	if err = f.release(ctx, v, previous); err != nil {
+		klog.Warningf("unable to release %q of volume %q. retry later: %s", previous, v.VolumeID, err)
+		v.Retired = append(v.Retired, previous)
+	}
+
+	return nil
+}
+
+// expose mounts the image beside the current one, then atomically switches the target to it.
+// Images of retired directories are still mounted and switched back to directly.
+func (f *Follower) expose(ctx context.Context, v *Volume, image reference.Named, imageID string) (err error) {
+	dir := filepath.Join(v.Target, versionDir(imageID))
+	for i, retired := range v.Retired {
+		if retired == versionDir(imageID) {
+			v.Retired = append(v.Retired[:i], v.Retired[i+1:]...)
+			if err = switchTo(v.Target, retired); err != nil {
+				v.Retired = append(v.Retired, retired)
+				return err
+			}
+
+			v.ImageID = imageID
+			return nil
+		}
+	}
+
+	mountCtx, err := f.source.MountContext(ctx, v.VolumeContext)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	if f.tracker != nil {
+		mountCtx = backend.WithCRIImageID(mountCtx, imageID)
+	}
+
+	if err = f.mounter.Mount(mountCtx, v.VolumeID, backend.MountTarget(dir), image, true); err != nil {
+		return err
+	}
+
+	if f.tracker != nil {
+		if err := f.tracker.Mounted(imageID, image.String()); err != nil {
+			klog.Errorf("unable to track the mount of image %q: %s", image, err)
+		}
+	}
+
+	if err = switchTo(v.Target, versionDir(imageID)); err != nil {
+		if unmountErr := f.mounter.Unmount(ctx, v.VolumeID, backend.MountTarget(dir)); unmountErr != nil {
+			klog.Errorf("unable to unmount %q: %s", dir, unmountErr)
+		}
+
+		return err
+	}
+
+	v.ImageID = imageID
+	return nil
+}
+
+// release unmounts the image at the given directory of the target, which releases its snapshot.
+func (f *Follower) release(ctx context.Context, v *Volume, name string) error {
+	dir := filepath.Join(v.Target, name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := f.mounter.Unmount(ctx, v.VolumeID, backend.MountTarget(dir)); err != nil {
+		return err
+	}
+
+	return os.Remove(dir)
+}
+
+// switchTo points ..data to the given directory of the target atomically, and links top-level entries of it.
+func switchTo(target, dir string) error {
+	entries, err := os.ReadDir(filepath.Join(target, dir))
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(target, dataLink+"_tmp")
+	if err = os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = os.Symlink(dir, tmp); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(target, dataLink)); err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..") {
+			continue
+		}
+
+		wanted[e.Name()] = true
+		link := filepath.Join(target, e.Name())
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+
+		if err = os.Symlink(filepath.Join(dataLink, e.Name()), link); err != nil {
+			return err
+		}
+	}
+
+	existing, err := os.ReadDir(target)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range existing {
+		if strings.HasPrefix(e.Name(), "..") || wanted[e.Name()] {
+			continue
+		}
+
+		if err = os.Remove(filepath.Join(target, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// versionDir returns the name of the directory of the image in targets.
+func versionDir(imageID string) string {
+	return ".." + strings.ReplaceAll(imageID, ":", "-")
+}
+
+// commit saves the locked volume, or forgets it if it is unpublished.
+func (f *Follower) commit(v *volume) error {
+	f.guard.Lock()
+	defer f.guard.Unlock()
+	if v.unpublished {
+		delete(f.records, v.Target)
+	} else {
+		record := v.Volume
+		record.Retired = append([]string(nil), v.Retired...)
+		f.records[v.Target] = record
+	}
+
+	return f.save()
+}
+
+func (f *Follower) save() error {
+	persisted := make([]Volume, 0, len(f.records))
+	for _, v := range f.records {
+		persisted = append(persisted, v)
+	}
+
+	sort.Slice(persisted, func(i, j int) bool {
+		return persisted[i].Target < persisted[j].Target
+	})
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write following volumes: %w", err)
+	}
+
+	if err = os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("unable to save following volumes: %w", err)
+	}
+
+	return nil
+}
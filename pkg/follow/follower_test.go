@@ -0,0 +1,171 @@
+package follow
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+)
+
+// fakeMounter "mounts" images by writing their top-level entries to targets.
+type fakeMounter struct {
+	entries     map[string][]string
+	mounted     map[backend.MountTarget]string
+	unmountBusy bool
+}
+
+func (m *fakeMounter) Mount(_ context.Context, _ string, target backend.MountTarget, image reference.Named, ro bool) error {
+	if !ro {
+		return errors.New("following volumes must be read-only")
+	}
+
+	for _, entry := range m.entries[image.String()] {
+		if err := os.WriteFile(filepath.Join(string(target), entry), []byte(image.String()), 0o644); err != nil {
+			return err
+		}
+	}
+
+	m.mounted[target] = image.String()
+	return nil
+}
+
+func (m *fakeMounter) Unmount(_ context.Context, _ string, target backend.MountTarget) error {
+	if m.unmountBusy {
+		return errors.New("device or resource busy")
+	}
+
+	entries, err := os.ReadDir(string(target))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err = os.Remove(filepath.Join(string(target), e.Name())); err != nil {
+			return err
+		}
+	}
+
+	delete(m.mounted, target)
+	return nil
+}
+
+func (m *fakeMounter) ImageExists(context.Context, reference.Named) bool { return true }
+func (m *fakeMounter) MountedImages() map[string]int                     { return nil }
+
+type fakeSource struct {
+	digest  digest.Digest
+	imageID string
+	pulls   int
+}
+
+func (s *fakeSource) Resolve(context.Context, reference.Named, map[string]string) (digest.Digest, error) {
+	return s.digest, nil
+}
+
+func (s *fakeSource) MountContext(ctx context.Context, _ map[string]string) (context.Context, error) {
+	return ctx, nil
+}
+
+func (s *fakeSource) Pull(context.Context, reference.Named, map[string]string) (string, error) {
+	s.pulls++
+	return s.imageID, nil
+}
+
+func newFollower(t *testing.T, mounter *fakeMounter, source *fakeSource) *Follower {
+	f, err := Load(filepath.Join(t.TempDir(), "follow.json"), mounter, source, nil, nil)
+	assert.NoError(t, err)
+	f.mountTmpfs = func(string) error { return nil }
+	f.unmount = func(string) error { return nil }
+	return f
+}
+
+func readLink(t *testing.T, target, name string) string {
+	data, err := os.ReadFile(filepath.Join(target, name))
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestFollow(t *testing.T) {
+	ctx := context.TODO()
+	image, err := reference.ParseDockerRef("docker.io/foo/config:latest")
+	assert.NoError(t, err)
+
+	mounter := &fakeMounter{
+		entries: map[string][]string{image.String(): {"etc", "old"}},
+		mounted: map[backend.MountTarget]string{},
+	}
+	source := &fakeSource{digest: digest.FromString("v1"), imageID: "sha256:v1"}
+	f := newFollower(t, mounter, source)
+
+	target := t.TempDir()
+	assert.NoError(t, f.Publish(ctx, "vol", target, image, "sha256:v1", nil))
+	assert.True(t, f.Follows(target))
+	assert.Equal(t, image.String(), readLink(t, target, "etc"))
+	link, err := os.Readlink(filepath.Join(target, dataLink))
+	assert.NoError(t, err)
+	assert.Equal(t, "..sha256-v1", link)
+
+	// Nothing is pulled if the tag doesn't move.
+	f.Refresh(ctx)
+	assert.Equal(t, 0, source.pulls)
+
+	// The tag moves. The old snapshot stays if it is busy.
+	source.digest, source.imageID = digest.FromString("v2"), "sha256:v2"
+	mounter.entries[image.String()] = []string{"etc", "new"}
+	mounter.unmountBusy = true
+	f.Refresh(ctx)
+	assert.Equal(t, 1, source.pulls)
+	link, err = os.Readlink(filepath.Join(target, dataLink))
+	assert.NoError(t, err)
+	assert.Equal(t, "..sha256-v2", link)
+	_, err = os.Lstat(filepath.Join(target, "old"))
+	assert.True(t, os.IsNotExist(err), "entries of the old image should be removed")
+	_, err = os.Lstat(filepath.Join(target, "new"))
+	assert.NoError(t, err)
+	assert.Len(t, mounter.mounted, 2)
+	assert.Equal(t, []string{"..sha256-v1"}, f.volumes[target].Retired)
+
+	// The old snapshot is released once it isn't busy.
+	mounter.unmountBusy = false
+	f.Refresh(ctx)
+	assert.Len(t, mounter.mounted, 1)
+	assert.Empty(t, f.volumes[target].Retired)
+
+	// Volumes are persisted to be restored after restarts.
+	data, err := os.ReadFile(f.path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"imageID":"sha256:v2"`)
+
+	assert.NoError(t, f.Unpublish(ctx, target))
+	assert.False(t, f.Follows(target))
+	assert.Empty(t, mounter.mounted)
+	data, err = os.ReadFile(f.path)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+}
+
+func TestSwitchTo(t *testing.T) {
+	target := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(target, "..a", "bin"), 0o755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(target, "..b", "lib"), 0o755))
+
+	assert.NoError(t, switchTo(target, "..a"))
+	link, err := os.Readlink(filepath.Join(target, "bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dataLink, "bin"), link)
+
+	assert.NoError(t, switchTo(target, "..b"))
+	entries, err := os.ReadDir(target)
+	assert.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"..a", "..b", "..data", "lib"}, names)
+}
@@ -0,0 +1,79 @@
+package imagecache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const repoDigestIndex = "repoDigest"
+
+// Index finds nodes holding an image via NodeImageCache objects.
+type Index struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewIndex creates an index of NodeImageCache objects. Call Run to start syncing.
+func NewIndex(client dynamic.Interface, resyncPeriod time.Duration) (*Index, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resyncPeriod)
+	informer := factory.ForResource(v1alpha1.NodeImageCacheResource).Informer()
+	if err := informer.AddIndexers(cache.Indexers{
+		repoDigestIndex: func(obj interface{}) ([]string, error) {
+			nodeCache := &v1alpha1.NodeImageCache{}
+			if err := v1alpha1.FromUnstructured(obj, nodeCache); err != nil {
+				return nil, err
+			}
+
+			var digests []string
+			for _, img := range nodeCache.Status.Images {
+				digests = append(digests, img.RepoDigests...)
+			}
+
+			return digests, nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to index NodeImageCache objects: %w", err)
+	}
+
+	return &Index{informer: informer}, nil
+}
+
+// Run syncs NodeImageCache objects until the context is cancelled.
+func (i *Index) Run(ctx context.Context) {
+	klog.Infof("start watching NodeImageCache objects")
+	i.informer.Run(ctx.Done())
+}
+
+// HasSynced returns true if NodeImageCache objects have been synced.
+func (i *Index) HasSynced() bool {
+	return i.informer.HasSynced()
+}
+
+// NodesWithImage returns names of nodes holding the image of the given repo digest,
+// e.g. "docker.io/library/alpine@sha256:...", sorted.
+func (i *Index) NodesWithImage(repoDigest string) ([]string, error) {
+	objs, err := i.informer.GetIndexer().ByIndex(repoDigestIndex, repoDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		nodeCache := &v1alpha1.NodeImageCache{}
+		if err = v1alpha1.FromUnstructured(obj, nodeCache); err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, nodeCache.Name)
+	}
+
+	sort.Strings(nodes)
+	return nodes, nil
+}
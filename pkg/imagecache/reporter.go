@@ -0,0 +1,167 @@
+// Package imagecache publishes images cached on nodes via NodeImageCache objects,
+// so that volumes can be placed on nodes which already hold their images.
+package imagecache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/metrics"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
+)
+
+// Reporter reports images in the runtime of the current node to the NodeImageCache object of the node.
+type Reporter struct {
+	nodeName   string
+	kubeClient kubernetes.Interface
+	client     dynamic.Interface
+	imageSvc   cri.ImageServiceClient
+}
+
+// NewReporter creates a reporter of the given node.
+func NewReporter(
+	nodeName string, kubeClient kubernetes.Interface, client dynamic.Interface, imageSvc cri.ImageServiceClient,
+) *Reporter {
+	return &Reporter{
+		nodeName:   nodeName,
+		kubeClient: kubeClient,
+		client:     client,
+		imageSvc:   imageSvc,
+	}
+}
+
+// Run reports images periodically until the context is cancelled.
+func (r *Reporter) Run(ctx context.Context, interval time.Duration) {
+	klog.Infof("start reporting cached images of node %q every %s", r.nodeName, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Report(ctx); err != nil {
+			klog.Errorf("unable to report cached images: %s", err)
+			metrics.OperationErrorsCount.WithLabelValues("image-cache-report").Inc()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Report saves images in the runtime to the NodeImageCache object of the node once.
+// The object is created if it doesn't exist, and is owned by the node to be removed along with it.
+// It is not updated if images are not changed.
+func (r *Reporter) Report(ctx context.Context) error {
+	resp, err := r.imageSvc.ListImages(ctx, &cri.ListImagesRequest{})
+	if err != nil {
+		return err
+	}
+
+	images := make([]v1alpha1.CachedImage, 0, len(resp.Images))
+	for _, img := range resp.Images {
+		if len(img.RepoDigests) == 0 && len(img.RepoTags) == 0 {
+			continue
+		}
+
+		images = append(images, v1alpha1.CachedImage{
+			RepoDigests: sortedCopy(img.RepoDigests),
+			RepoTags:    sortedCopy(img.RepoTags),
+			Size:        int64(img.Size),
+		})
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return imageKey(images[i]) < imageKey(images[j])
+	})
+
+	resource := r.client.Resource(v1alpha1.NodeImageCacheResource)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := resource.Get(ctx, r.nodeName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			obj, err = r.create(ctx)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		nodeCache := &v1alpha1.NodeImageCache{}
+		if err = v1alpha1.FromUnstructured(obj, nodeCache); err != nil {
+			return err
+		}
+
+		if nodeCache.Status.LastUpdateTime != nil && reflect.DeepEqual(nodeCache.Status.Images, images) {
+			return nil
+		}
+
+		now := metav1.Now()
+		nodeCache.Status = v1alpha1.NodeImageCacheStatus{Images: images, LastUpdateTime: &now}
+		updated, err := v1alpha1.ToUnstructured(nodeCache)
+		if err != nil {
+			return err
+		}
+
+		if _, err = resource.UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+
+		klog.V(4).Infof("reported %d cached images of node %q", len(images), r.nodeName)
+		return nil
+	})
+}
+
+func (r *Reporter) create(ctx context.Context) (*unstructured.Unstructured, error) {
+	node, err := r.kubeClient.CoreV1().Nodes().Get(ctx, r.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch node %q: %w", r.nodeName, err)
+	}
+
+	nodeCache, err := v1alpha1.ToUnstructured(&v1alpha1.NodeImageCache{
+		TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.GroupName + "/" + v1alpha1.Version, Kind: "NodeImageCache"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: r.nodeName,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Node",
+				Name:       node.Name,
+				UID:        node.UID,
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.client.Resource(v1alpha1.NodeImageCacheResource).Create(ctx, nodeCache, metav1.CreateOptions{})
+}
+
+func sortedCopy(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+
+	c := append([]string(nil), s...)
+	sort.Strings(c)
+	return c
+}
+
+func imageKey(img v1alpha1.CachedImage) string {
+	if len(img.RepoDigests) > 0 {
+		return img.RepoDigests[0]
+	}
+
+	return img.RepoTags[0]
+}
@@ -0,0 +1,83 @@
+package imagecache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+type fakeImageService struct {
+	cri.ImageServiceClient
+	images []*cri.Image
+}
+
+func (f *fakeImageService) ListImages(context.Context, *cri.ListImagesRequest, ...grpc.CallOption) (*cri.ListImagesResponse, error) {
+	return &cri.ListImagesResponse{Images: f.images}, nil
+}
+
+func TestReport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kubeClient := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: "uid-1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2", UID: "uid-2"}},
+	)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.NodeImageCacheResource: "NodeImageCacheList"})
+
+	alpine := "docker.io/library/alpine@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	nginx := "docker.io/library/nginx@sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	node1Images := &fakeImageService{images: []*cri.Image{
+		{Id: "nginx", RepoDigests: []string{nginx}, RepoTags: []string{"docker.io/library/nginx:latest"}, Size: 200},
+		{Id: "alpine", RepoDigests: []string{alpine}, Size: 100},
+		{Id: "dangling", Size: 10},
+	}}
+
+	assert.NoError(t, NewReporter("node-1", kubeClient, client, node1Images).Report(ctx))
+	assert.NoError(t, NewReporter("node-2", kubeClient, client, &fakeImageService{images: []*cri.Image{
+		{Id: "alpine", RepoDigests: []string{alpine}, Size: 100},
+	}}).Report(ctx))
+
+	obj, err := client.Resource(v1alpha1.NodeImageCacheResource).Get(ctx, "node-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	nodeCache := &v1alpha1.NodeImageCache{}
+	assert.NoError(t, v1alpha1.FromUnstructured(obj, nodeCache))
+	if assert.Len(t, nodeCache.OwnerReferences, 1) {
+		assert.Equal(t, "uid-1", string(nodeCache.OwnerReferences[0].UID), "the object should be owned by the node")
+	}
+	if assert.Len(t, nodeCache.Status.Images, 2, "images without references should be ignored") {
+		assert.Equal(t, []string{alpine}, nodeCache.Status.Images[0].RepoDigests)
+		assert.Equal(t, int64(200), nodeCache.Status.Images[1].Size)
+	}
+
+	resourceVersion := obj.GetResourceVersion()
+	assert.NoError(t, NewReporter("node-1", kubeClient, client, node1Images).Report(ctx))
+	obj, err = client.Resource(v1alpha1.NodeImageCacheResource).Get(ctx, "node-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, resourceVersion, obj.GetResourceVersion(), "unchanged images should not be reported again")
+
+	index, err := NewIndex(client, 0)
+	assert.NoError(t, err)
+	go index.Run(ctx)
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), index.HasSynced))
+
+	nodes, err := index.NodesWithImage(alpine)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-1", "node-2"}, nodes)
+
+	nodes, err = index.NodesWithImage(nginx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-1"}, nodes)
+}
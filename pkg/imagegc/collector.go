@@ -0,0 +1,202 @@
+package imagegc
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/metrics"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	reasonTTL       = "ttl"
+	reasonQuota     = "quota"
+	reasonMaxImages = "max-images"
+)
+
+// Policy determines which unused images are removed. Zero values disable the corresponding rule.
+type Policy struct {
+	// TTL removes images that haven't been used for the duration.
+	TTL time.Duration
+	// Quota is the total bytes of images pulled by the driver. Least recently used images are removed until
+	// the total size is under the quota.
+	Quota int64
+	// MaxImages is the maximum number of images pulled by the driver. Least recently used images are removed
+	// until the number of images is under the limit.
+	MaxImages int
+}
+
+// Enabled returns true if any rule is set.
+func (p Policy) Enabled() bool {
+	return p.TTL > 0 || p.Quota > 0 || p.MaxImages > 0
+}
+
+// Collector removes unused images pulled by the driver via the CRI image service.
+// Images which are mounted by volumes, used by containers, or pinned by the runtime are never removed.
+type Collector struct {
+	tracker    *Tracker
+	imageSvc   cri.ImageServiceClient
+	runtimeSvc cri.RuntimeServiceClient
+	policy     Policy
+	// onRemoved is called with IDs of removed images.
+	onRemoved func(imageID string)
+}
+
+// NewCollector creates an image collector. onRemoved is optional.
+func NewCollector(
+	tracker *Tracker, imageSvc cri.ImageServiceClient, runtimeSvc cri.RuntimeServiceClient, policy Policy,
+	onRemoved func(imageID string),
+) *Collector {
+	return &Collector{
+		tracker:    tracker,
+		imageSvc:   imageSvc,
+		runtimeSvc: runtimeSvc,
+		policy:     policy,
+		onRemoved:  onRemoved,
+	}
+}
+
+// Run collects images periodically until the context is cancelled.
+func (c *Collector) Run(ctx context.Context, interval time.Duration) {
+	klog.Infof("start collecting images every %s with policy %+v", interval, c.policy)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Collect(ctx); err != nil {
+				klog.Errorf("unable to collect images: %s", err)
+				metrics.OperationErrorsCount.WithLabelValues("image-gc").Inc()
+			}
+		}
+	}
+}
+
+type candidate struct {
+	usage ImageUsage
+	size  int64
+}
+
+// Collect removes images according to the policy once.
+func (c *Collector) Collect(ctx context.Context) error {
+	// Publishing is blocked during collection, so that images are not removed between being checked and mounted.
+	c.tracker.collecting.Lock()
+	defer c.tracker.collecting.Unlock()
+
+	imagesResp, err := c.imageSvc.ListImages(ctx, &cri.ListImagesRequest{})
+	if err != nil {
+		return err
+	}
+
+	images := make(map[string]*cri.Image, len(imagesResp.Images))
+	for _, img := range imagesResp.Images {
+		images[img.Id] = img
+	}
+
+	containersResp, err := c.runtimeSvc.ListContainers(ctx, &cri.ListContainersRequest{})
+	if err != nil {
+		return err
+	}
+
+	usedByContainers := make(map[string]struct{}, 2*len(containersResp.Containers))
+	for _, ctr := range containersResp.Containers {
+		usedByContainers[ctr.ImageRef] = struct{}{}
+		usedByContainers[ctr.ImageId] = struct{}{}
+		if ctr.Image != nil {
+			usedByContainers[ctr.Image.Image] = struct{}{}
+		}
+	}
+
+	var candidates []candidate
+	var totalSize int64
+	numImages := 0
+	for _, usage := range c.tracker.Usages() {
+		if !usage.Pulled {
+			continue
+		}
+
+		img, found := images[usage.ID]
+		if !found {
+			klog.Infof("image %q has been removed by others. forget it", usage.ID)
+			if err = c.tracker.Forget(usage.ID); err != nil {
+				klog.Errorf("unable to forget image %q: %s", usage.ID, err)
+			}
+			continue
+		}
+
+		numImages++
+		totalSize += int64(img.Size)
+		if usage.Mounts > 0 || img.Pinned || imageUsedBy(img, usedByContainers) {
+			continue
+		}
+
+		candidates = append(candidates, candidate{usage: usage, size: int64(img.Size)})
+	}
+
+	// Least recently used images come first.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].usage.lastUsed().Before(candidates[j].usage.lastUsed())
+	})
+
+	now := time.Now()
+	for _, cand := range candidates {
+		reason := ""
+		switch {
+		case c.policy.TTL > 0 && now.Sub(cand.usage.lastUsed()) > c.policy.TTL:
+			reason = reasonTTL
+		case c.policy.Quota > 0 && totalSize > c.policy.Quota:
+			reason = reasonQuota
+		case c.policy.MaxImages > 0 && numImages > c.policy.MaxImages:
+			reason = reasonMaxImages
+		default:
+			continue
+		}
+
+		klog.Infof("remove image %q%v because of %s", cand.usage.ID, cand.usage.Names, reason)
+		if _, err = c.imageSvc.RemoveImage(ctx, &cri.RemoveImageRequest{
+			Image: &cri.ImageSpec{Image: cand.usage.ID},
+		}); err != nil {
+			klog.Errorf("unable to remove image %q: %s", cand.usage.ID, err)
+			metrics.OperationErrorsCount.WithLabelValues("image-gc-remove").Inc()
+			continue
+		}
+
+		metrics.ImageGCRemovedCount.WithLabelValues(reason).Inc()
+		totalSize -= cand.size
+		numImages--
+		if err = c.tracker.Forget(cand.usage.ID); err != nil {
+			klog.Errorf("unable to forget image %q: %s", cand.usage.ID, err)
+		}
+
+		if c.onRemoved != nil {
+			c.onRemoved(cand.usage.ID)
+		}
+	}
+
+	return nil
+}
+
+func imageUsedBy(img *cri.Image, used map[string]struct{}) bool {
+	if _, ok := used[img.Id]; ok {
+		return true
+	}
+
+	for _, tag := range img.RepoTags {
+		if _, ok := used[tag]; ok {
+			return true
+		}
+	}
+
+	for _, digest := range img.RepoDigests {
+		if _, ok := used[digest]; ok {
+			return true
+		}
+	}
+
+	return false
+}
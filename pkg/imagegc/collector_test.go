@@ -0,0 +1,92 @@
+package imagegc
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+type fakeImageService struct {
+	cri.ImageServiceClient
+	images  []*cri.Image
+	removed []string
+}
+
+func (f *fakeImageService) ListImages(context.Context, *cri.ListImagesRequest, ...grpc.CallOption) (*cri.ListImagesResponse, error) {
+	return &cri.ListImagesResponse{Images: f.images}, nil
+}
+
+func (f *fakeImageService) RemoveImage(_ context.Context, req *cri.RemoveImageRequest, _ ...grpc.CallOption) (*cri.RemoveImageResponse, error) {
+	f.removed = append(f.removed, req.Image.Image)
+	return &cri.RemoveImageResponse{}, nil
+}
+
+type fakeRuntimeService struct {
+	cri.RuntimeServiceClient
+	containers []*cri.Container
+}
+
+func (f *fakeRuntimeService) ListContainers(context.Context, *cri.ListContainersRequest, ...grpc.CallOption) (*cri.ListContainersResponse, error) {
+	return &cri.ListContainersResponse{Containers: f.containers}, nil
+}
+
+type fakeMountedImages map[string]int
+
+func (f fakeMountedImages) MountedImages() map[string]int {
+	return f
+}
+
+func TestCollect(t *testing.T) {
+	mounted := fakeMountedImages{"mounted": 1}
+	tracker, err := LoadTracker(filepath.Join(t.TempDir(), "image-usage.json"), mounted)
+	assert.NoError(t, err)
+
+	for _, id := range []string{"mounted", "used-by-container", "pinned", "old", "recent", "not-pulled"} {
+		if id != "not-pulled" {
+			assert.NoError(t, tracker.Pulled(id, "docker.io/library/"+id+":latest"))
+		}
+	}
+	assert.NoError(t, tracker.Mounted("mounted", ""))
+	// Unmounted meanwhile.
+	assert.NoError(t, tracker.Mounted("not-pulled", ""))
+
+	// Make "old" the least recently used image.
+	tracker.images["old"].PulledAt = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, tracker.Mounted("recent", ""))
+
+	imageSvc := &fakeImageService{images: []*cri.Image{
+		{Id: "mounted", Size: 100},
+		{Id: "used-by-container", RepoTags: []string{"docker.io/library/used-by-container:latest"}, Size: 100},
+		{Id: "pinned", Pinned: true, Size: 100},
+		{Id: "old", Size: 100},
+		{Id: "recent", Size: 100},
+		{Id: "not-pulled", Size: 100},
+	}}
+	runtimeSvc := &fakeRuntimeService{containers: []*cri.Container{
+		{Image: &cri.ImageSpec{Image: "docker.io/library/used-by-container:latest"}, ImageRef: "sha256:foo"},
+	}}
+
+	ctx := context.Background()
+	// "mounted" has been mounted for long.
+	tracker.images["mounted"].LastUsed = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, NewCollector(tracker, imageSvc, runtimeSvc, Policy{TTL: time.Hour}, nil).Collect(ctx))
+	assert.Equal(t, []string{"old"}, imageSvc.removed, "only images unused for longer than the TTL should be removed")
+
+	var removed []string
+	onRemoved := func(imageID string) { removed = append(removed, imageID) }
+	imageSvc.removed = nil
+	assert.NoError(t, NewCollector(tracker, imageSvc, runtimeSvc, Policy{Quota: 350}, onRemoved).Collect(ctx))
+	assert.Equal(t, []string{"recent"}, imageSvc.removed, "in-use, pinned and not-pulled images should be kept")
+	assert.Equal(t, []string{"recent"}, removed)
+
+	for _, usage := range tracker.Usages() {
+		assert.NotEqual(t, "old", usage.ID)
+		assert.NotEqual(t, "recent", usage.ID)
+		assert.NotEqual(t, "not-pulled", usage.ID, "unused images not pulled by the driver should not be tracked")
+	}
+}
@@ -0,0 +1,216 @@
+// Package imagegc removes images pulled by the driver once no volumes use them.
+package imagegc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ImageUsage is the usage of a local image tracked by the driver.
+type ImageUsage struct {
+	// ID is the image ID reported by the CRI image service.
+	ID string `json:"id"`
+	// Names are the references the image was pulled or mounted via.
+	Names []string `json:"names,omitempty"`
+	// Pulled is true if the driver pulled the image. Only these images are collected.
+	Pulled   bool      `json:"pulled,omitempty"`
+	PulledAt time.Time `json:"pulledAt,omitempty"`
+	// LastUsed is the last time when the image was seen mounted by volumes.
+	LastUsed time.Time `json:"lastUsed,omitempty"`
+	// Mounts is the number of targets the image is currently mounted to, as counted by the mounter.
+	Mounts int `json:"-"`
+}
+
+// lastUsed returns the time the image was used or pulled last.
+func (u *ImageUsage) lastUsed() time.Time {
+	if u.LastUsed.After(u.PulledAt) {
+		return u.LastUsed
+	}
+
+	return u.PulledAt
+}
+
+// MountedImages counts mounts of images. It is implemented by backend.Mounter.
+type MountedImages interface {
+	// MountedImages returns the number of targets each image is mounted to, keyed by image IDs.
+	MountedImages() map[string]int
+}
+
+// Tracker records which images the driver pulled and when they were used last.
+// Mounts of images are counted by the mounter, which keeps references of snapshots, rather than by the tracker, so
+// that images are in use exactly as long as the mounter refers to them.
+type Tracker struct {
+	path    string
+	mounted MountedImages
+
+	// collecting blocks volume publishing while the collector is removing images.
+	collecting sync.RWMutex
+
+	guard  sync.Mutex
+	images map[string]*ImageUsage
+}
+
+// LoadTracker loads image usages from the given file. Mounts of images are queried from the given mounter.
+func LoadTracker(path string, mounted MountedImages) (*Tracker, error) {
+	t := &Tracker{
+		path:    path,
+		mounted: mounted,
+		images:  make(map[string]*ImageUsage),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+
+		return nil, fmt.Errorf("unable to read image usages %q: %w", path, err)
+	}
+
+	var persisted []*ImageUsage
+	if err = json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("unable to decode image usages %q: %w", path, err)
+	}
+
+	for _, usage := range persisted {
+		t.images[usage.ID] = usage
+	}
+
+	klog.Infof("loaded usages of %d images from %q", len(t.images), path)
+	return t, nil
+}
+
+// BeginUse blocks image removal until the returned function is called.
+// It should be held from checking the existence of an image until the image is mounted, but never across pulls,
+// which would block the collector and then all other volumes being published.
+func (t *Tracker) BeginUse() (done func()) {
+	t.collecting.RLock()
+	return t.collecting.RUnlock
+}
+
+// Pulled records that the driver pulled the image with the given ID via the name.
+func (t *Tracker) Pulled(imageID, name string) error {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	usage := t.usage(imageID, name)
+	usage.Pulled = true
+	usage.PulledAt = time.Now().UTC()
+	return t.save()
+}
+
+// Mounted records that the image has been mounted via the name.
+func (t *Tracker) Mounted(imageID, name string) error {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	usage := t.usage(imageID, name)
+	usage.LastUsed = time.Now().UTC()
+	return t.save()
+}
+
+// Forget removes the image from the tracker.
+func (t *Tracker) Forget(imageID string) error {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	if _, ok := t.images[imageID]; !ok {
+		return nil
+	}
+
+	delete(t.images, imageID)
+	return t.save()
+}
+
+// Usages returns copies of all tracked image usages along with their mounts. Images still mounted are used now, while
+// unmounted images not pulled by the driver are not tracked any more.
+func (t *Tracker) Usages() []ImageUsage {
+	mounts := t.mounted.MountedImages()
+
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	now := time.Now().UTC()
+	changed := false
+	usages := make([]ImageUsage, 0, len(t.images))
+	for id, usage := range t.images {
+		if mounts[id] > 0 {
+			usage.LastUsed = now
+			changed = true
+		} else if !usage.Pulled {
+			delete(t.images, id)
+			changed = true
+			continue
+		}
+
+		u := *usage
+		u.Names = append([]string(nil), usage.Names...)
+		u.Mounts = mounts[id]
+		usages = append(usages, u)
+	}
+
+	if changed {
+		if err := t.save(); err != nil {
+			klog.Errorf("unable to save image usages: %s", err)
+		}
+	}
+
+	return usages
+}
+
+func (t *Tracker) usage(imageID, name string) *ImageUsage {
+	usage := t.images[imageID]
+	if usage == nil {
+		usage = &ImageUsage{ID: imageID}
+		t.images[imageID] = usage
+	}
+
+	if name != "" {
+		i := sort.SearchStrings(usage.Names, name)
+		if i == len(usage.Names) || usage.Names[i] != name {
+			usage.Names = append(usage.Names, "")
+			copy(usage.Names[i+1:], usage.Names[i:])
+			usage.Names[i] = name
+		}
+	}
+
+	return usage
+}
+
+func (t *Tracker) save() error {
+	persisted := make([]*ImageUsage, 0, len(t.images))
+	for _, usage := range t.images {
+		persisted = append(persisted, usage)
+	}
+
+	sort.Slice(persisted, func(i, j int) bool {
+		return persisted[i].ID < persisted[j].ID
+	})
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write image usages: %w", err)
+	}
+
+	if err = os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("unable to save image usages: %w", err)
+	}
+
+	return nil
+}
@@ -13,6 +13,8 @@ const ImagePullTimeKey = "pull_duration_seconds"
 const ImagePullTimeHistKey = "pull_duration_seconds_hist"
 const ImagePullSizeKey = "pull_size_bytes"
 const OperationErrorsCountKey = "operation_errors_total"
+const ImageGCRemovedCountKey = "image_gc_removed_total"
+const SnapshotDriftCountKey = "snapshot_drift_total"
 
 var ImagePullTimeHist = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
@@ -50,12 +52,32 @@ var OperationErrorsCount = prometheus.NewCounterVec(
 	[]string{"operation_type"},
 )
 
+var ImageGCRemovedCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "warm_metal",
+		Name:      ImageGCRemovedCountKey,
+		Help:      "Cumulative number of images removed by the image garbage collector",
+	},
+	[]string{"reason"},
+)
+
+var SnapshotDriftCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "warm_metal",
+		Name:      SnapshotDriftCountKey,
+		Help:      "Cumulative number of drifts between snapshots, mounts and refcounts found by the reconciler",
+	},
+	[]string{"drift", "repaired"},
+)
+
 func RegisterMetrics() *prometheus.Registry {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(ImagePullTime)
 	reg.MustRegister(ImagePullTimeHist)
 	reg.MustRegister(ImagePullSizeBytes)
 	reg.MustRegister(OperationErrorsCount)
+	reg.MustRegister(ImageGCRemovedCount)
+	reg.MustRegister(SnapshotDriftCount)
 
 	return reg
 }
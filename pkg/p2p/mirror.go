@@ -0,0 +1,144 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// maxProbedPeers is the maximum number of peers asked for a blob before the mirror gives up.
+	maxProbedPeers = 5
+	probeTimeout   = 2 * time.Second
+)
+
+// Mirror is a registry mirror for the container runtime on the current node. It serves blobs and manifests by
+// digest from peers holding them, and responds 404 otherwise, so that the runtime falls back to the origin registry.
+// Content is only fetched if the origin registry accepts anonymous pulls of it, or the credential the runtime sends
+// on the challenge of the mirror.
+type Mirror struct {
+	peers  func() []string
+	client *http.Client
+	origin *Origin
+}
+
+// NewMirror creates a mirror proxying requests to the given peers via the client, which authenticates the mirror by
+// its TLS certificate.
+func NewMirror(peers func() []string, client *http.Client, origin *Origin) *Mirror {
+	return &Mirror{peers: peers, client: client, origin: origin}
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the mirror is read-only")
+		return
+	}
+
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	c, ok := parseContent(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "only blobs and manifests by digest are available")
+		return
+	}
+
+	kind, dgst := c.kind, c.dgst
+	username, secret, withCredential := r.BasicAuth()
+	authorization, err := m.origin.authorize(r.Context(), c, username, secret)
+	if err != nil {
+		if !withCredential {
+			// The runtime retries with its credential of the origin registry, or falls back to the registry.
+			w.Header().Set("WWW-Authenticate", `Basic realm="container-image-csi-driver"`)
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "a credential of the origin registry is required")
+			return
+		}
+
+		klog.V(2).Infof("unable to authorize pulls of %q: %s", dgst, err)
+		writeError(w, http.StatusNotFound, unknownCode(kind), dgst.String())
+		return
+	}
+
+	peer := m.find(r.Context(), c, authorization)
+	if len(peer) == 0 {
+		writeError(w, http.StatusNotFound, unknownCode(kind), dgst.String())
+		return
+	}
+
+	resp, err := m.do(r.Context(), r.Method, peer, c, authorization)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		klog.Warningf("unable to fetch %q from peer %s: %v", dgst, peer, err)
+		writeError(w, http.StatusNotFound, unknownCode(kind), dgst.String())
+		return
+	}
+
+	defer resp.Body.Close()
+	for _, h := range []string{"Content-Type", "Content-Length", headerDigest} {
+		if v := resp.Header.Get(h); len(v) > 0 {
+			w.Header().Set(h, v)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	klog.V(2).Infof("fetching %q from peer %s", dgst, peer)
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		klog.Warningf("unable to fetch %q from peer %s: %s", dgst, peer, err)
+	}
+}
+
+// find returns the address of a peer holding the content, or an empty string if none is found.
+// Peers are probed in random order to spread the load.
+func (m *Mirror) find(ctx context.Context, c content, authorization string) string {
+	peers := m.peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > maxProbedPeers {
+		peers = peers[:maxProbedPeers]
+	}
+
+	for _, peer := range peers {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		resp, err := m.do(probeCtx, http.MethodHead, peer, c, authorization)
+		cancel()
+		if err != nil {
+			klog.V(4).Infof("unable to probe peer %s: %s", peer, err)
+			continue
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return peer
+		}
+	}
+
+	return ""
+}
+
+// do sends the request of the content to the peer, along with the authorization of the origin registry.
+func (m *Mirror) do(
+	ctx context.Context, method, peer string, c content, authorization string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+peer+c.path(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authorization) > 0 {
+		req.Header.Set(headerRegistryAuthorization, authorization)
+	}
+
+	return m.client.Do(req)
+}
@@ -0,0 +1,241 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// headerRegistryAuthorization carries the authorization of the origin registry from mirrors to peers.
+	headerRegistryAuthorization = "X-Registry-Authorization"
+
+	// originTTL is how long a successful check against the origin registry is trusted.
+	originTTL = time.Minute
+	// maxOriginChecks is the number of checks cached before expired ones are dropped.
+	maxOriginChecks = 4096
+)
+
+// content is a blob or manifest in a repository of the origin registry.
+type content struct {
+	registry string
+	repo     string
+	kind     string
+	dgst     digest.Digest
+}
+
+// parseContent returns the content of the request. The origin registry is the query parameter "ns", set by
+// containerd on requests to mirrors, or the first component of the repository for mirrors configured with the
+// registry as the path prefix, e.g. "/v2/docker.io/library/alpine/blobs/...". Tags are not supported since they are
+// not verifiable.
+func parseContent(r *http.Request) (content, bool) {
+	match := pathPattern.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return content{}, false
+	}
+
+	dgst, err := digest.Parse(match[3])
+	if err != nil {
+		return content{}, false
+	}
+
+	name := match[1]
+	registry := r.URL.Query().Get("ns")
+	if len(registry) == 0 {
+		prefix, rest, found := strings.Cut(name, "/")
+		if !found || !strings.ContainsAny(prefix, ".:") && prefix != "localhost" {
+			return content{}, false
+		}
+
+		registry, name = prefix, rest
+	}
+
+	named, err := reference.ParseNormalizedNamed(registry + "/" + name)
+	if err != nil || reference.Domain(named) != registry {
+		return content{}, false
+	}
+
+	return content{
+		registry: reference.Domain(named),
+		repo:     reference.Path(named),
+		kind:     match[2],
+		dgst:     dgst,
+	}, true
+}
+
+// path returns the path of the content on peers.
+func (c content) path() string {
+	return fmt.Sprintf("/v2/%s/%s/%s?ns=%s", c.repo, c.kind, c.dgst, url.QueryEscape(c.registry))
+}
+
+// originURL returns the URL of the content in the origin registry.
+func (c content) originURL() string {
+	host := c.registry
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	return fmt.Sprintf("https://%s/v2/%s/%s/%s", host, c.repo, c.kind, c.dgst)
+}
+
+// Origin checks whether credentials are able to pull content from its origin registry, so that peers only share
+// content with those who could pull it by themselves. Successful checks are cached for a minute.
+type Origin struct {
+	client *http.Client
+
+	guard sync.Mutex
+	// mapping from checks to when they expire
+	checks map[string]time.Time
+	// mapping from repositories and credentials to authorizations of the origin registry
+	authorizations map[string]authorization
+}
+
+type authorization struct {
+	header  string
+	expires time.Time
+}
+
+// NewOrigin creates an Origin sending requests to registries via the client.
+func NewOrigin(client *http.Client) *Origin {
+	return &Origin{
+		client:         client,
+		checks:         make(map[string]time.Time),
+		authorizations: make(map[string]authorization),
+	}
+}
+
+// authorize returns the Authorization header the origin registry accepts to pull the content with the credential,
+// which is empty for anonymous pulls. Credentials are exchanged for tokens scoped to pulls of the repository if the
+// registry supports it.
+func (o *Origin) authorize(ctx context.Context, c content, username, secret string) (string, error) {
+	key := strings.Join([]string{c.registry, c.repo, hash(username + "\x00" + secret)}, "|")
+	o.guard.Lock()
+	cached, found := o.authorizations[key]
+	o.guard.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.header, nil
+	}
+
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthClient(o.client),
+		docker.WithAuthCreds(func(string) (string, string, error) {
+			return username, secret, nil
+		}),
+	)
+
+	ctx = docker.ContextWithAppendPullRepositoryScope(ctx, c.repo)
+	for retried := false; ; retried = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.originURL(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if err = authorizer.Authorize(ctx, req); err != nil {
+			return "", err
+		}
+
+		resp, err := o.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			if err = authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+				return "", err
+			}
+
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("unable to pull %s/%s@%s from the origin registry: %s", c.registry, c.repo, c.dgst,
+				resp.Status)
+		}
+
+		header := req.Header.Get("Authorization")
+		o.guard.Lock()
+		defer o.guard.Unlock()
+		o.authorizations[key] = authorization{header: header, expires: time.Now().Add(originTTL)}
+		o.checked(c, header)
+		return header, nil
+	}
+}
+
+// verify returns true if the origin registry accepts the Authorization header, which can be empty, to pull the
+// content.
+func (o *Origin) verify(ctx context.Context, c content, header string) bool {
+	key := checkKey(c, header)
+	o.guard.Lock()
+	expires, found := o.checks[key]
+	o.guard.Unlock()
+	if found && time.Now().Before(expires) {
+		return true
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.originURL(), nil)
+	if err != nil {
+		return false
+	}
+
+	if len(header) > 0 {
+		req.Header.Set("Authorization", header)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		klog.Warningf("unable to check %s/%s@%s with the origin registry: %s", c.registry, c.repo, c.dgst, err)
+		return false
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		klog.V(2).Infof("the origin registry refused to serve %s/%s@%s: %s", c.registry, c.repo, c.dgst, resp.Status)
+		return false
+	}
+
+	o.guard.Lock()
+	defer o.guard.Unlock()
+	o.checked(c, header)
+	return true
+}
+
+// checked caches the successful check. The guard must be held.
+func (o *Origin) checked(c content, header string) {
+	now := time.Now()
+	if len(o.checks) >= maxOriginChecks {
+		for key, expires := range o.checks {
+			if now.After(expires) {
+				delete(o.checks, key)
+			}
+		}
+
+		for key, cached := range o.authorizations {
+			if now.After(cached.expires) {
+				delete(o.authorizations, key)
+			}
+		}
+	}
+
+	o.checks[checkKey(c, header)] = now.Add(originTTL)
+}
+
+func checkKey(c content, header string) string {
+	return strings.Join([]string{c.registry, c.repo, c.kind, c.dgst.String(), hash(header)}, "|")
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,330 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+)
+
+const serverName = "p2p.test"
+
+type fakeStore map[digest.Digest][]byte
+
+func (s fakeStore) Open(_ context.Context, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	data, found := s[dgst]
+	if !found {
+		return nil, 0, fmt.Errorf("%w: %s", backend.ErrBlobNotFound, dgst)
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func newStore(blobs ...string) (fakeStore, []digest.Digest) {
+	store := fakeStore{}
+	var digests []digest.Digest
+	for _, blob := range blobs {
+		dgst := digest.FromString(blob)
+		store[dgst] = []byte(blob)
+		digests = append(digests, dgst)
+	}
+
+	return store, digests
+}
+
+// fakeRegistry is an origin registry holding the given digests in repositories. Repositories under "private/"
+// require the basic credential "user:pass".
+type fakeRegistry struct {
+	*httptest.Server
+	repos map[string][]digest.Digest
+	// checks is the number of requests.
+	checks atomic.Int64
+}
+
+func newRegistry(t *testing.T, repos map[string][]digest.Digest) *fakeRegistry {
+	r := &fakeRegistry{repos: repos}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.checks.Add(1)
+		match := pathPattern.FindStringSubmatch(req.URL.Path)
+		if match == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if strings.HasPrefix(match[1], "private/") {
+			if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "pass" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		for _, dgst := range r.repos[match[1]] {
+			if dgst.String() == match[3] {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	t.Cleanup(r.Close)
+	return r
+}
+
+// host returns the registry host, which is the value of the parameter "ns" of requests.
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+func get(handler http.Handler, method, path string, header http.Header) *http.Response {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestServer(t *testing.T) {
+	store, digests := newStore("layer", `{"schemaVersion":2,"manifests":[]}`)
+	layer, index := digests[0], digests[1]
+	absent := digest.FromString("absent")
+	registry := newRegistry(t, map[string][]digest.Digest{
+		"library/alpine": {layer, index, absent},
+		"private/app":    {layer},
+	})
+
+	server := NewServer(store, NewOrigin(registry.Client()))
+	ns := "?ns=" + registry.host()
+
+	resp := get(server, http.MethodGet, "/v2/", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = get(server, http.MethodGet, "/v2/library/alpine/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, layer.String(), resp.Header.Get(headerDigest))
+	assert.Equal(t, "5", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "layer", body(t, resp))
+
+	resp = get(server, http.MethodGet, "/v2/"+registry.host()+"/library/alpine/blobs/"+layer.String(), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the registry can be the prefix of the repository")
+
+	resp = get(server, http.MethodHead, "/v2/library/alpine/manifests/"+index.String()+ns, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ocispec.MediaTypeImageIndex, resp.Header.Get("Content-Type"))
+	assert.Empty(t, body(t, resp))
+
+	resp = get(server, http.MethodGet, "/v2/private/app/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "content should only be served to those able to pull it")
+	resp = get(server, http.MethodGet, "/v2/private/app/blobs/"+layer.String()+ns,
+		http.Header{headerRegistryAuthorization: {basicAuth("user", "wrong")}})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = get(server, http.MethodGet, "/v2/private/app/blobs/"+layer.String()+ns,
+		http.Header{headerRegistryAuthorization: {basicAuth("user", "pass")}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "layer", body(t, resp))
+
+	resp = get(server, http.MethodGet, "/v2/private/app/manifests/"+index.String()+ns,
+		http.Header{headerRegistryAuthorization: {basicAuth("user", "pass")}})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "content should never be served by digest alone")
+
+	resp = get(server, http.MethodGet, "/v2/library/alpine/blobs/"+layer.String(), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the origin registry is required")
+
+	resp = get(server, http.MethodGet, "/v2/library/alpine/manifests/latest"+ns, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "tags should not be served")
+
+	resp = get(server, http.MethodGet, "/v2/library/alpine/blobs/"+absent.String()+ns, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body(t, resp), "BLOB_UNKNOWN")
+
+	resp = get(server, http.MethodDelete, "/v2/library/alpine/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	checks := registry.checks.Load()
+	resp = get(server, http.MethodGet, "/v2/library/alpine/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, checks, registry.checks.Load(), "checks of the origin registry should be cached")
+}
+
+func TestManifestMediaType(t *testing.T) {
+	assert.Equal(t, "application/vnd.docker.distribution.manifest.v2+json",
+		manifestMediaType([]byte(`{"mediaType":"application/vnd.docker.distribution.manifest.v2+json"}`)))
+	assert.Equal(t, ocispec.MediaTypeImageIndex, manifestMediaType([]byte(`{"manifests":[]}`)))
+	assert.Equal(t, ocispec.MediaTypeImageManifest, manifestMediaType([]byte(`{"layers":[]}`)))
+}
+
+// newCA returns a self-signed CA certificate and its key.
+func newCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "p2p-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return ca, key
+}
+
+// writeTLSFiles writes a CA and a certificate signed by signer, which is the CA if nil, to the directory, and returns
+// paths of the certificate, the key and the CA.
+func writeTLSFiles(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, signer *x509.Certificate,
+	signerKey *ecdsa.PrivateKey) (string, string, string) {
+	if signer == nil {
+		signer, signerKey = ca, caKey
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"ca.crt":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+	}
+
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+	}
+
+	return filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+}
+
+func newTLSConfigs(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, signer *x509.Certificate,
+	signerKey *ecdsa.PrivateKey) (*tls.Config, *tls.Config) {
+	cert, key, caFile := writeTLSFiles(t, ca, caKey, signer, signerKey)
+	server, client, err := NewTLSConfigs(cert, key, caFile, serverName)
+	require.NoError(t, err)
+	return server, client
+}
+
+func newPeer(t *testing.T, store backend.BlobStore, origin *Origin, config *tls.Config) string {
+	peer := httptest.NewUnstartedServer(NewServer(store, origin))
+	peer.TLS = config
+	peer.StartTLS()
+	t.Cleanup(peer.Close)
+	return strings.TrimPrefix(peer.URL, "https://")
+}
+
+func newMirror(peers []string, config *tls.Config, origin *Origin) *Mirror {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return NewMirror(func() []string { return append([]string(nil), peers...) }, &http.Client{Transport: transport},
+		origin)
+}
+
+func TestMirror(t *testing.T) {
+	store, digests := newStore("layer")
+	layer := digests[0]
+	missing := digest.FromString("missing")
+	registry := newRegistry(t, map[string][]digest.Digest{
+		"library/alpine": {layer, missing},
+		"private/app":    {layer},
+	})
+
+	ca, caKey := newCA(t)
+	serverTLS, clientTLS := newTLSConfigs(t, ca, caKey, nil, nil)
+	emptyStore, _ := newStore()
+	peers := []string{
+		newPeer(t, emptyStore, NewOrigin(registry.Client()), serverTLS),
+		newPeer(t, store, NewOrigin(registry.Client()), serverTLS),
+	}
+
+	mirror := newMirror(peers, clientTLS, NewOrigin(registry.Client()))
+	ns := "?ns=" + registry.host()
+
+	resp := get(mirror, http.MethodGet, "/v2/library/alpine/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, layer.String(), resp.Header.Get(headerDigest))
+	assert.Equal(t, "layer", body(t, resp))
+
+	resp = get(mirror, http.MethodGet, "/v2/private/app/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "the runtime should be challenged for its credential")
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	resp = get(mirror, http.MethodGet, "/v2/private/app/blobs/"+layer.String()+ns,
+		http.Header{"Authorization": {basicAuth("user", "pass")}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "layer", body(t, resp))
+
+	resp = get(mirror, http.MethodGet, "/v2/private/app/blobs/"+layer.String()+ns,
+		http.Header{"Authorization": {basicAuth("user", "wrong")}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the runtime should fall back to the origin registry")
+
+	resp = get(mirror, http.MethodGet, "/v2/library/alpine/blobs/"+missing.String()+ns, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the runtime should fall back to the origin registry")
+
+	// Peers reject mirrors with certificates of other CAs, and mirrors reject peers of other CAs.
+	otherCA, otherKey := newCA(t)
+	_, untrustedTLS := newTLSConfigs(t, ca, caKey, otherCA, otherKey)
+	untrusted := newMirror(peers, untrustedTLS, NewOrigin(registry.Client()))
+	resp = get(untrusted, http.MethodGet, "/v2/library/alpine/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	otherServerTLS, _ := newTLSConfigs(t, otherCA, otherKey, nil, nil)
+	impostor := newPeer(t, store, NewOrigin(registry.Client()), otherServerTLS)
+	resp = get(newMirror([]string{impostor}, clientTLS, NewOrigin(registry.Client())), http.MethodGet,
+		"/v2/library/alpine/blobs/"+layer.String()+ns, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// Peers discovers node plugins on other nodes via the API server.
+type Peers struct {
+	nodeName string
+	port     int
+	informer cache.SharedIndexInformer
+	lister   listersv1.PodLister
+}
+
+// NewPeers watches pods of node plugins in the namespace matching the label selector.
+// Peers are addressed by pod IPs and the given port. Call Run to start syncing.
+func NewPeers(
+	client kubernetes.Interface, namespace, selector, nodeName string, port int, resyncPeriod time.Duration,
+) (*Peers, error) {
+	if _, err := labels.Parse(selector); err != nil {
+		return nil, err
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector
+		}),
+	)
+
+	pods := factory.Core().V1().Pods()
+	return &Peers{
+		nodeName: nodeName,
+		port:     port,
+		informer: pods.Informer(),
+		lister:   pods.Lister(),
+	}, nil
+}
+
+// Run syncs peers until the context is cancelled.
+func (p *Peers) Run(ctx context.Context) {
+	klog.Infof("start discovering peers")
+	p.informer.Run(ctx.Done())
+}
+
+// Addresses returns addresses of ready peers on other nodes.
+func (p *Peers) Addresses() []string {
+	pods, err := p.lister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("unable to list peers: %s", err)
+		return nil
+	}
+
+	var addrs []string
+	for _, pod := range pods {
+		if pod.Spec.NodeName == p.nodeName || len(pod.Status.PodIP) == 0 || !ready(pod) {
+			continue
+		}
+
+		addrs = append(addrs, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p.port)))
+	}
+
+	return addrs
+}
+
+func ready(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
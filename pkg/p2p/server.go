@@ -0,0 +1,159 @@
+// Package p2p lets node plugins share blobs held by their container runtimes, so that images are pulled from peers
+// before the origin registry.
+//
+// Each node plugin serves blobs of its runtime via a read-only subset of the OCI distribution API over mutual TLS.
+// Blobs and manifests are only served by digest, which clients verify after fetching, so a peer can't inject content.
+// Requests must also carry an authorization of the origin registry, which peers check with the registry before
+// serving, so that content is only shared with those able to pull it by themselves. The node plugin also runs a
+// mirror on the node, which is configured as a registry mirror of the runtime and proxies requests to peers holding
+// the requested blobs.
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/backend"
+	"k8s.io/klog/v2"
+)
+
+const (
+	headerDigest = "Docker-Content-Digest"
+
+	// maxManifestSize is the maximum size of manifests read to determine their media types.
+	maxManifestSize = 4 << 20
+)
+
+// pathPattern matches paths of blobs and manifests, e.g. "/v2/library/alpine/blobs/sha256:...".
+var pathPattern = regexp.MustCompile(`^/v2/(.+)/(blobs|manifests)/([^/]+)$`)
+
+// Server serves blobs of the container runtime to peers. Peers are authenticated by TLS client certificates.
+type Server struct {
+	store  backend.BlobStore
+	origin *Origin
+}
+
+// NewServer creates a server of blobs in the given store. Content is only served if the origin registry accepts the
+// authorization in the request to pull it.
+func NewServer(store backend.BlobStore, origin *Origin) *Server {
+	return &Server{store: store, origin: origin}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	c, ok := parseContent(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "only blobs and manifests by digest are available")
+		return
+	}
+
+	if !s.origin.verify(r.Context(), c, r.Header.Get(headerRegistryAuthorization)) {
+		writeError(w, http.StatusForbidden, "DENIED", "the origin registry refused the authorization")
+		return
+	}
+
+	kind, dgst := c.kind, c.dgst
+	rc, size, err := s.store.Open(r.Context(), dgst)
+	if err != nil {
+		if errors.Is(err, backend.ErrBlobNotFound) {
+			writeError(w, http.StatusNotFound, unknownCode(kind), dgst.String())
+			return
+		}
+
+		klog.Errorf("unable to open blob %q: %s", dgst, err)
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	defer rc.Close()
+
+	if kind == "blobs" {
+		writeHeader(w, "application/octet-stream", size, dgst)
+		if r.Method == http.MethodGet {
+			if _, err = io.Copy(w, rc); err != nil {
+				klog.V(4).Infof("unable to send blob %q: %s", dgst, err)
+			}
+		}
+
+		return
+	}
+
+	if size > maxManifestSize {
+		writeError(w, http.StatusNotFound, unknownCode(kind), "manifest is too large")
+		return
+	}
+
+	manifest, err := io.ReadAll(rc)
+	if err != nil {
+		klog.Errorf("unable to read manifest %q: %s", dgst, err)
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	writeHeader(w, manifestMediaType(manifest), size, dgst)
+	if r.Method == http.MethodGet {
+		if _, err = w.Write(manifest); err != nil {
+			klog.V(4).Infof("unable to send manifest %q: %s", dgst, err)
+		}
+	}
+}
+
+func writeHeader(w http.ResponseWriter, contentType string, size int64, dgst digest.Digest) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set(headerDigest, dgst.String())
+	w.WriteHeader(http.StatusOK)
+}
+
+// manifestMediaType returns the media type of the manifest, which the runtime doesn't record along with blobs.
+func manifestMediaType(manifest []byte) string {
+	var m struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return ocispec.MediaTypeImageManifest
+	}
+
+	if len(m.MediaType) > 0 {
+		return m.MediaType
+	}
+
+	if m.Manifests != nil {
+		return ocispec.MediaTypeImageIndex
+	}
+
+	return ocispec.MediaTypeImageManifest
+}
+
+func unknownCode(kind string) string {
+	if kind == "manifests" {
+		return "MANIFEST_UNKNOWN"
+	}
+
+	return "BLOB_UNKNOWN"
+}
+
+// writeError writes an error in the format of the OCI distribution spec.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
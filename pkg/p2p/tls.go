@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// NewTLSConfigs returns TLS configs of the server and of clients of peers, which authenticate each other by
+// certificates signed by the CA in caFile. Peers are addressed by pod IPs, so servers are verified by serverName
+// instead. The certificate and key are reloaded on each handshake, so that they are rotated without restarts.
+func NewTLSConfigs(certFile, keyFile, caFile, serverName string) (server, client *tls.Config, err error) {
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read the p2p CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, nil, fmt.Errorf("no certificates found in the p2p CA %q", caFile)
+	}
+
+	load := func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the p2p certificate: %w", err)
+		}
+
+		return &cert, nil
+	}
+
+	if _, err = load(); err != nil {
+		return nil, nil, err
+	}
+
+	server = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return load()
+		},
+	}
+
+	client = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return load()
+		},
+	}
+
+	return server, client, nil
+}
@@ -0,0 +1,482 @@
+// Package prewarm pulls images requested by ImagePrewarm objects before workloads land on nodes.
+package prewarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/pullcoord"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimageasync"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
+)
+
+// fieldManagerPrefix prefixes field managers of statuses of nodes.
+const fieldManagerPrefix = "container-image-csi-driver-"
+
+// Controller pulls images of ImagePrewarm objects on the current node,
+// then writes progress and errors back to the status of these objects.
+type Controller struct {
+	nodeName    string
+	kubeClient  kubernetes.Interface
+	client      dynamic.Interface
+	imageSvc    cri.ImageServiceClient
+	secretStore secret.Store
+	asyncPuller remoteimageasync.AsyncPuller
+	pullTimeout time.Duration
+	pullRecords *remoteimage.PullRecords
+	coordinator *pullcoord.Coordinator
+	newPuller   remoteimage.NewPullerFunc
+	workers     int
+	// pulls limits concurrent pulls of all objects to the number of workers.
+	pulls chan struct{}
+
+	informer cache.SharedIndexInformer
+	queue    workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewController creates a prewarm controller of the given node.
+// If asyncPuller is nil, images are pulled synchronously. pullRecords and coordinator are optional.
+// Images are pulled via the CRI image service if newPuller is nil. Objects are processed by the given number of
+// workers, and at most the same number of images are pulled at the same time.
+func NewController(
+	nodeName string, kubeClient kubernetes.Interface, client dynamic.Interface, imageSvc cri.ImageServiceClient,
+	secretStore secret.Store, asyncPuller remoteimageasync.AsyncPuller, pullTimeout time.Duration,
+	pullRecords *remoteimage.PullRecords, coordinator *pullcoord.Coordinator, resyncPeriod time.Duration,
+	newPuller remoteimage.NewPullerFunc, workers int,
+) *Controller {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if newPuller == nil {
+		newPuller = func(image reference.Named, keyring secret.DockerKeyring) (remoteimage.Puller, error) {
+			return remoteimage.NewPuller(imageSvc, image, keyring), nil
+		}
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resyncPeriod)
+	c := &Controller{
+		nodeName:    nodeName,
+		kubeClient:  kubeClient,
+		client:      client,
+		imageSvc:    imageSvc,
+		secretStore: secretStore,
+		asyncPuller: asyncPuller,
+		pullTimeout: pullTimeout,
+		pullRecords: pullRecords,
+		coordinator: coordinator,
+		newPuller:   newPuller,
+		workers:     workers,
+		pulls:       make(chan struct{}, workers),
+		informer:    factory.ForResource(v1alpha1.ImagePrewarmResource).Informer(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "image-prewarm"},
+		),
+	}
+
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, oldErr := meta(oldObj)
+			newMeta, newErr := meta(newObj)
+			// Status updates of other nodes are ignored. Periodic resyncs are processed to catch up with
+			// label changes of the node.
+			if oldErr != nil || newErr != nil || oldMeta.GetGeneration() != newMeta.GetGeneration() ||
+				oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				c.enqueue(newObj)
+			}
+		},
+	})
+
+	return c
+}
+
+// Run processes ImagePrewarm objects until the context is cancelled.
+func (c *Controller) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	klog.Infof("starting image prewarm controller on node %q", c.nodeName)
+	go c.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		klog.Errorf("unable to sync ImagePrewarm objects")
+		return
+	}
+
+	for i := 0; i < c.workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+	klog.Infof("image prewarm controller stopped")
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("unable to get key of object %#v: %s", obj, err)
+		return
+	}
+
+	c.queue.Add(key)
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+
+	defer c.queue.Done(key)
+
+	requeueAfter, err := c.sync(ctx, key)
+	if err != nil {
+		klog.Errorf("unable to prewarm images of %q: %s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	if requeueAfter > 0 {
+		c.queue.AddAfter(key, requeueAfter)
+	}
+
+	return true
+}
+
+// sync pulls images of the given ImagePrewarm object if the current node is selected.
+// The duration returned is when images should be pulled again.
+func (c *Controller) sync(ctx context.Context, key string) (time.Duration, error) {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	prewarm := &v1alpha1.ImagePrewarm{}
+	if err = v1alpha1.FromUnstructured(obj, prewarm); err != nil {
+		return 0, err
+	}
+
+	selected, err := c.nodeSelected(ctx, prewarm.Spec.NodeSelector)
+	if err != nil {
+		return 0, err
+	}
+
+	if !selected {
+		if prewarm.Status.NodeStatus(c.nodeName) != nil {
+			klog.Infof("node is no longer selected by %q. remove its status", key)
+			return 0, c.applyNodeStatus(ctx, prewarm, nil)
+		}
+
+		return 0, nil
+	}
+
+	var interval time.Duration
+	if prewarm.Spec.Schedule != nil {
+		interval = prewarm.Spec.Schedule.Duration
+	}
+
+	keyring, err := c.secretStore.GetDockerKeyringFromSecrets(ctx, prewarm.Namespace, prewarm.Spec.ImagePullSecrets)
+	if err != nil {
+		msg := fmt.Sprintf("unable to fetch image pull secrets: %s", err)
+		for _, image := range prewarm.Spec.Images {
+			if updateErr := c.setImageState(ctx, prewarm, image, v1alpha1.PrewarmFailed, msg, nil); updateErr != nil {
+				klog.Errorf("unable to update status of %q: %s", key, updateErr)
+			}
+		}
+
+		return 0, err
+	}
+
+	var requeueAfter time.Duration
+	var images []string
+	nodeStatus := prewarm.Status.NodeStatus(c.nodeName)
+	for _, image := range prewarm.Spec.Images {
+		if nodeStatus != nil {
+			if state := nodeStatus.ImageState(image); state != nil &&
+				state.Phase == v1alpha1.PrewarmReady && state.LastPullTime != nil {
+				if interval == 0 {
+					continue
+				}
+
+				if next := time.Until(state.LastPullTime.Add(interval)); next > 0 {
+					requeueAfter = earlier(requeueAfter, next)
+					continue
+				}
+			}
+		}
+
+		images = append(images, image)
+	}
+
+	// Images are pulled in parallel, so that a slow image doesn't hold back the others.
+	var wg sync.WaitGroup
+	var guard sync.Mutex
+	var pullErr, statusErr error
+	setImageState := func(image string, phase v1alpha1.PrewarmPhase, msg string, lastPullTime *metav1.Time) error {
+		guard.Lock()
+		defer guard.Unlock()
+		return c.setImageState(ctx, prewarm, image, phase, msg, lastPullTime)
+	}
+
+	for _, image := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.prewarmImage(ctx, image, keyring, setImageState)
+
+			guard.Lock()
+			defer guard.Unlock()
+			var pullFailed *pullError
+			switch {
+			case errors.As(err, &pullFailed):
+				klog.Errorf("unable to prewarm image %q for %q: %s", image, key, err)
+				pullErr = pullFailed.err
+			case err != nil:
+				statusErr = err
+			case interval > 0:
+				requeueAfter = earlier(requeueAfter, interval)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if statusErr != nil {
+		return 0, statusErr
+	}
+
+	return requeueAfter, pullErr
+}
+
+// pullError is an error of pulling an image, rather than updating the status.
+type pullError struct {
+	err error
+}
+
+func (e *pullError) Error() string { return e.err.Error() }
+
+// prewarmImage pulls the image once a slot of pulls is available, and updates its state via setImageState.
+func (c *Controller) prewarmImage(
+	ctx context.Context, image string, keyring secret.DockerKeyring,
+	setImageState func(image string, phase v1alpha1.PrewarmPhase, msg string, lastPullTime *metav1.Time) error,
+) error {
+	select {
+	case c.pulls <- struct{}{}:
+		defer func() { <-c.pulls }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := setImageState(image, v1alpha1.PrewarmPulling, "", nil); err != nil {
+		return err
+	}
+
+	if err := c.pull(ctx, image, keyring); err != nil {
+		if updateErr := setImageState(image, v1alpha1.PrewarmFailed, err.Error(), nil); updateErr != nil {
+			return updateErr
+		}
+
+		return &pullError{err: err}
+	}
+
+	now := metav1.Now()
+	return setImageState(image, v1alpha1.PrewarmReady, "", &now)
+}
+
+func (c *Controller) pull(ctx context.Context, image string, keyring secret.DockerKeyring) error {
+	namedRef, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return fmt.Errorf("invalid image %q: %w", image, err)
+	}
+
+	klog.Infof("prewarm image %q", image)
+	puller, err := c.newPuller(namedRef, keyring)
+	if err != nil {
+		return fmt.Errorf("unable to create the puller of image %q: %w", image, err)
+	}
+
+	if c.coordinator != nil {
+		puller = c.coordinator.Wrap(puller, namedRef, keyring)
+	}
+
+	var identity string
+	if c.asyncPuller != nil {
+		identities := secret.KeyringIdentities(keyring, namedRef.Name())
+		session, err := c.asyncPuller.StartPull(remoteimageasync.SessionKey(namedRef, identities), puller, c.pullTimeout)
+		if err != nil {
+			return err
+		}
+
+		if err = c.asyncPuller.WaitForPull(session, ctx); err != nil {
+			return err
+		}
+
+		identity = session.CredentialIdentity()
+	} else {
+		pullCtx := ctx
+		if c.pullTimeout > 0 {
+			var cancel context.CancelFunc
+			pullCtx, cancel = context.WithTimeout(ctx, c.pullTimeout)
+			defer cancel()
+		}
+
+		if err = puller.Pull(pullCtx); err != nil {
+			return err
+		}
+
+		identity = puller.CredentialIdentity()
+	}
+
+	if c.pullRecords != nil {
+		if err = c.pullRecords.RecordPull(ctx, c.imageSvc, namedRef, identity); err != nil {
+			klog.Errorf("unable to record the pull of image %q: %s", image, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) nodeSelected(ctx context.Context, selector map[string]string) (bool, error) {
+	if len(selector) == 0 {
+		return true, nil
+	}
+
+	node, err := c.kubeClient.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("unable to fetch node %q: %w", c.nodeName, err)
+	}
+
+	return labels.SelectorFromSet(selector).Matches(labels.Set(node.Labels)), nil
+}
+
+func (c *Controller) setImageState(
+	ctx context.Context, prewarm *v1alpha1.ImagePrewarm, image string, phase v1alpha1.PrewarmPhase, msg string,
+	lastPullTime *metav1.Time,
+) error {
+	nodeStatus := v1alpha1.NodePrewarmStatus{NodeName: c.nodeName}
+	if current := prewarm.Status.NodeStatus(c.nodeName); current != nil {
+		nodeStatus.Images = append(nodeStatus.Images, current.Images...)
+	}
+
+	// Drop states of images which are no longer requested.
+	requested := make(map[string]struct{}, len(prewarm.Spec.Images))
+	for _, img := range prewarm.Spec.Images {
+		requested[img] = struct{}{}
+	}
+
+	states := nodeStatus.Images[:0]
+	for _, state := range nodeStatus.Images {
+		if _, ok := requested[state.Image]; ok {
+			states = append(states, state)
+		}
+	}
+	nodeStatus.Images = states
+
+	state := nodeStatus.ImageState(image)
+	if state == nil {
+		nodeStatus.Images = append(nodeStatus.Images, v1alpha1.ImagePrewarmState{Image: image})
+		state = &nodeStatus.Images[len(nodeStatus.Images)-1]
+	}
+
+	state.Phase = phase
+	state.Message = msg
+	if lastPullTime != nil {
+		state.LastPullTime = lastPullTime
+	}
+
+	return c.applyNodeStatus(ctx, prewarm, &nodeStatus)
+}
+
+// fieldManager is the field manager of the status of the node. Each node owns its own entry of status.nodes.
+func (c *Controller) fieldManager() string {
+	return fieldManagerPrefix + c.nodeName
+}
+
+// applyNodeStatus saves the status of the current node via server-side apply, or removes it if nodeStatus is nil.
+// status.nodes is a list-map keyed by nodeName, and each node applies only its own entry as its own field manager, so
+// that nodes never conflict with each other. The given object is updated as well.
+func (c *Controller) applyNodeStatus(
+	ctx context.Context, prewarm *v1alpha1.ImagePrewarm, nodeStatus *v1alpha1.NodePrewarmStatus,
+) error {
+	nodes := []interface{}{}
+	if nodeStatus != nil {
+		node, err := runtime.DefaultUnstructuredConverter.ToUnstructured(nodeStatus)
+		if err != nil {
+			return err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	applied := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": v1alpha1.GroupName + "/" + v1alpha1.Version,
+		"kind":       "ImagePrewarm",
+		"metadata":   map[string]interface{}{"name": prewarm.Name, "namespace": prewarm.Namespace},
+		"status":     map[string]interface{}{"nodes": nodes},
+	}}
+
+	resource := c.client.Resource(v1alpha1.ImagePrewarmResource).Namespace(prewarm.Namespace)
+	_, err := resource.ApplyStatus(ctx, prewarm.Name, applied,
+		metav1.ApplyOptions{FieldManager: c.fieldManager(), Force: true})
+	if err != nil {
+		return err
+	}
+
+	removeNodeStatus(&prewarm.Status, c.nodeName)
+	if nodeStatus != nil {
+		prewarm.Status.Nodes = append(prewarm.Status.Nodes, *nodeStatus)
+	}
+
+	return nil
+}
+
+func removeNodeStatus(status *v1alpha1.ImagePrewarmStatus, node string) {
+	nodes := status.Nodes[:0]
+	for _, n := range status.Nodes {
+		if n.NodeName != node {
+			nodes = append(nodes, n)
+		}
+	}
+
+	status.Nodes = nodes
+}
+
+func meta(obj interface{}) (metav1.Object, error) {
+	accessor, ok := obj.(metav1.Object)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+
+	return accessor, nil
+}
+
+func earlier(current, next time.Duration) time.Duration {
+	if current == 0 || next < current {
+		return next
+	}
+
+	return current
+}
@@ -0,0 +1,191 @@
+package prewarm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSetImageState(t *testing.T) {
+	prewarm := &v1alpha1.ImagePrewarm{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupName + "/" + v1alpha1.Version, Kind: "ImagePrewarm"},
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       v1alpha1.ImagePrewarmSpec{Images: []string{"docker.io/library/alpine:3"}},
+		Status: v1alpha1.ImagePrewarmStatus{Nodes: []v1alpha1.NodePrewarmStatus{{
+			NodeName: "other",
+			Images:   []v1alpha1.ImagePrewarmState{{Image: "docker.io/library/alpine:3", Phase: v1alpha1.PrewarmReady}},
+		}}},
+	}
+
+	obj, err := v1alpha1.ToUnstructured(prewarm)
+	assert.NoError(t, err)
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.ImagePrewarmResource: "ImagePrewarmList"}, obj)
+	applied := applyStatuses(t, client)
+	c := &Controller{nodeName: "node", client: client}
+
+	ctx := context.Background()
+	image := "docker.io/library/alpine:3"
+	assert.NoError(t, c.setImageState(ctx, prewarm, image, v1alpha1.PrewarmPulling, "", nil))
+	now := metav1.Now()
+	assert.NoError(t, c.setImageState(ctx, prewarm, image, v1alpha1.PrewarmReady, "", &now))
+
+	// Only the entry of the node is applied, so that nodes never conflict.
+	require.Len(t, *applied, 2)
+	latest := &v1alpha1.ImagePrewarm{}
+	require.NoError(t, v1alpha1.FromUnstructured((*applied)[1], latest))
+	assert.Len(t, latest.Status.Nodes, 1)
+
+	saved, err := client.Resource(v1alpha1.ImagePrewarmResource).Namespace("default").Get(ctx, "foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NoError(t, v1alpha1.FromUnstructured(saved, latest))
+	assert.Len(t, latest.Status.Nodes, 2, "status of other nodes should be kept")
+	nodeStatus := latest.Status.NodeStatus("node")
+	if assert.NotNil(t, nodeStatus) && assert.Len(t, nodeStatus.Images, 1) {
+		assert.Equal(t, v1alpha1.PrewarmReady, nodeStatus.Images[0].Phase)
+		assert.NotNil(t, nodeStatus.Images[0].LastPullTime)
+	}
+
+	// The entry is removed by applying none.
+	assert.NoError(t, c.applyNodeStatus(ctx, prewarm, nil))
+	assert.Nil(t, prewarm.Status.NodeStatus("node"))
+	assert.NotNil(t, prewarm.Status.NodeStatus("other"))
+	require.Len(t, *applied, 3)
+	latest = &v1alpha1.ImagePrewarm{}
+	require.NoError(t, v1alpha1.FromUnstructured((*applied)[2], latest))
+	assert.Empty(t, latest.Status.Nodes)
+}
+
+// applyStatuses emulates server-side apply of statuses of nodes, which the fake client doesn't support for
+// unstructured objects. Entries of status.nodes are merged by nodeName, and the entry of a node is removed if it
+// applies none. Applied objects are returned.
+func applyStatuses(t *testing.T, client *dynamicfake.FakeDynamicClient) *[]*unstructured.Unstructured {
+	var applied []*unstructured.Unstructured
+	client.PrependReactor("patch", "imageprewarms", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchActionImpl)
+		require.Equal(t, types.ApplyPatchType, patch.GetPatchType())
+		require.Equal(t, "status", patch.GetSubresource())
+		require.True(t, strings.HasPrefix(patch.PatchOptions.FieldManager, fieldManagerPrefix))
+		obj := &unstructured.Unstructured{}
+		require.NoError(t, obj.UnmarshalJSON(patch.GetPatch()))
+		applied = append(applied, obj)
+
+		patched := &v1alpha1.ImagePrewarm{}
+		require.NoError(t, v1alpha1.FromUnstructured(obj, patched))
+		existing, err := client.Tracker().Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		latest := &v1alpha1.ImagePrewarm{}
+		require.NoError(t, v1alpha1.FromUnstructured(existing, latest))
+		removeNodeStatus(&latest.Status, strings.TrimPrefix(patch.PatchOptions.FieldManager, fieldManagerPrefix))
+		latest.Status.Nodes = append(latest.Status.Nodes, patched.Status.Nodes...)
+		updated, err := v1alpha1.ToUnstructured(latest)
+		require.NoError(t, err)
+		return true, updated, client.Tracker().Update(patch.GetResource(), updated, patch.GetNamespace())
+	})
+
+	return &applied
+}
+
+type fakeSecretStore struct{}
+
+func (fakeSecretStore) GetDockerKeyring(context.Context, map[string]string) (secret.DockerKeyring, error) {
+	return secret.NewDockerKeyring(), nil
+}
+
+func (fakeSecretStore) GetDockerKeyringFromSecrets(context.Context, string, []string) (secret.DockerKeyring, error) {
+	return secret.NewDockerKeyring(), nil
+}
+
+// blockingPuller blocks pulls of the image until release is closed.
+type blockingPuller struct {
+	remoteimage.Puller
+	image   reference.Named
+	blocked string
+	release chan struct{}
+}
+
+func (p blockingPuller) Pull(ctx context.Context) error {
+	if p.image.String() == p.blocked {
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (p blockingPuller) CredentialIdentity() string { return secret.AnonymousIdentity }
+
+func (p blockingPuller) ImageID() string { return "" }
+
+func TestSlowImageDoesntBlockOthers(t *testing.T) {
+	slow, fast := "docker.io/library/slow:1", "docker.io/library/fast:1"
+	prewarm := &v1alpha1.ImagePrewarm{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupName + "/" + v1alpha1.Version, Kind: "ImagePrewarm"},
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       v1alpha1.ImagePrewarmSpec{Images: []string{slow, fast}},
+	}
+
+	obj, err := v1alpha1.ToUnstructured(prewarm)
+	require.NoError(t, err)
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.ImagePrewarmResource: "ImagePrewarmList"}, obj)
+	applyStatuses(t, client)
+	release := make(chan struct{})
+	c := NewController("node", nil, client, nil, fakeSecretStore{}, nil, 0, nil, nil, 0,
+		func(image reference.Named, _ secret.DockerKeyring) (remoteimage.Puller, error) {
+			return blockingPuller{image: image, blocked: slow, release: release}, nil
+		}, 2)
+	require.NoError(t, c.informer.GetIndexer().Add(obj))
+
+	ctx := context.Background()
+	phaseOf := func(image string) v1alpha1.PrewarmPhase {
+		saved, err := client.Resource(v1alpha1.ImagePrewarmResource).Namespace("default").Get(ctx, "foo",
+			metav1.GetOptions{})
+		require.NoError(t, err)
+		latest := &v1alpha1.ImagePrewarm{}
+		require.NoError(t, v1alpha1.FromUnstructured(saved, latest))
+		nodeStatus := latest.Status.NodeStatus("node")
+		if nodeStatus == nil || nodeStatus.ImageState(image) == nil {
+			return ""
+		}
+
+		return nodeStatus.ImageState(image).Phase
+	}
+
+	synced := make(chan error)
+	go func() {
+		_, err := c.sync(ctx, "default/foo")
+		synced <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		return phaseOf(fast) == v1alpha1.PrewarmReady && phaseOf(slow) == v1alpha1.PrewarmPulling
+	}, 5*time.Second, 10*time.Millisecond, "the fast image is pulled while the slow one is still being pulled")
+
+	close(release)
+	require.NoError(t, <-synced)
+	assert.Equal(t, v1alpha1.PrewarmReady, phaseOf(slow))
+}
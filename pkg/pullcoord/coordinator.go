@@ -0,0 +1,252 @@
+// Package pullcoord limits how many nodes pull the same image from the origin registry at a time,
+// via coordination.k8s.io Lease objects.
+//
+// Each image digest has a fixed number of slots, each of which is a Lease. A node pulls the image only if it holds
+// a slot, otherwise it waits until a slot is released or expires. Coordination fails open: if the API server is
+// unavailable or a node waits too long, the image is pulled anyway.
+package pullcoord
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/registry"
+	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultLeaseDuration  = 30 * time.Second
+	defaultRetryInterval  = 2 * time.Second
+	defaultResolveTimeout = 10 * time.Second
+
+	// imageLabel is the label of leases with the hash of the image they coordinate.
+	imageLabel = "csi.warm-metal.tech/image-hash"
+)
+
+// Coordinator hands out pull slots of images to the current node.
+type Coordinator struct {
+	client    kubernetes.Interface
+	namespace string
+	holder    string
+	slots     int
+	maxWait   time.Duration
+
+	leaseDuration time.Duration
+	retryInterval time.Duration
+	resolve       func(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) (string, error)
+}
+
+// NewCoordinator creates a coordinator which allows slots nodes to pull the same image at a time.
+// Leases are created in the given namespace on behalf of the holder, which is usually the node name.
+// Nodes waiting longer than maxWait pull images anyway.
+func NewCoordinator(
+	client kubernetes.Interface, namespace, holder string, slots int, maxWait time.Duration,
+) *Coordinator {
+	return &Coordinator{
+		client:        client,
+		namespace:     namespace,
+		holder:        holder,
+		slots:         slots,
+		maxWait:       maxWait,
+		leaseDuration: defaultLeaseDuration,
+		retryInterval: defaultRetryInterval,
+		resolve: func(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) (string, error) {
+			desc, err := registry.Resolve(ctx, image, keyring)
+			if err != nil {
+				return "", err
+			}
+
+			return image.Name() + "@" + desc.Digest.String(), nil
+		},
+	}
+}
+
+// Wrap returns a puller which holds a slot of the image while pulling it.
+func (c *Coordinator) Wrap(puller remoteimage.Puller, image reference.Named, keyring secret.DockerKeyring) remoteimage.Puller {
+	return &coordinatedPuller{Puller: puller, coordinator: c, image: image, keyring: keyring}
+}
+
+type coordinatedPuller struct {
+	remoteimage.Puller
+	coordinator *Coordinator
+	image       reference.Named
+	keyring     secret.DockerKeyring
+}
+
+func (p *coordinatedPuller) Pull(ctx context.Context) error {
+	release := p.coordinator.Acquire(ctx, p.coordinator.imageKey(ctx, p.image, p.keyring))
+	defer release()
+	return p.Puller.Pull(ctx)
+}
+
+// imageKey returns the reference of the image by digest. Images which can't be resolved are coordinated
+// by their references.
+func (c *Coordinator) imageKey(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) string {
+	if digested, ok := image.(reference.Digested); ok {
+		return image.Name() + "@" + digested.Digest().String()
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, defaultResolveTimeout)
+	defer cancel()
+	key, err := c.resolve(resolveCtx, image, keyring)
+	if err != nil {
+		klog.Warningf("unable to resolve the digest of image %q. coordinate pulls by the reference: %s", image, err)
+		return image.String()
+	}
+
+	return key
+}
+
+// Acquire waits until the current node holds a slot of the image, and renews the slot until the returned function
+// is called. It returns without a slot if the context is cancelled, the API server fails, or maxWait expires.
+func (c *Coordinator) Acquire(ctx context.Context, image string) (release func()) {
+	hash := imageHash(image)
+	start := time.Now()
+	for {
+		lease, err := c.tryAcquire(ctx, hash)
+		if err != nil {
+			klog.Warningf("unable to coordinate pulls of image %q. pull it without coordination: %s", image, err)
+			return func() {}
+		}
+
+		if lease != nil {
+			klog.V(2).Infof("acquired pull slot %q of image %q after %s", lease.Name, image,
+				time.Since(start).Round(time.Millisecond))
+			return c.hold(lease)
+		}
+
+		if time.Since(start) >= c.maxWait {
+			klog.Warningf("no pull slot of image %q is available in %s. pull it anyway", image, c.maxWait)
+			return func() {}
+		}
+
+		klog.V(4).Infof("all %d pull slots of image %q are taken. wait", c.slots, image)
+		select {
+		case <-ctx.Done():
+			return func() {}
+		case <-time.After(wait.Jitter(c.retryInterval, 0.5)):
+		}
+	}
+}
+
+// tryAcquire takes a free or expired slot. It returns nil if all slots are taken by others.
+func (c *Coordinator) tryAcquire(ctx context.Context, hash string) (*coordinationv1.Lease, error) {
+	leases := c.client.CoordinationV1().Leases(c.namespace)
+	for i := 0; i < c.slots; i++ {
+		name := fmt.Sprintf("pull-%s-%d", hash, i)
+		now := metav1.NewMicroTime(time.Now())
+		duration := int32(c.leaseDuration.Seconds())
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			lease, err = leases.Create(ctx, &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: c.namespace,
+					Labels:    map[string]string{imageLabel: hash},
+				},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &c.holder,
+					LeaseDurationSeconds: &duration,
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			}, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			return lease, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !expired(lease, now.Time) && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != c.holder {
+			continue
+		}
+
+		lease.Spec.HolderIdentity = &c.holder
+		lease.Spec.LeaseDurationSeconds = &duration
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+		lease, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		if apierrors.IsConflict(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return lease, nil
+	}
+
+	return nil, nil
+}
+
+// hold renews the lease until the returned function is called, which then deletes the lease.
+// Failures of renewals are ignored, so that the pull is never interrupted.
+func (c *Coordinator) hold(lease *coordinationv1.Lease) func() {
+	holdCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	leases := c.client.CoordinationV1().Leases(c.namespace)
+	go func() {
+		defer close(done)
+		wait.Until(func() {
+			now := metav1.NewMicroTime(time.Now())
+			lease.Spec.RenewTime = &now
+			renewed, err := leases.Update(holdCtx, lease, metav1.UpdateOptions{})
+			if err != nil {
+				klog.Warningf("unable to renew pull slot %q: %s", lease.Name, err)
+				return
+			}
+
+			lease = renewed
+		}, c.leaseDuration/3, holdCtx.Done())
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		resourceVersion := lease.ResourceVersion
+		err := leases.Delete(context.Background(), lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Warningf("unable to release pull slot %q. it expires in %s: %s", lease.Name, c.leaseDuration, err)
+		}
+	}
+}
+
+func expired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.HolderIdentity == nil || len(*lease.Spec.HolderIdentity) == 0 {
+		return true
+	}
+
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+func imageHash(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return hex.EncodeToString(sum[:])[:16]
+}
@@ -0,0 +1,127 @@
+package pullcoord
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const image = "docker.io/library/alpine@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+func newCoordinator(client *fake.Clientset, holder string, maxWait time.Duration) *Coordinator {
+	c := NewCoordinator(client, "default", holder, 2, maxWait)
+	c.retryInterval = 10 * time.Millisecond
+	return c
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	releaseA := newCoordinator(client, "node-a", time.Minute).Acquire(ctx, image)
+	releaseB := newCoordinator(client, "node-b", time.Minute).Acquire(ctx, image)
+	leases, err := client.CoordinationV1().Leases("default").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, leases.Items, 2)
+
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		newCoordinator(client, "node-c", time.Minute).Acquire(ctx, image)()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("node-c should wait for a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	releaseA()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node-c should take the released slot")
+	}
+
+	releaseB()
+	leases, err = client.CoordinationV1().Leases("default").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, leases.Items, "released slots should be deleted")
+}
+
+func TestAcquireExpiredSlot(t *testing.T) {
+	ctx := context.Background()
+	stale := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	duration := int32(30)
+	var objects []runtime.Object
+	for i, name := range []string{"pull-" + imageHash(image) + "-0", "pull-" + imageHash(image) + "-1"} {
+		holder := "crashed"
+		renewTime := stale
+		if i == 1 {
+			holder = "alive"
+			renewTime = metav1.NewMicroTime(time.Now())
+		}
+
+		objects = append(objects, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity: &holder, LeaseDurationSeconds: &duration, RenewTime: &renewTime,
+			},
+		})
+	}
+
+	client := fake.NewSimpleClientset(objects...)
+	lease, err := newCoordinator(client, "node-a", time.Minute).tryAcquire(ctx, imageHash(image))
+	assert.NoError(t, err)
+	if assert.NotNil(t, lease, "expired slots should be taken over") {
+		assert.Equal(t, "node-a", *lease.Spec.HolderIdentity)
+		assert.Equal(t, objects[0].(*coordinationv1.Lease).Name, lease.Name)
+	}
+}
+
+func TestAcquireFailsOpen(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	released := newCoordinator(client, "node-a", time.Minute)
+	released.slots = 1
+	release := released.Acquire(ctx, image)
+	defer release()
+
+	start := time.Now()
+	newCoordinator(client, "node-b", 50*time.Millisecond).Acquire(ctx, image)()
+	assert.Less(t, time.Since(start), 5*time.Second, "nodes should stop waiting after maxWait")
+
+	client.PrependReactor("get", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("api server is unavailable")
+	})
+
+	start = time.Now()
+	newCoordinator(client, "node-c", time.Hour).Acquire(ctx, image)()
+	assert.Less(t, time.Since(start), 5*time.Second, "pulls should not wait if the api server is unavailable")
+}
+
+func TestImageKey(t *testing.T) {
+	c := NewCoordinator(fake.NewSimpleClientset(), "default", "node", 1, time.Minute)
+	c.resolve = func(context.Context, reference.Named, secret.DockerKeyring) (string, error) {
+		return "", errors.New("registry is unavailable")
+	}
+
+	tagged, err := reference.ParseDockerRef("alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine:3", c.imageKey(context.Background(), tagged, nil),
+		"unresolved images should be coordinated by their references")
+
+	digested, err := reference.ParseDockerRef(image)
+	assert.NoError(t, err)
+	assert.Equal(t, image, c.imageKey(context.Background(), digested, nil))
+}
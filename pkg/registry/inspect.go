@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+)
+
+// maxManifestSize is the maximum size of manifests and indexes to fetch.
+const maxManifestSize = 4 << 20
+
+// ImageInfo is what the registry knows about an image.
+type ImageInfo struct {
+	// Digest is the digest of the manifest or the index the image reference resolves to.
+	Digest digest.Digest
+	// Size is the total size of the config and layers of the image.
+	Size int64
+}
+
+// Inspect returns the digest and the size of the image in the registry.
+// For multi-platform images, the size is of the manifest which best matches the platform.
+func Inspect(ctx context.Context, image reference.Named, keyring secret.DockerKeyring, platform platforms.MatchComparer) (
+	*ImageInfo, error,
+) {
+	resolver, desc, err := resolve(ctx, image, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, image.String())
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := fetchManifest(ctx, fetcher, desc, platform)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the manifest of image %q: %w", image, err)
+	}
+
+	info := &ImageInfo{Digest: desc.Digest, Size: manifest.Config.Size}
+	for _, layer := range manifest.Layers {
+		info.Size += layer.Size
+	}
+
+	return info, nil
+}
+
+func fetchManifest(ctx context.Context, fetcher remotes.Fetcher, desc specs.Descriptor, platform platforms.MatchComparer) (
+	*specs.Manifest, error,
+) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, specs.MediaTypeImageManifest:
+		manifest := &specs.Manifest{}
+		if err := fetchJSON(ctx, fetcher, desc, manifest); err != nil {
+			return nil, err
+		}
+
+		return manifest, nil
+	case images.MediaTypeDockerSchema2ManifestList, specs.MediaTypeImageIndex:
+		index := &specs.Index{}
+		if err := fetchJSON(ctx, fetcher, desc, index); err != nil {
+			return nil, err
+		}
+
+		var candidates []specs.Descriptor
+		for _, m := range index.Manifests {
+			if m.Platform == nil || platform.Match(*m.Platform) {
+				candidates = append(candidates, m)
+			}
+		}
+
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("no manifest matches the platform: %w", errdefs.ErrNotFound)
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].Platform == nil {
+				return false
+			}
+
+			if candidates[j].Platform == nil {
+				return true
+			}
+
+			return platform.Less(*candidates[i].Platform, *candidates[j].Platform)
+		})
+
+		return fetchManifest(ctx, fetcher, candidates[0], platform)
+	default:
+		return nil, fmt.Errorf("unsupported media type %q", desc.MediaType)
+	}
+}
+
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc specs.Descriptor, v interface{}) error {
+	if desc.Size > maxManifestSize {
+		return fmt.Errorf("manifest %s is too large: %d bytes", desc.Digest, desc.Size)
+	}
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	return json.NewDecoder(io.LimitReader(rc, maxManifestSize)).Decode(v)
+}
@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+type blob struct {
+	mediaType string
+	data      []byte
+}
+
+func newBlob(t *testing.T, mediaType string, v interface{}) (specs.Descriptor, blob) {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return specs.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))},
+		blob{mediaType: mediaType, data: data}
+}
+
+// newRegistry serves manifests of the repository "foo" by digests, or the given tag.
+func newRegistry(tag string, tagged specs.Descriptor, blobs map[digest.Digest]blob) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/v2/foo/manifests/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ref := strings.TrimPrefix(r.URL.Path, prefix)
+		if ref == tag {
+			ref = tagged.Digest.String()
+		}
+
+		b, found := blobs[digest.Digest(ref)]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", b.mediaType)
+		w.Header().Set("Docker-Content-Digest", ref)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(b.data)
+		}
+	}))
+}
+
+func TestInspect(t *testing.T) {
+	amd64Desc, amd64 := newBlob(t, specs.MediaTypeImageManifest, specs.Manifest{
+		Config: specs.Descriptor{Size: 10},
+		Layers: []specs.Descriptor{{Size: 100}, {Size: 1000}},
+	})
+	arm64Desc, arm64 := newBlob(t, specs.MediaTypeImageManifest, specs.Manifest{
+		Config: specs.Descriptor{Size: 20},
+		Layers: []specs.Descriptor{{Size: 200}},
+	})
+
+	amd64Desc.Platform = &specs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64Desc.Platform = &specs.Platform{OS: "linux", Architecture: "arm64"}
+	indexDesc, index := newBlob(t, specs.MediaTypeImageIndex, specs.Index{
+		Manifests: []specs.Descriptor{amd64Desc, arm64Desc},
+	})
+
+	server := newRegistry("latest", indexDesc, map[digest.Digest]blob{
+		amd64Desc.Digest: amd64,
+		arm64Desc.Digest: arm64,
+		indexDesc.Digest: index,
+	})
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	image, err := reference.ParseDockerRef(host + "/foo:latest")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	info, err := Inspect(ctx, image, nil, platforms.Only(specs.Platform{OS: "linux", Architecture: "arm64"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(220), info.Size)
+	assert.Equal(t, indexDesc.Digest, info.Digest, "the digest should be of the index")
+
+	info, err = Inspect(ctx, image, nil, platforms.Only(specs.Platform{OS: "linux", Architecture: "amd64"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1110), info.Size)
+
+	_, err = Inspect(ctx, image, nil, platforms.Only(specs.Platform{OS: "windows", Architecture: "amd64"}))
+	assert.True(t, IsNotFound(err), "images without manifests of the platform should be not found")
+
+	missing, err := reference.ParseDockerRef(host + "/foo:missing")
+	assert.NoError(t, err)
+	_, err = Resolve(ctx, missing, nil)
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,83 @@
+// Package registry accesses images in registries via the OCI distribution API without pulling them.
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
+)
+
+// Resolve returns the descriptor of the image manifest in the registry.
+// Each credential the keyring provides for the image is tried in order, then anonymous access.
+func Resolve(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) (specs.Descriptor, error) {
+	_, desc, err := resolve(ctx, image, keyring)
+	return desc, err
+}
+
+// IsNotFound returns true if the error means that the image doesn't exist in the registry.
+func IsNotFound(err error) bool {
+	return errdefs.IsNotFound(err)
+}
+
+// resolve returns the descriptor of the image manifest and the resolver which resolved it.
+func resolve(ctx context.Context, image reference.Named, keyring secret.DockerKeyring) (
+	remotes.Resolver, specs.Descriptor, error,
+) {
+	var auths []*cri.AuthConfig
+	if keyring != nil {
+		auths, _ = keyring.Lookup(image.Name())
+	}
+
+	// The anonymous access is tried at last.
+	auths = append(auths, nil)
+
+	var errs []error
+	notFound := true
+	for _, auth := range auths {
+		resolver := newResolver(auth)
+		_, desc, err := resolver.Resolve(ctx, image.String())
+		if err == nil {
+			return resolver, desc, nil
+		}
+
+		klog.V(4).Infof("unable to resolve image %q: %s", image, err)
+		errs = append(errs, err)
+		notFound = notFound && IsNotFound(err)
+	}
+
+	// Some registries respond NotFound to unauthorized clients. The image is missing only if all attempts say so.
+	if notFound {
+		return nil, specs.Descriptor{}, errs[len(errs)-1]
+	}
+
+	return nil, specs.Descriptor{}, fmt.Errorf("unable to resolve image %q: %w", image, utilerrors.NewAggregate(errs))
+}
+
+func newResolver(auth *cri.AuthConfig) remotes.Resolver {
+	authorizerOpts := []docker.AuthorizerOpt{}
+	if auth != nil {
+		authorizerOpts = append(authorizerOpts, docker.WithAuthCreds(func(string) (string, string, error) {
+			if len(auth.IdentityToken) > 0 {
+				return "", auth.IdentityToken, nil
+			}
+
+			return auth.Username, auth.Password, nil
+		}))
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(authorizerOpts...)),
+			docker.WithPlainHTTP(docker.MatchLocalhost),
+		),
+	})
+}
@@ -0,0 +1,222 @@
+package remoteimage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/containerd/v2/core/remotes/docker/config"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// criImageLabel makes images pulled via containerd visible to the CRI plugin, the same as images pulled via CRI.
+	criImageLabel      = "io.cri-containerd.image"
+	criImageLabelValue = "managed"
+
+	dockerHubDomain = "docker.io"
+	dockerHubHost   = "registry-1.docker.io"
+)
+
+// ContainerdPullOptions are options of pulls via containerd.
+type ContainerdPullOptions struct {
+	// HostsDir is the directory of hosts.toml of registries, e.g. /etc/containerd/certs.d.
+	// Registries are accessed directly if it is empty.
+	HostsDir string
+	// Platform is the platform to pull and unpack. The default platform of the node is used if it is empty.
+	Platform string
+	// Snapshotter is the snapshotter to unpack to, along with labels for remote snapshotters. The default snapshotter
+	// of containerd is used if it is empty.
+	Snapshotter string
+	// Namespace is the containerd namespace to pull to. The default namespace of the client is used if it is empty.
+	Namespace string
+}
+
+// containerdPuller pulls and unpacks images via the containerd client instead of the CRI image service.
+type containerdPuller struct {
+	cli      *client.Client
+	image    reference.Named
+	keyring  secret.DockerKeyring
+	opts     ContainerdPullOptions
+	identity string
+	imageID  string
+}
+
+// NewContainerdPuller creates a puller pulling images via containerd. Credentials of the keyring are only sent to
+// the registry of the image, never to its mirrors.
+func NewContainerdPuller(
+	cli *client.Client, image reference.Named, keyring secret.DockerKeyring, opts ContainerdPullOptions,
+) Puller {
+	return &containerdPuller{
+		cli:     cli,
+		image:   image,
+		keyring: keyring,
+		opts:    opts,
+	}
+}
+
+func (p containerdPuller) ImageWithTag() string {
+	return p.image.String()
+}
+
+func (p containerdPuller) ImageWithoutTag() string {
+	return p.image.Name()
+}
+
+// ImageSize returns the compressed size of the image of the pulled platform.
+func (p containerdPuller) ImageSize(ctx context.Context) (int, error) {
+	ctx = p.withNamespace(ctx)
+	img, err := p.cli.GetImage(ctx, p.image.String())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get image: %w", err)
+	}
+
+	size, err := img.Size(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get image size: %w", err)
+	}
+
+	return int(size), nil
+}
+
+func (p containerdPuller) CredentialIdentity() string {
+	return p.identity
+}
+
+// ImageID returns the digest of the config of the pulled image, which the CRI plugin uses as the image ID.
+func (p containerdPuller) ImageID() string {
+	return p.imageID
+}
+
+// Pull pulls the image without credentials at first, then with each credential of the keyring.
+func (p *containerdPuller) Pull(ctx context.Context) (err error) {
+	startTime := time.Now()
+	defer func() {
+		recordPullMetrics(ctx, p, startTime, err)
+	}()
+
+	ctx = p.withNamespace(ctx)
+
+	// The anonymous access is tried at first.
+	auths := []*cri.AuthConfig{nil}
+	if p.keyring != nil {
+		if authConfigs, found := p.keyring.Lookup(p.image.Name()); found {
+			auths = append(auths, authConfigs...)
+		}
+	}
+
+	var errs []error
+	for i, auth := range auths {
+		klog.V(2).Infof("pull image %s via containerd with credential option %d", p.image, i)
+		opts := []client.RemoteOpt{
+			client.WithPullUnpack,
+			client.WithResolver(p.resolver(ctx, auth)),
+			client.WithPullLabel(criImageLabel, criImageLabelValue),
+		}
+
+		if len(p.opts.Platform) > 0 {
+			opts = append(opts, client.WithPlatform(p.opts.Platform))
+		}
+
+		if len(p.opts.Snapshotter) > 0 {
+			// Labels of the image let remote snapshotters, e.g. stargz, nydus or SOCI, mount layers lazily.
+			opts = append(opts, client.WithPullSnapshotter(p.opts.Snapshotter),
+				client.WithImageHandlerWrapper(snapshotters.AppendInfoHandlerWrapper(p.image.String())))
+		}
+
+		var img client.Image
+		if img, err = p.cli.Pull(ctx, p.image.String(), opts...); err == nil {
+			p.identity = secret.AuthIdentity(auth)
+			p.imageID = imageConfigDigest(ctx, img)
+			klog.Infof("pulled image %s via containerd with credential option %d", p.image, i)
+			return nil
+		}
+
+		klog.V(2).Infof("unable to pull image %s via containerd with credential option %d: %s", p.image, i, err)
+		errs = append(errs, fmt.Errorf("auth option %d: %w", i, err))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// imageConfigDigest returns the digest of the image config of the platform of the image, or the digest of the image
+// if the config can't be read.
+func imageConfigDigest(ctx context.Context, img client.Image) string {
+	config, err := img.Config(ctx)
+	if err != nil {
+		klog.Warningf("unable to read the config of image %s. identify it by digest: %s", img.Name(), err)
+		return img.Target().Digest.String()
+	}
+
+	return config.Digest.String()
+}
+
+func (p containerdPuller) withNamespace(ctx context.Context) context.Context {
+	if len(p.opts.Namespace) > 0 {
+		return namespaces.WithNamespace(ctx, p.opts.Namespace)
+	}
+
+	return ctx
+}
+
+// resolver returns a resolver using hosts.toml in HostsDir, which sends credentials of auth to the registry of the
+// image only.
+func (p containerdPuller) resolver(ctx context.Context, auth *cri.AuthConfig) remotes.Resolver {
+	hostOpts := config.HostOptions{}
+	if len(p.opts.HostsDir) > 0 {
+		hostOpts.HostDir = config.HostDirFromRoot(p.opts.HostsDir)
+	}
+
+	if auth != nil {
+		hostOpts.Credentials = func(host string) (string, string, error) {
+			if !isRegistryHost(p.image, host) {
+				return "", "", nil
+			}
+
+			return credentials(auth)
+		}
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{Hosts: config.ConfigureHosts(ctx, hostOpts)})
+}
+
+// isRegistryHost returns true if host is the registry of the image, rather than a mirror.
+func isRegistryHost(image reference.Named, host string) bool {
+	domain := reference.Domain(image)
+	return host == domain || (domain == dockerHubDomain && host == dockerHubHost)
+}
+
+// credentials returns the username and secret of auth. The Auth field, base64 encoded "username:password", is only
+// used if both Username and Password are empty.
+func credentials(auth *cri.AuthConfig) (string, string, error) {
+	if len(auth.IdentityToken) > 0 {
+		return "", auth.IdentityToken, nil
+	}
+
+	if len(auth.Username) > 0 || len(auth.Password) > 0 || len(auth.Auth) == 0 {
+		return auth.Username, auth.Password, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid auth: %s", err)
+	}
+
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return "", "", fmt.Errorf("invalid auth: no colon")
+	}
+
+	return username, password, nil
+}
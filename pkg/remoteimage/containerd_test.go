@@ -0,0 +1,45 @@
+package remoteimage
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestIsRegistryHost(t *testing.T) {
+	hub, err := reference.ParseDockerRef("foo/bar:v1")
+	require.NoError(t, err)
+	assert.True(t, isRegistryHost(hub, "docker.io"))
+	assert.True(t, isRegistryHost(hub, "registry-1.docker.io"))
+	assert.False(t, isRegistryHost(hub, "mirror.local:5000"))
+
+	private, err := reference.ParseDockerRef("registry.local:5000/foo/bar:v1")
+	require.NoError(t, err)
+	assert.True(t, isRegistryHost(private, "registry.local:5000"))
+	assert.False(t, isRegistryHost(private, "registry-1.docker.io"))
+}
+
+func TestCredentials(t *testing.T) {
+	cases := []struct {
+		auth             *cri.AuthConfig
+		username, secret string
+	}{
+		{&cri.AuthConfig{Username: "foo", Password: "bar"}, "foo", "bar"},
+		{&cri.AuthConfig{IdentityToken: "token", Username: "foo"}, "", "token"},
+		{&cri.AuthConfig{Auth: base64.StdEncoding.EncodeToString([]byte("foo:b:ar"))}, "foo", "b:ar"},
+	}
+
+	for _, c := range cases {
+		username, secret, err := credentials(c.auth)
+		assert.NoError(t, err)
+		assert.Equal(t, c.username, username)
+		assert.Equal(t, c.secret, secret)
+	}
+
+	_, _, err := credentials(&cri.AuthConfig{Auth: base64.StdEncoding.EncodeToString([]byte("foo"))})
+	assert.Error(t, err)
+}
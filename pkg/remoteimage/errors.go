@@ -0,0 +1,58 @@
+package remoteimage
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons of pull failures.
+const (
+	PullErrorTimeout      = "Timeout"
+	PullErrorCanceled     = "Canceled"
+	PullErrorUnauthorized = "Unauthorized"
+	PullErrorNotFound     = "NotFound"
+	PullErrorUnknown      = "Unknown"
+)
+
+// ClassifyPullError returns the reason why a pull failed.
+// Runtimes don't return structured errors, so messages of registries are also matched.
+func ClassifyPullError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return PullErrorTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return PullErrorCanceled
+	}
+
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.DeadlineExceeded:
+			return PullErrorTimeout
+		case codes.Canceled:
+			return PullErrorCanceled
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return PullErrorUnauthorized
+		case codes.NotFound:
+			return PullErrorNotFound
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "unauthorized"), strings.Contains(msg, "denied"),
+		strings.Contains(msg, "401"), strings.Contains(msg, "403"):
+		return PullErrorUnauthorized
+	case strings.Contains(msg, "not found"), strings.Contains(msg, "manifest unknown"),
+		strings.Contains(msg, "404"):
+		return PullErrorNotFound
+	case strings.Contains(msg, "deadline exceeded"), strings.Contains(msg, "timeout"):
+		return PullErrorTimeout
+	default:
+		return PullErrorUnknown
+	}
+}
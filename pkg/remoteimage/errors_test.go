@@ -0,0 +1,28 @@
+package remoteimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyPullError(t *testing.T) {
+	cases := map[string]error{
+		PullErrorTimeout:  fmt.Errorf("pull: %w", context.DeadlineExceeded),
+		PullErrorCanceled: status.Error(codes.Canceled, "context canceled"),
+		PullErrorUnauthorized: errors.New(`failed to pull and unpack image "docker.io/foo/bar:latest": ` +
+			`failed to authorize: failed to fetch anonymous token: unexpected status: 401 Unauthorized`),
+		PullErrorNotFound: status.Error(codes.Unknown,
+			`failed to resolve reference "docker.io/foo/bar:latest": docker.io/foo/bar:latest: not found`),
+		PullErrorUnknown: errors.New("no space left on device"),
+	}
+
+	for reason, err := range cases {
+		assert.Equal(t, reason, ClassifyPullError(err), err.Error())
+	}
+}
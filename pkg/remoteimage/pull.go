@@ -23,6 +23,12 @@ type Puller interface {
 	ImageWithoutTag() string
 	// ImageSize returns the size of the image in bytes
 	ImageSize(context.Context) (int, error)
+	// CredentialIdentity returns the identity of the credential used by the last successful pull.
+	// It is secret.AnonymousIdentity if the image was pulled without credentials.
+	CredentialIdentity() string
+	// ImageID returns the local ID of the image pulled by the last successful pull, the same as the ID reported by
+	// the CRI, or empty if unknown.
+	ImageID() string
 }
 
 // NewPuller creates a new image puller instance
@@ -35,11 +41,32 @@ func NewPuller(imageSvc cri.ImageServiceClient, image reference.Named,
 	}
 }
 
+// NewPullerFunc creates a puller of the image using credentials of the keyring.
+type NewPullerFunc func(image reference.Named, keyring secret.DockerKeyring) (Puller, error)
+
+// LocalImageID returns the ID of the local image via the CRI image service
+func LocalImageID(ctx context.Context, imageSvc cri.ImageServiceClient, image reference.Named) (string, error) {
+	resp, err := imageSvc.ImageStatus(ctx, &cri.ImageStatusRequest{
+		Image: &cri.ImageSpec{Image: image.String()},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Image == nil || resp.Image.Id == "" {
+		return "", fmt.Errorf("image %q not found", image)
+	}
+
+	return resp.Image.Id, nil
+}
+
 // puller implements the Puller interface
 type puller struct {
 	imageSvc cri.ImageServiceClient
 	image    reference.Named
 	keyring  secret.DockerKeyring
+	identity string
+	imageID  string
 }
 
 // ImageWithTag returns the full image name with tag
@@ -78,13 +105,23 @@ func (p puller) ImageSize(ctx context.Context) (int, error) {
 	return int(imageStatusResponse.Image.Size), nil
 }
 
+// CredentialIdentity returns the identity of the credential used by the last successful pull
+func (p puller) CredentialIdentity() string {
+	return p.identity
+}
+
+// ImageID returns the image reference returned by the CRI for the last successful pull
+func (p puller) ImageID() string {
+	return p.imageID
+}
+
 // Pull downloads the container image
-func (p puller) Pull(ctx context.Context) (err error) {
+func (p *puller) Pull(ctx context.Context) (err error) {
 	startTime := time.Now()
 
 	// Setup deferred metrics collection
 	defer func() {
-		p.recordPullMetrics(startTime, err, ctx)
+		recordPullMetrics(ctx, p, startTime, err)
 	}()
 
 	// Create image spec for CRI API
@@ -92,15 +129,21 @@ func (p puller) Pull(ctx context.Context) (err error) {
 
 	// First try without credentials
 	if err = p.pullWithoutCredentials(ctx, imageSpec); err == nil {
+		p.identity = secret.AnonymousIdentity
 		return nil // Success without credentials
 	}
 
 	// If public pull failed, try with credentials
-	return p.pullWithCredentials(ctx, imageSpec, err)
+	identity, err := p.pullWithCredentials(ctx, imageSpec, err)
+	if err == nil {
+		p.identity = identity
+	}
+
+	return err
 }
 
 // recordPullMetrics records metrics about the image pull operation
-func (p puller) recordPullMetrics(startTime time.Time, err error, ctx context.Context) {
+func recordPullMetrics(ctx context.Context, p Puller, startTime time.Time, err error) {
 	elapsed := time.Since(startTime).Seconds()
 	imageTag := p.ImageWithTag()
 
@@ -122,12 +165,12 @@ func (p puller) recordPullMetrics(startTime time.Time, err error, ctx context.Co
 
 	// Record size metrics if pull was successful
 	if err == nil {
-		p.recordSizeMetrics(ctx, imageTag)
+		recordSizeMetrics(ctx, p, imageTag)
 	}
 }
 
 // recordSizeMetrics records metrics about the image size
-func (p puller) recordSizeMetrics(ctx context.Context, imageTag string) {
+func recordSizeMetrics(ctx context.Context, p Puller, imageTag string) {
 	size, err := p.ImageSize(ctx)
 	if err != nil {
 		return // Error already logged in ImageSize()
@@ -144,15 +187,16 @@ func (p puller) recordSizeMetrics(ctx context.Context, imageTag string) {
 }
 
 // pullWithoutCredentials attempts to pull the image without authentication
-func (p puller) pullWithoutCredentials(ctx context.Context, imageSpec *cri.ImageSpec) error {
+func (p *puller) pullWithoutCredentials(ctx context.Context, imageSpec *cri.ImageSpec) error {
 	klog.V(2).Infof("Attempting to pull image %s without credentials", p.ImageWithTag())
 
-	_, err := p.imageSvc.PullImage(ctx, &cri.PullImageRequest{
+	resp, err := p.imageSvc.PullImage(ctx, &cri.PullImageRequest{
 		Image: imageSpec,
 	})
 
 	if err == nil {
 		klog.V(2).Infof("Successfully pulled image %s without credentials", p.ImageWithTag())
+		p.imageID = resp.GetImageRef()
 		return nil
 	}
 
@@ -160,8 +204,9 @@ func (p puller) pullWithoutCredentials(ctx context.Context, imageSpec *cri.Image
 	return err
 }
 
-// pullWithCredentials attempts to pull the image using credentials from the keyring
-func (p puller) pullWithCredentials(ctx context.Context, imageSpec *cri.ImageSpec, initialErr error) error {
+// pullWithCredentials attempts to pull the image using credentials from the keyring.
+// The identity of the credential that succeeded is returned.
+func (p *puller) pullWithCredentials(ctx context.Context, imageSpec *cri.ImageSpec, initialErr error) (string, error) {
 	// Look up credentials for this image repository
 	repo := p.ImageWithoutTag()
 	klog.V(2).Infof("Looking up credentials for repo=%s (full image=%s)", repo, p.ImageWithTag())
@@ -170,7 +215,7 @@ func (p puller) pullWithCredentials(ctx context.Context, imageSpec *cri.ImageSpe
 	// If no credentials are available, return the original error
 	if !withCredentials || len(authConfigs) == 0 {
 		klog.V(2).Infof("No credentials found for %s", p.ImageWithTag())
-		return fmt.Errorf("failed to pull image without credentials and no credentials available: %w", initialErr)
+		return "", fmt.Errorf("failed to pull image without credentials and no credentials available: %w", initialErr)
 	}
 
 	klog.V(2).Infof("Found %d credential options for image %s", len(authConfigs), p.ImageWithTag())
@@ -180,7 +225,7 @@ func (p puller) pullWithCredentials(ctx context.Context, imageSpec *cri.ImageSpe
 }
 
 // tryCredentials attempts to pull the image with each credential option
-func (p puller) tryCredentials(ctx context.Context, imageSpec *cri.ImageSpec, authConfigs []*cri.AuthConfig) error {
+func (p *puller) tryCredentials(ctx context.Context, imageSpec *cri.ImageSpec, authConfigs []*cri.AuthConfig) (string, error) {
 	var pullErrs []error
 
 	// Try each credential until one succeeds
@@ -189,7 +234,7 @@ func (p puller) tryCredentials(ctx context.Context, imageSpec *cri.ImageSpec, au
 
 		// Try pulling with this credential
 		if err := p.pullWithAuth(ctx, imageSpec, authConfig, i+1); err == nil {
-			return nil // Success
+			return secret.AuthIdentity(authConfig), nil // Success
 		} else {
 			pullErrs = append(pullErrs, err)
 		}
@@ -199,21 +244,22 @@ func (p puller) tryCredentials(ctx context.Context, imageSpec *cri.ImageSpec, au
 	err := utilerrors.NewAggregate(pullErrs)
 	klog.Warningf("All %d credential options failed for image %s",
 		len(authConfigs), p.ImageWithTag())
-	return err
+	return "", err
 }
 
 // pullWithAuth attempts to pull using a specific credential
-func (p puller) pullWithAuth(ctx context.Context, imageSpec *cri.ImageSpec, auth *cri.AuthConfig, optionNum int) error {
+func (p *puller) pullWithAuth(ctx context.Context, imageSpec *cri.ImageSpec, auth *cri.AuthConfig, optionNum int) error {
 	klog.V(2).Infof("Attempting pull for %s with credential option %d (username: '%s')",
 		p.ImageWithTag(), optionNum, auth.Username)
 
-	_, err := p.imageSvc.PullImage(ctx, &cri.PullImageRequest{
+	resp, err := p.imageSvc.PullImage(ctx, &cri.PullImageRequest{
 		Image: imageSpec,
 		Auth:  auth,
 	})
 
 	if err == nil {
 		klog.Infof("Successfully pulled image %s with credential option %d", p.ImageWithTag(), optionNum)
+		p.imageID = resp.GetImageRef()
 		return nil
 	}
 
@@ -2,11 +2,14 @@ package remoteimage
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/stretchr/testify/assert"
 	"github.com/warm-metal/container-image-csi-driver/pkg/cri"
+	"google.golang.org/grpc"
 	v1 "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
@@ -28,3 +31,38 @@ func TestPull(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, r)
 }
+
+type fakeImageService struct {
+	v1.ImageServiceClient
+	anonymous bool
+}
+
+func (f *fakeImageService) PullImage(_ context.Context, req *v1.PullImageRequest, _ ...grpc.CallOption) (*v1.PullImageResponse, error) {
+	if req.Auth == nil && !f.anonymous {
+		return nil, errors.New("unauthorized")
+	}
+
+	return &v1.PullImageResponse{ImageRef: "sha256:config"}, nil
+}
+
+func (f *fakeImageService) ImageStatus(context.Context, *v1.ImageStatusRequest, ...grpc.CallOption) (*v1.ImageStatusResponse, error) {
+	return &v1.ImageStatusResponse{Image: &v1.Image{Id: "sha256:config", Size: 1}}, nil
+}
+
+type fakeKeyring struct{}
+
+func (fakeKeyring) Lookup(string) ([]*v1.AuthConfig, bool) {
+	return []*v1.AuthConfig{{Username: "foo", Password: "bar"}}, true
+}
+
+func TestPullerImageID(t *testing.T) {
+	image, err := reference.ParseDockerRef("docker.io/library/alpine:3")
+	assert.NoError(t, err)
+
+	for _, anonymous := range []bool{true, false} {
+		p := NewPuller(&fakeImageService{anonymous: anonymous}, image, fakeKeyring{})
+		assert.Empty(t, p.ImageID())
+		assert.NoError(t, p.Pull(context.Background()))
+		assert.Equal(t, "sha256:config", p.ImageID(), "the image reference returned by the CRI should be the ID")
+	}
+}
@@ -0,0 +1,159 @@
+package remoteimage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/distribution/reference"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
+)
+
+// PullRecords remembers which credentials successfully pulled each image.
+// It is used to make sure that an image cached on the node is only mounted by workloads
+// which are able to pull it by themselves.
+type PullRecords struct {
+	path string
+
+	guard sync.Mutex
+	// mapping from image IDs to identities of credentials which pulled the image
+	records map[string]map[string]struct{}
+}
+
+// LoadPullRecords loads pull records from the given file. An empty set of records returns if the file doesn't exist.
+func LoadPullRecords(path string) (*PullRecords, error) {
+	r := &PullRecords{
+		path:    path,
+		records: make(map[string]map[string]struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+
+		return nil, fmt.Errorf("unable to read pull records %q: %w", path, err)
+	}
+
+	persisted := make(map[string][]string)
+	if err = json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("unable to decode pull records %q: %w", path, err)
+	}
+
+	for imageID, identities := range persisted {
+		r.records[imageID] = make(map[string]struct{}, len(identities))
+		for _, id := range identities {
+			r.records[imageID][id] = struct{}{}
+		}
+	}
+
+	klog.Infof("loaded pull records of %d images from %q", len(r.records), path)
+	return r, nil
+}
+
+// Record saves that the image with the given ID was pulled using the credential identity.
+func (r *PullRecords) Record(imageID, identity string) error {
+	if imageID == "" || identity == "" {
+		return fmt.Errorf("both image ID and credential identity are required")
+	}
+
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	if _, ok := r.records[imageID][identity]; ok {
+		return nil
+	}
+
+	if r.records[imageID] == nil {
+		r.records[imageID] = make(map[string]struct{})
+	}
+
+	r.records[imageID][identity] = struct{}{}
+	return r.save()
+}
+
+// RecordPull saves the credential identity used to pull the image. The image ID is fetched via the CRI image service.
+func (r *PullRecords) RecordPull(ctx context.Context, imageSvc cri.ImageServiceClient, image reference.Named, identity string) error {
+	if identity == "" {
+		return fmt.Errorf("unknown credentials pulled image %q", image)
+	}
+
+	imageID, err := LocalImageID(ctx, imageSvc, image)
+	if err != nil {
+		return fmt.Errorf("unable to fetch ID of image %q: %w", image, err)
+	}
+
+	return r.Record(imageID, identity)
+}
+
+// Verify returns true if the image was pulled anonymously or by any of the given credential identities.
+func (r *PullRecords) Verify(imageID string, identities []string) bool {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	recorded := r.records[imageID]
+	if _, ok := recorded[secret.AnonymousIdentity]; ok {
+		return true
+	}
+
+	for _, id := range identities {
+		if _, ok := recorded[id]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Forget removes all records of the given image.
+func (r *PullRecords) Forget(imageID string) error {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	if _, ok := r.records[imageID]; !ok {
+		return nil
+	}
+
+	delete(r.records, imageID)
+	return r.save()
+}
+
+func (r *PullRecords) save() error {
+	persisted := make(map[string][]string, len(r.records))
+	for imageID, identities := range r.records {
+		ids := make([]string, 0, len(identities))
+		for id := range identities {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+		persisted[imageID] = ids
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write pull records: %w", err)
+	}
+
+	if err = os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("unable to save pull records: %w", err)
+	}
+
+	return nil
+}
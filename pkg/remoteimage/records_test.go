@@ -0,0 +1,32 @@
+package remoteimage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
+)
+
+func TestPullRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pull-records.json")
+	records, err := LoadPullRecords(path)
+	assert.NoError(t, err)
+
+	assert.False(t, records.Verify("sha256:private", []string{"foo"}), "unknown images should not be verified")
+
+	assert.NoError(t, records.Record("sha256:private", "foo"))
+	assert.NoError(t, records.Record("sha256:public", secret.AnonymousIdentity))
+
+	assert.True(t, records.Verify("sha256:private", []string{"bar", "foo"}))
+	assert.False(t, records.Verify("sha256:private", []string{"bar"}), "other credentials should not be verified")
+	assert.False(t, records.Verify("sha256:private", nil), "workloads without credentials should not be verified")
+	assert.True(t, records.Verify("sha256:public", nil), "anonymously pulled images are accessible to everyone")
+
+	reloaded, err := LoadPullRecords(path)
+	assert.NoError(t, err)
+	assert.True(t, reloaded.Verify("sha256:private", []string{"foo"}), "records should survive restarts")
+
+	assert.NoError(t, reloaded.Forget("sha256:private"))
+	assert.False(t, reloaded.Verify("sha256:private", []string{"foo"}))
+}
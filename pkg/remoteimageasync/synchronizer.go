@@ -22,7 +22,7 @@ func StartAsyncPuller(ctx context.Context, sessionChanDepth int) AsyncPuller {
 		async.mutex.Lock()
 		defer async.mutex.Unlock()
 		klog.V(2).Infof("%s.StartAsyncPuller(): clearing session for %s", prefix, ses.ImageWithTag())
-		delete(async.sessionMap, ses.ImageWithTag()) // no-op if already deleted
+		delete(async.sessionMap, ses.key) // no-op if already deleted
 	}
 	RunPullerLoop(ctx, sessionChan, completedFunc)
 	klog.Infof("%s.StartAsyncPuller(): async puller is operational", prefix)
@@ -45,13 +45,14 @@ func getSynchronizer(
 	}
 }
 
-func (s synchronizer) StartPull(image string, puller remoteimage.Puller, asyncPullTimeout time.Duration) (ses *PullSession, err error) {
-	klog.V(2).Infof("%s.StartPull(): start pull: asked to pull image %s", prefix, image)
+func (s synchronizer) StartPull(key string, puller remoteimage.Puller, asyncPullTimeout time.Duration) (ses *PullSession, err error) {
+	klog.V(2).Infof("%s.StartPull(): start pull: asked to pull image %s", prefix, puller.ImageWithTag())
 	s.mutex.Lock() // lock mutex, no blocking sends/receives inside mutex
 	defer s.mutex.Unlock()
-	ses, ok := s.sessionMap[image] // try get session
-	if !ok {                       // if no session, create session
+	ses, ok := s.sessionMap[key] // try get session
+	if !ok {                     // if no session, create session
 		ses = &PullSession{
+			key:        key,
 			puller:     puller,
 			timeout:    asyncPullTimeout,
 			done:       make(chan interface{}),
@@ -70,7 +71,7 @@ func (s synchronizer) StartPull(image string, puller remoteimage.Puller, asyncPu
 		select {
 		case s.sessions <- ses: // start session, check for deadlock... possibility of panic but only during app shutdown where Puller has already ceased to operate, handle with defer/recover
 			klog.V(2).Infof("%s.StartPull(): new session created for %s with timeout %v", prefix, ses.ImageWithTag(), ses.timeout)
-			s.sessionMap[image] = ses // add session to map to allow continuation... only do this because was passed to puller via sessions channel
+			s.sessionMap[key] = ses // add session to map to allow continuation... only do this because was passed to puller via sessions channel
 			return ses, nil
 		default: // catch deadlock or throttling (they may look the same)
 			err := fmt.Errorf("%s.StartPull(): cannot create pull session for %s at this time, throttling or deadlock condition exists, retry if throttling", prefix, ses.ImageWithTag())
@@ -220,6 +220,14 @@ func (p pullerMock) ImageWithoutTag() string {
 	panic("Not implemented")
 }
 
+func (p pullerMock) CredentialIdentity() string {
+	return ""
+}
+
+func (p pullerMock) ImageID() string {
+	return ""
+}
+
 func (p pullerMock) ImageSize(ctx context.Context) (int, error) {
 	if p.size < 0 {
 		return 0, fmt.Errorf("error occurred when checking image size")
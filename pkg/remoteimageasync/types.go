@@ -2,15 +2,19 @@ package remoteimageasync
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/warm-metal/container-image-csi-driver/pkg/remoteimage"
+	"github.com/warm-metal/container-image-csi-driver/pkg/secret"
 )
 
 const prefix = "remoteimageasync"
 
 type PullSession struct {
+	key        string // sessions are merged by this key
 	puller     remoteimage.Puller
 	timeout    time.Duration    // this is the session timeout, not the caller timeout
 	done       chan interface{} // chan will block until result
@@ -22,6 +26,16 @@ func (p PullSession) ImageWithTag() string {
 	return p.puller.ImageWithTag()
 }
 
+// only valid after the session is done
+func (p PullSession) CredentialIdentity() string {
+	return p.puller.CredentialIdentity()
+}
+
+// only valid after the session is done
+func (p PullSession) ImageID() string {
+	return p.puller.ImageID()
+}
+
 type synchronizer struct {
 	sessionMap map[string]*PullSession // all interactions must be mutex'd
 	mutex      *sync.Mutex             // this exclusively protects the sessionMap
@@ -29,10 +43,21 @@ type synchronizer struct {
 	ctx        context.Context         // top level application context
 }
 
+// SessionKey generates the key of pull sessions which are shared only by the same image
+// and the same set of credentials.
+func SessionKey(image reference.Named, identities []string) string {
+	if len(identities) == 0 {
+		return image.String() + "|" + secret.AnonymousIdentity
+	}
+
+	return image.String() + "|" + strings.Join(identities, ",")
+}
+
 // allows mocking/dependency injection
 type AsyncPuller interface {
-	// returns session that is ready to wait on, or error
-	StartPull(image string, puller remoteimage.Puller, asyncPullTimeout time.Duration) (*PullSession, error)
+	// returns session that is ready to wait on, or error.
+	// concurrent pulls with the same key share a session, so the key should identify both the image and the credentials.
+	StartPull(key string, puller remoteimage.Puller, asyncPullTimeout time.Duration) (*PullSession, error)
 	// waits for session to time out or succeed
 	WaitForPull(session *PullSession, callerTimeout context.Context) error
 }
@@ -0,0 +1,308 @@
+// Package schedgate holds pods using image volumes out of scheduling until their images are warm on enough nodes.
+package schedgate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// GateName is the scheduling gate of pods waiting for images of their volumes.
+// Kubernetes only accepts scheduling gates on pod creation, so the gate is added by an admission policy.
+const GateName = v1alpha1.GroupName + "/image-warm"
+
+// pollInterval is how often the progress of prewarming is checked.
+const pollInterval = 5 * time.Second
+
+// PodImages are images of volumes of a pod, along with Secrets in the pod namespace to pull them.
+type PodImages struct {
+	Images      []string
+	PullSecrets []string
+}
+
+// ImagesFunc returns images of volumes of the driver used by the pod.
+// It returns an error if images can't be determined yet, e.g. PVCs are not bound.
+type ImagesFunc func(pod *corev1.Pod) (*PodImages, error)
+
+// Controller prewarms images of volumes of gated pods on the nodes they can be scheduled on,
+// and removes the gate once enough nodes hold the images or the timeout expires.
+type Controller struct {
+	kubeClient kubernetes.Interface
+	client     dynamic.Interface
+	watcher    *watcher.Watcher
+	imagesOf   ImagesFunc
+	minNodes   int
+	timeout    time.Duration
+
+	queue workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewController creates a scheduling gate controller. Gates are removed once minNodes nodes hold the images,
+// or timeout after pods are created.
+func NewController(
+	kubeClient kubernetes.Interface, client dynamic.Interface, watcher *watcher.Watcher, imagesOf ImagesFunc,
+	minNodes int, timeout time.Duration,
+) (*Controller, error) {
+	c := &Controller{
+		kubeClient: kubeClient,
+		client:     client,
+		watcher:    watcher,
+		imagesOf:   imagesOf,
+		minNodes:   minNodes,
+		timeout:    timeout,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "scheduling-gate"},
+		),
+	}
+
+	err := watcher.AddPodEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			pod, ok := obj.(*corev1.Pod)
+			return ok && gated(pod)
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.enqueue,
+			UpdateFunc: func(_, newObj interface{}) { c.enqueue(newObj) },
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Run processes gated pods until the context is cancelled.
+func (c *Controller) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	klog.Infof("starting scheduling gate controller. gates are removed once %d nodes hold images or after %s",
+		c.minNodes, c.timeout)
+	if !c.watcher.WaitForCacheSync(ctx) {
+		klog.Errorf("unable to sync pods and volumes")
+		return
+	}
+
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	<-ctx.Done()
+	klog.Infof("scheduling gate controller stopped")
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("unable to get key of object %#v: %s", obj, err)
+		return
+	}
+
+	c.queue.Add(key)
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+
+	defer c.queue.Done(key)
+
+	requeueAfter, err := c.sync(ctx, key)
+	if err != nil {
+		klog.Errorf("unable to process scheduling gate of pod %q: %s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	if requeueAfter > 0 {
+		c.queue.AddAfter(key, requeueAfter)
+	}
+
+	return true
+}
+
+// sync prewarms images of the given pod and removes its gate if they are warm or the timeout expires.
+// The duration returned is when the pod should be checked again.
+func (c *Controller) sync(ctx context.Context, key string) (time.Duration, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	pod, err := c.watcher.GetPod(namespace, name)
+	if err != nil || pod == nil || !gated(pod) {
+		return 0, err
+	}
+
+	remaining := c.timeout - time.Since(pod.CreationTimestamp.Time)
+	if remaining <= 0 {
+		klog.Warningf("images of pod %q are not warm in %s. remove the scheduling gate", key, c.timeout)
+		return 0, c.removeGate(ctx, pod)
+	}
+
+	images, err := c.imagesOf(pod)
+	if err != nil {
+		klog.V(4).Infof("images of pod %q are not determined yet: %s", key, err)
+		return earlier(pollInterval, remaining), nil
+	}
+
+	if len(images.Images) == 0 {
+		klog.Infof("pod %q doesn't use images of the driver. remove the scheduling gate", key)
+		return 0, c.removeGate(ctx, pod)
+	}
+
+	prewarm, err := c.ensurePrewarm(ctx, pod, images)
+	if err != nil {
+		return 0, err
+	}
+
+	nodes := warmNodes(prewarm)
+	if len(nodes) < c.minNodes {
+		klog.V(4).Infof("images of pod %q are warm on %d nodes %v", key, len(nodes), nodes)
+		return earlier(pollInterval, remaining), nil
+	}
+
+	klog.Infof("images of pod %q are warm on nodes %v. remove the scheduling gate", key, nodes)
+	return 0, c.removeGate(ctx, pod)
+}
+
+// ensurePrewarm creates an ImagePrewarm object of the pod on nodes matching its nodeSelector if it doesn't exist.
+// The object is owned by the pod to be removed along with it.
+func (c *Controller) ensurePrewarm(ctx context.Context, pod *corev1.Pod, images *PodImages) (
+	*v1alpha1.ImagePrewarm, error,
+) {
+	resource := c.client.Resource(v1alpha1.ImagePrewarmResource).Namespace(pod.Namespace)
+	name := prewarmName(pod)
+	obj, err := resource.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		prewarm, convertErr := v1alpha1.ToUnstructured(&v1alpha1.ImagePrewarm{
+			TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.GroupName + "/" + v1alpha1.Version, Kind: "ImagePrewarm"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: pod.Namespace,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Pod",
+					Name:       pod.Name,
+					UID:        pod.UID,
+				}},
+			},
+			Spec: v1alpha1.ImagePrewarmSpec{
+				Images:           images.Images,
+				NodeSelector:     pod.Spec.NodeSelector,
+				ImagePullSecrets: images.PullSecrets,
+			},
+		})
+		if convertErr != nil {
+			return nil, convertErr
+		}
+
+		klog.Infof("prewarm images %v of pod %s/%s", images.Images, pod.Namespace, pod.Name)
+		obj, err = resource.Create(ctx, prewarm, metav1.CreateOptions{})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to prewarm images of pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+
+	prewarm := &v1alpha1.ImagePrewarm{}
+	if err = v1alpha1.FromUnstructured(obj, prewarm); err != nil {
+		return nil, err
+	}
+
+	return prewarm, nil
+}
+
+// removeGate removes the gate of the driver from the pod, keeping gates of others.
+func (c *Controller) removeGate(ctx context.Context, pod *corev1.Pod) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := c.kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		gates := latest.Spec.SchedulingGates[:0]
+		for _, gate := range latest.Spec.SchedulingGates {
+			if gate.Name != GateName {
+				gates = append(gates, gate)
+			}
+		}
+
+		if len(gates) == len(latest.Spec.SchedulingGates) {
+			return nil
+		}
+
+		latest.Spec.SchedulingGates = gates
+		_, err = c.kubeClient.CoreV1().Pods(pod.Namespace).Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// warmNodes returns names of nodes where all images of the ImagePrewarm object are ready, sorted.
+func warmNodes(prewarm *v1alpha1.ImagePrewarm) []string {
+	var nodes []string
+	for i := range prewarm.Status.Nodes {
+		nodeStatus := &prewarm.Status.Nodes[i]
+		ready := true
+		for _, image := range prewarm.Spec.Images {
+			state := nodeStatus.ImageState(image)
+			if state == nil || state.Phase != v1alpha1.PrewarmReady {
+				ready = false
+				break
+			}
+		}
+
+		if ready {
+			nodes = append(nodes, nodeStatus.NodeName)
+		}
+	}
+
+	sort.Strings(nodes)
+	return nodes
+}
+
+func gated(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name == GateName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func prewarmName(pod *corev1.Pod) string {
+	return "pod-" + string(pod.UID)
+}
+
+func earlier(current, next time.Duration) time.Duration {
+	if next < current {
+		return next
+	}
+
+	return current
+}
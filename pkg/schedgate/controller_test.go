@@ -0,0 +1,91 @@
+package schedgate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/warm-metal/container-image-csi-driver/pkg/apis/v1alpha1"
+	"github.com/warm-metal/container-image-csi-driver/pkg/watcher"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func gatedPod(name string, created time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              name,
+			UID:               types.UID("uid-" + name),
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: corev1.PodSpec{
+			NodeSelector:    map[string]string{"pool": "gpu"},
+			SchedulingGates: []corev1.PodSchedulingGate{{Name: "others"}, {Name: GateName}},
+		},
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kubeClient := fake.NewSimpleClientset(
+		gatedPod("warming", time.Now()),
+		gatedPod("expired", time.Now().Add(-time.Hour)),
+	)
+	w := watcher.NewWithClient(ctx, kubeClient, 0)
+	defer w.Stop()
+	assert.True(t, w.WaitForCacheSync(ctx))
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.ImagePrewarmResource: "ImagePrewarmList"})
+	image := "docker.io/library/alpine:3"
+	c, err := NewController(kubeClient, client, w, func(*corev1.Pod) (*PodImages, error) {
+		return &PodImages{Images: []string{image}, PullSecrets: []string{"creds"}}, nil
+	}, 1, 10*time.Minute)
+	assert.NoError(t, err)
+
+	requeueAfter, err := c.sync(ctx, "default/warming")
+	assert.NoError(t, err)
+	assert.Equal(t, pollInterval, requeueAfter, "pods should wait for images")
+
+	resource := client.Resource(v1alpha1.ImagePrewarmResource).Namespace("default")
+	obj, err := resource.Get(ctx, "pod-uid-warming", metav1.GetOptions{})
+	assert.NoError(t, err)
+	prewarm := &v1alpha1.ImagePrewarm{}
+	assert.NoError(t, v1alpha1.FromUnstructured(obj, prewarm))
+	assert.Equal(t, []string{image}, prewarm.Spec.Images)
+	assert.Equal(t, map[string]string{"pool": "gpu"}, prewarm.Spec.NodeSelector)
+	assert.Equal(t, []string{"creds"}, prewarm.Spec.ImagePullSecrets)
+
+	prewarm.Status.Nodes = []v1alpha1.NodePrewarmStatus{
+		{NodeName: "pulling", Images: []v1alpha1.ImagePrewarmState{{Image: image, Phase: v1alpha1.PrewarmPulling}}},
+		{NodeName: "ready", Images: []v1alpha1.ImagePrewarmState{{Image: image, Phase: v1alpha1.PrewarmReady}}},
+	}
+	obj, err = v1alpha1.ToUnstructured(prewarm)
+	assert.NoError(t, err)
+	_, err = resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	requeueAfter, err = c.sync(ctx, "default/warming")
+	assert.NoError(t, err)
+	assert.Zero(t, requeueAfter)
+
+	requeueAfter, err = c.sync(ctx, "default/expired")
+	assert.NoError(t, err)
+	assert.Zero(t, requeueAfter, "gates should be removed once the timeout expires")
+
+	for _, name := range []string{"warming", "expired"} {
+		pod, err := kubeClient.CoreV1().Pods("default").Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []corev1.PodSchedulingGate{{Name: "others"}}, pod.Spec.SchedulingGates,
+			"only the gate of the driver should be removed from pod %q", name)
+	}
+}
@@ -19,6 +19,9 @@ import (
 type Store interface {
 	// GetDockerKeyring returns a keyring with credentials from all available sources
 	GetDockerKeyring(ctx context.Context, secretData map[string]string) (DockerKeyring, error)
+	// GetDockerKeyringFromSecrets returns a keyring with credentials from the named Secrets in the given namespace,
+	// along with credentials of the driver
+	GetDockerKeyringFromSecrets(ctx context.Context, namespace string, names []string) (DockerKeyring, error)
 }
 
 // secretDataWrapper abstracts data access for both byte slices and strings
@@ -145,6 +148,36 @@ func (s credentialStore) GetDockerKeyring(ctx context.Context, secretData map[st
 	return s.createUnionKeyring(keyrings), nil
 }
 
+// GetDockerKeyringFromSecrets returns credentials from the named Secrets, driver SA secrets, and plugins
+func (s credentialStore) GetDockerKeyringFromSecrets(ctx context.Context, namespace string, names []string) (DockerKeyring, error) {
+	var keyrings []DockerKeyring
+	if len(names) > 0 {
+		if s.client == nil {
+			return nil, fmt.Errorf("unable to fetch secrets %v: kubernetes client is not available", names)
+		}
+
+		secrets := make([]corev1.Secret, 0, len(names))
+		for _, name := range names {
+			secret, err := s.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get secret %s/%s: %w", namespace, name, err)
+			}
+
+			secrets = append(secrets, *secret)
+		}
+
+		keyring, err := makeDockerKeyringFromSecrets(secrets)
+		if err != nil {
+			return nil, err
+		}
+
+		keyrings = append(keyrings, keyring)
+	}
+
+	keyrings = append(keyrings, s.collectKeyrings(ctx, nil)...)
+	return s.createUnionKeyring(keyrings), nil
+}
+
 // collectKeyrings gathers credentials from all available sources in priority order
 func (s credentialStore) collectKeyrings(ctx context.Context, secretData map[string]string) []DockerKeyring {
 	var keyrings []DockerKeyring
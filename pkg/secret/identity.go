@@ -0,0 +1,119 @@
+package secret
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// AnonymousIdentity is the credential identity of a pull that didn't use any credentials.
+const AnonymousIdentity = "anonymous"
+
+// identityKeySize is the size of keys salting identities of credentials.
+const identityKeySize = 32
+
+// identityKey salts identities of credentials. It is random per process until LoadIdentityKey is called.
+var identityKey = newIdentityKey()
+
+func newIdentityKey() []byte {
+	key := make([]byte, identityKeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("unable to generate a key of credential identities: %s", err))
+	}
+
+	return key
+}
+
+// LoadIdentityKey loads the key salting identities of credentials from the given file, so that identities persisted
+// on the node stay valid across restarts. A random key is generated and saved with 0600 permissions if the file
+// doesn't exist. It must be called before any identities are computed.
+func LoadIdentityKey(path string) error {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != identityKeySize {
+			return fmt.Errorf("key of credential identities %q is corrupted", path)
+		}
+
+		identityKey = key
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read key of credential identities %q: %w", path, err)
+	}
+
+	key = newIdentityKey()
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, key, 0o600); err != nil {
+		return fmt.Errorf("unable to write key of credential identities: %w", err)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to save key of credential identities: %w", err)
+	}
+
+	identityKey = key
+	return nil
+}
+
+// AuthIdentity returns a stable identity of the given credential.
+// The identity is an HMAC of the credential material keyed by a secret of the node, so it can be persisted without
+// leaking secrets or allowing offline guesses of them.
+func AuthIdentity(auth *cri.AuthConfig) string {
+	if auth == nil {
+		return AnonymousIdentity
+	}
+
+	fields := []string{auth.Username, auth.Password, auth.IdentityToken, auth.RegistryToken}
+	if auth.Username == "" && auth.Password == "" {
+		// The Auth field is only used if it can't be decoded into Username and Password.
+		fields = append(fields, auth.Auth)
+	}
+
+	h := hmac.New(sha256.New, identityKey)
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// KeyringIdentities returns identities of all credentials the keyring provides for the given image, sorted.
+// An empty slice returns if no credentials are available.
+func KeyringIdentities(keyring DockerKeyring, image string) []string {
+	if keyring == nil {
+		return nil
+	}
+
+	authConfigs, found := keyring.Lookup(image)
+	if !found {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(authConfigs))
+	identities := make([]string, 0, len(authConfigs))
+	for _, auth := range authConfigs {
+		id := AuthIdentity(auth)
+		if _, ok := seen[id]; ok {
+			continue
+		}
+
+		seen[id] = struct{}{}
+		identities = append(identities, id)
+	}
+
+	sort.Strings(identities)
+	return identities
+}
@@ -0,0 +1,35 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestLoadIdentityKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	auth := &cri.AuthConfig{Username: "foo", Password: "bar"}
+	unsaved := AuthIdentity(auth)
+
+	require.NoError(t, LoadIdentityKey(path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	identity := AuthIdentity(auth)
+	assert.NotEqual(t, unsaved, identity, "identities are keyed by the node")
+	assert.NotEqual(t, identity, AuthIdentity(&cri.AuthConfig{Username: "foo", Password: "baz"}))
+	assert.Equal(t, AnonymousIdentity, AuthIdentity(nil))
+
+	// The key is reused on restart.
+	identityKey = newIdentityKey()
+	require.NoError(t, LoadIdentityKey(path))
+	assert.Equal(t, identity, AuthIdentity(auth))
+
+	require.NoError(t, os.WriteFile(path, []byte("short"), 0o600))
+	assert.Error(t, LoadIdentityKey(path))
+}
@@ -43,6 +43,11 @@ func (m *MockMounter) ImageExists(ctx context.Context, image reference.Named) bo
 	return m.ImageSvcClient.PulledImages[image.Name()]
 }
 
+// MountedImages returns no images since mounts of images are not counted
+func (m *MockMounter) MountedImages() map[string]int {
+	return nil
+}
+
 func (c *MockImageServiceClient) ListImages(ctx context.Context, in *criapi.ListImagesRequest, opts ...grpc.CallOption) (*criapi.ListImagesResponse, error) {
 	resp := new(criapi.ListImagesResponse)
 	resp.Images = []*criapi.Image{}
@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// annotationPrefix is the prefix of all PVC annotations of the driver.
+	annotationPrefix = "csi.storage.k8s.io/"
+
+	// PullPolicyAnnotation is the annotation key for the pull policy, either "Always" or "IfNotPresent".
+	PullPolicyAnnotation = annotationPrefix + "pull-policy"
+	// PullSecretAnnotation is the annotation key for the name of the Secret in the PVC namespace to pull the image.
+	PullSecretAnnotation = annotationPrefix + "pull-secret"
+	// PlatformAnnotation is the annotation key for the platform of the image, e.g. "linux/arm64".
+	PlatformAnnotation = annotationPrefix + "platform"
+	// ReadWriteAnnotation is the annotation key to mount the volume writable if it is "true".
+	// Changes are discarded once the volume is unpublished.
+	ReadWriteAnnotation = annotationPrefix + "read-write"
+)
+
+// VolumeAnnotations are settings of a volume given by PVC annotations.
+type VolumeAnnotations struct {
+	Image string
+	// PullAlways is nil if the pull policy is not set.
+	PullAlways          *bool
+	PullSecret          string
+	PullSecretNamespace string
+	Platform            string
+	ReadWrite           bool
+}
+
+// ParseAnnotations validates annotations of the driver on the given PVC.
+// Unknown annotations with the prefix "csi.storage.k8s.io/" are rejected.
+func ParseAnnotations(pvc *corev1.PersistentVolumeClaim) (*VolumeAnnotations, error) {
+	a := &VolumeAnnotations{}
+	for k, v := range pvc.Annotations {
+		if !strings.HasPrefix(k, annotationPrefix) {
+			continue
+		}
+
+		switch k {
+		case ImageAnnotation:
+			if _, err := reference.ParseDockerRef(v); err != nil {
+				return nil, fmt.Errorf("invalid annotation %s=%q: %s", k, v, err)
+			}
+			a.Image = v
+		case PullPolicyAnnotation:
+			var pullAlways bool
+			switch corev1.PullPolicy(v) {
+			case corev1.PullAlways:
+				pullAlways = true
+			case corev1.PullIfNotPresent:
+			default:
+				return nil, fmt.Errorf("invalid annotation %s=%q: must be %q or %q", k, v,
+					corev1.PullAlways, corev1.PullIfNotPresent)
+			}
+			a.PullAlways = &pullAlways
+		case PullSecretAnnotation:
+			if errs := validation.IsDNS1123Subdomain(v); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid annotation %s=%q: %s", k, v, strings.Join(errs, ", "))
+			}
+			a.PullSecret = v
+			a.PullSecretNamespace = pvc.Namespace
+		case PlatformAnnotation:
+			if _, err := platforms.Parse(v); err != nil {
+				return nil, fmt.Errorf("invalid annotation %s=%q: %s", k, v, err)
+			}
+			a.Platform = v
+		case ReadWriteAnnotation:
+			rw, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid annotation %s=%q: %s", k, v, err)
+			}
+			a.ReadWrite = rw
+		default:
+			return nil, fmt.Errorf("unknown annotation %q", k)
+		}
+	}
+
+	return a, nil
+}
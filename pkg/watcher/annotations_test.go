@@ -0,0 +1,49 @@
+package watcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Annotations: map[string]string{
+			ImageAnnotation:      "docker.io/library/alpine:3",
+			PullPolicyAnnotation: "Always",
+			PullSecretAnnotation: "regcred",
+			PlatformAnnotation:   "linux/arm64",
+			ReadWriteAnnotation:  "true",
+			"foo.io/bar":         "ignored",
+		},
+	}}
+
+	a, err := ParseAnnotations(pvc)
+	assert.NoError(t, err)
+	if assert.NotNil(t, a.PullAlways) {
+		assert.True(t, *a.PullAlways)
+	}
+	assert.Equal(t, "docker.io/library/alpine:3", a.Image)
+	assert.Equal(t, "regcred", a.PullSecret)
+	assert.Equal(t, "default", a.PullSecretNamespace)
+	assert.Equal(t, "linux/arm64", a.Platform)
+	assert.True(t, a.ReadWrite)
+
+	invalid := map[string]string{
+		ImageAnnotation:                  "Invalid Image",
+		PullPolicyAnnotation:             "Never",
+		PullSecretAnnotation:             "Reg_Cred",
+		PlatformAnnotation:               "linux/unknown-arch/v9/x",
+		ReadWriteAnnotation:              "yes please",
+		"csi.storage.k8s.io/pull-secrte": "typo",
+	}
+	for k, v := range invalid {
+		_, err = ParseAnnotations(&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{k: v},
+		}})
+		assert.Error(t, err, "%s=%s", k, v)
+	}
+}
@@ -0,0 +1,90 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// VolumeImageAnnotation is the PV annotation of the image a volume currently maps to, set by the controller plugin
+// once the volume is modified via a VolumeAttributesClass. It takes precedence over the image in the volume context,
+// which is immutable.
+const VolumeImageAnnotation = "container-image.csi.k8s.io/image"
+
+// CurrentImage returns the image the PV currently maps to if it has been modified, or an empty string.
+func CurrentImage(pv *corev1.PersistentVolume) string {
+	return pv.Annotations[VolumeImageAnnotation]
+}
+
+// SetVolumeImage records that the PV maps to the given image.
+func (w *Watcher) SetVolumeImage(ctx context.Context, pvName, image string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{VolumeImageAnnotation: image},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.client.CoreV1().PersistentVolumes().Patch(ctx, pvName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return errors.Wrapf(err, "failed to set image of pv %s", pvName)
+}
+
+// VolumeImages looks up images of modified volumes on nodes. PVs are read from an informer cache, and only fetched
+// from the API server if they are not synced yet.
+type VolumeImages struct {
+	client   kubernetes.Interface
+	pvLister cache.Indexer
+}
+
+// NewVolumeImages creates a VolumeImages, which watches PVs until the context is cancelled.
+func NewVolumeImages(ctx context.Context, client kubernetes.Interface, resyncPeriod time.Duration) *VolumeImages {
+	pvLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().PersistentVolumes().List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().PersistentVolumes().Watch(ctx, options)
+		},
+	}
+
+	pvInformer := cache.NewSharedIndexInformer(
+		cache.ToListWatcherWithWatchListSemantics(pvLW, client),
+		&corev1.PersistentVolume{},
+		resyncPeriod,
+		cache.Indexers{},
+	)
+
+	go pvInformer.Run(ctx.Done())
+	return &VolumeImages{client: client, pvLister: pvInformer.GetIndexer()}
+}
+
+// Image returns the image the PV currently maps to if it has been modified, or an empty string.
+func (v *VolumeImages) Image(ctx context.Context, pvName string) (string, error) {
+	obj, exists, err := v.pvLister.GetByKey(pvName)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get pv %s from indexer", pvName)
+	}
+
+	if exists {
+		return CurrentImage(obj.(*corev1.PersistentVolume)), nil
+	}
+
+	// The PV may be not synced yet.
+	pv, err := v.client.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get pv %s", pvName)
+	}
+
+	return CurrentImage(pv), nil
+}
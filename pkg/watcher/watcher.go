@@ -3,12 +3,15 @@ package watcher
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
@@ -22,11 +25,20 @@ const (
 	ImageAnnotation = "csi.storage.k8s.io/image"
 )
 
-// Watcher watches PVCs.
+const (
+	uidIndex          = "uid"
+	volumeHandleIndex = "volumeHandle"
+)
+
+// Watcher watches PVCs, PVs and pods not scheduled yet.
 type Watcher struct {
 	client      kubernetes.Interface
 	pvcInformer cache.SharedIndexInformer
 	pvcIndexer  cache.Indexer
+	pvInformer  cache.SharedIndexInformer
+	pvIndexer   cache.Indexer
+	podInformer cache.SharedIndexInformer
+	podIndexer  cache.Indexer
 	stopChan    chan struct{}
 }
 
@@ -52,7 +64,12 @@ func New(ctx context.Context, resyncPeriod time.Duration) (*Watcher, error) {
 		return nil, err
 	}
 
-	lw := &cache.ListWatch{
+	return NewWithClient(ctx, clientSet, resyncPeriod), nil
+}
+
+// NewWithClient creates a new Watcher using the given client.
+func NewWithClient(ctx context.Context, clientSet kubernetes.Interface, resyncPeriod time.Duration) *Watcher {
+	pvcLW := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 			return clientSet.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, options)
 		},
@@ -61,8 +78,8 @@ func New(ctx context.Context, resyncPeriod time.Duration) (*Watcher, error) {
 		},
 	}
 
-	indexers := cache.Indexers{
-		"uid": func(obj interface{}) ([]string, error) {
+	pvcIndexers := cache.Indexers{
+		uidIndex: func(obj interface{}) ([]string, error) {
 			object, err := meta.Accessor(obj)
 			if err != nil {
 				return nil, err
@@ -73,23 +90,81 @@ func New(ctx context.Context, resyncPeriod time.Duration) (*Watcher, error) {
 	}
 
 	pvcInformer := cache.NewSharedIndexInformer(
-		lw,
+		cache.ToListWatcherWithWatchListSemantics(pvcLW, clientSet),
 		&corev1.PersistentVolumeClaim{},
 		resyncPeriod,
-		indexers,
+		pvcIndexers,
+	)
+
+	pvLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return clientSet.CoreV1().PersistentVolumes().List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return clientSet.CoreV1().PersistentVolumes().Watch(ctx, options)
+		},
+	}
+
+	pvIndexers := cache.Indexers{
+		volumeHandleIndex: func(obj interface{}) ([]string, error) {
+			pv, ok := obj.(*corev1.PersistentVolume)
+			if !ok || pv.Spec.CSI == nil {
+				return nil, nil
+			}
+
+			return []string{volumeHandleKey(pv.Spec.CSI.Driver, pv.Spec.CSI.VolumeHandle)}, nil
+		},
+	}
+
+	pvInformer := cache.NewSharedIndexInformer(
+		cache.ToListWatcherWithWatchListSemantics(pvLW, clientSet),
+		&corev1.PersistentVolume{},
+		resyncPeriod,
+		pvIndexers,
+	)
+
+	// Only pods not scheduled yet are watched, which are those held by scheduling gates.
+	unscheduled := fields.OneTermEqualSelector("spec.nodeName", "").String()
+	podLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = unscheduled
+			return clientSet.CoreV1().Pods(metav1.NamespaceAll).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = unscheduled
+			return clientSet.CoreV1().Pods(metav1.NamespaceAll).Watch(ctx, options)
+		},
+	}
+
+	podInformer := cache.NewSharedIndexInformer(
+		cache.ToListWatcherWithWatchListSemantics(podLW, clientSet),
+		&corev1.Pod{},
+		resyncPeriod,
+		cache.Indexers{},
 	)
 
-	pvcIndexer := pvcInformer.GetIndexer()
 	stopChan := make(chan struct{})
 
 	go pvcInformer.Run(stopChan)
+	go pvInformer.Run(stopChan)
+	go podInformer.Run(stopChan)
 
 	return &Watcher{
 		client:      clientSet,
 		pvcInformer: pvcInformer,
-		pvcIndexer:  pvcIndexer,
+		pvcIndexer:  pvcInformer.GetIndexer(),
+		pvInformer:  pvInformer,
+		pvIndexer:   pvInformer.GetIndexer(),
+		podInformer: podInformer,
+		podIndexer:  podInformer.GetIndexer(),
 		stopChan:    stopChan,
-	}, err
+	}
+}
+
+// WaitForCacheSync waits until all informers are synced.
+func (w *Watcher) WaitForCacheSync(ctx context.Context) bool {
+	return cache.WaitForCacheSync(ctx.Done(), w.pvcInformer.HasSynced, w.pvInformer.HasSynced,
+		w.podInformer.HasSynced)
 }
 
 // Stop stops the watcher.
@@ -111,10 +186,34 @@ func (w *Watcher) GetImage(name string) (string, error) {
 	return "", fmt.Errorf("pvc %s does not have volume handle annotation %s", name, ImageAnnotation)
 }
 
+// GetPVCByVolumeName returns the PVC of the given volume, which name is "pvc-" followed by the PVC UID.
+func (w *Watcher) GetPVCByVolumeName(name string) (*corev1.PersistentVolumeClaim, error) {
+	return w.getPVCFromIndexer(name)
+}
+
+// GetPVC returns the PVC with the given namespace and name.
+func (w *Watcher) GetPVC(namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	obj, exists, err := w.pvcIndexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pvc %s/%s from indexer", namespace, name)
+	}
+
+	if exists {
+		return obj.(*corev1.PersistentVolumeClaim), nil
+	}
+
+	// The PVC may be not synced yet.
+	return w.client.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
 func (w *Watcher) getPVCFromIndexer(name string) (*corev1.PersistentVolumeClaim, error) {
+	if !strings.HasPrefix(name, "pvc-") {
+		return nil, fmt.Errorf("volume name %s doesn't contain the pvc uid", name)
+	}
+
 	uid := name[4:]
 
-	pvc, err := w.pvcIndexer.ByIndex("uid", uid)
+	pvc, err := w.pvcIndexer.ByIndex(uidIndex, uid)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get pvc from indexer by uid %s", uid)
 	} else if len(pvc) == 0 {
@@ -123,3 +222,78 @@ func (w *Watcher) getPVCFromIndexer(name string) (*corev1.PersistentVolumeClaim,
 
 	return pvc[0].(*corev1.PersistentVolumeClaim), nil
 }
+
+// ListVolumes returns PVs of the given driver, sorted by volume handles.
+func (w *Watcher) ListVolumes(driver string) []*corev1.PersistentVolume {
+	var pvs []*corev1.PersistentVolume
+	for _, obj := range w.pvIndexer.List() {
+		pv := obj.(*corev1.PersistentVolume)
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driver {
+			pvs = append(pvs, pv)
+		}
+	}
+
+	sort.Slice(pvs, func(i, j int) bool {
+		return pvs[i].Spec.CSI.VolumeHandle < pvs[j].Spec.CSI.VolumeHandle
+	})
+
+	return pvs
+}
+
+// GetVolumes returns PVs of the given driver and volume handle, sorted by names. Static PVs may share volume handles.
+func (w *Watcher) GetVolumes(driver, volumeHandle string) ([]*corev1.PersistentVolume, error) {
+	objs, err := w.pvIndexer.ByIndex(volumeHandleIndex, volumeHandleKey(driver, volumeHandle))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pv from indexer by volume handle %s", volumeHandle)
+	}
+
+	pvs := make([]*corev1.PersistentVolume, 0, len(objs))
+	for _, obj := range objs {
+		pvs = append(pvs, obj.(*corev1.PersistentVolume))
+	}
+
+	sort.Slice(pvs, func(i, j int) bool {
+		return pvs[i].Name < pvs[j].Name
+	})
+
+	return pvs, nil
+}
+
+// GetPV returns the PV with the given name, or nil if it doesn't exist.
+func (w *Watcher) GetPV(name string) (*corev1.PersistentVolume, error) {
+	obj, exists, err := w.pvIndexer.GetByKey(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pv %s from indexer", name)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	return obj.(*corev1.PersistentVolume), nil
+}
+
+// GetPod returns the unscheduled pod with the given namespace and name, or nil if it doesn't exist or has been
+// scheduled.
+func (w *Watcher) GetPod(namespace, name string) (*corev1.Pod, error) {
+	obj, exists, err := w.podIndexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pod %s/%s from indexer", namespace, name)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	return obj.(*corev1.Pod), nil
+}
+
+// AddPodEventHandler adds a handler of events of unscheduled pods. Existing pods are delivered as additions.
+func (w *Watcher) AddPodEventHandler(handler cache.ResourceEventHandler) error {
+	_, err := w.podInformer.AddEventHandler(handler)
+	return err
+}
+
+func volumeHandleKey(driver, volumeHandle string) string {
+	return driver + "/" + volumeHandle
+}